@@ -0,0 +1,634 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Accounts are off unless enabled (auth.enabled, FRAMESPDF_AUTH or -auth),
+// which keeps the single-user behaviour: no login, everything visible. With
+// accounts on, every request needs a session (cookie or bearer token), users
+// only see their own uploads, projects, jobs and outputs, and admins see and
+// manage everything.
+var (
+	authEnabled bool
+	// adminUser/adminPassword create the first admin when the store has no
+	// users yet.
+	adminUser, adminPassword string
+	// defaultQuotaBytes caps each user's storage unless the account sets its
+	// own quota; 0 is unlimited.
+	defaultQuotaBytes int64
+	sessionTTL        = 7 * 24 * time.Hour
+)
+
+const sessionCookie = "framespdf_session"
+
+// User is a local account. Owner fields elsewhere hold the user's ID.
+type User struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Admin        bool   `json:"admin"`
+	// QuotaBytes caps uploads plus outputs; 0 uses defaultQuotaBytes and a
+	// negative value is unlimited.
+	QuotaBytes int64  `json:"quota_bytes"`
+	Created    string `json:"created_at"`
+}
+
+// public is u without the password hash, for responses.
+func (u User) public() User {
+	u.PasswordHash = ""
+	return u
+}
+
+// session is keyed by the SHA-256 of its token so the store never holds
+// usable tokens.
+type session struct {
+	UserID  string `json:"user_id"`
+	Expires string `json:"expires_at"`
+}
+
+var (
+	usersMu  sync.Mutex
+	users    = map[string]*User{}
+	sessions = map[string]*session{}
+)
+
+// outputOwners maps generated file URLs to the user that produced them; it
+// is guarded by mu like the upload maps.
+var outputOwners = map[string]string{}
+
+func putUser(u *User) { storePut(bucketUsers, u.ID, u) }
+
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// findUser returns the user with the given name (case-insensitive) or nil.
+// Callers hold usersMu.
+func findUser(name string) *User {
+	for _, u := range users {
+		if strings.EqualFold(u.Username, name) {
+			return u
+		}
+	}
+	return nil
+}
+
+func createUser(name, password string, admin bool, quota int64) (*User, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return nil, errors.New("username must be 1-64 characters")
+	}
+	if len(password) < 8 {
+		return nil, errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	u := &User{ID: randID(8), Username: name, PasswordHash: string(hash), Admin: admin, QuotaBytes: quota, Created: time.Now().Format(time.RFC3339)}
+	usersMu.Lock()
+	if findUser(name) != nil {
+		usersMu.Unlock()
+		return nil, fmt.Errorf("username taken: %s", name)
+	}
+	users[u.ID] = u
+	usersMu.Unlock()
+	putUser(u)
+	return u, nil
+}
+
+// ensureAdmin creates the bootstrap admin on a store without users.
+func ensureAdmin() error {
+	usersMu.Lock()
+	n := len(users)
+	usersMu.Unlock()
+	if n > 0 {
+		return nil
+	}
+	if adminUser == "" || adminPassword == "" {
+		return errors.New("auth is enabled but there are no users: set FRAMESPDF_ADMIN_USER and FRAMESPDF_ADMIN_PASSWORD to create the first admin")
+	}
+	_, err := createUser(adminUser, adminPassword, true, -1)
+	return err
+}
+
+// authRequired resolves the session of every request except the login page
+// and share links. Without one, the UI is redirected to /login and API calls
+// get 401.
+func authRequired(c *gin.Context) {
+	if !authEnabled || c.FullPath() == "/login" || c.FullPath() == "/s/:token" || publicAPIPath(c.FullPath()) {
+		c.Next()
+		return
+	}
+	tok, _ := c.Cookie(sessionCookie)
+	if h := c.GetHeader("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok = strings.TrimPrefix(h, "Bearer ")
+	}
+	var u *User
+	if tok != "" {
+		usersMu.Lock()
+		if s := sessions[hashToken(tok)]; s != nil {
+			if exp, err := time.Parse(time.RFC3339, s.Expires); err == nil && time.Now().Before(exp) {
+				u = users[s.UserID]
+			}
+		}
+		usersMu.Unlock()
+	}
+	if u == nil {
+		if c.Request.Method == http.MethodGet && c.Request.URL.Path == "/" {
+			c.Redirect(http.StatusSeeOther, "/login")
+		} else {
+			fail(c, http.StatusUnauthorized, "login required")
+		}
+		c.Abort()
+		return
+	}
+	c.Set("user", u)
+	c.Next()
+}
+
+// currentUser is the logged-in user, nil when accounts are off.
+func currentUser(c *gin.Context) *User {
+	if u, ok := c.Get("user"); ok {
+		return u.(*User)
+	}
+	return nil
+}
+
+// ownerOf is the Owner value for things created by this request: the user
+// ID, the anonymous session, or "" when nothing is scoped.
+func ownerOf(c *gin.Context) string {
+	if u := currentUser(c); u != nil {
+		return u.ID
+	}
+	if id := c.GetString("anon"); id != "" {
+		return anonOwnerPrefix + id
+	}
+	return ""
+}
+
+// canAccess reports whether the request may see something owned by owner.
+func canAccess(c *gin.Context, owner string) bool {
+	if !scoped() {
+		return true
+	}
+	if u := currentUser(c); u != nil && u.Admin {
+		return true
+	}
+	me := ownerOf(c)
+	return me != "" && me == owner
+}
+
+func requireAdmin(c *gin.Context) {
+	if u := currentUser(c); authEnabled && (u == nil || !u.Admin) {
+		fail(c, http.StatusForbidden, "admin only")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// getVideo, getImage and getAudio return the upload if it exists and the
+// request may see it.
+func getVideo(c *gin.Context, id string) *VideoMeta {
+	mu.Lock()
+	defer mu.Unlock()
+	if vm := videos[id]; vm != nil && kindOn("video") && canAccess(c, vm.Owner) {
+		return vm
+	}
+	return nil
+}
+
+func getImage(c *gin.Context, id string) *ImgMeta {
+	mu.Lock()
+	defer mu.Unlock()
+	if im := images[id]; im != nil && kindOn("image") && canAccess(c, im.Owner) {
+		return im
+	}
+	return nil
+}
+
+func getAudio(c *gin.Context, id string) *AudioMeta {
+	mu.Lock()
+	defer mu.Unlock()
+	if am := audios[id]; am != nil && kindOn("audio") && canAccess(c, am.Owner) {
+		return am
+	}
+	return nil
+}
+
+// recordOutputs remembers who generated the files at urls. Nothing is
+// recorded without an owner.
+func recordOutputs(owner string, urls ...string) {
+	if owner == "" {
+		return
+	}
+	mu.Lock()
+	for _, u := range urls {
+		outputOwners[u] = owner
+	}
+	mu.Unlock()
+	for _, u := range urls {
+		storePut(bucketOutputs, u, owner)
+	}
+}
+
+// outputDirs maps the static route prefixes of generated files to their
+// directories.
+func outputDirs() map[string]string {
+	return map[string]string{"/download/": pdfsDir, "/audio/": audioDir, "/transcripts/": transcriptsDir, "/renders/": rendersDir}
+}
+
+// outputPath maps a generated file URL to its path on disk ("" if the URL
+// isn't under one of the output routes).
+func outputPath(url string) string {
+	for prefix, dir := range outputDirs() {
+		if rest, ok := strings.CutPrefix(url, prefix); ok {
+			return filepath.Join(dir, filepath.FromSlash(rest))
+		}
+	}
+	return ""
+}
+
+// pruneOutputs forgets output records whose file is gone.
+func pruneOutputs() {
+	var gone []string
+	mu.Lock()
+	for u := range outputOwners {
+		if !fileExists(outputPath(u)) {
+			gone = append(gone, u)
+			delete(outputOwners, u)
+		}
+	}
+	mu.Unlock()
+	for _, u := range gone {
+		storeDelete(bucketOutputs, u)
+	}
+}
+
+// guardFiles protects the static routes: uploads and frames are checked
+// against the upload's owner, generated files against outputOwners.
+func guardFiles(c *gin.Context) {
+	if !scoped() {
+		c.Next()
+		return
+	}
+	p := c.Request.URL.Path
+	owner := ""
+	mu.Lock()
+	rest, upload := strings.CutPrefix(p, "/uploads/")
+	if !upload {
+		rest, upload = strings.CutPrefix(p, "/frames/")
+	}
+	if upload {
+		id, _, _ := strings.Cut(rest, "/")
+		if vm := videos[id]; vm != nil {
+			owner = vm.Owner
+		} else if im := images[id]; im != nil {
+			owner = im.Owner
+		} else if am := audios[id]; am != nil {
+			owner = am.Owner
+		}
+	} else {
+		owner = outputOwners[p]
+	}
+	mu.Unlock()
+	// files nobody owns (unregistered, or from before accounts) are admin-only
+	if !canAccess(c, owner) {
+		fail(c, http.StatusNotFound, "404 page not found")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// pruneSessions drops expired sessions.
+func pruneSessions(now time.Time) {
+	var keys []string
+	usersMu.Lock()
+	for k, s := range sessions {
+		if exp, err := time.Parse(time.RFC3339, s.Expires); err != nil || now.After(exp) {
+			keys = append(keys, k)
+			delete(sessions, k)
+		}
+	}
+	usersMu.Unlock()
+	for _, k := range keys {
+		storeDelete(bucketSessions, k)
+	}
+}
+
+// userUsage is the size of everything owner (a user ID or anonymous
+// session) owns: uploads plus generated files.
+func userUsage(owner string) int64 {
+	var total int64
+	var outs []string
+	// uploads sharing a blob are stored, and counted, once
+	blobs := map[string]bool{}
+	count := func(sum string, size int64) {
+		if sum == "" || !blobs[sum] {
+			blobs[sum] = true
+			total += size
+		}
+	}
+	mu.Lock()
+	for _, vm := range videos {
+		if vm.Owner == owner {
+			count(vm.SHA256, vm.SizeBytes)
+		}
+	}
+	for _, im := range images {
+		if im.Owner == owner {
+			count(im.SHA256, im.SizeBytes)
+		}
+	}
+	for _, am := range audios {
+		if am.Owner == owner {
+			count(am.SHA256, am.SizeBytes)
+		}
+	}
+	for u, o := range outputOwners {
+		if o == owner {
+			outs = append(outs, u)
+		}
+	}
+	mu.Unlock()
+	for _, u := range outs {
+		if st, err := os.Stat(outputPath(u)); err == nil {
+			total += st.Size()
+		}
+	}
+	return total
+}
+
+// quotaFor is u's effective quota in bytes; 0 is unlimited.
+func quotaFor(u *User) int64 {
+	switch {
+	case u.QuotaBytes < 0:
+		return 0
+	case u.QuotaBytes > 0:
+		return u.QuotaBytes
+	}
+	return defaultQuotaBytes
+}
+
+// ownerQuota returns the caller's storage quota (0 = unlimited) and usage.
+func ownerQuota(c *gin.Context) (quota, used int64) {
+	owner := ownerOf(c)
+	if owner == "" {
+		return 0, 0
+	}
+	quota = defaultQuotaBytes
+	if u := currentUser(c); u != nil {
+		quota = quotaFor(u)
+	}
+	if quota > 0 {
+		used = userUsage(owner)
+	}
+	return quota, used
+}
+
+// enforceQuota rejects uploads and processing requests from users (or
+// anonymous sessions, which get the default quota) whose storage, plus the
+// incoming request body, would exceed their quota.
+func enforceQuota(c *gin.Context) {
+	if quota, used := ownerQuota(c); quota > 0 {
+		if used+max(c.Request.ContentLength, 0) > quota {
+			failCode(c, http.StatusRequestEntityTooLarge, errQuotaExceeded, "storage quota exceeded (%.1f of %.1f MB used)", float64(used)/(1<<20), float64(quota)/(1<<20))
+			c.Abort()
+			return
+		}
+	}
+	c.Next()
+}
+
+// ===== handlers =====
+
+type loginReq struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+}
+
+func handleLoginPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "login.html", gin.H{"Failed": c.Query("failed") != ""})
+}
+
+// handleLogin accepts JSON (returns the token) or the login form (sets the
+// cookie and redirects to the UI).
+func handleLogin(c *gin.Context) {
+	var req loginReq
+	if err := c.ShouldBind(&req); err != nil {
+		fail(c, http.StatusBadRequest, "bad request: %v", err)
+		return
+	}
+	isForm := c.ContentType() != "application/json"
+	usersMu.Lock()
+	u := findUser(strings.TrimSpace(req.Username))
+	usersMu.Unlock()
+	if u == nil || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.Password)) != nil {
+		if isForm {
+			c.Redirect(http.StatusSeeOther, "/login?failed=1")
+			return
+		}
+		failCode(c, http.StatusUnauthorized, errBadCredentials, "invalid username or password")
+		return
+	}
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	tok := hex.EncodeToString(b)
+	s := &session{UserID: u.ID, Expires: time.Now().Add(sessionTTL).Format(time.RFC3339)}
+	key := hashToken(tok)
+	usersMu.Lock()
+	sessions[key] = s
+	usersMu.Unlock()
+	storePut(bucketSessions, key, s)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, tok, int(sessionTTL.Seconds()), "/", "", c.Request.TLS != nil, true)
+	if isForm {
+		c.Redirect(http.StatusSeeOther, "/")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": u.public(), "token": tok, "expires_at": s.Expires})
+}
+
+func handleLogout(c *gin.Context) {
+	tok, _ := c.Cookie(sessionCookie)
+	if h := c.GetHeader("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok = strings.TrimPrefix(h, "Bearer ")
+	}
+	if tok != "" {
+		key := hashToken(tok)
+		usersMu.Lock()
+		delete(sessions, key)
+		usersMu.Unlock()
+		storeDelete(bucketSessions, key)
+	}
+	c.SetCookie(sessionCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, gin.H{"logged_out": true})
+}
+
+// handleMe reports the current user with their storage usage.
+func handleMe(c *gin.Context) {
+	u := currentUser(c)
+	if u == nil {
+		c.JSON(http.StatusOK, gin.H{"auth": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"auth": true, "user": u.public(), "used_bytes": userUsage(u.ID), "quota_bytes": quotaFor(u)})
+}
+
+type userReq struct {
+	Username string  `json:"username"`
+	Password *string `json:"password"`
+	Admin    *bool   `json:"admin"`
+	// QuotaMB overrides the default quota; -1 is unlimited, 0 the default.
+	QuotaMB *int64 `json:"quota_mb"`
+}
+
+func handleListUsers(c *gin.Context) {
+	type userUsageItem struct {
+		User
+		UsedBytes int64 `json:"used_bytes"`
+	}
+	usersMu.Lock()
+	out := make([]userUsageItem, 0, len(users))
+	for _, u := range users {
+		out = append(out, userUsageItem{User: u.public()})
+	}
+	usersMu.Unlock()
+	for i := range out {
+		out[i].UsedBytes = userUsage(out[i].ID)
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.ToLower(out[i].Username) < strings.ToLower(out[j].Username) })
+	c.JSON(http.StatusOK, gin.H{"users": out})
+}
+
+func handleCreateUser(c *gin.Context) {
+	var req userReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if req.Password == nil {
+		fail(c, http.StatusBadRequest, "password is required")
+		return
+	}
+	var quota int64
+	if req.QuotaMB != nil {
+		quota = quotaBytes(*req.QuotaMB)
+	}
+	u, err := createUser(req.Username, *req.Password, req.Admin != nil && *req.Admin, quota)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, u.public())
+}
+
+// handleUpdateUser changes password, admin flag or quota. A password change
+// ends the user's sessions.
+func handleUpdateUser(c *gin.Context) {
+	var req userReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	var hash []byte
+	if req.Password != nil {
+		if len(*req.Password) < 8 {
+			fail(c, http.StatusBadRequest, "password must be at least 8 characters")
+			return
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(*req.Password), bcrypt.DefaultCost); err != nil {
+			fail(c, http.StatusInternalServerError, "%v", err)
+			return
+		}
+	}
+	// the record is replaced by an edited copy: requests read the *User of
+	// their session without the lock
+	usersMu.Lock()
+	cur := users[c.Param("id")]
+	if cur == nil {
+		usersMu.Unlock()
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown user id: %s", c.Param("id"))
+		return
+	}
+	u := *cur
+	if hash != nil {
+		u.PasswordHash = string(hash)
+	}
+	if req.Admin != nil {
+		u.Admin = *req.Admin
+	}
+	if req.QuotaMB != nil {
+		u.QuotaBytes = quotaBytes(*req.QuotaMB)
+	}
+	users[u.ID] = &u
+	usersMu.Unlock()
+	putUser(&u)
+	if hash != nil {
+		endSessions(u.ID)
+	}
+	c.JSON(http.StatusOK, u.public())
+}
+
+// handleDeleteUser removes the account and its sessions. What the user owned
+// stays and is then only visible to admins.
+func handleDeleteUser(c *gin.Context) {
+	id := c.Param("id")
+	if u := currentUser(c); u != nil && u.ID == id {
+		fail(c, http.StatusBadRequest, "cannot delete yourself")
+		return
+	}
+	usersMu.Lock()
+	u := users[id]
+	delete(users, id)
+	usersMu.Unlock()
+	if u == nil {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown user id: %s", id)
+		return
+	}
+	storeDelete(bucketUsers, id)
+	endSessions(id)
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// quotaBytes converts a quota_mb value; negative means unlimited.
+func quotaBytes(mb int64) int64 {
+	if mb < 0 {
+		return -1
+	}
+	return mb << 20
+}
+
+func endSessions(uid string) {
+	var keys []string
+	usersMu.Lock()
+	for k, s := range sessions {
+		if s.UserID == uid {
+			keys = append(keys, k)
+			delete(sessions, k)
+		}
+	}
+	usersMu.Unlock()
+	for _, k := range keys {
+		storeDelete(bucketSessions, k)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dirUsage is the disk usage of one work subdirectory.
+type dirUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// workDirs are the work subdirectories reported by /admin/storage.
+func workDirs() map[string]string {
+	return map[string]string{"uploads": uploadDir, "frames": framesDir, "pdfs": pdfsDir, "audio": audioDir, "transcripts": transcriptsDir, "renders": rendersDir, "scratch": scratchDir, "logs": logsDir}
+}
+
+func dirSize(dir string) dirUsage {
+	var u dirUsage
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				u.Files++
+				u.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return u
+}
+
+func handleAdminStorage(c *gin.Context) {
+	dirs := map[string]dirUsage{}
+	var total int64
+	for name, dir := range workDirs() {
+		u := dirSize(dir)
+		dirs[name] = u
+		total += u.Bytes
+	}
+	var dbBytes int64
+	if st, err := os.Stat(storePath); err == nil {
+		dbBytes = st.Size()
+		total += dbBytes
+	}
+	mu.Lock()
+	items := gin.H{"videos": len(videos), "images": len(images), "audios": len(audios), "projects": len(projects)}
+	mu.Unlock()
+	jobsMu.Lock()
+	items["jobs"] = len(jobs)
+	jobsMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"dirs": dirs, "store_bytes": dbBytes, "total_bytes": total, "items": items})
+}
+
+// cleanupCategories are accepted by POST /admin/cleanup. The orphaned_*
+// categories only touch files no registered item refers to.
+var cleanupCategories = []string{"orphaned_frames", "orphaned_uploads", "uploads", "frames", "pdfs", "audio", "transcripts", "renders", "jobs"}
+
+type cleanupReq struct {
+	Categories []string `json:"categories"`
+	// OlderThan limits the purge to items older than this ("7d", "36h");
+	// empty purges everything in the selected categories.
+	OlderThan string `json:"older_than"`
+}
+
+func handleAdminCleanup(c *gin.Context) {
+	var req cleanupReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if len(req.Categories) == 0 {
+		fail(c, http.StatusBadRequest, "no categories provided")
+		return
+	}
+	for _, cat := range req.Categories {
+		if !slices.Contains(cleanupCategories, cat) {
+			fail(c, http.StatusBadRequest, "unknown category: %s", cat)
+			return
+		}
+	}
+	cutoff := time.Now()
+	if req.OlderThan != "" {
+		d, err := parseRetention(req.OlderThan)
+		if err != nil {
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		cutoff = cutoff.Add(-d)
+	}
+	dirs := workDirs()
+	out := map[string]sweepResult{}
+	for _, cat := range req.Categories {
+		var r sweepResult
+		switch cat {
+		case "orphaned_frames":
+			mu.Lock()
+			known := map[string]bool{}
+			for id := range videos {
+				known[id] = true
+			}
+			mu.Unlock()
+			r = removeOrphans(framesDir, known, cutoff)
+		case "orphaned_uploads":
+			mu.Lock()
+			known := map[string]bool{}
+			for id := range videos {
+				known[id] = true
+			}
+			for id := range images {
+				known[id] = true
+			}
+			for id := range audios {
+				known[id] = true
+			}
+			mu.Unlock()
+			r = removeOrphans(uploadDir, known, cutoff)
+		case "uploads":
+			r = expireUploads(cutoff)
+		case "jobs":
+			r.Files = expireJobs(cutoff)
+		default:
+			r = removeOlderThan(dirs[cat], cutoff)
+		}
+		out[cat] = r
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": out})
+}
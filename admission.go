@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admission control: the server samples free disk space under the work
+// directory, the load average and available memory every admissionPoll.
+// While one of them is past its threshold the box is overloaded: requests
+// that would start processing are turned away with 503 overloaded and a
+// Retry-After header, jobs already queued stay queued, and workers stop
+// taking tasks, until the next sample is back within the thresholds.
+// Load and memory are read from /proc, so those two checks only apply on
+// Linux.
+
+// Admission thresholds; 0 disables a check.
+var (
+	minFreeDiskMB int64 = 1024
+	// maxLoadPerCPU is the highest 1-minute load average per CPU.
+	maxLoadPerCPU float64
+	minFreeMemMB  int64
+)
+
+const (
+	admissionPoll = 5 * time.Second
+	// admissionRetryAfter is the Retry-After of a turned-away request.
+	admissionRetryAfter = 30 * time.Second
+)
+
+// loadSample is one reading of the box's resources; a field is -1 where
+// the platform doesn't tell.
+type loadSample struct {
+	DiskFreeMB int64   `json:"disk_free_mb"`
+	LoadPerCPU float64 `json:"load_per_cpu"`
+	MemFreeMB  int64   `json:"mem_available_mb"`
+	Checked    string  `json:"checked_at"`
+	// Overloaded lists the thresholds the sample is past.
+	Overloaded []string `json:"overloaded,omitempty"`
+}
+
+var (
+	admissionMu sync.Mutex
+	lastSample  loadSample
+)
+
+// sampleLoad reads the box's resources and checks them against the
+// thresholds.
+func sampleLoad() loadSample {
+	s := loadSample{DiskFreeMB: -1, LoadPerCPU: -1, MemFreeMB: -1, Checked: time.Now().Format(time.RFC3339)}
+	if n, ok := diskFree(workRoot); ok {
+		s.DiskFreeMB = n >> 20
+		if minFreeDiskMB > 0 && s.DiskFreeMB < minFreeDiskMB {
+			s.Overloaded = append(s.Overloaded, fmt.Sprintf("%d MB of disk free, want %d", s.DiskFreeMB, minFreeDiskMB))
+		}
+	}
+	if l, ok := loadAverage(); ok {
+		s.LoadPerCPU = l / float64(runtime.NumCPU())
+		if maxLoadPerCPU > 0 && s.LoadPerCPU > maxLoadPerCPU {
+			s.Overloaded = append(s.Overloaded, fmt.Sprintf("load %.2f per CPU, limit %.2f", s.LoadPerCPU, maxLoadPerCPU))
+		}
+	}
+	if n, ok := memAvailable(); ok {
+		s.MemFreeMB = n >> 20
+		if minFreeMemMB > 0 && s.MemFreeMB < minFreeMemMB {
+			s.Overloaded = append(s.Overloaded, fmt.Sprintf("%d MB of memory available, want %d", s.MemFreeMB, minFreeMemMB))
+		}
+	}
+	return s
+}
+
+// startAdmission takes a first sample and then one every admissionPoll.
+// When the box recovers, the jobs held back start.
+func startAdmission() {
+	lastSample = sampleLoad()
+	if len(lastSample.Overloaded) > 0 {
+		slog.Warn("overloaded, holding new jobs", "reasons", lastSample.Overloaded)
+	}
+	go func() {
+		for {
+			time.Sleep(admissionPoll)
+			s := sampleLoad()
+			admissionMu.Lock()
+			was := len(lastSample.Overloaded) > 0
+			lastSample = s
+			admissionMu.Unlock()
+			switch {
+			case !was && len(s.Overloaded) > 0:
+				slog.Warn("overloaded, holding new jobs", "reasons", s.Overloaded)
+			case was && len(s.Overloaded) == 0:
+				slog.Info("load back to normal, admitting jobs")
+				sched.Lock()
+				dispatchJobsLocked()
+				sched.Unlock()
+			}
+		}
+	}()
+}
+
+// currentLoad is the last sample.
+func currentLoad() loadSample {
+	admissionMu.Lock()
+	defer admissionMu.Unlock()
+	return lastSample
+}
+
+// overloaded reports why the box takes no new work, if it doesn't.
+func overloaded() []string { return currentLoad().Overloaded }
+
+// admitJob turns processing requests away while the box is overloaded.
+func admitJob(c *gin.Context) {
+	if reasons := overloaded(); len(reasons) > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(admissionRetryAfter.Seconds())))
+		failCode(c, http.StatusServiceUnavailable, errOverloaded, "server is overloaded, try again later: %s", strings.Join(reasons, "; "))
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// loadAverage is the 1-minute load average.
+func loadAverage() (float64, bool) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	f := strings.Fields(string(b))
+	if len(f) == 0 {
+		return 0, false
+	}
+	l, err := strconv.ParseFloat(f[0], 64)
+	return l, err == nil
+}
+
+// memAvailable is the memory the kernel estimates is available for new
+// work, in bytes.
+func memAvailable() (int64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		rest, ok := strings.CutPrefix(sc.Text(), "MemAvailable:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+		return kb << 10, err == nil
+	}
+	return 0, false
+}
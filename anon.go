@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Anonymous sessions scope uploads and outputs to a browser without
+// accounts: each browser gets a signed cookie and owns what it creates, the
+// same way an account would. Enabled with auth.anonymous_sessions,
+// FRAMESPDF_ANON_SESSIONS or -anon-sessions; ignored when accounts are on.
+var (
+	anonSessions bool
+	// sessionSecret signs the cookie. Unless configured it is generated once
+	// and kept in the store, so sessions survive restarts.
+	sessionSecret string
+)
+
+const anonCookie = "framespdf_anon"
+
+// anonOwnerPrefix marks Owner values that belong to an anonymous session.
+const anonOwnerPrefix = "anon:"
+
+// scoped reports whether things are owned by someone (account or session).
+func scoped() bool { return authEnabled || anonSessions }
+
+// loadSessionSecret resolves sessionSecret from the store when it isn't
+// configured.
+func loadSessionSecret() error {
+	if sessionSecret != "" {
+		return nil
+	}
+	if storeGet(bucketMeta, "session_secret", &sessionSecret) && sessionSecret != "" {
+		return nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	sessionSecret = base64.RawURLEncoding.EncodeToString(b)
+	storePut(bucketMeta, "session_secret", sessionSecret)
+	slog.Info("generated anonymous session secret")
+	return nil
+}
+
+func signAnon(id string) string {
+	m := hmac.New(sha256.New, []byte(sessionSecret))
+	m.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// anonSession attaches the browser's session id, minting a new cookie when
+// there is none or its signature doesn't verify.
+func anonSession(c *gin.Context) {
+	if authEnabled || !anonSessions {
+		c.Next()
+		return
+	}
+	id := ""
+	if v, err := c.Cookie(anonCookie); err == nil {
+		if sid, sig, ok := strings.Cut(v, "."); ok && hmac.Equal([]byte(sig), []byte(signAnon(sid))) {
+			id = sid
+		}
+	}
+	if id == "" {
+		id = randID(12)
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(anonCookie, id+"."+signAnon(id), 365*24*3600, "/", "", c.Request.TLS != nil, true)
+	}
+	c.Set("anon", id)
+	c.Next()
+}
+
+// claimedOutputs are the paths claimOutput handed out, with when; a path
+// stays taken while its file is being written.
+var claimedOutputs = map[string]time.Time{}
+
+// claimOutput reserves path for owner's output. If a file already sits
+// there, or another output is being written there, the path gets a version
+// suffix (_2, _3, ...), so outputs never overwrite each other: not two
+// uploads of the same name, not a repeated conversion, not another
+// session's file. With scoping the path is recorded as owner's.
+func claimOutput(owner, path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	mu.Lock()
+	for n := 2; ; n++ {
+		if _, taken := claimedOutputs[path]; !taken && !fileExists(path) {
+			break
+		}
+		path = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+	claimedOutputs[path] = time.Now()
+	url := outputURL(path)
+	record := scoped() && owner != ""
+	if record {
+		outputOwners[url] = owner
+	}
+	mu.Unlock()
+	if record {
+		storePut(bucketOutputs, url, owner)
+	}
+	return path
+}
+
+// pruneClaims forgets claims whose file exists, which keeps the path taken
+// by itself, or that were never written within a day.
+func pruneClaims(now time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	for p, t := range claimedOutputs {
+		if fileExists(p) || now.Sub(t) > 24*time.Hour {
+			delete(claimedOutputs, p)
+		}
+	}
+}
+
+// outputURL is the inverse of outputPath.
+func outputURL(path string) string {
+	for prefix, dir := range outputDirs() {
+		if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return prefix + filepath.ToSlash(rel)
+		}
+	}
+	return ""
+}
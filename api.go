@@ -0,0 +1,472 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiPrefix is the versioned home of the machine-facing endpoints. Each
+// route in apiRoutes is also served at its original, unversioned path for
+// the web UI; apiPrefix+"/openapi.json" describes every route, generated from the same
+// table so the document can't drift from what is served.
+const apiPrefix = "/api/v1"
+
+// apiRoute is one machine-facing endpoint.
+type apiRoute struct {
+	Method, Path string
+	Tag, Summary string
+	Handlers     []gin.HandlerFunc
+	// Body is a zero request struct for JSON bodies; Files names the
+	// multipart file field for uploads.
+	Body  any
+	Files string
+	Query []apiParam
+	// Resp is a sample of the success response: a struct, or a gin.H whose
+	// values stand for the types of its fields.
+	Resp any
+	// Async endpoints answer 202 with a job when the body sets "async".
+	Async bool
+	// Binary is the type of the file the endpoint can return in place of
+	// its JSON body; see binary.go.
+	Binary string
+	// Public routes need no login; Admin routes need an admin.
+	Public, Admin bool
+	// V1Only routes are only registered under apiPrefix: gin can't route
+	// their original path next to a static directory, which serves them
+	// itself (see serveUploadProgress).
+	V1Only bool
+	// Modules must all be enabled for the route to exist, "video|audio"
+	// meaning either; see modules.go. Routes taking several kinds of
+	// upload find the uploads of disabled kinds unknown.
+	Modules []string
+}
+
+// enabled reports whether rt's modules are on.
+func (rt apiRoute) enabled() bool {
+	for _, m := range rt.Modules {
+		if !slices.ContainsFunc(strings.Split(m, "|"), moduleOn) {
+			return false
+		}
+	}
+	return true
+}
+
+type apiParam struct{ Name, Desc string }
+
+var listParams = []apiParam{
+	{"q", "substring of the name"},
+	{"page", "1-based page"},
+	{"limit", "items per page"},
+	{"sort", "name, size, date or duration"},
+	{"order", "asc or desc"},
+	{"from", "earliest date (RFC 3339 or YYYY-MM-DD)"},
+	{"to", "latest date (RFC 3339 or YYYY-MM-DD)"},
+	{"min_duration", "minimum duration in seconds"},
+	{"tag", "required tag; repeatable"},
+}
+
+var auditParams = []apiParam{
+	{"owner", "user ID or username"},
+	{"type", "job type"},
+	{"status", "done or failed"},
+	{"source", "upload ID or SHA-256"},
+	{"since", "earliest finish time (RFC 3339 or YYYY-MM-DD)"},
+	{"until", "latest finish time (RFC 3339 or YYYY-MM-DD)"},
+}
+
+// uploadParams name an upload for GET /uploads/:id/progress; the
+// X-Upload-ID header does the same.
+var uploadParams = []apiParam{{"upload_id", "client-chosen ID to follow the upload's progress by"}}
+
+// jobAccepted is the 202 answer of async requests.
+var jobAccepted = gin.H{"job_id": "", "status_url": ""}
+
+// ingestSample lists the uploads an ingest registered under the key of
+// their kind.
+var ingestSample = gin.H{"job_id": "", "videos": []*VideoMeta{}, "images": []*ImgMeta{}, "audios": []*AudioMeta{}}
+
+func apiRoutes() []apiRoute {
+	h := func(fs ...gin.HandlerFunc) []gin.HandlerFunc { return fs }
+	routes := []apiRoute{
+		// accounts
+		{Method: "POST", Path: "/login", Tag: "accounts", Summary: "Log in and get a bearer token", Handlers: h(handleLogin), Body: loginReq{}, Resp: gin.H{"user": User{}, "token": "", "expires_at": ""}, Public: true},
+		{Method: "POST", Path: "/logout", Tag: "accounts", Summary: "End the session", Handlers: h(handleLogout), Resp: gin.H{"logged_out": true}},
+		{Method: "GET", Path: "/me", Tag: "accounts", Summary: "Current user, usage and quota", Handlers: h(handleMe), Resp: gin.H{"auth": true, "user": User{}, "used_bytes": int64(0), "quota_bytes": int64(0)}},
+
+		// videos
+		{Method: "POST", Path: "/upload", Tag: "videos", Summary: "Upload videos", Handlers: h(trackUpload, enforceQuota, handleUploadVideos), Query: uploadParams, Files: "videos", Resp: gin.H{"videos": []*VideoMeta{}}, Modules: []string{"video"}},
+		{Method: "POST", Path: "/process", Tag: "videos", Summary: "Extract frames and build a PDF per video", Handlers: h(idempotent, admitJob, enforceQuota, handleProcessVideos), Body: processReq{}, Resp: gin.H{"job_id": "", "results": []processItem{}}, Binary: "application/pdf", Modules: []string{"video"}},
+
+		// images
+		{Method: "POST", Path: "/upload_images", Tag: "images", Summary: "Upload images", Handlers: h(trackUpload, enforceQuota, handleUploadImages), Query: uploadParams, Files: "images", Resp: imagesUploadResp{}, Modules: []string{"images"}},
+		{Method: "POST", Path: "/images_pdf", Tag: "images", Summary: "Build one PDF from ordered images", Handlers: h(idempotent, admitJob, enforceQuota, handleImagesPDF), Body: imagesPDFReq{}, Resp: gin.H{"job_id": "", "pdf_url": "", "count": 0}, Binary: "application/pdf", Modules: []string{"images"}},
+
+		// audio
+		{Method: "POST", Path: "/upload_audio", Tag: "audio", Summary: "Upload audio", Handlers: h(trackUpload, enforceQuota, handleUploadAudio), Query: uploadParams, Files: "audios", Resp: audioUploadResp{}, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/convert_audio", Tag: "audio", Summary: "Convert audio to other formats", Handlers: h(idempotent, admitJob, enforceQuota, handleConvertAudio), Body: convertAudioReq{}, Resp: gin.H{"job_id": "", "results": []convertAudioItem{}, "zip_url": ""}, Async: true, Binary: "audio/*", Modules: []string{"audio"}},
+		{Method: "POST", Path: "/trim_audio", Tag: "audio", Summary: "Cut ranges out of audio", Handlers: h(admitJob, enforceQuota, handleTrimAudio), Body: trimAudioReq{}, Resp: gin.H{"results": []trimAudioItem{}}, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/analyze_audio", Tag: "audio", Summary: "Measure loudness", Handlers: h(handleAnalyzeAudio), Body: analyzeAudioReq{}, Resp: gin.H{"id": "", "name": "", "duration_seconds": 0.0, "loudness": &loudnessReport{}}, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/analyze_music", Tag: "audio", Summary: "Detect tempo and key", Handlers: h(admitJob, handleAnalyzeMusic), Body: analyzeMusicReq{}, Resp: gin.H{"job_id": "", "results": []musicAnalysis{}}, Async: true, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/concat_audio", Tag: "audio", Summary: "Join audio files", Handlers: h(admitJob, enforceQuota, handleConcatAudio), Body: concatAudioReq{}, Resp: gin.H{"out_url": "", "count": 0, "format": "", "duration_seconds": 0.0}, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/split_audio", Tag: "audio", Summary: "Split audio at silences", Handlers: h(admitJob, enforceQuota, handleSplitAudio), Body: splitAudioReq{}, Resp: audioUploadResp{}, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/preview_audio", Tag: "audio", Summary: "Render a short preview clip", Handlers: h(admitJob, enforceQuota, handlePreviewAudio), Body: previewAudioReq{}, Resp: gin.H{"id": "", "name": "", "start_seconds": 0.0, "duration_seconds": 0.0, "preview_url": ""}, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/separate_audio", Tag: "audio", Summary: "Separate stems", Handlers: h(admitJob, enforceQuota, handleSeparateAudio), Body: separateAudioReq{}, Resp: gin.H{"job_id": "", "audios": []*AudioMeta{}}, Async: true, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/slideshow", Tag: "images", Summary: "Render ordered images, with an optional soundtrack, into a slideshow video", Handlers: h(admitJob, enforceQuota, handleSlideshow), Body: slideshowReq{}, Resp: gin.H{"job_id": "", "video_url": "", "count": 0, "duration_seconds": 0.0}, Async: true, Modules: []string{"images", "video"}},
+		{Method: "POST", Path: "/waveform_video", Tag: "audio", Summary: "Render a waveform video", Handlers: h(admitJob, enforceQuota, handleWaveformVideo), Body: waveformVideoReq{}, Resp: gin.H{"job_id": "", "id": "", "name": "", "video_url": ""}, Async: true, Modules: []string{"audio"}},
+		{Method: "POST", Path: "/transcribe", Tag: "audio", Summary: "Transcribe audio or video", Handlers: h(admitJob, enforceQuota, handleTranscribe), Body: transcribeReq{}, Resp: gin.H{"job_id": "", "id": "", "name": "", "backend": "", "segments": 0, "srt_url": "", "vtt_url": "", "txt_url": "", "pdf_url": ""}, Async: true, Modules: []string{"audio|video"}},
+
+		// presets
+		{Method: "POST", Path: "/presets", Tag: "presets", Summary: "Create a preset", Handlers: h(handleCreatePreset), Body: presetReq{}, Resp: Preset{}},
+		{Method: "GET", Path: "/presets", Tag: "presets", Summary: "List presets", Handlers: h(handleListPresets), Query: listParams, Resp: listSample("presets", []*Preset{})},
+		{Method: "GET", Path: "/presets/:name", Tag: "presets", Summary: "Get a preset", Handlers: h(handleGetPreset), Resp: Preset{}},
+		{Method: "PATCH", Path: "/presets/:name", Tag: "presets", Summary: "Update a preset", Handlers: h(handleUpdatePreset), Body: presetReq{}, Resp: Preset{}},
+		{Method: "DELETE", Path: "/presets/:name", Tag: "presets", Summary: "Delete a preset", Handlers: h(handleDeletePreset), Resp: gin.H{"deleted": ""}},
+
+		// pipelines
+		{Method: "POST", Path: "/pipeline", Tag: "pipelines", Summary: "Run a chain of steps on one upload as one job", Handlers: h(admitJob, enforceQuota, handlePipeline), Body: pipelineReq{}, Resp: gin.H{"job_id": "", "id": "", "name": "", "steps": []pipelineStepResult{}, "outputs": []string{}}, Async: true, Modules: []string{"video|audio"}},
+
+		// remote sources
+		{Method: "POST", Path: "/ingest_s3", Tag: "ingest", Summary: "Import objects from S3-compatible storage", Handlers: h(admitJob, enforceQuota, handleIngestS3), Body: ingestReq{}, Resp: ingestSample, Async: true},
+		{Method: "POST", Path: "/ingest_url", Tag: "ingest", Summary: "Import files by URL", Handlers: h(admitJob, enforceQuota, handleIngestURL), Body: ingestURLReq{}, Resp: ingestSample, Async: true},
+		{Method: "POST", Path: "/ingest_ytdlp", Tag: "ingest", Summary: "Import videos from video sites", Handlers: h(admitJob, enforceQuota, handleIngestYtdlp), Body: ytdlpReq{}, Resp: ingestSample, Async: true, Modules: []string{"video"}},
+
+		// listings
+		{Method: "GET", Path: "/videos", Tag: "listings", Summary: "List videos", Handlers: h(handleListVideos), Query: listParams, Resp: listSample("videos", []*VideoMeta{}), Modules: []string{"video"}},
+		{Method: "GET", Path: "/images", Tag: "listings", Summary: "List images", Handlers: h(handleListImages), Query: listParams, Resp: listSample("images", []*ImgMeta{}), Modules: []string{"images"}},
+		{Method: "GET", Path: "/audios", Tag: "listings", Summary: "List audio", Handlers: h(handleListAudios), Query: listParams, Resp: listSample("audios", []*AudioMeta{}), Modules: []string{"audio"}},
+		{Method: "GET", Path: "/pdfs", Tag: "listings", Summary: "List generated PDFs", Handlers: h(handleListPDFs), Query: listParams, Resp: listSample("pdfs", []pdfItem{})},
+
+		// projects
+		{Method: "POST", Path: "/projects", Tag: "projects", Summary: "Create a project", Handlers: h(handleCreateProject), Body: projectReq{}, Resp: Project{}},
+		{Method: "GET", Path: "/projects", Tag: "projects", Summary: "List projects", Handlers: h(handleListProjects), Query: listParams, Resp: listSample("projects", []*Project{})},
+		{Method: "GET", Path: "/projects/:id", Tag: "projects", Summary: "Get a project with its items", Handlers: h(handleGetProject), Resp: gin.H{"project": Project{}, "videos": []*VideoMeta{}, "images": []*ImgMeta{}, "audios": []*AudioMeta{}}},
+		{Method: "PATCH", Path: "/projects/:id", Tag: "projects", Summary: "Update a project", Handlers: h(handleUpdateProject), Body: projectReq{}, Resp: Project{}},
+		{Method: "DELETE", Path: "/projects/:id", Tag: "projects", Summary: "Delete a project", Handlers: h(handleDeleteProject), Resp: gin.H{"deleted": ""}},
+		{Method: "POST", Path: "/projects/:id/items", Tag: "projects", Summary: "Add items to a project", Handlers: h(handleProjectItems), Body: projectItemsReq{}, Resp: Project{}},
+		{Method: "DELETE", Path: "/projects/:id/items", Tag: "projects", Summary: "Remove items from a project", Handlers: h(handleProjectItems), Body: projectItemsReq{}, Resp: Project{}},
+		{Method: "GET", Path: "/projects/:id/export", Tag: "projects", Summary: "Export a project's manifest, or a ZIP with its sources and outputs", Handlers: h(handleExportProject), Query: []apiParam{{"include", "sources, outputs or both (comma-separated) for a ZIP"}}, Resp: projectExport{}},
+		{Method: "POST", Path: "/projects/import", Tag: "projects", Summary: "Import an exported project", Handlers: h(enforceQuota, handleImportProject), Body: projectExport{}, Resp: projectImport{}},
+	}
+
+	// probing
+	for _, kind := range []string{"videos", "audios"} {
+		var resp any = VideoMeta{}
+		if kind == "audios" {
+			resp = AudioMeta{}
+		}
+		routes = append(routes, apiRoute{Method: "POST", Path: "/" + kind + "/:id/probe", Tag: "probing", Summary: "Probe one of the " + kind + " again, from the probe cache unless it changed or force is set", Handlers: h(handleReprobe(kind)), Body: reprobeReq{}, Resp: resp, Modules: []string{kindModules[strings.TrimSuffix(kind, "s")]}})
+	}
+
+	// embedded pictures
+	for _, kind := range []string{"videos", "audios"} {
+		routes = append(routes, apiRoute{Method: "POST", Path: "/" + kind + "/:id/attachments", Tag: "images", Summary: "Register the cover art and image attachments embedded in one of the " + kind + " as images", Handlers: h(enforceQuota, handleExtractAttachments(kind)), Body: attachmentsReq{}, Resp: gin.H{"id": "", "name": "", "attachments": []attachmentResult{}, "images": []*ImgMeta{}}, Modules: []string{kindModules[strings.TrimSuffix(kind, "s")], "images"}})
+	}
+
+	// tags
+	for _, kind := range []string{"videos", "images", "audios"} {
+		for _, m := range []string{"PUT", "PATCH"} {
+			summary := "Replace the tags of one of the " + kind
+			if m == "PATCH" {
+				summary = "Add or remove tags of one of the " + kind
+			}
+			routes = append(routes, apiRoute{Method: m, Path: "/" + kind + "/:id/tags", Tag: "tags", Summary: summary, Handlers: h(handleTags(kind)), Body: tagsReq{}, Resp: gin.H{"id": "", "tags": []string{}}, Modules: []string{kindModules[strings.TrimSuffix(kind, "s")]}})
+		}
+	}
+
+	return append(routes, []apiRoute{
+		// upload progress and limits
+		{Method: "GET", Path: "/uploads/:id/progress", Tag: "uploads", Summary: "Progress of an upload sent with an X-Upload-ID header", Handlers: h(handleUploadProgress), Resp: uploadProgress{}, V1Only: true},
+		{Method: "GET", Path: "/capabilities", Tag: "server", Summary: "Tool versions, ffmpeg codecs and filters, and the features they enable on this host", Handlers: h(handleCapabilities), Query: []apiParam{{"refresh", "1 to detect again now instead of using the result of the last 10 minutes (admins)"}}, Resp: capabilities{}},
+		{Method: "GET", Path: "/upload_limits", Tag: "uploads", Summary: "Size limits per upload request and per file, by kind", Handlers: h(handleUploadLimits), Resp: map[string]uploadLimit{}},
+
+		// jobs and history
+		{Method: "GET", Path: "/jobs", Tag: "jobs", Summary: "Queued and running jobs with their place in the queue", Handlers: h(handleListJobs), Query: []apiParam{{"status", "queued or running"}, {"type", "job type, e.g. process"}}, Resp: gin.H{"jobs": []jobSummary{}, "total": 0, "running": 0, "waiting": 0, "limit": 0}},
+		{Method: "GET", Path: "/jobs/:id", Tag: "jobs", Summary: "Job status, progress and result", Handlers: h(handleGetJob), Resp: Job{}},
+		{Method: "GET", Path: "/jobs/:id/log", Tag: "jobs", Summary: "Tool output of a job as plain text; follow=1 streams it while the job runs", Handlers: h(handleJobLog), Query: []apiParam{{"tail", "only the last lines"}, {"follow", "1 to keep sending output until the job is done"}}},
+		{Method: "GET", Path: "/jobs/:id/bundle", Tag: "jobs", Summary: "Download every output of a finished job as one ZIP with a manifest.json", Handlers: h(handleJobBundle)},
+		{Method: "GET", Path: "/jobs/:id/frames", Tag: "jobs", Summary: "List the frames a /process job extracted, with thumbnails", Handlers: h(handleJobFrames), Query: []apiParam{{"video_id", "the video whose frames to list (default the first)"}, {"offset", "frames to skip"}, {"limit", "frames to list (default 100, at most 1000)"}}, Resp: gin.H{"job_id": "", "videos": []frameVideo{}, "video_id": "", "total": 0, "offset": 0, "limit": 0, "frames": []frameInfo{}}, Modules: []string{"video"}},
+		{Method: "POST", Path: "/jobs/:id/frames/pdf", Tag: "jobs", Summary: "Build a PDF from the frames a /process job kept, or a chosen, ordered and rotated subset", Handlers: h(admitJob, enforceQuota, handleFramesPDF), Body: framesPDFReq{}, Resp: gin.H{"job_id": "", "pdf_url": "", "count": 0}, Async: true, Modules: []string{"video"}},
+		{Method: "GET", Path: "/audit", Tag: "jobs", Summary: "Job history, newest first", Handlers: h(handleListAudit), Query: append(auditParams, apiParam{"limit", "entries per page (at most 1000)"}, apiParam{"before", "next_before of the previous page"}), Resp: gin.H{"entries": []AuditEntry{}, "next_before": ""}},
+		{Method: "GET", Path: "/audit/export", Tag: "jobs", Summary: "Download the job history as CSV or JSON", Handlers: h(handleExportAudit), Query: append(auditParams, apiParam{"format", "csv (default) or json"}), Resp: []AuditEntry{}},
+
+		// retention pins
+		{Method: "GET", Path: "/pins", Tag: "retention", Summary: "List pins", Handlers: h(handleListPins), Resp: gin.H{"pins": []Pin{}}},
+		{Method: "POST", Path: "/pins", Tag: "retention", Summary: "Exempt an output or upload from retention", Handlers: h(handlePin), Body: pinReq{}, Resp: Pin{}},
+		{Method: "DELETE", Path: "/pins", Tag: "retention", Summary: "Remove a pin", Handlers: h(handleUnpin), Body: pinReq{}},
+
+		// share links
+		{Method: "POST", Path: "/shares", Tag: "shares", Summary: "Create a share link", Handlers: h(handleCreateShare), Body: shareReq{}, Resp: gin.H{"share": Share{}, "token": "", "share_url": ""}},
+		{Method: "GET", Path: "/shares", Tag: "shares", Summary: "List share links", Handlers: h(handleListShares), Resp: gin.H{"shares": []Share{}}},
+		{Method: "DELETE", Path: "/shares/:id", Tag: "shares", Summary: "Revoke a share link", Handlers: h(handleDeleteShare)},
+
+		// admin
+		{Method: "GET", Path: "/admin/storage", Tag: "admin", Summary: "Disk usage per work directory", Handlers: h(handleAdminStorage), Resp: gin.H{"dirs": map[string]dirUsage{}, "store_bytes": int64(0), "total_bytes": int64(0), "items": map[string]int{}}, Admin: true},
+		{Method: "GET", Path: "/admin/tools", Tag: "admin", Summary: "Tool and job concurrency and the box's load", Handlers: h(handleAdminTools), Resp: gin.H{"tools": map[string]any{}, "jobs": map[string]int{}, "load": loadSample{}}, Admin: true},
+		{Method: "POST", Path: "/admin/cleanup", Tag: "admin", Summary: "Purge stored files", Handlers: h(handleAdminCleanup), Body: cleanupReq{}, Resp: gin.H{"removed": map[string]sweepResult{}}, Admin: true},
+		{Method: "POST", Path: "/schedules", Tag: "schedules", Summary: "Create a schedule", Handlers: h(handleCreateSchedule), Body: scheduleReq{}, Resp: Schedule{}, Admin: true},
+		{Method: "GET", Path: "/schedules", Tag: "schedules", Summary: "List schedules", Handlers: h(handleListSchedules), Resp: gin.H{"schedules": []Schedule{}}, Admin: true},
+		{Method: "GET", Path: "/schedules/:id", Tag: "schedules", Summary: "Get a schedule", Handlers: h(handleGetSchedule), Resp: Schedule{}, Admin: true},
+		{Method: "PATCH", Path: "/schedules/:id", Tag: "schedules", Summary: "Update a schedule", Handlers: h(handleUpdateSchedule), Body: scheduleReq{}, Resp: Schedule{}, Admin: true},
+		{Method: "DELETE", Path: "/schedules/:id", Tag: "schedules", Summary: "Delete a schedule", Handlers: h(handleDeleteSchedule), Resp: gin.H{"deleted": ""}, Admin: true},
+		{Method: "POST", Path: "/schedules/:id/run", Tag: "schedules", Summary: "Run a schedule now", Handlers: h(handleRunSchedule), Resp: scheduleRun{}, Admin: true},
+		{Method: "GET", Path: "/admin/users", Tag: "admin", Summary: "List accounts", Handlers: h(handleListUsers), Resp: gin.H{"users": []User{}}, Admin: true},
+		{Method: "POST", Path: "/admin/users", Tag: "admin", Summary: "Create an account", Handlers: h(handleCreateUser), Body: userReq{}, Resp: User{}, Admin: true},
+		{Method: "PATCH", Path: "/admin/users/:id", Tag: "admin", Summary: "Update an account", Handlers: h(handleUpdateUser), Body: userReq{}, Resp: User{}, Admin: true},
+		{Method: "DELETE", Path: "/admin/users/:id", Tag: "admin", Summary: "Delete an account", Handlers: h(handleDeleteUser), Resp: gin.H{"deleted": ""}, Admin: true},
+	}...)
+}
+
+func listSample(key string, items any) gin.H {
+	return gin.H{key: items, "total": 0, "page": 0, "limit": 0}
+}
+
+// registerAPI serves the routes at their original paths and under
+// apiPrefix.
+func registerAPI(r *gin.Engine) {
+	v1 := r.Group(apiPrefix)
+	for _, rt := range apiRoutes() {
+		if !rt.enabled() {
+			continue
+		}
+		hs := rt.Handlers
+		if rt.Admin {
+			hs = append([]gin.HandlerFunc{requireAdmin}, hs...)
+		}
+		if !rt.V1Only {
+			r.Handle(rt.Method, rt.Path, hs...)
+		}
+		v1.Handle(rt.Method, rt.Path, hs...)
+	}
+	v1.GET("/openapi.json", handleOpenAPI)
+	r.NoRoute(func(c *gin.Context) {
+		fail(c, http.StatusNotFound, "no such endpoint: %s %s", c.Request.Method, c.Request.URL.Path)
+	})
+}
+
+// publicAPIPath reports whether the route needs no login.
+func publicAPIPath(fullPath string) bool {
+	return fullPath == apiPrefix+"/openapi.json" || fullPath == apiPrefix+"/login"
+}
+
+// ===== OpenAPI =====
+
+var openAPIDoc = sync.OnceValue(buildOpenAPI)
+
+func handleOpenAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, openAPIDoc())
+}
+
+// schemaGen builds JSON schemas from Go types, collecting named structs
+// under components/schemas.
+type schemaGen struct {
+	components map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func schemaName(t reflect.Type) string {
+	n := []rune(t.Name())
+	n[0] = unicode.ToUpper(n[0])
+	return string(n)
+}
+
+// sample returns the schema of a response sample.
+func (g *schemaGen) sample(v any) map[string]any {
+	if m, ok := v.(gin.H); ok {
+		props := map[string]any{}
+		for k, x := range m {
+			props[k] = g.sample(x)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	}
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	if t == nil {
+		return map[string]any{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := g.components[name]; !ok {
+			g.components[name] = map[string]any{} // placeholder for recursive types
+			g.components[name] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// object describes a struct's JSON fields; embedded structs without a tag
+// are flattened, as encoding/json does.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var walk func(reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+		}
+	}
+	walk(t)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+func buildOpenAPI() any {
+	g := &schemaGen{components: map[string]any{}}
+	errSchema := g.schema(reflect.TypeOf(apiError{}))
+	errResp := map[string]any{
+		"description": "error",
+		"content":     map[string]any{"application/json": map[string]any{"schema": errSchema}},
+	}
+	paths := map[string]any{}
+	for _, rt := range apiRoutes() {
+		if !rt.enabled() {
+			continue
+		}
+		op := map[string]any{
+			"summary":     rt.Summary,
+			"tags":        []string{rt.Tag},
+			"operationId": operationID(rt),
+		}
+		var params []any
+		for _, seg := range strings.Split(rt.Path, "/") {
+			if p, ok := strings.CutPrefix(seg, ":"); ok {
+				params = append(params, map[string]any{"name": p, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+			}
+		}
+		query := rt.Query
+		if rt.Binary != "" {
+			query = append(query, apiParam{"binary", "1 to get the generated file instead of JSON (one output only)"})
+		}
+		for _, q := range query {
+			params = append(params, map[string]any{"name": q.Name, "in": "query", "description": q.Desc, "schema": map[string]any{"type": "string"}})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		switch {
+		case rt.Body != nil:
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(rt.Body))}}}
+		case rt.Files != "":
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{"multipart/form-data": map[string]any{"schema": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					rt.Files:     map[string]any{"type": "array", "items": map[string]any{"type": "string", "format": "binary"}},
+					"tags":       map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+					"project_id": map[string]any{"type": "string"},
+				},
+				"required": []string{rt.Files},
+			}}}}
+		}
+		ok := map[string]any{"description": "OK"}
+		if rt.Resp != nil {
+			ok["content"] = map[string]any{"application/json": map[string]any{"schema": g.sample(rt.Resp)}}
+		}
+		if rt.Binary != "" {
+			ok["content"].(map[string]any)[rt.Binary] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+		}
+		status := "200"
+		if rt.Resp == nil && rt.Method == "DELETE" {
+			status, ok = "204", map[string]any{"description": "deleted"}
+		}
+		responses := map[string]any{status: ok, "default": errResp}
+		if rt.Async {
+			responses["202"] = map[string]any{"description": "queued (async: true); poll status_url", "content": map[string]any{"application/json": map[string]any{"schema": g.sample(jobAccepted)}}}
+		}
+		op["responses"] = responses
+		if rt.Public {
+			op["security"] = []any{}
+		}
+		path := openAPIPath(rt.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path].(map[string]any)[strings.ToLower(rt.Method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "framespdf API",
+			"version":     "1",
+			"description": "Turn videos into frame PDFs, images into PDFs, and convert, analyse and transcribe audio. With accounts enabled, send the token from POST /login as a bearer token.",
+		},
+		"servers":  []any{map[string]any{"url": publicURL + apiPrefix}},
+		"security": []any{map[string]any{"bearer": []string{}}},
+		"paths":    paths,
+		"components": map[string]any{
+			"schemas":         g.components,
+			"securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+// openAPIPath turns gin's :param segments into {param}.
+func openAPIPath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		if name, ok := strings.CutPrefix(s, ":"); ok {
+			segs[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// operationID derives a stable name like postProjectsIdItems.
+func operationID(rt apiRoute) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(rt.Method))
+	for _, w := range strings.FieldsFunc(rt.Path, func(r rune) bool { return r == '/' || r == '_' || r == ':' }) {
+		b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+	}
+	return b.String()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"video-to-pdf/probe"
+)
+
+// Attachments: POST /videos/:id/attachments and /audios/:id/attachments
+// pull the pictures embedded in an upload's container (MP3 APIC frames,
+// MP4 covr atoms, FLAC pictures, Matroska image attachments) out and
+// register each as an image upload, ready for /images_pdf or a
+// slideshow. Attachments that aren't images, such as the fonts Matroska
+// files carry for subtitles, are listed but not extracted. Extracting the
+// same upload again returns the images registered the first time.
+
+type attachmentsReq struct {
+	Tags      []string `json:"tags"`
+	ProjectID string   `json:"project_id"`
+}
+
+// attachmentResult is one embedded file and what became of it.
+type attachmentResult struct {
+	// Stream is the attachment's stream index in the container.
+	Stream int `json:"stream"`
+	// Kind is cover for an attached picture, attachment otherwise.
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	MIMEType string `json:"mime_type,omitempty"`
+	// ImageID is the image registered from it; Skipped says why none was.
+	ImageID string `json:"image_id,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// coverExts are the file extensions of attached picture codecs, which are
+// copied out as they are; pictures in other codecs are converted to PNG.
+var coverExts = map[string]string{"mjpeg": ".jpg", "png": ".png", "bmp": ".bmp", "webp": ".webp", "gif": ".gif", "tiff": ".tif"}
+
+// handleExtractAttachments extracts the embedded pictures of one of the
+// kind's uploads as images.
+func handleExtractAttachments(kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req attachmentsReq
+		if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength != 0 {
+			failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+			return
+		}
+		id := c.Param("id")
+		var src, name string
+		switch kind {
+		case "videos":
+			if vm := getVideo(c, id); vm != nil {
+				src, name = vm.AbsPath, vm.Name
+			}
+		case "audios":
+			if am := getAudio(c, id); am != nil {
+				src, name = am.AbsPath, am.Name
+			}
+		}
+		if src == "" {
+			failCode(c, http.StatusNotFound, errUnknownID, "unknown %s id: %s", strings.TrimSuffix(kind, "s"), id)
+			return
+		}
+		tags, err := normalizeTags(req.Tags)
+		if err != nil {
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		proj := lookupProject(c, req.ProjectID)
+		if req.ProjectID != "" && proj == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", req.ProjectID)
+			return
+		}
+		atts, err := prober(false).Attachments(src)
+		if err != nil {
+			fail(c, http.StatusUnprocessableEntity, "probe failed for %s: %v", name, err)
+			return
+		}
+		owner := ownerOf(c)
+		results := make([]attachmentResult, 0, len(atts))
+		images := []*ImgMeta{}
+		for i, a := range atts {
+			r, file := attachmentFile(a, name, i)
+			if r.Skipped == "" {
+				im, err := extractAttachment(src, a, file, owner, tags, proj)
+				if err != nil {
+					r.Skipped = err.Error()
+				} else {
+					r.ImageID = im.ID
+					images = append(images, im)
+				}
+			}
+			results = append(results, r)
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id, "name": name, "attachments": results, "images": images})
+	}
+}
+
+// attachmentFile describes the i-th attachment of the upload name and
+// picks the file name to extract it under; non-images come back skipped.
+func attachmentFile(a probe.Attachment, name string, i int) (attachmentResult, string) {
+	r := attachmentResult{Stream: a.Stream, Kind: "attachment", Name: displayName(a.Filename), MIMEType: a.MIMEType}
+	if a.Cover {
+		r.Kind = "cover"
+		ext, ok := coverExts[a.Codec]
+		if !ok {
+			ext = ".png"
+		}
+		r.Name = fmt.Sprintf("%s_cover_%d%s", stripExt(name), i+1, ext)
+		return r, r.Name
+	}
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("%s_attachment_%d", stripExt(name), i+1)
+	}
+	if !strings.HasPrefix(a.MIMEType, "image/") && !imageExts[strings.ToLower(filepath.Ext(r.Name))] {
+		r.Skipped = "not an image"
+	}
+	return r, r.Name
+}
+
+// extractAttachment writes attachment a of src to a new upload directory
+// as file and registers it as an image.
+func extractAttachment(src string, a probe.Attachment, file, owner string, tags []string, proj *Project) (*ImgMeta, error) {
+	id := randID(8)
+	dir := filepath.Join(uploadDir, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	out := filepath.Join(dir, file)
+	var err error
+	if a.Cover {
+		codec := "copy"
+		if _, ok := coverExts[a.Codec]; !ok {
+			codec = "png"
+		}
+		err = runFFmpeg([]string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-map", fmt.Sprintf("0:%d", a.Stream), "-c:v", codec, "-frames:v", "1", "-f", "image2", out}, 0, nil, nil)
+	} else {
+		// ffmpeg dumps attachments while opening the input, then wants an
+		// output; a null one that stops at once does, though it may still
+		// exit non-zero when the file has no other streams
+		err = runFFmpeg([]string{"-hide_banner", "-loglevel", "error", "-y", fmt.Sprintf("-dump_attachment:%d", a.Stream), out, "-i", src, "-t", "0", "-f", "null", "-"}, 0, nil, nil)
+		if fi, statErr := os.Stat(out); statErr == nil && fi.Size() > 0 {
+			err = nil
+		}
+	}
+	fi, statErr := os.Stat(out)
+	if err == nil && statErr != nil {
+		err = statErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("extract failed: %w", err)
+	}
+	if _, limit := uploadLimits("image"); limit > 0 && fi.Size() > limit {
+		os.RemoveAll(dir)
+		return nil, &sizeLimit{Scope: "file", Bytes: limit, File: file}
+	}
+	meta, err := registerSource("image", owner, id, file, fi.Size(), tags, proj)
+	if err != nil {
+		return nil, err
+	}
+	return meta.(*ImgMeta), nil
+}
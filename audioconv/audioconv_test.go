@@ -0,0 +1,120 @@
+package audioconv
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEncodeArgs(t *testing.T) {
+	for _, tc := range []struct {
+		format                      string
+		bitrate, sampleRate, channs int
+		want                        []string
+	}{
+		{"mp3", 400, 44100, 6, []string{"-c:a", "libmp3lame", "-ar", "44100", "-ac", "2", "-b:a", "320k"}},
+		{"flac", 320, 0, 0, []string{"-c:a", "flac"}},
+		{"opus", 96, 44100, 2, []string{"-c:a", "libopus", "-ar", "48000", "-ac", "2", "-b:a", "96k"}},
+		{"amr", 7, 0, 2, []string{"-c:a", "libopencore_amrnb", "-ar", "8000", "-ac", "1", "-b:a", "6700"}},
+		{"amr", 0, 0, 0, []string{"-c:a", "libopencore_amrnb", "-ar", "8000", "-ac", "1", "-b:a", "12200"}},
+		{"m4a", 0, 0, 3, []string{"-c:a", "aac", "-movflags", "+faststart"}},
+	} {
+		f, err := Lookup(tc.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.EncodeArgs(tc.bitrate, tc.sampleRate, tc.channs); !slices.Equal(got, tc.want) {
+			t.Errorf("%s.EncodeArgs(%d, %d, %d) = %v, want %v", tc.format, tc.bitrate, tc.sampleRate, tc.channs, got, tc.want)
+		}
+	}
+}
+
+func TestSecondPassKbps(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		target int
+		got    float64
+		want   int
+	}{
+		{"ogg", 128, 160, 102},
+		{"opus", 96, 90, 102},
+		{"mp3", 64, 20, 128},
+		{"mp3", 300, 200, 320},
+		{"flac", 128, 900, 128},
+		{"amr", 12, 6, 12},
+	} {
+		if got := Formats[tc.format].SecondPassKbps(tc.target, tc.got); got != tc.want {
+			t.Errorf("%s.SecondPassKbps(%d, %g) = %d, want %d", tc.format, tc.target, tc.got, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeFormats(t *testing.T) {
+	got, err := NormalizeFormats("wav", []string{"FLAC", "", "mp3", "flac"})
+	if err != nil || !slices.Equal(got, []string{"flac", "mp3"}) {
+		t.Errorf("NormalizeFormats = %v, %v", got, err)
+	}
+	if got, _ := NormalizeFormats(" Ogg ", nil); !slices.Equal(got, []string{"ogg"}) {
+		t.Errorf("NormalizeFormats single = %v", got)
+	}
+	if _, err := NormalizeFormats("", []string{"mp3", "xyz"}); err == nil {
+		t.Error("NormalizeFormats accepted xyz")
+	}
+}
+
+func TestTempoPitchFilters(t *testing.T) {
+	for _, tc := range []struct {
+		speed, semis float64
+		rate         int
+		want         string
+	}{
+		{1, 0, 44100, ""},
+		{0, 0, 0, ""},
+		{1.25, 0, 44100, "atempo=1.250000"},
+		{5, 0, 44100, "atempo=2,atempo=2,atempo=1.250000"},
+		{0.2, 0, 44100, "atempo=0.5,atempo=0.5,atempo=0.800000"},
+		{1, 12, 48000, "asetrate=96000,aresample=48000,atempo=0.500000"},
+	} {
+		filters, err := TempoPitchFilters(tc.speed, tc.semis, tc.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(filters, ","); got != tc.want {
+			t.Errorf("TempoPitchFilters(%g, %g, %d) = %q, want %q", tc.speed, tc.semis, tc.rate, got, tc.want)
+		}
+	}
+	if _, err := TempoPitchFilters(1, 3, 0); err == nil {
+		t.Error("TempoPitchFilters shifted pitch without a source rate")
+	}
+}
+
+func TestFadeFilters(t *testing.T) {
+	got := FadeFilters(2, 30, 10)
+	want := []string{"afade=t=in:st=0:d=2.000", "afade=t=out:st=0.000:d=10.000"}
+	if !slices.Equal(got, want) {
+		t.Errorf("FadeFilters = %v, want %v", got, want)
+	}
+	// the fade-out needs the length
+	if got := FadeFilters(0, 3, 0); len(got) != 0 {
+		t.Errorf("FadeFilters without length = %v", got)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	var ran []string
+	c := Converter{Run: func(name string, args ...string) error {
+		ran = append([]string{name}, args...)
+		return nil
+	}}
+	err := c.Convert("in.wav", "out.ogg", Options{Format: "OGG", BitrateKbps: 128, Speed: 2, FadeOutS: 1, DurationS: 10, StripTags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ffmpeg -hide_banner -loglevel error -nostdin -y -i in.wav -map 0:a:0 -af atempo=2.000000,afade=t=out:st=4.000:d=1.000 -c:a libvorbis -b:a 128k -map_metadata -1 out.ogg"
+	if got := strings.Join(ran, " "); got != want {
+		t.Errorf("ran %q\nwant %q", got, want)
+	}
+	if err := c.Convert("in.wav", "out.xyz", Options{Format: "xyz"}); err == nil {
+		t.Error("Convert accepted format xyz")
+	}
+}
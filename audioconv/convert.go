@@ -0,0 +1,81 @@
+package audioconv
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Converter runs ffmpeg.
+type Converter struct {
+	// FFmpeg is the ffmpeg binary; "ffmpeg" when empty.
+	FFmpeg string
+	// Run runs a command to completion; exec.Command's Run when nil.
+	Run func(name string, args ...string) error
+}
+
+// Options are the settings of a conversion; zero values keep the source's.
+type Options struct {
+	// Format is a key of Formats; mp3 when empty.
+	Format      string
+	BitrateKbps int
+	SampleRate  int
+	Channels    int
+	// Speed changes tempo without affecting pitch (1.25 = 25% faster);
+	// PitchSemitones transposes without affecting tempo.
+	Speed          float64
+	PitchSemitones float64
+	FadeInS        float64
+	FadeOutS       float64
+	// DurationS and SourceRate describe the input; the fade-out needs the
+	// former, pitch shifting the latter.
+	DurationS  float64
+	SourceRate int
+	// StripTags drops the source's tags instead of copying them.
+	StripTags bool
+}
+
+// Convert encodes the first audio stream of in to out.
+func (c Converter) Convert(in, out string, o Options) error {
+	format := strings.ToLower(o.Format)
+	if format == "" {
+		format = "mp3"
+	}
+	f, err := Lookup(format)
+	if err != nil {
+		return err
+	}
+	bin := c.FFmpeg
+	if bin == "" {
+		bin = "ffmpeg"
+	}
+	run := c.Run
+	if run == nil {
+		run = func(name string, args ...string) error { return exec.Command(name, args...).Run() }
+	}
+	args, err := convertArgs(in, out, f, o)
+	if err != nil {
+		return err
+	}
+	return run(bin, args...)
+}
+
+func convertArgs(in, out string, f Format, o Options) ([]string, error) {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y", "-i", in, "-map", "0:a:0"}
+	filters, err := TempoPitchFilters(o.Speed, o.PitchSemitones, o.SourceRate)
+	if err != nil {
+		return nil, err
+	}
+	length := o.DurationS
+	if o.Speed > 0 {
+		length /= o.Speed
+	}
+	filters = append(filters, FadeFilters(o.FadeInS, o.FadeOutS, length)...)
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	args = append(args, f.EncodeArgs(o.BitrateKbps, o.SampleRate, o.Channels)...)
+	if o.StripTags {
+		args = append(args, "-map_metadata", "-1")
+	}
+	return append(args, out), nil
+}
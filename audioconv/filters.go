@@ -0,0 +1,57 @@
+package audioconv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// TempoPitchFilters changes tempo by speed and transposes by semis
+// semitones. Pitch is shifted by resampling (asetrate) and the resulting
+// tempo change is folded into the atempo chain, so shifting pitch needs the
+// source's sample rate: it fails when sourceRate is unknown (0).
+func TempoPitchFilters(speed, semis float64, sourceRate int) ([]string, error) {
+	filters := []string{}
+	if speed <= 0 {
+		speed = 1
+	}
+	tempo := speed
+	if semis != 0 {
+		if sourceRate <= 0 {
+			return nil, errors.New("pitch shifting needs the source sample rate")
+		}
+		ratio := math.Pow(2, semis/12)
+		filters = append(filters, fmt.Sprintf("asetrate=%d", int(math.Round(float64(sourceRate)*ratio))), fmt.Sprintf("aresample=%d", sourceRate))
+		tempo /= ratio
+	}
+	if math.Abs(tempo-1) < 1e-9 {
+		return filters, nil
+	}
+	// a single atempo instance is limited to 0.5..2.0
+	for tempo > 2 {
+		filters = append(filters, "atempo=2")
+		tempo /= 2
+	}
+	for tempo < 0.5 {
+		filters = append(filters, "atempo=0.5")
+		tempo /= 0.5
+	}
+	return append(filters, fmt.Sprintf("atempo=%.6f", tempo)), nil
+}
+
+// FadeFilters returns afade filters for a fade-in from 0 and a fade-out
+// ending at length; both are clamped to length when it is known.
+func FadeFilters(fadeIn, fadeOut, length float64) []string {
+	filters := []string{}
+	if fadeIn > 0 {
+		if length > 0 {
+			fadeIn = math.Min(fadeIn, length)
+		}
+		filters = append(filters, fmt.Sprintf("afade=t=in:st=0:d=%.3f", fadeIn))
+	}
+	if fadeOut > 0 && length > 0 {
+		fadeOut = math.Min(fadeOut, length)
+		filters = append(filters, fmt.Sprintf("afade=t=out:st=%.3f:d=%.3f", length-fadeOut, fadeOut))
+	}
+	return filters
+}
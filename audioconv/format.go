@@ -0,0 +1,151 @@
+// Package audioconv holds the audio output formats and the ffmpeg arguments
+// and filters to encode them, plus a converter built on those.
+package audioconv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Format describes an output format and the constraints its encoder
+// imposes.
+type Format struct {
+	Codec string
+	Ext   string
+	// Bitrate is false for lossless/PCM codecs that ignore -b:a.
+	Bitrate        bool
+	MaxBitrateKbps int
+	// BitratesBps lists the only bitrates the encoder accepts (AMR); the
+	// closest one not above the requested value is used.
+	BitratesBps []int
+	// SampleRates lists accepted rates; requests outside it fall back to the
+	// first entry.
+	SampleRates []int
+	// Channels forces a channel count (0 = any); MaxChannels caps it.
+	Channels    int
+	MaxChannels int
+	// Extra is appended after the codec options (muxer flags etc.).
+	Extra []string
+}
+
+// Formats are the supported output formats by name.
+var Formats = map[string]Format{
+	"mp3":  {Codec: "libmp3lame", Ext: ".mp3", Bitrate: true, MaxBitrateKbps: 320, MaxChannels: 2},
+	"wav":  {Codec: "pcm_s16le", Ext: ".wav"},
+	"flac": {Codec: "flac", Ext: ".flac"},
+	"aac":  {Codec: "aac", Ext: ".aac", Bitrate: true, MaxBitrateKbps: 512},
+	"ogg":  {Codec: "libvorbis", Ext: ".ogg", Bitrate: true, MaxBitrateKbps: 500},
+	"opus": {Codec: "libopus", Ext: ".opus", Bitrate: true, MaxBitrateKbps: 510, SampleRates: []int{48000, 24000, 16000, 12000, 8000}},
+	"m4a":  {Codec: "aac", Ext: ".m4a", Bitrate: true, MaxBitrateKbps: 512, Extra: []string{"-movflags", "+faststart"}},
+	"alac": {Codec: "alac", Ext: ".m4a", Extra: []string{"-movflags", "+faststart"}},
+	"aiff": {Codec: "pcm_s16be", Ext: ".aiff"},
+	"wma":  {Codec: "wmav2", Ext: ".wma", Bitrate: true, MaxBitrateKbps: 320, MaxChannels: 2, SampleRates: []int{44100, 48000, 32000, 22050, 16000, 11025, 8000}},
+	"amr":  {Codec: "libopencore_amrnb", Ext: ".amr", Bitrate: true, BitratesBps: []int{4750, 5150, 5900, 6700, 7400, 7950, 10200, 12200}, SampleRates: []int{8000}, Channels: 1},
+}
+
+// ChannelLayouts maps the output channel counts that can be requested to
+// ffmpeg's layout name.
+var ChannelLayouts = map[int]string{1: "mono", 2: "stereo", 6: "5.1", 8: "7.1"}
+
+// Lookup returns the format called name.
+func Lookup(name string) (Format, error) {
+	f, ok := Formats[name]
+	if !ok {
+		return Format{}, fmt.Errorf("unsupported format: %s", name)
+	}
+	return f, nil
+}
+
+// EncodeArgs returns the -c:a/-ar/-ac/-b:a arguments for the requested
+// settings, clamped to what the encoder supports. Zero leaves a setting to
+// ffmpeg.
+func (f Format) EncodeArgs(bitrateKbps, sampleRate, channels int) []string {
+	args := []string{"-c:a", f.Codec}
+	if len(f.SampleRates) > 0 {
+		ok := false
+		for _, r := range f.SampleRates {
+			ok = ok || r == sampleRate
+		}
+		if !ok {
+			sampleRate = f.SampleRates[0]
+		}
+	}
+	if sampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(sampleRate))
+	}
+	if f.Channels > 0 {
+		channels = f.Channels
+	}
+	if f.MaxChannels > 0 && channels > f.MaxChannels {
+		channels = f.MaxChannels
+	}
+	if _, ok := ChannelLayouts[channels]; ok {
+		args = append(args, "-ac", strconv.Itoa(channels))
+	}
+	switch {
+	case len(f.BitratesBps) > 0:
+		bps := f.BitratesBps[len(f.BitratesBps)-1]
+		if bitrateKbps > 0 {
+			bps = f.BitratesBps[0]
+			for _, b := range f.BitratesBps {
+				if b <= bitrateKbps*1000 {
+					bps = b
+				}
+			}
+		}
+		args = append(args, "-b:a", strconv.Itoa(bps))
+	case f.Bitrate && bitrateKbps > 0:
+		if f.MaxBitrateKbps > 0 && bitrateKbps > f.MaxBitrateKbps {
+			bitrateKbps = f.MaxBitrateKbps
+		}
+		args = append(args, "-b:a", fmt.Sprintf("%dk", bitrateKbps))
+	}
+	return append(args, f.Extra...)
+}
+
+// NormalizeFormats resolves the format(s) of a conversion: formats wins
+// over format, names are lowercased, duplicates dropped and the default is
+// mp3.
+func NormalizeFormats(format string, formats []string) ([]string, error) {
+	if len(formats) == 0 {
+		formats = []string{format}
+	}
+	var out []string
+	seen := map[string]bool{}
+	for _, f := range formats {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			f = "mp3"
+		}
+		if _, err := Lookup(f); err != nil {
+			return nil, err
+		}
+		if !seen[f] {
+			seen[f] = true
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// TwoPass reports whether f takes a free target bitrate, which a second
+// pass can correct (see SecondPassKbps).
+func (f Format) TwoPass() bool { return f.Bitrate && len(f.BitratesBps) == 0 }
+
+// SecondPassKbps is the bitrate to encode with again when a first pass
+// asked for targetKbps came out at gotKbps, so that the second lands on the
+// target: it is scaled by how far the first missed, by at most a factor of
+// two either way, and kept within the encoder's limit.
+func (f Format) SecondPassKbps(targetKbps int, gotKbps float64) int {
+	if !f.TwoPass() || targetKbps <= 0 || gotKbps <= 0 {
+		return targetKbps
+	}
+	kbps := int(math.Round(float64(targetKbps) * float64(targetKbps) / gotKbps))
+	kbps = min(max(kbps, targetKbps/2, 8), 2*targetKbps)
+	if f.MaxBitrateKbps > 0 {
+		kbps = min(kbps, f.MaxBitrateKbps)
+	}
+	return kbps
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"video-to-pdf/probe"
+)
+
+// Audio tracks: a video with several audio streams, such as a
+// multi-language MKV, lists them as audio_tracks, probed at upload and by
+// POST /videos/:id/probe. Requests that take a video's sound (a pipeline
+// on a video, transcribing a video) choose one with audio_track: its index
+// among the audio streams ("1") or its language tag ("fre"), which picks
+// the default track of that language, else the first. Without audio_track
+// they take the first audio stream.
+
+// audioTrack is one audio stream of a video.
+type audioTrack struct {
+	// Index counts the audio streams only; audio_track takes it.
+	Index      int    `json:"index"`
+	Codec      string `json:"codec"`
+	Channels   int    `json:"channels"`
+	SampleRate int    `json:"sample_rate"`
+	Language   string `json:"language,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Default    bool   `json:"default,omitempty"`
+}
+
+// probeAudioTracks lists file's audio streams; nil when ffprobe can't
+// read it.
+func probeAudioTracks(file string) []audioTrack {
+	return audioTracksOf(prober(false).AudioTracks(file))
+}
+
+// audioTracksOf converts a probe's tracks.
+func audioTracksOf(tracks []probe.AudioTrack, err error) []audioTrack {
+	if err != nil {
+		return nil
+	}
+	out := make([]audioTrack, len(tracks))
+	for i, t := range tracks {
+		out[i] = audioTrack{Index: t.Index, Codec: t.Codec, Channels: t.Channels, SampleRate: t.SampleRate, Language: t.Language, Title: t.Title, Default: t.Default}
+	}
+	return out
+}
+
+// audioTrackMap resolves the audio_track sel of vm to an ffmpeg -map
+// specifier; "" is the first audio stream.
+func audioTrackMap(vm *VideoMeta, sel string) (string, error) {
+	sel = strings.ToLower(strings.TrimSpace(sel))
+	if sel == "" {
+		return "0:a:0", nil
+	}
+	mu.Lock()
+	tracks := vm.AudioTracks
+	mu.Unlock()
+	if tracks == nil {
+		// uploaded before tracks were probed
+		tracks = probeAudioTracks(vm.AbsPath)
+		mu.Lock()
+		vm.AudioTracks = tracks
+		mu.Unlock()
+		putVideo(vm)
+	}
+	if len(tracks) == 0 {
+		return "", fmt.Errorf("%s has no audio track", vm.Name)
+	}
+	if n, err := strconv.Atoi(sel); err == nil {
+		if n < 0 || n >= len(tracks) {
+			return "", fmt.Errorf("audio_track %d: %s has %d audio tracks, from 0", n, vm.Name, len(tracks))
+		}
+		return "0:a:" + strconv.Itoa(n), nil
+	}
+	pick := -1
+	var langs []string
+	for _, t := range tracks {
+		if t.Language != "" && !slices.Contains(langs, t.Language) {
+			langs = append(langs, t.Language)
+		}
+		if t.Language == sel && (pick < 0 || t.Default) {
+			pick = t.Index
+			if t.Default {
+				break
+			}
+		}
+	}
+	if pick < 0 {
+		if len(langs) == 0 {
+			return "", fmt.Errorf("audio_track %q: %s's audio tracks have no language tags; choose one by index", sel, vm.Name)
+		}
+		return "", fmt.Errorf("audio_track %q: %s has %s audio", sel, vm.Name, strings.Join(langs, ", "))
+	}
+	return "0:a:" + strconv.Itoa(pick), nil
+}
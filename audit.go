@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// AuditEntry is the permanent record of one finished job: who ran what on
+// which sources, with which parameters, and what came out. Unlike jobs,
+// entries are never expired by the janitor, and they outlive the uploads
+// and outputs they name.
+type AuditEntry struct {
+	JobID  string `json:"job_id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Owner is the user (or anonymous session) ID; User the username at
+	// the time.
+	Owner     string        `json:"owner,omitempty"`
+	User      string        `json:"user,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+	Sources   []AuditSource `json:"sources,omitempty"`
+	Params    any           `json:"params,omitempty"`
+	Outputs   []string      `json:"outputs,omitempty"`
+	Created   string        `json:"created_at"`
+	Started   string        `json:"started_at,omitempty"`
+	Finished  string        `json:"finished_at"`
+	// DurationMS runs from start to finish, retries included.
+	DurationMS int64 `json:"duration_ms"`
+	Attempts   int   `json:"attempts"`
+}
+
+// AuditSource identifies a job's input by ID, name and content hash, so it
+// can be matched even after the upload is gone.
+type AuditSource struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind,omitempty"`
+	Name   string `json:"name,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// auditKey orders entries by finish time.
+func auditKey(e *AuditEntry) string { return e.Finished + "/" + e.JobID }
+
+// recordAudit appends the finished job j to the history.
+func recordAudit(j Job) {
+	e := &AuditEntry{
+		JobID:     j.ID,
+		Type:      j.Type,
+		Status:    j.Status,
+		Error:     j.Error,
+		Owner:     j.Owner,
+		RequestID: j.RequestID,
+		Params:    j.Params,
+		Created:   j.Created,
+		Started:   j.Started,
+		Finished:  j.Finished,
+		Attempts:  len(j.Attempts),
+	}
+	if start, err := time.Parse(time.RFC3339, j.Started); err == nil {
+		if end, err := time.Parse(time.RFC3339, j.Finished); err == nil {
+			e.DurationMS = end.Sub(start).Milliseconds()
+		}
+	}
+	if j.Status == jobDone {
+		e.Outputs = resultURLs(j.Result)
+	}
+	usersMu.Lock()
+	if u := users[j.Owner]; u != nil {
+		e.User = u.Username
+	}
+	usersMu.Unlock()
+	e.Sources = jobSources(j)
+	storePut(bucketAudit, auditKey(e), e)
+}
+
+// jobSources describes the uploads job j worked on.
+func jobSources(j Job) []AuditSource {
+	ids := append([]string{}, j.sources...)
+	for _, it := range j.Items {
+		if it.ID != "" {
+			ids = append(ids, it.ID)
+		}
+	}
+	var out []AuditSource
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range ids {
+		src := AuditSource{ID: id}
+		if vm := videos[id]; vm != nil {
+			src.Kind, src.Name, src.SHA256 = "video", vm.Name, vm.SHA256
+		} else if im := images[id]; im != nil {
+			src.Kind, src.Name, src.SHA256 = "image", im.Name, im.SHA256
+		} else if am := audios[id]; am != nil {
+			src.Kind, src.Name, src.SHA256 = "audio", am.Name, am.SHA256
+		}
+		out = append(out, src)
+	}
+	return out
+}
+
+// auditFilter selects entries by the query parameters owner, type, status,
+// source (an upload ID or SHA-256), since and until (RFC 3339 or
+// YYYY-MM-DD, on the finish time).
+type auditFilter struct {
+	owner, typ, status, source string
+	since, until               string
+}
+
+func parseAuditFilter(c *gin.Context) (auditFilter, error) {
+	f := auditFilter{owner: c.Query("owner"), typ: c.Query("type"), status: c.Query("status"), source: c.Query("source")}
+	for _, p := range []struct {
+		name string
+		dst  *string
+	}{{"since", &f.since}, {"until", &f.until}} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, v); err != nil {
+				return f, fmt.Errorf("bad %s: %s", p.name, v)
+			}
+			if p.name == "until" {
+				t = t.Add(24*time.Hour - time.Second)
+			}
+		}
+		*p.dst = t.UTC().Format(time.RFC3339)
+	}
+	if f.owner != "" {
+		// accept a username as well as an ID
+		usersMu.Lock()
+		if u := findUser(f.owner); u != nil && users[f.owner] == nil {
+			f.owner = u.ID
+		}
+		usersMu.Unlock()
+	}
+	return f, nil
+}
+
+func (f auditFilter) match(c *gin.Context, e *AuditEntry) bool {
+	if !canAccess(c, e.Owner) {
+		return false
+	}
+	if (f.owner != "" && e.Owner != f.owner) || (f.typ != "" && e.Type != f.typ) || (f.status != "" && e.Status != f.status) {
+		return false
+	}
+	if f.since != "" && e.Finished < f.since || f.until != "" && e.Finished > f.until {
+		return false
+	}
+	if f.source != "" {
+		for _, s := range e.Sources {
+			if s.ID == f.source || s.SHA256 == f.source {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// eachAudit calls fn for the entries matching f, newest first, until fn
+// returns false.
+func eachAudit(c *gin.Context, f auditFilter, fn func(*AuditEntry) bool) error {
+	if db == nil {
+		return nil
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte(bucketAudit)).Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				continue
+			}
+			if f.since != "" && e.Finished < f.since {
+				break
+			}
+			if f.match(c, &e) && !fn(&e) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// handleListAudit pages through the job history, newest first: ?limit=
+// (default 100, at most 1000) entries finished before ?before= (the
+// next_before of the previous page).
+func handleListAudit(c *gin.Context) {
+	f, err := parseAuditFilter(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 1000 {
+			fail(c, http.StatusBadRequest, "limit must be 1..1000")
+			return
+		}
+	}
+	before := c.Query("before")
+	out := []*AuditEntry{}
+	next := ""
+	err = eachAudit(c, f, func(e *AuditEntry) bool {
+		if before != "" && auditKey(e) >= before {
+			return true
+		}
+		if len(out) == limit {
+			next = auditKey(out[len(out)-1])
+			return false
+		}
+		out = append(out, e)
+		return true
+	})
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	resp := gin.H{"entries": out}
+	if next != "" {
+		resp["next_before"] = next
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+var auditCSVHeader = []string{"finished_at", "job_id", "type", "status", "error", "owner", "user", "request_id", "sources", "params", "outputs", "created_at", "started_at", "duration_ms", "attempts"}
+
+// handleExportAudit downloads every matching entry as ?format=csv (the
+// default) or json.
+func handleExportAudit(c *gin.Context) {
+	f, err := parseAuditFilter(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	format := strings.ToLower(c.DefaultQuery("format", "csv"))
+	if format != "csv" && format != "json" {
+		fail(c, http.StatusBadRequest, "format must be csv or json")
+		return
+	}
+	// collected first, so a slow download doesn't hold the store's read
+	// transaction open
+	entries := []*AuditEntry{}
+	if err := eachAudit(c, f, func(e *AuditEntry) bool {
+		entries = append(entries, e)
+		return true
+	}); err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	name := "framespdf-audit-" + time.Now().Format("20060102_150405") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	if format == "json" {
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write(auditCSVHeader)
+	for _, e := range entries {
+		_ = w.Write(e.csvRow())
+	}
+	w.Flush()
+}
+
+func (e *AuditEntry) csvRow() []string {
+	srcs := make([]string, len(e.Sources))
+	for i, s := range e.Sources {
+		srcs[i] = strings.Join([]string{s.ID, s.Kind, s.Name, s.SHA256}, ":")
+	}
+	params := ""
+	if e.Params != nil {
+		b, _ := json.Marshal(e.Params)
+		params = string(b)
+	}
+	return []string{
+		e.Finished, e.JobID, e.Type, e.Status, e.Error, e.Owner, e.User, e.RequestID,
+		strings.Join(srcs, ";"), params, strings.Join(e.Outputs, ";"),
+		e.Created, e.Started, strconv.FormatInt(e.DurationMS, 10), strconv.Itoa(e.Attempts),
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Binary response mode: a client that doesn't want a second request to
+// fetch the result (a serverless function, a shell script) can ask
+// /process, /images_pdf and /convert_audio for the generated file itself,
+// either with ?binary=1 or by accepting the file's type (Accept:
+// application/pdf, Accept: audio/*) ahead of JSON. It only works for one
+// output per request; the file's URL and the job id still come back in the
+// Content-Location and X-Job-ID headers.
+
+// maxBinaryResponseBytes caps the files sent in the body; bigger ones are
+// left at their URL.
+const maxBinaryResponseBytes = 100 << 20
+
+// wantsBinary reports whether the request asks for the file itself. mime is
+// the type of file the endpoint produces.
+func wantsBinary(c *gin.Context, mime string) bool {
+	if v := c.Query("binary"); v != "" {
+		on, _ := strconv.ParseBool(v)
+		return on
+	}
+	if c.GetHeader("Accept") == "" {
+		return false
+	}
+	return c.NegotiateFormat(gin.MIMEJSON, mime) == mime
+}
+
+// sendOutput answers with the generated file at url.
+func sendOutput(c *gin.Context, jobID, url string) {
+	path := outputPath(url)
+	st, err := os.Stat(path)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "output %s: %v", url, err)
+		return
+	}
+	if st.Size() > maxBinaryResponseBytes {
+		failCode(c, http.StatusRequestEntityTooLarge, errTooLarge, "output is %d bytes, over the %d-byte limit for binary responses; fetch it from %s", st.Size(), maxBinaryResponseBytes, url)
+		return
+	}
+	idemOutput(c, jobID, url)
+	c.Header("X-Job-ID", jobID)
+	c.Header("Content-Location", url)
+	c.FileAttachment(path, filepath.Base(path))
+}
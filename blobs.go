@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploads are content-addressed: uploads/<id>/<name> is a hard link to
+// blobs/<sha256[:2]>/<sha256>, so identical bytes are kept once however
+// many records and names point at them. Deleting an upload removes its
+// link; pruneBlobs drops blobs no record refers to anymore.
+
+// blobGrace keeps new blobs from being pruned before their upload is
+// registered.
+const blobGrace = time.Hour
+
+func blobsDir() string { return filepath.Join(workRoot, "blobs") }
+
+func blobPath(sum string) string { return filepath.Join(blobsDir(), sum[:2], sum) }
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var linkWarnOnce sync.Once
+
+// internBlob makes path a link to the blob holding its content (sum, or
+// hashed here when empty), storing the blob first if it is new, and returns
+// the sum. Where hard links aren't supported the file is left as it is.
+func internBlob(path, sum string) (string, error) {
+	if sum == "" {
+		var err error
+		if sum, err = hashFile(path); err != nil {
+			return "", err
+		}
+	}
+	blob := blobPath(sum)
+	if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+		return "", err
+	}
+	err := os.Link(path, blob)
+	if err == nil {
+		return sum, nil
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		linkWarnOnce.Do(func() { slog.Warn("uploads are not deduplicated", "error", err.Error()) })
+		return sum, nil
+	}
+	// the blob exists: swap our copy for a link to it
+	tmp := path + ".link"
+	if err := os.Link(blob, tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return sum, nil
+}
+
+// sameUpload returns the registered upload of kind with the same owner,
+// name and content, or nil. Re-uploading it then returns that record.
+func sameUpload(kind, owner, name, sum string) any {
+	if sum == "" {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	switch kind {
+	case "video":
+		for _, vm := range videos {
+			if vm.SHA256 == sum && vm.Owner == owner && vm.Name == name {
+				return vm
+			}
+		}
+	case "image":
+		for _, im := range images {
+			if im.SHA256 == sum && im.Owner == owner && im.Name == name {
+				return im
+			}
+		}
+	default:
+		for _, am := range audios {
+			if am.SHA256 == sum && am.Owner == owner && am.Name == name {
+				return am
+			}
+		}
+	}
+	return nil
+}
+
+// pruneBlobs removes blobs older than blobGrace that no registered upload
+// refers to.
+func pruneBlobs(now time.Time) sweepResult {
+	mu.Lock()
+	known := map[string]bool{}
+	for _, vm := range videos {
+		known[vm.SHA256] = true
+	}
+	for _, im := range images {
+		known[im.SHA256] = true
+	}
+	for _, am := range audios {
+		known[am.SHA256] = true
+	}
+	mu.Unlock()
+	var r sweepResult
+	_ = filepath.WalkDir(blobsDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || known[d.Name()] || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || now.Sub(info.ModTime()) < blobGrace {
+			return nil
+		}
+		if os.Remove(path) == nil {
+			r.Files++
+			r.Bytes += info.Size()
+		}
+		return nil
+	})
+	return r
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job bundles: GET /jobs/:id/bundle streams one ZIP with every output of a
+// finished job and a manifest.json of its settings and sources. Nothing is
+// kept on disk; the ZIP is built from the job's current outputs on each
+// request.
+
+// bundleManifest is the manifest.json at the root of a bundle.
+type bundleManifest struct {
+	JobID    string        `json:"job_id"`
+	Type     string        `json:"type"`
+	Created  string        `json:"created_at"`
+	Finished string        `json:"finished_at"`
+	Params   any           `json:"params,omitempty"`
+	Sources  []AuditSource `json:"sources,omitempty"`
+	Outputs  []bundleFile  `json:"outputs"`
+}
+
+// bundleFile is one output of the job. Name is its path in the ZIP; outputs
+// removed since the job ran are listed as missing.
+type bundleFile struct {
+	URL       string `json:"url"`
+	Name      string `json:"name,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	Missing   bool   `json:"missing,omitempty"`
+}
+
+// bundleURL is where the bundle of job id is served.
+func bundleURL(id string) string { return "/jobs/" + id + "/bundle" }
+
+// filePath maps an output or upload URL to its path on disk.
+func filePath(url string) string {
+	if rest, ok := strings.CutPrefix(url, "/uploads/"); ok {
+		return filepath.Join(uploadDir, filepath.FromSlash(rest))
+	}
+	return outputPath(url)
+}
+
+func handleJobBundle(c *gin.Context) {
+	jobsMu.Lock()
+	j := jobs[c.Param("id")]
+	jobsMu.Unlock()
+	if j == nil || !canAccess(c, j.Owner) {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown job id: %s", c.Param("id"))
+		return
+	}
+	snap := j.snapshot()
+	if snap.Status != jobDone {
+		fail(c, http.StatusConflict, "job is %s; only finished jobs have a bundle", snap.Status)
+		return
+	}
+	m := bundleManifest{JobID: snap.ID, Type: snap.Type, Created: snap.Created, Finished: snap.Finished, Params: snap.Params, Sources: jobSources(snap)}
+	var paths []string
+	seen := map[string]int{}
+	for _, u := range resultURLs(snap.Result) {
+		if strings.HasSuffix(u, ".zip") {
+			// a job's own archive (convert_audio's zip_url) repeats the
+			// other outputs
+			continue
+		}
+		f := bundleFile{URL: u}
+		path := filePath(u)
+		st, err := os.Stat(path)
+		if err != nil || st.IsDir() {
+			f.Missing = true
+			m.Outputs = append(m.Outputs, f)
+			continue
+		}
+		name := filepath.Base(path)
+		if n := seen[name]; n > 0 {
+			name = fmt.Sprintf("%s_%d%s", stripExt(name), n+1, filepath.Ext(name))
+		}
+		seen[filepath.Base(path)]++
+		f.Name, f.SizeBytes = name, st.Size()
+		m.Outputs = append(m.Outputs, f)
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		fail(c, http.StatusGone, "the job's outputs are no longer available")
+		return
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "manifest: %v", err)
+		return
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "job_"+snap.ID+".zip"))
+	zw := zip.NewWriter(c.Writer)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		_, err = w.Write(manifest)
+	}
+	i := 0
+	for _, f := range m.Outputs {
+		if err != nil {
+			break
+		}
+		if !f.Missing {
+			err = addFileToZip(zw, paths[i], f.Name)
+			i++
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// the status is sent already; without its central directory the
+		// ZIP won't open, so the client can't mistake it for a whole one
+		_ = c.Error(err)
+	}
+}
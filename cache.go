@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Result cache: a /process video or an /images_pdf build whose sources (by
+// content hash) and settings match an earlier one of the same owner gets the
+// earlier PDF back instead of running ffmpeg and ImageMagick again. Entries
+// remember the output's size and modification time, so one whose file has
+// since been removed or rewritten is dropped rather than served. Requests
+// can skip the cache with "no_cache".
+
+// cachedResult is a reusable output, keyed by resultKey.
+type cachedResult struct {
+	URL       string `json:"url"`
+	SizeBytes int64  `json:"size_bytes"`
+	ModTime   int64  `json:"mod_time"`
+	// FramesWrote to FramesURL are the rest of a /process item.
+	FramesWrote      int    `json:"frames_wrote,omitempty"`
+	FramesDropped    int    `json:"frames_dropped,omitempty"`
+	FramesDuplicated int    `json:"frames_duplicated,omitempty"`
+	FramesURL        string `json:"frames_url,omitempty"`
+	Created          string `json:"created_at"`
+}
+
+// resultKey identifies a result by owner, job type, the SHA-256 of each
+// source in order and the settings that shape the output. It is "" when a
+// source has no hash (an upload from before hashes were kept).
+func resultKey(owner, typ string, sums []string, params any) string {
+	for _, s := range sums {
+		if s == "" {
+			return ""
+		}
+	}
+	b, _ := json.Marshal(struct {
+		Owner   string   `json:"owner"`
+		Type    string   `json:"type"`
+		Sources []string `json:"sources"`
+		Params  any      `json:"params"`
+	}{owner, typ, sums, params})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// current reports whether the output is still the file the entry was made
+// for.
+func (r *cachedResult) current() bool {
+	st, err := os.Stat(outputPath(r.URL))
+	return err == nil && st.Size() == r.SizeBytes && st.ModTime().UnixNano() == r.ModTime
+}
+
+// lookupResult returns the cached result for key, nil on a miss.
+func lookupResult(key string) *cachedResult {
+	var r cachedResult
+	if key == "" || !storeGet(bucketResults, key, &r) {
+		return nil
+	}
+	if !r.current() {
+		storeDelete(bucketResults, key)
+		return nil
+	}
+	return &r
+}
+
+// storeResult caches r, the result just written, under key.
+func storeResult(key string, r cachedResult) {
+	st, err := os.Stat(outputPath(r.URL))
+	if key == "" || err != nil {
+		return
+	}
+	r.SizeBytes, r.ModTime = st.Size(), st.ModTime().UnixNano()
+	r.Created = time.Now().Format(time.RFC3339)
+	storePut(bucketResults, key, r)
+}
+
+// pruneResults drops cache entries whose output is gone or was rewritten.
+func pruneResults() {
+	if db == nil {
+		return
+	}
+	var stale []string
+	_ = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketResults)).ForEach(func(k, v []byte) error {
+			var r cachedResult
+			if json.Unmarshal(v, &r) != nil || !r.current() {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+	})
+	for _, k := range stale {
+		storeDelete(bucketResults, k)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"video-to-pdf/audioconv"
+)
+
+// Capabilities: GET /capabilities tells clients what this host can do: the
+// versions of ffmpeg, ffprobe, ImageMagick and the optional tools, ffmpeg's
+// encoders, decoders, filters and hardware accelerations, and from those
+// which features and audio formats work here, so clients can offer only
+// what will succeed. Detection runs the tools, so its result is kept for
+// capabilitiesTTL; admins can force a fresh one with ?refresh=1.
+
+const capabilitiesTTL = 10 * time.Minute
+
+// toolVersion is an external tool as found on this host.
+type toolVersion struct {
+	Found   bool   `json:"found"`
+	Path    string `json:"path,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// capability is whether a feature works here and, if not, what it lacks.
+type capability struct {
+	Enabled bool     `json:"enabled"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+type capabilities struct {
+	// Modules are the enabled parts of the service; see modules.go.
+	Modules []string               `json:"modules"`
+	Tools   map[string]toolVersion `json:"tools"`
+	// Encoders and Decoders are ffmpeg's, by kind: audio, video, subtitle.
+	Encoders map[string][]string `json:"encoders"`
+	Decoders map[string][]string `json:"decoders"`
+	Filters  []string            `json:"filters"`
+	HWAccels []string            `json:"hwaccels"`
+	// TranscriptionBackends are the configured transcribers, in the order
+	// they are tried.
+	TranscriptionBackends []string              `json:"transcription_backends"`
+	Features              map[string]capability `json:"features"`
+	// AudioFormats are /convert_audio's output formats.
+	AudioFormats map[string]capability `json:"audio_formats"`
+	Detected     string                `json:"detected_at"`
+}
+
+// featureNeeds lists what each feature needs: "tool:" a program, "enc:" an
+// ffmpeg encoder, "filter:" an ffmpeg filter.
+var featureNeeds = map[string][]string{
+	"process":                 {"tool:magick", "enc:mjpeg"},
+	"process.tonemap":         {"filter:zscale", "filter:tonemap"},
+	"images_pdf":              {"tool:magick"},
+	"contact_sheet":           {"tool:magick", "enc:mjpeg"},
+	"convert_audio":           {},
+	"normalize":               {"filter:loudnorm"},
+	"analyze_audio":           {"filter:ebur128"},
+	"analyze_music":           {"enc:pcm_f32le"},
+	"split_audio":             {"filter:silencedetect"},
+	"trim":                    {"enc:libx264", "enc:aac"},
+	"waveform_video":          {"enc:libx264", "enc:aac", "filter:showwaves"},
+	"waveform_video.spectrum": {"enc:libx264", "enc:aac", "filter:showspectrum"},
+	"waveform_video.cqt":      {"enc:libx264", "enc:aac", "filter:showcqt"},
+	"waveform_video.title":    {"filter:drawtext"},
+	"slideshow":               {"enc:libx264", "enc:aac"},
+	"slideshow.transitions":   {"filter:xfade"},
+	"separate_audio":          {"tool:demucs"},
+	"transcribe":              {"transcriber"},
+	"ingest_ytdlp":            {"tool:yt-dlp"},
+}
+
+var (
+	capsMu sync.Mutex
+	caps   *capabilities
+	capsAt time.Time
+)
+
+func handleCapabilities(c *gin.Context) {
+	refresh := c.Query("refresh") == "1" || c.Query("refresh") == "true"
+	if u := currentUser(c); refresh && authEnabled && (u == nil || !u.Admin) {
+		failCode(c, http.StatusForbidden, errForbidden, "only admins can refresh the capabilities")
+		return
+	}
+	capsMu.Lock()
+	if caps == nil || refresh || time.Since(capsAt) > capabilitiesTTL {
+		caps, capsAt = detectCapabilities(), time.Now()
+	}
+	out := caps
+	capsMu.Unlock()
+	c.JSON(http.StatusOK, out)
+}
+
+// detectCapabilities runs the tools to see what they support.
+func detectCapabilities() *capabilities {
+	cp := &capabilities{
+		Modules: modules,
+		Tools: map[string]toolVersion{
+			"ffmpeg":  detectTool(ffmpegBin, "-hide_banner", "-version"),
+			"ffprobe": detectTool(ffprobeBin, "-hide_banner", "-version"),
+			"magick":  detectTool(magickBin, "-version"),
+			"demucs":  detectTool(demucsBin),
+			"yt-dlp":  detectTool(ytdlpBin, "--version"),
+		},
+		Encoders:              map[string][]string{},
+		Decoders:              map[string][]string{},
+		Filters:               []string{},
+		HWAccels:              []string{},
+		TranscriptionBackends: []string{},
+		Features:              map[string]capability{},
+		AudioFormats:          map[string]capability{},
+		Detected:              time.Now().Format(time.RFC3339),
+	}
+	for _, t := range transcribers {
+		if t.Available() {
+			cp.TranscriptionBackends = append(cp.TranscriptionBackends, t.Name())
+		}
+	}
+	if cp.Tools["ffmpeg"].Found {
+		cp.Encoders = ffmpegCodecs("-encoders")
+		cp.Decoders = ffmpegCodecs("-decoders")
+		cp.Filters = ffmpegFilters()
+		cp.HWAccels = ffmpegHWAccels()
+	}
+
+	has := func(need string) bool {
+		kind, name, _ := strings.Cut(need, ":")
+		switch kind {
+		case "tool":
+			return cp.Tools[name].Found
+		case "enc":
+			for _, names := range cp.Encoders {
+				if slices.Contains(names, name) {
+					return true
+				}
+			}
+			return false
+		case "filter":
+			return slices.Contains(cp.Filters, name)
+		case "transcriber":
+			return len(cp.TranscriptionBackends) > 0
+		}
+		return false
+	}
+	check := func(needs []string) capability {
+		// everything runs through ffmpeg
+		f := capability{Enabled: true}
+		for _, need := range append([]string{"tool:ffmpeg"}, needs...) {
+			if !has(need) {
+				f.Enabled = false
+				f.Missing = append(f.Missing, need)
+			}
+		}
+		return f
+	}
+	for name, needs := range featureNeeds {
+		cp.Features[name] = check(needs)
+	}
+	for name, f := range audioconv.Formats {
+		cp.AudioFormats[name] = check([]string{"enc:" + f.Codec})
+	}
+	return cp
+}
+
+// detectTool looks bin up in PATH and, given versionArgs, reads its version
+// from the first line they print: the word after "version" ("ffmpeg
+// version 7.0.1 ..."), after "ImageMagick" ("Version: ImageMagick
+// 7.1.1-29 Q16 ..."), or the whole line (yt-dlp).
+func detectTool(bin string, versionArgs ...string) toolVersion {
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return toolVersion{}
+	}
+	t := toolVersion{Found: true, Path: path}
+	if len(versionArgs) == 0 {
+		return t
+	}
+	out, err := toolOutput(bin, versionArgs...)
+	if err != nil {
+		return t
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	f := strings.Fields(line)
+	for i, w := range f {
+		if (strings.EqualFold(w, "version") || w == "ImageMagick") && i+1 < len(f) {
+			t.Version = f[i+1]
+			return t
+		}
+	}
+	t.Version = strings.TrimSpace(line)
+	return t
+}
+
+// codecLineRe matches a codec in ffmpeg's -encoders/-decoders listing:
+// six flag columns, the first being the kind (V, A or S), then the name.
+var codecLineRe = regexp.MustCompile(`^ ([VAS])[A-Z.]{5} (\S+)`)
+
+func ffmpegCodecs(list string) map[string][]string {
+	kinds := map[string]string{"V": "video", "A": "audio", "S": "subtitle"}
+	out := map[string][]string{}
+	b, err := toolOutput(ffmpegBin, "-hide_banner", list)
+	if err != nil {
+		return out
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if m := codecLineRe.FindStringSubmatch(sc.Text()); m != nil && m[2] != "=" {
+			out[kinds[m[1]]] = append(out[kinds[m[1]]], m[2])
+		}
+	}
+	return out
+}
+
+// filterLineRe matches a filter in ffmpeg's -filters listing: three flag
+// columns, the name and its input->output pads.
+var filterLineRe = regexp.MustCompile(`^ [T.][S.][C.] (\S+)\s+\S*->\S*`)
+
+func ffmpegFilters() []string {
+	var out []string
+	b, err := toolOutput(ffmpegBin, "-hide_banner", "-filters")
+	if err != nil {
+		return out
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if m := filterLineRe.FindStringSubmatch(sc.Text()); m != nil {
+			out = append(out, m[1])
+		}
+	}
+	return out
+}
+
+// ffmpegHWAccels lists the hardware acceleration methods ffmpeg was built
+// with, one per line after a header.
+func ffmpegHWAccels() []string {
+	var out []string
+	b, err := toolOutput(ffmpegBin, "-hide_banner", "-hwaccels")
+	if err != nil {
+		return out
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasSuffix(line, ":") {
+			out = append(out, line)
+		}
+	}
+	return out
+}
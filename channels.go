@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// layoutChannels lists the channels of the source layouts we know how to
+// downmix explicitly.
+var layoutChannels = map[string][]string{
+	"quad":      {"FL", "FR", "BL", "BR"},
+	"5.0":       {"FL", "FR", "FC", "BL", "BR"},
+	"5.0(side)": {"FL", "FR", "FC", "SL", "SR"},
+	"5.1":       {"FL", "FR", "FC", "LFE", "BL", "BR"},
+	"5.1(side)": {"FL", "FR", "FC", "LFE", "SL", "SR"},
+	"6.1":       {"FL", "FR", "FC", "LFE", "BC", "SL", "SR"},
+	"7.1":       {"FL", "FR", "FC", "LFE", "BL", "BR", "SL", "SR"},
+	"7.1(wide)": {"FL", "FR", "FC", "LFE", "BL", "BR", "FLC", "FRC"},
+}
+
+// downmixCoefs are the per-channel gains of the explicit stereo downmixes:
+// centre, side/back surrounds (same side), back centre and LFE. The front
+// channel of the same side is always 1.
+var downmixCoefs = map[string]struct{ C, S, BC, LFE, Front float64 }{
+	// ITU-R BS.775: centre and surrounds at -3 dB, LFE dropped.
+	"itu": {C: 0.707, S: 0.707, BC: 0.5, Front: 1},
+	// dialog favours the centre channel for speech intelligibility.
+	"dialog": {C: 1, S: 0.5, BC: 0.354, Front: 0.707},
+}
+
+// audioStreamLayout returns the channel_layout ffprobe reported for the
+// first audio stream.
+func audioStreamLayout(probeJSON string) string {
+	var pr struct {
+		Streams []struct {
+			CodecType     string `json:"codec_type"`
+			ChannelLayout string `json:"channel_layout"`
+		} `json:"streams"`
+	}
+	if json.Unmarshal([]byte(probeJSON), &pr) != nil {
+		return ""
+	}
+	for _, st := range pr.Streams {
+		if st.CodecType == "audio" {
+			return st.ChannelLayout
+		}
+	}
+	return ""
+}
+
+// downmixFilters returns the filters that fold a surround source down to
+// stereo (or mono, via -ac afterwards) using the named mode. An empty mode
+// or "default" leaves the downmix to ffmpeg's -ac matrix. gainDB is makeup
+// gain applied after the matrix to compensate the loudness lost by the
+// normalized coefficients; a limiter keeps it from clipping.
+func downmixFilters(mode, srcLayout string, targetChannels int, gainDB float64) ([]string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	var filters []string
+	switch mode {
+	case "", "default":
+	case "dplii":
+		if targetChannels != 2 {
+			return nil, fmt.Errorf("dplii downmix needs a stereo target")
+		}
+		filters = append(filters, "aresample=matrix_encoding=dplii:out_chlayout=stereo")
+	case "itu", "dialog":
+		if targetChannels > 2 {
+			return nil, fmt.Errorf("%s downmix needs a mono or stereo target", mode)
+		}
+		chs, ok := layoutChannels[srcLayout]
+		if !ok {
+			return nil, fmt.Errorf("cannot downmix unknown source layout %q", srcLayout)
+		}
+		k := downmixCoefs[mode]
+		var l, r []string
+		for _, ch := range chs {
+			switch ch {
+			case "FL", "FLC":
+				l = append(l, fmt.Sprintf("%g*%s", k.Front, ch))
+			case "FR", "FRC":
+				r = append(r, fmt.Sprintf("%g*%s", k.Front, ch))
+			case "FC":
+				l = append(l, fmt.Sprintf("%g*FC", k.C))
+				r = append(r, fmt.Sprintf("%g*FC", k.C))
+			case "BL", "SL":
+				l = append(l, fmt.Sprintf("%g*%s", k.S, ch))
+			case "BR", "SR":
+				r = append(r, fmt.Sprintf("%g*%s", k.S, ch))
+			case "BC":
+				l = append(l, fmt.Sprintf("%g*BC", k.BC))
+				r = append(r, fmt.Sprintf("%g*BC", k.BC))
+			}
+		}
+		// "<" renormalizes each output so the sum of gains is 1 (no clipping)
+		filters = append(filters, fmt.Sprintf("pan=stereo|FL<%s|FR<%s", strings.Join(l, "+"), strings.Join(r, "+")))
+	default:
+		return nil, fmt.Errorf("unknown downmix mode: %s", mode)
+	}
+	if gainDB != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%gdB", gainDB))
+		if gainDB > 0 {
+			filters = append(filters, "alimiter=limit=0.97")
+		}
+	}
+	return filters, nil
+}
+
+// splitChannel is one source channel extracted to its own mono output.
+type splitChannel struct {
+	Index int
+	Label string
+}
+
+// splitChannels resolves a split_channels mode against a source with the
+// given layout and channel count: "all" yields every channel, "left" and
+// "right" just the first or second one.
+func splitChannels(mode, srcLayout string, channels int) ([]splitChannel, error) {
+	if channels < 2 {
+		return nil, fmt.Errorf("channel splitting needs a multichannel source")
+	}
+	names := layoutChannels[srcLayout]
+	if srcLayout == "stereo" {
+		names = []string{"FL", "FR"}
+	}
+	label := func(i int) string {
+		if i < len(names) {
+			return names[i]
+		}
+		return fmt.Sprintf("c%d", i)
+	}
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "all":
+		out := make([]splitChannel, channels)
+		for i := range out {
+			out[i] = splitChannel{Index: i, Label: label(i)}
+		}
+		return out, nil
+	case "left":
+		return []splitChannel{{Index: 0, Label: "left"}}, nil
+	case "right":
+		return []splitChannel{{Index: 1, Label: "right"}}, nil
+	}
+	return nil, fmt.Errorf("unknown split_channels mode: %s", mode)
+}
+
+// panExtract returns the filter that keeps only channel i as mono.
+func panExtract(i int) string {
+	return fmt.Sprintf("pan=mono|c0=c%d", i)
+}
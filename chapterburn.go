@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Chapter burn-in: a /process item with "burn_chapters": true has the
+// title of the chapter each frame falls in drawn onto the frame, so the
+// pages of a long recording say which section they come from. The
+// chapters are the video's own, read with ffprobe, or a label list sent
+// as "chapters" ([{"title": ..., "start_seconds": ...}], each title
+// running until the next one starts), which implies burn_chapters.
+
+// maxBurnChapters caps the chapters burnt into one video's frames; each
+// is a drawtext filter.
+const maxBurnChapters = 500
+
+// chapterLabel is a title shown on the frames from StartS up to EndS, or
+// to the end when EndS is 0.
+type chapterLabel struct {
+	Title  string  `json:"title"`
+	StartS float64 `json:"start_seconds"`
+	EndS   float64 `json:"end_seconds,omitempty"`
+}
+
+// sortChapters sorts chs by start, checking each has a title and a start
+// of its own.
+func sortChapters(chs []audioChapter) ([]audioChapter, error) {
+	chs = append([]audioChapter{}, chs...)
+	sort.SliceStable(chs, func(i, j int) bool { return chs[i].StartS < chs[j].StartS })
+	for i, ch := range chs {
+		if ch.StartS < 0 || strings.TrimSpace(ch.Title) == "" || (i > 0 && ch.StartS == chs[i-1].StartS) {
+			return nil, errors.New("chapters need a title and distinct, non-negative start times")
+		}
+	}
+	return chs, nil
+}
+
+// chapterLabels turns sorted chapters into labels, each ending where the
+// next begins.
+func chapterLabels(chs []audioChapter) []chapterLabel {
+	labels := make([]chapterLabel, len(chs))
+	for i, ch := range chs {
+		labels[i] = chapterLabel{Title: strings.TrimSpace(ch.Title), StartS: ch.StartS}
+		if i+1 < len(chs) {
+			labels[i].EndS = chs[i+1].StartS
+		}
+	}
+	return labels
+}
+
+// videoChapterLabels reads vm's own chapters as labels; untitled chapters
+// are left unlabelled.
+func videoChapterLabels(vm *VideoMeta) ([]chapterLabel, error) {
+	chs, err := prober(false).Chapters(vm.AbsPath)
+	if err != nil {
+		return nil, err
+	}
+	var labels []chapterLabel
+	for _, ch := range chs {
+		if ch.Title != "" && ch.EndS > ch.StartS {
+			labels = append(labels, chapterLabel{Title: ch.Title, StartS: ch.StartS, EndS: ch.EndS})
+		}
+	}
+	return labels, nil
+}
+
+// chapterFilter is a drawtext filter chain showing each label over its
+// time span in the frame's top-left corner. The titles are written to
+// files in dir, which sidesteps drawtext's quoting rules.
+func chapterFilter(labels []chapterLabel, dir string) (string, error) {
+	chain := make([]string, 0, len(labels))
+	for i, l := range labels {
+		titlePath := filepath.Join(dir, fmt.Sprintf("chapter_%03d.txt", i))
+		if err := os.WriteFile(titlePath, []byte(l.Title), 0o644); err != nil {
+			return "", err
+		}
+		enable := fmt.Sprintf("gte(t,%.3f)", l.StartS)
+		if l.EndS > 0 {
+			enable += fmt.Sprintf("*lt(t,%.3f)", l.EndS)
+		}
+		chain = append(chain, fmt.Sprintf("drawtext=textfile='%s':expansion=none:fontcolor=white:fontsize=h/24:box=1:boxcolor=black@0.6:boxborderw=8:x=h/40:y=h/40:enable='%s'", titlePath, enable))
+	}
+	return strings.Join(chain, ","), nil
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"flag"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"video-to-pdf/audioconv"
+)
+
+// Server settings. Each can be set in the config file, with a FRAMESPDF_*
+// environment variable or with a flag, in increasing order of precedence;
+// see loadConfig.
+var (
+	addr     = ":5060"
+	workRoot = "./work"
+
+	ffmpegBin  = "ffmpeg"
+	ffprobeBin = "ffprobe"
+	// magickBin is ImageMagick's "magick", or legacy "convert" when only that
+	// is installed; resolved by loadConfig unless configured.
+	magickBin = ""
+
+	// processDefaults fill in settings a request leaves unset (after the
+	// project's own defaults).
+	processDefaults = projectDefaults{FPS: 1, JPEGQuality: 2, Density: 150, Quality: 92, AudioFormat: "mp3"}
+
+	// Request body limits for the upload endpoints, and limits for each
+	// file of an upload or ingest (0: only the request limit applies).
+	maxVideoUploadBytes int64 = 20 << 30
+	maxImageUploadBytes int64 = 5 << 30
+	maxAudioUploadBytes int64 = 5 << 30
+	maxVideoFileBytes   int64
+	maxImageFileBytes   int64
+	maxAudioFileBytes   int64
+
+	// retentionConfig holds the config file's retention section (same keys
+	// and values as the FRAMESPDF_RETENTION* variables, lowercased).
+	retentionConfig = map[string]string{}
+)
+
+// fileConfig is the YAML config file; see config.example.yaml.
+type fileConfig struct {
+	Server struct {
+		Addr string `yaml:"addr"`
+		// GRPCAddr enables the gRPC service; see grpc.go.
+		GRPCAddr string `yaml:"grpc_addr"`
+		Workdir  string `yaml:"workdir"`
+		FFmpeg   string `yaml:"ffmpeg"`
+		FFprobe  string `yaml:"ffprobe"`
+		Magick   string `yaml:"magick"`
+		Demucs   string `yaml:"demucs"`
+		Ytdlp    string `yaml:"ytdlp"`
+		// ShutdownTimeout is a Go duration, e.g. "2m".
+		ShutdownTimeout string `yaml:"shutdown_timeout"`
+		// LogFormat is text or json; LogLevel debug, info, warn or error.
+		LogFormat string `yaml:"log_format"`
+		LogLevel  string `yaml:"log_level"`
+	} `yaml:"server"`
+	// Modules are the parts of the service to enable; see modules.go.
+	Modules  []string        `yaml:"modules"`
+	Defaults projectDefaults `yaml:"defaults"`
+	Uploads  struct {
+		MaxVideoMB int64 `yaml:"max_video_mb"`
+		MaxImageMB int64 `yaml:"max_image_mb"`
+		MaxAudioMB int64 `yaml:"max_audio_mb"`
+		// Max*FileMB bound each file of an upload; 0 leaves only the
+		// request limit.
+		MaxVideoFileMB int64 `yaml:"max_video_file_mb"`
+		MaxImageFileMB int64 `yaml:"max_image_file_mb"`
+		MaxAudioFileMB int64 `yaml:"max_audio_file_mb"`
+		// TypeCheck is reject, warn or off; see typeCheck.
+		TypeCheck string `yaml:"type_check"`
+	} `yaml:"uploads"`
+	// Retention keys: default, interval and the per-type names.
+	Retention map[string]string `yaml:"retention"`
+	// Limits caps concurrent processes per tool (ffmpeg, ffprobe, magick)
+	// and, under "jobs", concurrently running jobs.
+	Limits map[string]int `yaml:"limits"`
+	// Retries is the retry policy for transient job failures.
+	Retries struct {
+		// Attempts counts the first run; 1 disables retries.
+		Attempts int `yaml:"attempts"`
+		// Backoff is a Go duration, doubled after every retry.
+		Backoff string `yaml:"backoff"`
+	} `yaml:"retries"`
+	// Timeouts limit how long a job may run, keyed by "default" and job
+	// type; values are Go durations or "off". See timeouts.go.
+	Timeouts map[string]string `yaml:"timeouts"`
+	// Admission holds new jobs back while the box is short of resources;
+	// see admission.go.
+	Admission struct {
+		MinFreeDiskMB *int64   `yaml:"min_free_disk_mb"`
+		MaxLoadPerCPU *float64 `yaml:"max_load_per_cpu"`
+		MinFreeMemMB  *int64   `yaml:"min_free_mem_mb"`
+	} `yaml:"admission"`
+	// Storage is the object-storage backend for outputs; see storage.go.
+	Storage storageSettings `yaml:"storage"`
+	// Delivery lists the Dropbox and Google Drive folders outputs are
+	// pushed to; see delivery.go.
+	Delivery []*deliveryTarget `yaml:"delivery"`
+	// Notifications announce finished jobs; see notify.go.
+	Notifications struct {
+		PublicURL      string       `yaml:"public_url"`
+		SlackWebhook   string       `yaml:"slack_webhook"`
+		DiscordWebhook string       `yaml:"discord_webhook"`
+		Email          smtpSettings `yaml:"email"`
+		FailedOnly     bool         `yaml:"failed_only"`
+		// MinDuration is a Go duration; shorter jobs aren't announced.
+		MinDuration string `yaml:"min_duration"`
+	} `yaml:"notifications"`
+	// Tracing exports OpenTelemetry spans over OTLP/HTTP; see tracing.go.
+	Tracing struct {
+		// Endpoint is the collector's base URL, e.g. http://localhost:4318.
+		Endpoint    string            `yaml:"endpoint"`
+		ServiceName string            `yaml:"service_name"`
+		Headers     map[string]string `yaml:"headers"`
+	} `yaml:"tracing"`
+	// TLS serves HTTPS with a certificate or via ACME; see tls.go.
+	TLS struct {
+		Cert        string   `yaml:"cert"`
+		Key         string   `yaml:"key"`
+		ACMEDomains []string `yaml:"acme_domains"`
+		ACMEEmail   string   `yaml:"acme_email"`
+		ACMECache   string   `yaml:"acme_cache"`
+		// ACMEDirectory is the CA's directory URL; Let's Encrypt when empty.
+		ACMEDirectory string `yaml:"acme_directory"`
+		// HTTPAddr is a plain-HTTP listener redirecting to HTTPS.
+		HTTPAddr string `yaml:"http_addr"`
+	} `yaml:"tls"`
+	// Queue hands /process and /images_pdf jobs to worker processes; see
+	// worker.go.
+	Queue struct {
+		// URL is a redis:// or rediss:// URL.
+		URL string `yaml:"url"`
+	} `yaml:"queue"`
+	// Watch lists directories whose new files are processed automatically;
+	// see watch.go.
+	Watch struct {
+		// Interval is a Go duration between scans.
+		Interval string        `yaml:"interval"`
+		Folders  []watchFolder `yaml:"folders"`
+	} `yaml:"watch"`
+	Auth struct {
+		Enabled       bool   `yaml:"enabled"`
+		AdminUser     string `yaml:"admin_user"`
+		AdminPassword string `yaml:"admin_password"`
+		// DefaultQuotaMB applies to accounts without their own quota.
+		DefaultQuotaMB int64 `yaml:"default_quota_mb"`
+		// SessionTTL is a Go duration, e.g. "168h".
+		SessionTTL string `yaml:"session_ttl"`
+		// AnonymousSessions scopes uploads to a signed browser cookie when
+		// accounts are off; SessionSecret signs it.
+		AnonymousSessions bool   `yaml:"anonymous_sessions"`
+		SessionSecret     string `yaml:"session_secret"`
+	} `yaml:"auth"`
+}
+
+// configPathArg finds -config/--config in args before the flags are parsed,
+// since the file supplies the flags' defaults.
+func configPathArg(args []string) string {
+	for i, a := range args {
+		name, val, hasVal := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || name != "config" {
+			continue
+		}
+		if hasVal {
+			return val
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("FRAMESPDF_CONFIG")
+}
+
+// applyConfigFile loads path and applies every setting it contains.
+func applyConfigFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	set(&addr, fc.Server.Addr)
+	set(&grpcAddr, fc.Server.GRPCAddr)
+	set(&workRoot, fc.Server.Workdir)
+	set(&ffmpegBin, fc.Server.FFmpeg)
+	set(&ffprobeBin, fc.Server.FFprobe)
+	set(&magickBin, fc.Server.Magick)
+	set(&demucsBin, fc.Server.Demucs)
+	set(&ytdlpBin, fc.Server.Ytdlp)
+	set(&logFormat, fc.Server.LogFormat)
+	set(&logLevel, fc.Server.LogLevel)
+	if v := fc.Server.ShutdownTimeout; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s: bad server.shutdown_timeout: %s", path, v)
+		}
+		shutdownTimeout = d
+	}
+
+	d := fc.Defaults
+	if d.FPS < 0 || d.JPEGQuality < 0 || d.JPEGQuality > 31 || d.Density < 0 || d.Quality < 0 || d.Quality > 100 || d.AudioBitrateKbps < 0 {
+		return fmt.Errorf("%s: defaults out of range", path)
+	}
+	if d.AudioFormat != "" {
+		if _, err := audioconv.Lookup(strings.ToLower(d.AudioFormat)); err != nil {
+			return fmt.Errorf("%s: defaults.audio_format: %v", path, err)
+		}
+		processDefaults.AudioFormat = strings.ToLower(d.AudioFormat)
+	}
+	if d.FPS > 0 {
+		processDefaults.FPS = d.FPS
+	}
+	if d.JPEGQuality > 0 {
+		processDefaults.JPEGQuality = d.JPEGQuality
+	}
+	if d.Density > 0 {
+		processDefaults.Density = d.Density
+	}
+	if d.Quality > 0 {
+		processDefaults.Quality = d.Quality
+	}
+	if d.AudioBitrateKbps > 0 {
+		processDefaults.AudioBitrateKbps = d.AudioBitrateKbps
+	}
+
+	for dst, mb := range map[*int64]int64{
+		&maxVideoUploadBytes: fc.Uploads.MaxVideoMB, &maxImageUploadBytes: fc.Uploads.MaxImageMB, &maxAudioUploadBytes: fc.Uploads.MaxAudioMB,
+		&maxVideoFileBytes: fc.Uploads.MaxVideoFileMB, &maxImageFileBytes: fc.Uploads.MaxImageFileMB, &maxAudioFileBytes: fc.Uploads.MaxAudioFileMB,
+	} {
+		if mb < 0 {
+			return fmt.Errorf("%s: upload limits must not be negative", path)
+		}
+		if mb > 0 {
+			*dst = mb << 20
+		}
+	}
+	set(&typeCheck, fc.Uploads.TypeCheck)
+	for k, v := range fc.Retention {
+		retentionConfig[strings.ToLower(k)] = v
+	}
+
+	for tool, n := range fc.Limits {
+		if tool == "jobs" {
+			if n < 1 {
+				return fmt.Errorf("%s: limits.jobs must be at least 1", path)
+			}
+			maxJobs = n
+			continue
+		}
+		if _, ok := toolLimits[tool]; !ok || n < 0 {
+			return fmt.Errorf("%s: bad limits.%s: %d", path, tool, n)
+		}
+		toolLimits[tool] = n
+	}
+	if n := fc.Retries.Attempts; n != 0 {
+		if n < 1 {
+			return fmt.Errorf("%s: retries.attempts must be at least 1", path)
+		}
+		jobMaxAttempts = n
+	}
+	if v := fc.Retries.Backoff; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s: bad retries.backoff: %s", path, v)
+		}
+		jobRetryBackoff = d
+	}
+	for typ, v := range fc.Timeouts {
+		if err := setJobTimeout(typ, v); err != nil {
+			return fmt.Errorf("%s: timeouts: %w", path, err)
+		}
+	}
+	// set but 0 turns a check off, so these are pointers
+	if a := fc.Admission.MinFreeDiskMB; a != nil {
+		minFreeDiskMB = *a
+	}
+	if a := fc.Admission.MaxLoadPerCPU; a != nil {
+		maxLoadPerCPU = *a
+	}
+	if a := fc.Admission.MinFreeMemMB; a != nil {
+		minFreeMemMB = *a
+	}
+	if minFreeDiskMB < 0 || maxLoadPerCPU < 0 || minFreeMemMB < 0 {
+		return fmt.Errorf("%s: admission thresholds must not be negative", path)
+	}
+
+	if fc.Storage.Backend != "" {
+		storageConfig = fc.Storage
+	}
+
+	n := fc.Notifications
+	set(&publicURL, n.PublicURL)
+	set(&slackWebhook, n.SlackWebhook)
+	set(&discordWebhook, n.DiscordWebhook)
+	if n.Email.Addr != "" {
+		smtpConfig = n.Email
+	}
+	notifyFailedOnly = notifyFailedOnly || n.FailedOnly
+	if v := n.MinDuration; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s: bad notifications.min_duration: %s", path, v)
+		}
+		notifyMinDuration = d
+	}
+
+	set(&tlsCert, fc.TLS.Cert)
+	set(&tlsKey, fc.TLS.Key)
+	if len(fc.TLS.ACMEDomains) > 0 {
+		acmeDomains = fc.TLS.ACMEDomains
+	}
+	set(&acmeEmail, fc.TLS.ACMEEmail)
+	set(&acmeCache, fc.TLS.ACMECache)
+	set(&acmeDirectory, fc.TLS.ACMEDirectory)
+	set(&httpAddr, fc.TLS.HTTPAddr)
+	set(&queueURL, fc.Queue.URL)
+	set(&otlpEndpoint, fc.Tracing.Endpoint)
+	set(&otlpServiceName, fc.Tracing.ServiceName)
+	maps.Copy(otlpHeaders, fc.Tracing.Headers)
+	if v := fc.Watch.Interval; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			return fmt.Errorf("%s: bad watch.interval: %s", path, v)
+		}
+		watchInterval = d
+	}
+	watchFolders = append(watchFolders, fc.Watch.Folders...)
+	deliveryTargets = append(deliveryTargets, fc.Delivery...)
+	if len(fc.Modules) > 0 {
+		if modules, err = parseModules(fc.Modules); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	authEnabled = authEnabled || fc.Auth.Enabled
+	anonSessions = anonSessions || fc.Auth.AnonymousSessions
+	set(&sessionSecret, fc.Auth.SessionSecret)
+	set(&adminUser, fc.Auth.AdminUser)
+	set(&adminPassword, fc.Auth.AdminPassword)
+	if fc.Auth.DefaultQuotaMB < 0 {
+		return fmt.Errorf("%s: auth.default_quota_mb must not be negative", path)
+	}
+	if fc.Auth.DefaultQuotaMB > 0 {
+		defaultQuotaBytes = fc.Auth.DefaultQuotaMB << 20
+	}
+	if v := fc.Auth.SessionTTL; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return fmt.Errorf("%s: bad auth.session_ttl: %s", path, v)
+		}
+		sessionTTL = d
+	}
+	return nil
+}
+
+// loadConfig applies the config file (-config or FRAMESPDF_CONFIG), then the
+// environment, then args (os.Args[1:]), and points the work directories at
+// the configured root.
+func loadConfig(args []string) error {
+	if path := configPathArg(args); path != "" {
+		if err := applyConfigFile(path); err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+	}
+	env := func(key, def string) string {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return def
+	}
+	fs := flag.NewFlagSet("framespdf", flag.ContinueOnError)
+	fs.String("config", "", "YAML config file (FRAMESPDF_CONFIG)")
+	fs.StringVar(&addr, "addr", env("FRAMESPDF_ADDR", addr), "listen address (FRAMESPDF_ADDR)")
+	fs.StringVar(&grpcAddr, "grpc-addr", env("FRAMESPDF_GRPC_ADDR", grpcAddr), "gRPC listen address, off when empty (FRAMESPDF_GRPC_ADDR)")
+	fs.StringVar(&tlsCert, "tls-cert", env("FRAMESPDF_TLS_CERT", tlsCert), "serve HTTPS with this PEM certificate (chain) file (FRAMESPDF_TLS_CERT)")
+	fs.StringVar(&tlsKey, "tls-key", env("FRAMESPDF_TLS_KEY", tlsKey), "PEM private key of -tls-cert (FRAMESPDF_TLS_KEY)")
+	if v := os.Getenv("FRAMESPDF_ACME_DOMAINS"); v != "" {
+		acmeDomains = strings.Split(v, ",")
+	}
+	fs.Func("acme-domains", "serve HTTPS with certificates from Let's Encrypt for these comma-separated domains (FRAMESPDF_ACME_DOMAINS)", func(v string) error {
+		acmeDomains = strings.Split(v, ",")
+		return nil
+	})
+	fs.StringVar(&acmeEmail, "acme-email", env("FRAMESPDF_ACME_EMAIL", acmeEmail), "contact address for the ACME account (FRAMESPDF_ACME_EMAIL)")
+	fs.StringVar(&acmeCache, "acme-cache", env("FRAMESPDF_ACME_CACHE", acmeCache), "directory for ACME keys and certificates, default <workdir>/acme (FRAMESPDF_ACME_CACHE)")
+	fs.StringVar(&acmeDirectory, "acme-directory", env("FRAMESPDF_ACME_DIRECTORY", acmeDirectory), "ACME directory URL, default Let's Encrypt (FRAMESPDF_ACME_DIRECTORY)")
+	fs.StringVar(&httpAddr, "http-addr", env("FRAMESPDF_HTTP_ADDR", httpAddr), "with HTTPS, a plain-HTTP listener that redirects to it and answers ACME challenges, e.g. :80 (FRAMESPDF_HTTP_ADDR)")
+	fs.StringVar(&workRoot, "workdir", env("FRAMESPDF_WORKDIR", workRoot), "work directory (FRAMESPDF_WORKDIR)")
+	if v := os.Getenv("FRAMESPDF_MODULES"); v != "" {
+		modules = strings.Split(v, ",")
+	}
+	fs.Func("modules", "comma-separated modules to enable: video, images, audio (FRAMESPDF_MODULES)", func(v string) error {
+		modules = strings.Split(v, ",")
+		return nil
+	})
+	fs.StringVar(&ffmpegBin, "ffmpeg", env("FRAMESPDF_FFMPEG", ffmpegBin), "ffmpeg binary (FRAMESPDF_FFMPEG)")
+	fs.StringVar(&ffprobeBin, "ffprobe", env("FRAMESPDF_FFPROBE", ffprobeBin), "ffprobe binary (FRAMESPDF_FFPROBE)")
+	fs.StringVar(&magickBin, "magick", env("FRAMESPDF_MAGICK", magickBin), "ImageMagick binary, magick or convert (FRAMESPDF_MAGICK)")
+	fs.StringVar(&demucsBin, "demucs", env("FRAMESPDF_DEMUCS", demucsBin), "demucs binary (FRAMESPDF_DEMUCS)")
+	fs.StringVar(&ytdlpBin, "ytdlp", env("FRAMESPDF_YTDLP", ytdlpBin), "yt-dlp binary (FRAMESPDF_YTDLP)")
+	if v := os.Getenv("FRAMESPDF_SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad FRAMESPDF_SHUTDOWN_TIMEOUT: %s", v)
+		}
+		shutdownTimeout = d
+	}
+	// the standard OTel exporter variables
+	otlpEndpoint = env("OTEL_EXPORTER_OTLP_ENDPOINT", otlpEndpoint)
+	otlpEndpoint = env("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", otlpEndpoint)
+	otlpServiceName = env("OTEL_SERVICE_NAME", otlpServiceName)
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		if v := os.Getenv(name); v != "" {
+			h, err := parseOTLPHeaders(v)
+			if err != nil {
+				return fmt.Errorf("bad %s: %v", name, err)
+			}
+			maps.Copy(otlpHeaders, h)
+		}
+	}
+	fs.StringVar(&otlpEndpoint, "otlp-endpoint", otlpEndpoint, "OTLP/HTTP collector to export traces to, e.g. http://localhost:4318 (OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.StringVar(&logFormat, "log-format", env("FRAMESPDF_LOG_FORMAT", logFormat), "log output: text or json (FRAMESPDF_LOG_FORMAT)")
+	fs.StringVar(&logLevel, "log-level", env("FRAMESPDF_LOG_LEVEL", logLevel), "minimum log level: debug, info, warn or error (FRAMESPDF_LOG_LEVEL)")
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "grace period for running work on SIGINT/SIGTERM (FRAMESPDF_SHUTDOWN_TIMEOUT)")
+	if v := os.Getenv("FRAMESPDF_AUTH"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad FRAMESPDF_AUTH: %s", v)
+		}
+		authEnabled = b
+	}
+	fs.BoolVar(&authEnabled, "auth", authEnabled, "require login and isolate users (FRAMESPDF_AUTH)")
+	if v := os.Getenv("FRAMESPDF_ANON_SESSIONS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad FRAMESPDF_ANON_SESSIONS: %s", v)
+		}
+		anonSessions = b
+	}
+	fs.BoolVar(&anonSessions, "anon-sessions", anonSessions, "scope uploads to a browser session cookie when -auth is off (FRAMESPDF_ANON_SESSIONS)")
+	sessionSecret = env("FRAMESPDF_SESSION_SECRET", sessionSecret)
+	if v := os.Getenv("FRAMESPDF_MAX_JOBS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad FRAMESPDF_MAX_JOBS: %s", v)
+		}
+		maxJobs = n
+	}
+	fs.IntVar(&maxJobs, "max-jobs", maxJobs, "max concurrently running jobs; bulk jobs get one fewer (FRAMESPDF_MAX_JOBS)")
+	if v := os.Getenv("FRAMESPDF_JOB_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad FRAMESPDF_JOB_ATTEMPTS: %s", v)
+		}
+		jobMaxAttempts = n
+	}
+	fs.IntVar(&jobMaxAttempts, "job-attempts", jobMaxAttempts, "runs per job before a transient failure is final, 1 = no retries (FRAMESPDF_JOB_ATTEMPTS)")
+	if v := os.Getenv("FRAMESPDF_JOB_RETRY_BACKOFF"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad FRAMESPDF_JOB_RETRY_BACKOFF: %s", v)
+		}
+		jobRetryBackoff = d
+	}
+	fs.DurationVar(&jobRetryBackoff, "job-retry-backoff", jobRetryBackoff, "wait before the first retry, doubled after each (FRAMESPDF_JOB_RETRY_BACKOFF)")
+	if v := os.Getenv("FRAMESPDF_JOB_TIMEOUT"); v != "" {
+		if err := setJobTimeouts(v); err != nil {
+			return fmt.Errorf("bad FRAMESPDF_JOB_TIMEOUT: %w", err)
+		}
+	}
+	fs.Func("job-timeout", "max run time of a job, e.g. 30m or transcribe=2h,process=20m; off by default (FRAMESPDF_JOB_TIMEOUT)", setJobTimeouts)
+	for _, l := range []struct {
+		name, key, what string
+		dst             *int64
+	}{
+		{"min-free-disk-mb", "FRAMESPDF_MIN_FREE_DISK_MB", "free disk space in MB under the work directory", &minFreeDiskMB},
+		{"min-free-mem-mb", "FRAMESPDF_MIN_FREE_MEM_MB", "available memory in MB", &minFreeMemMB},
+	} {
+		if v := os.Getenv(l.key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("bad %s: %s", l.key, v)
+			}
+			*l.dst = n
+		}
+		fs.Int64Var(l.dst, l.name, *l.dst, fmt.Sprintf("hold new jobs while there is less %s, 0 = no check (%s)", l.what, l.key))
+	}
+	if v := os.Getenv("FRAMESPDF_MAX_LOAD_PER_CPU"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("bad FRAMESPDF_MAX_LOAD_PER_CPU: %s", v)
+		}
+		maxLoadPerCPU = f
+	}
+	fs.Float64Var(&maxLoadPerCPU, "max-load-per-cpu", maxLoadPerCPU, "hold new jobs while the 1-minute load average per CPU is higher, 0 = no check (FRAMESPDF_MAX_LOAD_PER_CPU)")
+	for _, tool := range []string{"ffmpeg", "ffprobe", "magick"} {
+		key := "FRAMESPDF_MAX_" + strings.ToUpper(tool)
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("bad %s: %s", key, v)
+			}
+			toolLimits[tool] = n
+		}
+		fs.Func("max-"+tool, fmt.Sprintf("max concurrent %s processes, 0 = unlimited (%s; default %d)", tool, key, toolLimits[tool]), func(v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a non-negative integer")
+			}
+			toolLimits[tool] = n
+			return nil
+		})
+	}
+	for _, l := range []struct {
+		kind string
+		file bool
+		dst  *int64
+	}{
+		{"video", false, &maxVideoUploadBytes}, {"image", false, &maxImageUploadBytes}, {"audio", false, &maxAudioUploadBytes},
+		{"video", true, &maxVideoFileBytes}, {"image", true, &maxImageFileBytes}, {"audio", true, &maxAudioFileBytes},
+	} {
+		name, what, least := l.kind, "the request body of the "+l.kind+" upload endpoint", int64(1)
+		if l.file {
+			name, what, least = l.kind+"-file", "each "+l.kind+" file of an upload or ingest, 0 = only the request limit", 0
+		}
+		key := "FRAMESPDF_MAX_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_MB"
+		parse := func(v string) error {
+			mb, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || mb < least {
+				return fmt.Errorf("must be an integer of at least %d", least)
+			}
+			*l.dst = mb << 20
+			return nil
+		}
+		if v := os.Getenv(key); v != "" {
+			if err := parse(v); err != nil {
+				return fmt.Errorf("bad %s: %s", key, v)
+			}
+		}
+		fs.Func("max-"+name+"-mb", fmt.Sprintf("size limit in MB for %s (%s; default %d)", what, key, *l.dst>>20), parse)
+	}
+	fs.StringVar(&storageConfig.Backend, "storage", env("FRAMESPDF_STORAGE", storageConfig.Backend), "object storage for outputs: local, s3, gcs or azure (FRAMESPDF_STORAGE)")
+	sc := &storageConfig
+	sc.Bucket = env("FRAMESPDF_STORAGE_BUCKET", sc.Bucket)
+	sc.Prefix = env("FRAMESPDF_STORAGE_PREFIX", sc.Prefix)
+	sc.Region = env("FRAMESPDF_STORAGE_REGION", env("AWS_REGION", sc.Region))
+	sc.Endpoint = env("FRAMESPDF_STORAGE_ENDPOINT", sc.Endpoint)
+	sc.PublicURL = env("FRAMESPDF_STORAGE_PUBLIC_URL", sc.PublicURL)
+	sc.AccessKey = env("FRAMESPDF_STORAGE_ACCESS_KEY", sc.AccessKey)
+	sc.SecretKey = env("FRAMESPDF_STORAGE_SECRET_KEY", sc.SecretKey)
+	if v := os.Getenv("FRAMESPDF_INGEST_BUCKETS"); v != "" {
+		sc.IngestBuckets = strings.Split(v, ",")
+	}
+	for i, b := range sc.IngestBuckets {
+		sc.IngestBuckets[i] = strings.TrimSpace(b)
+	}
+	if v := os.Getenv("FRAMESPDF_STORAGE_FRAMES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad FRAMESPDF_STORAGE_FRAMES: %s", v)
+		}
+		sc.Frames = b
+	}
+	if v := os.Getenv("FRAMESPDF_INGEST_PRIVATE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad FRAMESPDF_INGEST_PRIVATE: %s", v)
+		}
+		ingestPrivate = b
+	}
+	fs.StringVar(&queueURL, "queue", env("FRAMESPDF_QUEUE_URL", queueURL), "Redis URL of the job queue shared with -worker processes, e.g. redis://localhost:6379/0 (FRAMESPDF_QUEUE_URL)")
+	if v := os.Getenv("FRAMESPDF_WORKER"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad FRAMESPDF_WORKER: %s", v)
+		}
+		workerMode = b
+	}
+	fs.BoolVar(&workerMode, "worker", workerMode, "run as a worker: take jobs off -queue instead of serving HTTP (FRAMESPDF_WORKER)")
+	fs.StringVar(&typeCheck, "type-check", env("FRAMESPDF_TYPE_CHECK", typeCheck), "uploads whose content isn't what the endpoint takes: reject, warn or off (FRAMESPDF_TYPE_CHECK)")
+	fs.BoolVar(&ingestPrivate, "ingest-private", ingestPrivate, "let /ingest_url fetch from private and loopback addresses (FRAMESPDF_INGEST_PRIVATE)")
+	fs.StringVar(&publicURL, "public-url", env("FRAMESPDF_PUBLIC_URL", publicURL), "external base URL used in notification links (FRAMESPDF_PUBLIC_URL)")
+	slackWebhook = env("FRAMESPDF_SLACK_WEBHOOK", slackWebhook)
+	discordWebhook = env("FRAMESPDF_DISCORD_WEBHOOK", discordWebhook)
+	smtpConfig.Addr = env("FRAMESPDF_SMTP_ADDR", smtpConfig.Addr)
+	smtpConfig.Username = env("FRAMESPDF_SMTP_USER", smtpConfig.Username)
+	smtpConfig.Password = env("FRAMESPDF_SMTP_PASSWORD", smtpConfig.Password)
+	smtpConfig.From = env("FRAMESPDF_SMTP_FROM", smtpConfig.From)
+	if v := os.Getenv("FRAMESPDF_NOTIFY_EMAIL"); v != "" {
+		smtpConfig.To = strings.Split(v, ",")
+	}
+	if v := os.Getenv("FRAMESPDF_NOTIFY_FAILED_ONLY"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad FRAMESPDF_NOTIFY_FAILED_ONLY: %s", v)
+		}
+		notifyFailedOnly = b
+	}
+	if v := os.Getenv("FRAMESPDF_NOTIFY_MIN_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad FRAMESPDF_NOTIFY_MIN_DURATION: %s", v)
+		}
+		notifyMinDuration = d
+	}
+	adminUser = env("FRAMESPDF_ADMIN_USER", adminUser)
+	adminPassword = env("FRAMESPDF_ADMIN_PASSWORD", adminPassword)
+	if v := os.Getenv("FRAMESPDF_DEFAULT_QUOTA_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb < 0 {
+			return fmt.Errorf("bad FRAMESPDF_DEFAULT_QUOTA_MB: %s", v)
+		}
+		defaultQuotaBytes = mb << 20
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if maxJobs < 1 {
+		return fmt.Errorf("-max-jobs must be at least 1")
+	}
+	if jobMaxAttempts < 1 {
+		return fmt.Errorf("-job-attempts must be at least 1")
+	}
+	if minFreeDiskMB < 0 || maxLoadPerCPU < 0 || minFreeMemMB < 0 {
+		return fmt.Errorf("-min-free-disk-mb, -min-free-mem-mb and -max-load-per-cpu must not be negative")
+	}
+	typeCheck = strings.ToLower(typeCheck)
+	if typeCheck != "reject" && typeCheck != "warn" && typeCheck != "off" {
+		return fmt.Errorf("-type-check must be reject, warn or off")
+	}
+	var err error
+	if modules, err = parseModules(modules); err != nil {
+		return err
+	}
+	// the providers' usual credential variables fill in what isn't set
+	if strings.ToLower(sc.Backend) == "azure" {
+		sc.AccessKey = cmp.Or(sc.AccessKey, os.Getenv("AZURE_STORAGE_ACCOUNT"))
+		sc.SecretKey = cmp.Or(sc.SecretKey, os.Getenv("AZURE_STORAGE_KEY"))
+	} else {
+		sc.AccessKey = cmp.Or(sc.AccessKey, os.Getenv("AWS_ACCESS_KEY_ID"))
+		sc.SecretKey = cmp.Or(sc.SecretKey, os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	}
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	if queueURL != "" {
+		if u, err := url.Parse(queueURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			return fmt.Errorf("-queue must be a redis:// or rediss:// URL")
+		}
+	}
+	var domains []string
+	for _, d := range acmeDomains {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	acmeDomains = domains
+	if err := checkTLSConfig(); err != nil {
+		return err
+	}
+	if workerMode && queueURL == "" {
+		return fmt.Errorf("-worker needs -queue")
+	}
+	if otlpEndpoint != "" {
+		if u, err := url.Parse(otlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("-otlp-endpoint must be an http(s) URL")
+		}
+	}
+	for name, v := range map[string]string{"public URL": publicURL, "Slack webhook": slackWebhook, "Discord webhook": discordWebhook} {
+		if err := validateNotifyURL(name, v); err != nil {
+			return err
+		}
+	}
+	for i, to := range smtpConfig.To {
+		smtpConfig.To[i] = strings.TrimSpace(to)
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if magickBin == "" {
+		magickBin = "magick"
+		// legacy ImageMagick 6 only has convert, which on Windows is
+		// usually the system's disk converter instead
+		if _, err := exec.LookPath(magickBin); err != nil {
+			if p, err := exec.LookPath("convert"); err == nil && !isSystemConvert(p) {
+				magickBin = "convert"
+			}
+		}
+	}
+	setWorkRoot(workRoot)
+	return nil
+}
+
+// setWorkRoot points every work subdirectory (and the store) at root.
+func setWorkRoot(root string) {
+	root = platformWorkRoot(root)
+	workRoot = root
+	uploadDir = filepath.Join(root, "uploads")
+	framesDir = filepath.Join(root, "frames")
+	pdfsDir = filepath.Join(root, "pdfs")
+	audioDir = filepath.Join(root, "audio")
+	transcriptsDir = filepath.Join(root, "transcripts")
+	rendersDir = filepath.Join(root, "renders")
+	scratchDir = filepath.Join(root, "scratch")
+	logsDir = filepath.Join(root, "logs")
+	storePath = filepath.Join(root, "framespdf.db")
+}
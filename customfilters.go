@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Custom filters: /process items can carry a video_filter and
+// /convert_audio items an audio_filter, an ffmpeg filter chain applied
+// after the server's own filters ("crop=iw/2:ih:0:0,eq=contrast=1.2",
+// "highpass=f=80,acompressor"). The chain is handed to ffmpeg as one
+// argument, never through a shell, and only filters from the safelists
+// below are allowed: ones that transform the stream in place. Filters that
+// read files (movie, subtitles, lut3d), run commands (sendcmd), load
+// plugins or change the graph's shape (split, amix, labelled pads) are
+// left out, and so are options starting with '/', which ffmpeg reads the
+// value of from a file ("eq=/contrast=/etc/passwd").
+
+// maxFilterLen and maxFilterChain cap a custom filter chain.
+const (
+	maxFilterLen   = 1000
+	maxFilterChain = 20
+)
+
+var safeVideoFilters = map[string]bool{
+	"scale": true, "crop": true, "pad": true, "rotate": true, "transpose": true, "hflip": true, "vflip": true,
+	"eq": true, "hue": true, "colorchannelmixer": true, "colorbalance": true, "colorlevels": true,
+	"colortemperature": true, "vibrance": true, "monochrome": true, "negate": true, "grayworld": true,
+	"unsharp": true, "cas": true, "gblur": true, "boxblur": true, "avgblur": true, "smartblur": true, "deband": true,
+	"hqdn3d": true, "nlmeans": true, "atadenoise": true, "removegrain": true, "median": true,
+	"edgedetect": true, "sobel": true, "vignette": true, "drawbox": true, "drawgrid": true, "lutyuv": true,
+	"lutrgb": true, "yadif": true, "bwdif": true, "w3fdif": true, "format": true, "setsar": true, "setdar": true,
+	"fade": true, "noise": true, "histeq": true, "normalize": true, "chromashift": true, "rgbashift": true,
+	"convolution": true, "erosion": true, "dilation": true, "deflate": true, "inflate": true,
+}
+
+var safeAudioFilters = map[string]bool{
+	"volume": true, "highpass": true, "lowpass": true, "bandpass": true, "bandreject": true, "allpass": true,
+	"equalizer": true, "anequalizer": true, "bass": true, "treble": true, "lowshelf": true, "highshelf": true,
+	"acompressor": true, "alimiter": true, "agate": true, "compand": true, "mcompand": true,
+	"dynaudnorm": true, "speechnorm": true, "afftdn": true, "anlmdn": true, "adeclick": true, "adeclip": true,
+	"adenorm": true, "deesser": true, "crystalizer": true, "aexciter": true, "aecho": true, "chorus": true,
+	"flanger": true, "aphaser": true, "tremolo": true, "vibrato": true, "atempo": true, "asetrate": true,
+	"aresample": true, "aformat": true, "silenceremove": true, "apad": true, "atrim": true, "afade": true,
+	"extrastereo": true, "stereotools": true, "stereowiden": true, "pan": true,
+	"channelmap": true, "earwax": true, "haas": true, "dcshift": true, "acrusher": true, "asoftclip": true,
+}
+
+// checkFilterChain accepts s if it is a plain chain of allowed filters:
+// comma-separated filter[=options], without the quoting, escapes, pad
+// labels and ';' that would let it reach beyond a single chain, nor
+// options loaded from files.
+func checkFilterChain(s string, allowed map[string]bool) error {
+	if len(s) > maxFilterLen {
+		return fmt.Errorf("filter is longer than %d characters", maxFilterLen)
+	}
+	if i := strings.IndexAny(s, ";[]'\"\\\n\r"); i >= 0 {
+		return fmt.Errorf("filter may not contain %q", s[i])
+	}
+	chain := strings.Split(s, ",")
+	if len(chain) > maxFilterChain {
+		return fmt.Errorf("filter chains more than %d filters", maxFilterChain)
+	}
+	for _, f := range chain {
+		name, opts, _ := strings.Cut(strings.TrimSpace(f), "=")
+		if name == "" {
+			return fmt.Errorf("filter has an empty step")
+		}
+		if !allowed[name] {
+			return fmt.Errorf("filter %q is not allowed", name)
+		}
+		for _, opt := range strings.Split(opts, ":") {
+			key, val, _ := strings.Cut(opt, "=")
+			if strings.HasPrefix(strings.TrimSpace(key), "/") || strings.HasPrefix(strings.TrimSpace(val), "/") {
+				return fmt.Errorf("filter %q: options may not start with '/'", name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCheckFilterChain(t *testing.T) {
+	for _, tc := range []struct {
+		chain string
+		ok    bool
+	}{
+		{"crop=iw/2:ih:0:0,eq=contrast=1.2", true},
+		{"scale=1280:-2", true},
+		{"hflip", true},
+		{"movie=/etc/passwd", false},
+		{"eq=/contrast=/etc/passwd", false},
+		{"eq=contrast=/etc/passwd", false},
+		{"eq=brightness=0.1: /contrast=/etc/passwd", false},
+		{"scale=/etc/passwd", false},
+		{"drawbox=x=10:y=10:w=/dev/stdin", false},
+		{"eq=contrast=1.2;[out]", false},
+		{"eq,,hflip", false},
+	} {
+		err := checkFilterChain(tc.chain, safeVideoFilters)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkFilterChain(%q) = %v, want ok %v", tc.chain, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Delivery pushes the outputs of finished jobs (PDFs, audio, transcripts,
+// renders) into Dropbox or Google Drive folders, configured as the config
+// file's delivery targets. Each target holds an OAuth app's client ID and
+// secret and a refresh token granted to it, from which short-lived access
+// tokens are fetched as needed. A target takes every job, or only the job
+// types and owners it lists. The job result gains "deliveries": per target
+// and output, the remote link, or the error when the upload failed; a
+// failed delivery doesn't fail the job, whose outputs are still served
+// locally.
+var deliveryTargets []*deliveryTarget
+
+// deliveryTarget is a folder outputs are delivered to.
+type deliveryTarget struct {
+	Name string `yaml:"name"`
+	// Provider is dropbox or gdrive.
+	Provider string `yaml:"provider"`
+	// Folder is the Dropbox path ("/Frames PDF") or the Google Drive
+	// folder ID; the root folder when empty.
+	Folder       string `yaml:"folder"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+	// JobTypes and Owners (user IDs) limit the jobs delivered.
+	JobTypes []string `yaml:"job_types"`
+	Owners   []string `yaml:"owners"`
+	// Share makes each delivered file readable by anyone with the link;
+	// otherwise the link only opens for the folder's owner.
+	Share bool `yaml:"share"`
+	// Endpoint replaces the provider's API hosts, e.g. with a proxy.
+	Endpoint string `yaml:"endpoint"`
+
+	// mu guards the cached access token.
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// delivery is one output delivered, or not, to a target.
+type delivery struct {
+	Target string `json:"target"`
+	// URL is the output's local URL; Link is where it landed.
+	URL   string `json:"url"`
+	Link  string `json:"link,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var deliveryClient = &http.Client{}
+
+// dropboxChunk is the most Dropbox takes in one upload request; larger
+// files go up in an upload session of chunks this size.
+const dropboxChunk = 128 << 20
+
+// checkDeliveryTargets validates the configured targets.
+func checkDeliveryTargets() error {
+	seen := map[string]bool{}
+	for i, t := range deliveryTargets {
+		if t.Name == "" {
+			return fmt.Errorf("delivery target %d: name is required", i+1)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("delivery target %s: name is used twice", t.Name)
+		}
+		seen[t.Name] = true
+		t.Provider = strings.ToLower(t.Provider)
+		switch t.Provider {
+		case "dropbox":
+			t.Folder = strings.TrimSuffix(t.Folder, "/")
+			if t.Folder != "" && !strings.HasPrefix(t.Folder, "/") {
+				return fmt.Errorf("delivery target %s: a Dropbox folder is a path starting with /", t.Name)
+			}
+		case "gdrive":
+		default:
+			return fmt.Errorf("delivery target %s: provider must be dropbox or gdrive", t.Name)
+		}
+		if t.ClientID == "" || t.ClientSecret == "" || t.RefreshToken == "" {
+			return fmt.Errorf("delivery target %s: client_id, client_secret and refresh_token are required", t.Name)
+		}
+		for _, typ := range t.JobTypes {
+			if !slices.Contains(jobTypes, typ) {
+				return fmt.Errorf("delivery target %s: unknown job type %q", t.Name, typ)
+			}
+		}
+		if t.Endpoint != "" {
+			if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("delivery target %s: bad endpoint %q", t.Name, t.Endpoint)
+			}
+			t.Endpoint = strings.TrimSuffix(t.Endpoint, "/")
+		}
+	}
+	return nil
+}
+
+// takes reports whether t delivers job j's outputs.
+func (t *deliveryTarget) takes(j *Job) bool {
+	return (len(t.JobTypes) == 0 || slices.Contains(t.JobTypes, j.Type)) && (len(t.Owners) == 0 || slices.Contains(t.Owners, j.Owner))
+}
+
+// deliverOutputs uploads the outputs linked from resp to every target
+// taking j and records the outcome under resp["deliveries"].
+func deliverOutputs(j *Job, resp gin.H) {
+	var urls []string
+	for _, u := range resultURLs(resp) {
+		if outputPath(u) != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+	sort.Strings(urls)
+	var out []delivery
+	for _, t := range deliveryTargets {
+		if !t.takes(j) {
+			continue
+		}
+		for _, u := range urls {
+			d := delivery{Target: t.Name, URL: u}
+			link, err := t.deliver(outputPath(u))
+			if err != nil {
+				d.Error = err.Error()
+				j.logger().Warn("delivery failed", "target", t.Name, "url", u, "error", d.Error)
+			}
+			d.Link = link
+			out = append(out, d)
+		}
+	}
+	if len(out) > 0 {
+		resp["deliveries"] = out
+	}
+}
+
+// deliver uploads the file at p and returns its link.
+func (t *deliveryTarget) deliver(p string) (string, error) {
+	ctx, cancel := context.WithTimeout(workCtx, objectUploadTimeout)
+	defer cancel()
+	if t.Provider == "dropbox" {
+		return t.dropboxUpload(ctx, p)
+	}
+	return t.driveUpload(ctx, p)
+}
+
+// host is the base URL of one of the provider's API hosts.
+func (t *deliveryTarget) host(def string) string {
+	return cmp.Or(t.Endpoint, def)
+}
+
+// accessToken returns a cached access token, refreshing it when it is
+// about to expire.
+func (t *deliveryTarget) accessToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expiry) > time.Minute {
+		return t.token, nil
+	}
+	tokenURL := t.host("https://api.dropboxapi.com") + "/oauth2/token"
+	if t.Provider == "gdrive" {
+		tokenURL = t.host("https://oauth2.googleapis.com") + "/token"
+	}
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {t.RefreshToken}, "client_id": {t.ClientID}, "client_secret": {t.ClientSecret}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := deliveryDo(req, &tok); err != nil {
+		return "", fmt.Errorf("refresh access token: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("refresh access token: no token in the response")
+	}
+	t.token, t.expiry = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return t.token, nil
+}
+
+// authorize sets req's bearer token.
+func (t *deliveryTarget) authorize(ctx context.Context, req *http.Request) error {
+	tok, err := t.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	return nil
+}
+
+func (t *deliveryTarget) forgetToken() {
+	t.mu.Lock()
+	t.token = ""
+	t.mu.Unlock()
+}
+
+// deliveryError is a provider API's refusal.
+type deliveryError struct {
+	Status int
+	Body   string
+}
+
+func (e *deliveryError) Error() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.Status), e.Body)
+}
+
+// deliveryDo sends req and decodes a JSON reply into out (if not nil).
+func deliveryDo(req *http.Request, out any) error {
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return &deliveryError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body[:min(len(body), 512)]))}
+	}
+	if out != nil && len(body) > 0 {
+		return json.Unmarshal(body, out)
+	}
+	return nil
+}
+
+// call makes an authorized request; when the token is refused it is
+// dropped, so the next call fetches a new one.
+func (t *deliveryTarget) call(req *http.Request, out any) error {
+	if err := t.authorize(req.Context(), req); err != nil {
+		return err
+	}
+	err := deliveryDo(req, out)
+	var de *deliveryError
+	if errors.As(err, &de) && de.Status == http.StatusUnauthorized {
+		t.forgetToken()
+	}
+	return err
+}
+
+// ----- Dropbox -----
+
+// dropboxArg encodes v for the Dropbox-API-Arg header, which must be
+// ASCII: other characters are escaped as JSON \u sequences.
+func dropboxArg(v any) string {
+	raw, _ := json.Marshal(v)
+	var b strings.Builder
+	for _, r := range string(raw) {
+		switch {
+		case r < 0x80:
+			b.WriteRune(r)
+		case r > 0xffff:
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
+
+// dropboxContent posts a chunk of file content to a Dropbox content
+// endpoint.
+func (t *deliveryTarget) dropboxContent(ctx context.Context, endpoint string, arg any, body io.Reader, n int64, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.host("https://content.dropboxapi.com")+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", dropboxArg(arg))
+	return t.call(req, out)
+}
+
+// dropboxUpload uploads p into the folder, renaming it if the name is
+// taken, and returns its link.
+func (t *deliveryTarget) dropboxUpload(ctx context.Context, p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	commit := gin.H{"path": t.Folder + "/" + filepath.Base(p), "mode": "add", "autorename": true, "mute": true}
+	var meta struct {
+		PathDisplay string `json:"path_display"`
+	}
+	if st.Size() <= dropboxChunk {
+		err = t.dropboxContent(ctx, "/2/files/upload", commit, f, st.Size(), &meta)
+	} else {
+		err = t.dropboxSession(ctx, f, st.Size(), commit, &meta)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !t.Share {
+		dir, name := path.Split(meta.PathDisplay)
+		return "https://www.dropbox.com/home" + (&url.URL{Path: strings.TrimSuffix(dir, "/")}).EscapedPath() + "?preview=" + url.QueryEscape(name), nil
+	}
+	return t.dropboxShare(ctx, meta.PathDisplay)
+}
+
+// dropboxSession uploads f, of size n, in chunks through an upload
+// session.
+func (t *deliveryTarget) dropboxSession(ctx context.Context, f *os.File, n int64, commit gin.H, meta any) error {
+	var start struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := t.dropboxContent(ctx, "/2/files/upload_session/start", gin.H{"close": false}, io.LimitReader(f, dropboxChunk), dropboxChunk, &start); err != nil {
+		return err
+	}
+	offset := int64(dropboxChunk)
+	for n-offset > dropboxChunk {
+		cursor := gin.H{"session_id": start.SessionID, "offset": offset}
+		if err := t.dropboxContent(ctx, "/2/files/upload_session/append_v2", gin.H{"cursor": cursor, "close": false}, io.LimitReader(f, dropboxChunk), dropboxChunk, nil); err != nil {
+			return err
+		}
+		offset += dropboxChunk
+	}
+	cursor := gin.H{"session_id": start.SessionID, "offset": offset}
+	return t.dropboxContent(ctx, "/2/files/upload_session/finish", gin.H{"cursor": cursor, "commit": commit}, f, n-offset, meta)
+}
+
+// dropboxShare returns a shared link to the file at p, creating one
+// unless it exists.
+func (t *deliveryTarget) dropboxShare(ctx context.Context, p string) (string, error) {
+	body, _ := json.Marshal(gin.H{"path": p})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.host("https://api.dropboxapi.com")+"/2/sharing/create_shared_link_with_settings", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var link struct {
+		URL string `json:"url"`
+	}
+	err = t.call(req, &link)
+	var de *deliveryError
+	if errors.As(err, &de) && de.Status == http.StatusConflict {
+		// the file was shared before: the error carries the link
+		var conflict struct {
+			Error struct {
+				Exists struct {
+					Metadata struct {
+						URL string `json:"url"`
+					} `json:"metadata"`
+				} `json:"shared_link_already_exists"`
+			} `json:"error"`
+		}
+		if json.Unmarshal([]byte(de.Body), &conflict) == nil && conflict.Error.Exists.Metadata.URL != "" {
+			return conflict.Error.Exists.Metadata.URL, nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("share: %w", err)
+	}
+	return link.URL, nil
+}
+
+// ----- Google Drive -----
+
+// driveUpload uploads p into the folder through a resumable upload and
+// returns its link.
+func (t *deliveryTarget) driveUpload(ctx context.Context, p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	ct := cmp.Or(mime.TypeByExtension(filepath.Ext(p)), "application/octet-stream")
+	meta := gin.H{"name": filepath.Base(p)}
+	if t.Folder != "" {
+		meta["parents"] = []string{t.Folder}
+	}
+	body, _ := json.Marshal(meta)
+	api := t.host("https://www.googleapis.com")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api+"/upload/drive/v3/files?uploadType=resumable&supportsAllDrives=true&fields=id,webViewLink", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", ct)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(st.Size(), 10))
+	if err := t.authorize(ctx, req); err != nil {
+		return "", err
+	}
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if resp.StatusCode/100 != 2 || session == "" {
+		if resp.StatusCode == http.StatusUnauthorized {
+			t.forgetToken()
+		}
+		return "", fmt.Errorf("start upload: %s", resp.Status)
+	}
+	put, err := http.NewRequestWithContext(ctx, http.MethodPut, session, f)
+	if err != nil {
+		return "", err
+	}
+	put.ContentLength = st.Size()
+	put.Header.Set("Content-Type", ct)
+	var file struct {
+		ID          string `json:"id"`
+		WebViewLink string `json:"webViewLink"`
+	}
+	if err := t.call(put, &file); err != nil {
+		return "", err
+	}
+	if t.Share {
+		body, _ := json.Marshal(gin.H{"role": "reader", "type": "anyone"})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, api+"/drive/v3/files/"+url.PathEscape(file.ID)+"/permissions?supportsAllDrives=true", bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := t.call(req, nil); err != nil {
+			return file.WebViewLink, fmt.Errorf("share: %w", err)
+		}
+	}
+	return file.WebViewLink, nil
+}
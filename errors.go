@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes of the JSON error body. They are stable: clients branch on
+// the code, while the message is for people and may change.
+const (
+	errBadRequest      = "bad_request"
+	errInvalidJSON     = "invalid_json"
+	errInvalidItems    = "invalid_items"
+	errUnknownID       = "unknown_id"
+	errLoginRequired   = "login_required"
+	errBadCredentials  = "invalid_credentials"
+	errForbidden       = "forbidden"
+	errNotFound        = "not_found"
+	errTooLarge        = "too_large"
+	errQuotaExceeded   = "quota_exceeded"
+	errUnsupportedType = "unsupported_media_type"
+	errKeyReused       = "idempotency_key_reused"
+	errExists          = "already_exists"
+	errGone            = "gone"
+	errToolFailed      = "tool_failed"
+	errTimedOut        = "timed_out"
+	errOverloaded      = "overloaded"
+	errUpstream        = "upstream_failed"
+	errNotImplemented  = "not_implemented"
+	errInternal        = "internal"
+)
+
+// apiError is the body of every error response.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Items lists what is wrong with each item of a batch request.
+	Items []itemError `json:"items,omitempty"`
+	// Tool and Stderr name the external tool that failed and the end of
+	// what it printed.
+	Tool   string `json:"tool,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+	// Limit is the size limit a too_large upload ran into.
+	Limit     *sizeLimit `json:"limit,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+}
+
+// sizeLimit is a size limit an upload is held to: of the whole request
+// body (Scope "request") or of each file in it ("file").
+type sizeLimit struct {
+	Scope string `json:"scope"`
+	Bytes int64  `json:"bytes"`
+	// File is the file that was over a file limit.
+	File string `json:"file,omitempty"`
+}
+
+func (l *sizeLimit) Error() string {
+	if l.Scope == "file" {
+		return fmt.Sprintf("%s is over the %.1f MB file size limit", l.File, float64(l.Bytes)/(1<<20))
+	}
+	return fmt.Sprintf("upload exceeds the limit of %.1f MB", float64(l.Bytes)/(1<<20))
+}
+
+// failTooLarge answers 413 too_large for an upload over l.
+func failTooLarge(c *gin.Context, l *sizeLimit) {
+	abortWith(c, http.StatusRequestEntityTooLarge, &apiError{Code: errTooLarge, Message: l.Error(), Limit: l})
+}
+
+// itemError is the error of one item of a batch request; Index is its
+// position in the request's items.
+type itemError struct {
+	Index   int    `json:"index"`
+	ID      string `json:"id,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// toolError is a failed ffmpeg/ImageMagick/... run. It keeps the tail of
+// the tool's stderr for the error response; wrap it with %w to keep it.
+type toolError struct {
+	Tool   string
+	Stderr string
+	err    error
+}
+
+func (e *toolError) Error() string { return e.err.Error() }
+func (e *toolError) Unwrap() error { return e.err }
+
+// codeFor is the code of an error response that doesn't choose one.
+func codeFor(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return errLoginRequired
+	case http.StatusForbidden:
+		return errForbidden
+	case http.StatusNotFound:
+		return errNotFound
+	case http.StatusRequestEntityTooLarge:
+		return errTooLarge
+	case http.StatusUnsupportedMediaType:
+		return errUnsupportedType
+	case http.StatusGone:
+		return errGone
+	case http.StatusNotImplemented:
+		return errNotImplemented
+	case http.StatusBadGateway:
+		return errUpstream
+	}
+	if status >= 500 {
+		return errInternal
+	}
+	return errBadRequest
+}
+
+// fail answers with an apiError carrying the status's generic code, or
+// tool_failed for a 5xx caused by a tool (see toolError).
+func fail(c *gin.Context, status int, format string, args ...any) {
+	failCode(c, status, "", format, args...)
+}
+
+// failCode is fail with a specific code. A tool failure among args adds the
+// tool's name and stderr; a job timeout makes a 5xx timed_out.
+func failCode(c *gin.Context, status int, code, format string, args ...any) {
+	e := &apiError{Code: code, Message: fmt.Sprintf(format, args...)}
+	for _, a := range args {
+		var te *toolError
+		var to *timeoutError
+		if err, ok := a.(error); ok && errors.As(err, &te) {
+			e.Tool, e.Stderr = te.Tool, te.Stderr
+			if code == "" && status >= 500 {
+				e.Code = errToolFailed
+			}
+		}
+		if err, ok := a.(error); ok && errors.As(err, &to) && code == "" && status >= 500 {
+			e.Code = errTimedOut
+		}
+	}
+	abortWith(c, status, e)
+}
+
+// itemErrors collects the errors of a batch request's items, so that one
+// response reports all of them.
+type itemErrors []itemError
+
+func (e *itemErrors) add(index int, id, code, format string, args ...any) {
+	*e = append(*e, itemError{Index: index, ID: id, Code: cmp.Or(code, errBadRequest), Message: fmt.Sprintf(format, args...)})
+}
+
+// fail answers 400 invalid_items if any item failed, and reports whether
+// it did.
+func (e itemErrors) fail(c *gin.Context) bool {
+	if len(e) == 0 {
+		return false
+	}
+	msg := e[0].Message
+	if len(e) > 1 {
+		msg = fmt.Sprintf("%s (and %d more)", msg, len(e)-1)
+	}
+	abortWith(c, http.StatusBadRequest, &apiError{Code: errInvalidItems, Message: msg, Items: e})
+	return true
+}
+
+func abortWith(c *gin.Context, status int, e *apiError) {
+	if e.Code == "" {
+		e.Code = codeFor(status)
+	}
+	e.RequestID = requestID(c)
+	_ = c.Error(errors.New(e.Message))
+	c.AbortWithStatusJSON(status, e)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"video-to-pdf/probe"
+)
+
+// Phone footage: videos straight off a phone are often stored sideways
+// with a rotation flag, shot in HDR (HLG or PQ) that comes out washed out
+// in a JPEG, or at a variable frame rate. Before sampling frames, /process
+// and video_pdf watch folders straighten them out: a variable frame rate
+// is evened out to its average, HDR is tone-mapped to SDR and the frames
+// are turned upright by their rotation, by hand rather than by ffmpeg's
+// autorotation so the turn is the same with every ffmpeg build. What they
+// go by is the video's picture, probed at upload; an item with
+// "no_preprocess": true is extracted as before, with ffmpeg's autorotation
+// only.
+
+// videoPicture is how a video's frames are stored and meant to be shown.
+type videoPicture struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Rotation is the clockwise turn the frames need for display.
+	Rotation      int     `json:"rotation,omitempty"`
+	PixFmt        string  `json:"pix_fmt,omitempty"`
+	ColorTransfer string  `json:"color_transfer,omitempty"`
+	HDR           bool    `json:"hdr,omitempty"`
+	FPS           float64 `json:"fps,omitempty"`
+	VFR           bool    `json:"vfr,omitempty"`
+}
+
+// framePrep is the filter chain that straightens a video's frames out
+// before they are sampled, and the steps in it: vfr, tonemap, rotate.
+type framePrep struct {
+	Chain string   `json:"chain,omitempty"`
+	Steps []string `json:"steps,omitempty"`
+	// Manual turns ffmpeg's autorotation off; Chain turns the frames.
+	Manual bool `json:"manual,omitempty"`
+}
+
+// toneMapChain converts HDR to SDR BT.709: zscale linearises the
+// picture, tonemap squeezes its highlights in with the Hable curve.
+const toneMapChain = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// canToneMap reports whether ffmpeg has the filters of toneMapChain;
+// zscale needs a build with zimg.
+var canToneMap = sync.OnceValue(func() bool {
+	filters := ffmpegFilters()
+	return slices.Contains(filters, "zscale") && slices.Contains(filters, "tonemap")
+})
+
+// probePicture reads file's picture; nil when ffprobe can't.
+func probePicture(file string) *videoPicture {
+	return pictureOf(prober(false).Picture(file))
+}
+
+// pictureOf converts a probe's picture.
+func pictureOf(p probe.Picture, err error) *videoPicture {
+	if err != nil {
+		return nil
+	}
+	return &videoPicture{Width: p.Width, Height: p.Height, Rotation: p.Rotation, PixFmt: p.PixFmt, ColorTransfer: p.ColorTransfer, HDR: p.HDR(), FPS: p.FPS, VFR: p.VFR()}
+}
+
+// framePrepFor works out how to prepare vm's frames for sampling at fps;
+// fps 0 keeps every source frame, so the frame rate is left alone.
+// Animations are taken as they are.
+func framePrepFor(vm *VideoMeta, fps float64) framePrep {
+	if vm.Frames > 0 {
+		return framePrep{}
+	}
+	mu.Lock()
+	pic := vm.Picture
+	mu.Unlock()
+	if pic == nil {
+		// uploaded before pictures were probed
+		if pic = probePicture(vm.AbsPath); pic == nil {
+			return framePrep{}
+		}
+		mu.Lock()
+		vm.Picture = pic
+		mu.Unlock()
+		putVideo(vm)
+	}
+	var chain []string
+	p := framePrep{Manual: true}
+	if pic.VFR && fps > 0 {
+		chain = append(chain, fmt.Sprintf("setpts=PTS-STARTPTS,fps=%.3f", pic.FPS))
+		p.Steps = append(p.Steps, "vfr")
+	}
+	if pic.HDR {
+		if canToneMap() {
+			chain = append(chain, toneMapChain)
+			p.Steps = append(p.Steps, "tonemap")
+		} else {
+			slog.Warn("HDR video not tone-mapped: ffmpeg lacks zscale", "video_id", vm.ID)
+		}
+	}
+	switch pic.Rotation {
+	case 90:
+		chain = append(chain, "transpose=clock")
+	case 180:
+		chain = append(chain, "hflip,vflip")
+	case 270:
+		chain = append(chain, "transpose=cclock")
+	}
+	if pic.Rotation != 0 {
+		p.Steps = append(p.Steps, "rotate")
+	}
+	p.Chain = strings.Join(chain, ",")
+	return p
+}
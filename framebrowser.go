@@ -0,0 +1,347 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"video-to-pdf/frames"
+	"video-to-pdf/pdfgen"
+)
+
+// Frame browser: the frames a /process job extracted are kept with the job
+// (see frameRunDir) and served under /frames. GET /jobs/:id/frames lists
+// them a page at a time, with thumbnails made on first listing, so they
+// can be looked over before binding them. A /process request with
+// frames_only stops there, and POST /jobs/:id/frames/pdf then binds a
+// video's frames into a PDF: all of them less any excluded, or a chosen
+// subset in a chosen order, each page turned as asked. Frames stay until
+// the video is processed again or retention removes them.
+
+const (
+	frameThumbWidth = 320
+	// defaultFramesPage and maxFramesPage are the default and largest
+	// number of frames listed at once.
+	defaultFramesPage = 100
+	maxFramesPage     = 1000
+)
+
+// thumbsMu keeps two listings from making the same thumbnails at once.
+var thumbsMu sync.Mutex
+
+// frameVideo is one video of a job in its frame listing. Missing is set
+// once its frames are gone.
+type frameVideo struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	FPS     float64 `json:"fps"`
+	Count   int     `json:"count"`
+	Missing bool    `json:"missing,omitempty"`
+}
+
+// frameInfo is one extracted frame. TimeS is where it was taken from the
+// video, -1 when every frame was extracted.
+type frameInfo struct {
+	Index     int     `json:"index"`
+	URL       string  `json:"url"`
+	ThumbURL  string  `json:"thumb_url"`
+	TimeS     float64 `json:"time_seconds"`
+	SizeBytes int64   `json:"size_bytes"`
+}
+
+type framesPDFReq struct {
+	// VideoID picks the video of a job that processed several.
+	VideoID string `json:"video_id"`
+	// Exclude lists the indexes of the frames to leave out.
+	Exclude []int `json:"exclude"`
+	// Frames picks the pages instead: frames by index, in page order, each
+	// turned clockwise by Rotate degrees (0, 90, 180 or 270).
+	Frames []struct {
+		Index  int `json:"index"`
+		Rotate int `json:"rotate"`
+	} `json:"frames"`
+	// Density and Quality default to the /process request's.
+	Density  int    `json:"pdf_density"`
+	Quality  int    `json:"pdf_quality"`
+	OutName  string `json:"out_name"`
+	Async    bool   `json:"async"`
+	Priority string `json:"priority"`
+}
+
+// framesListURL is where the frames of job id are listed.
+func framesListURL(id string) string { return "/jobs/" + id + "/frames" }
+
+// frameJob looks up the finished /process job of the request, answering
+// the request if there is none, and returns it with its results.
+func frameJob(c *gin.Context) (Job, []processItem, bool) {
+	jobsMu.Lock()
+	j := jobs[c.Param("id")]
+	jobsMu.Unlock()
+	if j == nil || !canAccess(c, j.Owner) {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown job id: %s", c.Param("id"))
+		return Job{}, nil, false
+	}
+	snap := j.snapshot()
+	if snap.Type != "process" {
+		fail(c, http.StatusBadRequest, "a %s job extracts no frames", snap.Type)
+		return snap, nil, false
+	}
+	if snap.Status != jobDone {
+		fail(c, http.StatusConflict, "job is %s; frames are listed once it is done", snap.Status)
+		return snap, nil, false
+	}
+	var res struct {
+		Results []processItem `json:"results"`
+	}
+	raw, err := json.Marshal(snap.Result)
+	if err == nil {
+		err = json.Unmarshal(raw, &res)
+	}
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "job result: %v", err)
+		return snap, nil, false
+	}
+	return snap, res.Results, true
+}
+
+// pickFrameVideo is the result of the video the request names in
+// results, or the only one; it answers the request if there is none.
+func pickFrameVideo(c *gin.Context, results []processItem, id string) (processItem, bool) {
+	if id == "" {
+		if len(results) != 1 {
+			fail(c, http.StatusBadRequest, "the job processed %d videos; name one with video_id", len(results))
+			return processItem{}, false
+		}
+		return results[0], true
+	}
+	i := slices.IndexFunc(results, func(r processItem) bool { return r.ID == id })
+	if i < 0 {
+		failCode(c, http.StatusNotFound, errUnknownID, "the job has no video %s", id)
+		return processItem{}, false
+	}
+	return results[i], true
+}
+
+// frameURL is the URL path a kept frame is served at.
+func frameURL(path string) string {
+	rel, err := filepath.Rel(framesDir, path)
+	if err != nil {
+		return ""
+	}
+	return "/frames/" + filepath.ToSlash(rel)
+}
+
+// thumbPath is where the thumbnail of frame is kept.
+func thumbPath(frame string) string {
+	return filepath.Join(filepath.Dir(frame), "thumbs", filepath.Base(frame))
+}
+
+// ensureThumbs makes the thumbnails of imgs that don't have one yet.
+func ensureThumbs(imgs []string) error {
+	thumbsMu.Lock()
+	defer thumbsMu.Unlock()
+	var todo, outs []string
+	for _, img := range imgs {
+		if t := thumbPath(img); !fileExists(t) {
+			todo, outs = append(todo, img), append(outs, t)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(outs[0]), 0o755); err != nil {
+		return err
+	}
+	return pdfgen.Builder{Magick: magickBin, Run: toolRun}.Thumbnails(todo, outs, frameThumbWidth)
+}
+
+// handleJobFrames lists a page of one video's frames (?video_id=, else
+// the first) with every video of the job.
+func handleJobFrames(c *gin.Context) {
+	snap, results, ok := frameJob(c)
+	if !ok {
+		return
+	}
+	offset, err := strconv.Atoi(cmp.Or(c.Query("offset"), "0"))
+	if err != nil || offset < 0 {
+		fail(c, http.StatusBadRequest, "offset must be a number of frames")
+		return
+	}
+	limit, err := strconv.Atoi(cmp.Or(c.Query("limit"), strconv.Itoa(defaultFramesPage)))
+	if err != nil || limit < 1 || limit > maxFramesPage {
+		fail(c, http.StatusBadRequest, "limit must be between 1 and %d", maxFramesPage)
+		return
+	}
+	vids := make([]frameVideo, len(results))
+	for i, r := range results {
+		vids[i] = frameVideo{ID: r.ID, Name: r.Name, FPS: r.FPS, Count: r.FramesWrote}
+		if !fileExists(frameRunDir(r.ID, snap.ID)) {
+			vids[i].Missing, vids[i].Count = true, 0
+		}
+	}
+	id := c.Query("video_id")
+	if id == "" {
+		if i := slices.IndexFunc(vids, func(v frameVideo) bool { return !v.Missing }); i >= 0 {
+			id = vids[i].ID
+		}
+	}
+	resp := gin.H{"job_id": snap.ID, "videos": vids, "offset": offset, "limit": limit, "frames": []frameInfo{}}
+	if id == "" {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	r, ok := pickFrameVideo(c, results, id)
+	if !ok {
+		return
+	}
+	resp["video_id"] = r.ID
+	all := frames.Files(filepath.Join(frameRunDir(r.ID, snap.ID), "frame_%05d.jpg"), r.FramesWrote)
+	if !fileExists(frameRunDir(r.ID, snap.ID)) {
+		all = nil
+	}
+	resp["total"] = len(all)
+	page := all[min(offset, len(all)):min(offset+limit, len(all))]
+	if err := ensureThumbs(page); err != nil {
+		fail(c, http.StatusInternalServerError, "thumbnails: %v", err)
+		return
+	}
+	list := make([]frameInfo, 0, len(page))
+	for k, img := range page {
+		st, err := os.Stat(img)
+		if err != nil {
+			continue
+		}
+		f := frameInfo{Index: offset + k + 1, URL: frameURL(img), ThumbURL: frameURL(thumbPath(img)), TimeS: -1, SizeBytes: st.Size()}
+		if r.FPS > 0 {
+			// the fps filter takes frame n at (n-1)/fps
+			f.TimeS = float64(f.Index-1) / r.FPS
+		}
+		list = append(list, f)
+	}
+	resp["frames"] = list
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleFramesPDF binds the frames a job kept for one video into a PDF.
+func handleFramesPDF(c *gin.Context) {
+	var req framesPDFReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	snap, results, ok := frameJob(c)
+	if !ok {
+		return
+	}
+	r, ok := pickFrameVideo(c, results, req.VideoID)
+	if !ok {
+		return
+	}
+	dir := frameRunDir(r.ID, snap.ID)
+	if !fileExists(dir) {
+		fail(c, http.StatusGone, "the frames of %s are no longer kept", r.Name)
+		return
+	}
+	all := frames.Files(filepath.Join(dir, "frame_%05d.jpg"), r.FramesWrote)
+	var pages []pdfgen.Page
+	if len(req.Frames) > 0 {
+		if len(req.Exclude) > 0 {
+			fail(c, http.StatusBadRequest, "send frames or exclude, not both")
+			return
+		}
+		var bad itemErrors
+		for i, f := range req.Frames {
+			switch {
+			case f.Index < 1 || f.Index > r.FramesWrote:
+				bad.add(i, "", "", "no frame %d (the video has %d)", f.Index, r.FramesWrote)
+			case f.Rotate%90 != 0 || f.Rotate < 0 || f.Rotate > 270:
+				bad.add(i, "", "", "rotate must be 0, 90, 180 or 270")
+			default:
+				pages = append(pages, pdfgen.Page{Image: all[f.Index-1], Rotate: f.Rotate})
+			}
+		}
+		if bad.fail(c) {
+			return
+		}
+	} else {
+		skip := map[int]bool{}
+		for _, n := range req.Exclude {
+			if n < 1 || n > r.FramesWrote {
+				fail(c, http.StatusBadRequest, "exclude: no frame %d (the video has %d)", n, r.FramesWrote)
+				return
+			}
+			skip[n] = true
+		}
+		for k, img := range all {
+			if !skip[k+1] {
+				pages = append(pages, pdfgen.Page{Image: img})
+			}
+		}
+		if len(pages) == 0 {
+			fail(c, http.StatusBadRequest, "every frame is excluded")
+			return
+		}
+	}
+	// settings left out come from the /process request
+	var params processReq
+	if raw, err := json.Marshal(snap.Params); err == nil {
+		_ = json.Unmarshal(raw, &params)
+	}
+	density := cmp.Or(req.Density, params.Density, processDefaults.Density)
+	quality := cmp.Or(req.Quality, params.Quality, processDefaults.Quality)
+	if density < 1 || quality < 1 || quality > 100 {
+		fail(c, http.StatusBadRequest, "pdf_density must be positive and pdf_quality between 1 and 100")
+		return
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	name := r.ID + "_" + stripExt(sanitizeName(r.Name)) + "_" + snap.ID + ".pdf"
+	if strings.TrimSpace(req.OutName) != "" {
+		name = sanitizeName(req.OutName)
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".pdf") {
+		name += ".pdf"
+	}
+	owner := ownerOf(c)
+	out := claimOutput(owner, filepath.Join(pdfsDir, name))
+	proj := lookupProject(c, params.ProjectID)
+	job := newJob(owner, requestID(c), "frames_pdf", prio, []string{r.ID}, []string{filepath.Base(out)})
+	job.Params = req
+	if req.Async {
+		go runFramesPDF(job, proj, pages, out, density, quality)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runFramesPDF(job, proj, pages, out, density, quality)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func runFramesPDF(job *Job, proj *Project, pages []pdfgen.Page, out string, density, quality int) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		job.setItem(0, jobRunning, 0)
+		if err := pagesToPDF(pages, out, density, quality); err != nil {
+			return nil, fmt.Errorf("pdf build failed: %w", err)
+		}
+		job.setItem(0, jobDone, 100)
+		url := "/download/" + filepath.Base(out)
+		recordProjectOutputs(proj, url)
+		recordOutputs(job.Owner, url)
+		return gin.H{"job_id": job.ID, "pdf_url": url, "count": len(pages)}, nil
+	})
+}
@@ -0,0 +1,81 @@
+package frames
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg" // frames are JPEGs
+	_ "image/png"
+	"math"
+	"os"
+)
+
+// thumbSize is the side of the grayscale grid frames are compared on; it
+// is coarse enough that compression noise and a moving cursor average out.
+const thumbSize = 16
+
+// Distinct drops frames that look like the frame kept before them, e.g.
+// the many frames of a slide that stays on screen. Two frames differ by the
+// mean difference of their grayscale thumbnails, from 0 (same) to 1 (black
+// against white); a frame is kept when it differs from the last kept one
+// by more than threshold. The first frame is always kept.
+func Distinct(files []string, threshold float64) ([]string, error) {
+	var kept []string
+	var last []float64
+	for _, f := range files {
+		t, err := thumbnail(f)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil && difference(last, t) <= threshold {
+			continue
+		}
+		kept = append(kept, f)
+		last = t
+	}
+	return kept, nil
+}
+
+// thumbnail averages the luma of file's picture over a thumbSize square
+// grid, on a 0-1 scale.
+func thumbnail(file string) ([]float64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("frames: %s: %w", file, err)
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, fmt.Errorf("frames: %s is empty", file)
+	}
+	// sample about 64 pixels across each axis; that is plenty for 16 cells
+	step := max(1, min(b.Dx(), b.Dy())/64)
+	sum := make([]float64, thumbSize*thumbSize)
+	n := make([]int, len(sum))
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		cy := (y - b.Min.Y) * thumbSize / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x += step {
+			cx := (x - b.Min.X) * thumbSize / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sum[cy*thumbSize+cx] += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 0xffff
+			n[cy*thumbSize+cx]++
+		}
+	}
+	for i := range sum {
+		if n[i] > 0 {
+			sum[i] /= float64(n[i])
+		}
+	}
+	return sum, nil
+}
+
+func difference(a, b []float64) float64 {
+	var d float64
+	for i := range a {
+		d += math.Abs(a[i] - b[i])
+	}
+	return d / float64(len(a))
+}
@@ -0,0 +1,138 @@
+// Package frames extracts still frames from a video with ffmpeg.
+package frames
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Extractor runs ffmpeg.
+type Extractor struct {
+	// FFmpeg is the ffmpeg binary; "ffmpeg" when empty.
+	FFmpeg string
+	// Output runs a command and returns its stdout; exec.Command's Output
+	// when nil. Set it to apply limits or logging to the runs.
+	Output func(name string, args ...string) ([]byte, error)
+	// Filter is an ffmpeg filter chain run on the frames after the fps
+	// filter, if there is one (e.g. "crop=iw/2:ih:0:0,eq=contrast=1.2"). It goes to ffmpeg
+	// as it is; callers check it first.
+	Filter string
+	// Prepare is a filter chain run on the source's frames before the fps
+	// filter, to straighten them out first: turn them upright, tone-map
+	// HDR, even out a variable frame rate.
+	Prepare string
+	// NoAutorotate stops ffmpeg turning the frames by the stream's rotation
+	// metadata, for a Prepare that turns them itself.
+	NoAutorotate bool
+}
+
+// Stats is ffmpeg's own account of an extraction. Dropped and Duplicated
+// are the frames the fps filter's timing made ffmpeg skip or repeat.
+type Stats struct {
+	Frames     int
+	Dropped    int
+	Duplicated int
+}
+
+// Extract writes the first video stream of in as JPEGs at fps frames per
+// second, rounding up so a short clip still yields a frame; fps 0 writes
+// every source frame once, as for an animated GIF. outPattern is
+// an ffmpeg image pattern containing %05d (e.g. "dir/frame_%05d.jpg");
+// jpegQuality is ffmpeg's -q:v, 2 (best) to 31. The frames written are
+// numbered from 1 (see Files); the count comes from ffmpeg's progress
+// report, so files left in the directory by an earlier run don't add to it.
+func (e Extractor) Extract(in, outPattern string, fps float64, jpegQuality int) (Stats, error) {
+	if !strings.Contains(outPattern, "%05d") {
+		return Stats{}, fmt.Errorf("frames: pattern %q lacks %%05d", outPattern)
+	}
+	bin := e.FFmpeg
+	if bin == "" {
+		bin = "ffmpeg"
+	}
+	output := e.Output
+	if output == nil {
+		output = func(name string, args ...string) ([]byte, error) { return exec.Command(name, args...).Output() }
+	}
+	out, err := output(bin, e.args(in, outPattern, fps, jpegQuality)...)
+	if err != nil {
+		return Stats{}, err
+	}
+	return parseProgress(out)
+}
+
+// Files lists the first n files of outPattern in frame order.
+func Files(outPattern string, n int) []string {
+	files := make([]string, n)
+	for i := range files {
+		files[i] = strings.Replace(outPattern, "%05d", fmt.Sprintf("%05d", i+1), 1)
+	}
+	return files
+}
+
+func (e Extractor) args(in, outPattern string, fps float64, jpegQuality int) []string {
+	vsync := "passthrough"
+	chain := []string{e.Prepare}
+	if fps > 0 {
+		vsync = "vfr"
+		chain = append(chain, fmt.Sprintf("fps=%g:round=up:start_time=0", fps))
+	}
+	chain = append(chain, e.Filter)
+	vf := strings.Join(slices.DeleteFunc(chain, func(f string) bool { return f == "" }), ",")
+	a := []string{
+		"-hide_banner", "-loglevel", "error", "-nostdin", "-y",
+		"-progress", "pipe:1", "-nostats",
+		"-fflags", "+genpts",
+	}
+	if e.NoAutorotate {
+		a = append(a, "-noautorotate")
+	}
+	a = append(a,
+		"-i", in,
+		"-map", "0:v:0",
+		"-vsync", vsync,
+	)
+	if vf != "" {
+		a = append(a, "-vf", vf)
+	}
+	return append(a, "-q:v", strconv.Itoa(jpegQuality), outPattern)
+}
+
+// parseProgress reads the last report of ffmpeg's -progress output, blocks
+// of key=value lines each ending with a progress= line.
+func parseProgress(out []byte) (Stats, error) {
+	var s Stats
+	seen := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if !ok {
+			continue
+		}
+		var dst *int
+		switch k {
+		case "frame":
+			dst, seen = &s.Frames, true
+		case "drop_frames":
+			dst = &s.Dropped
+		case "dup_frames":
+			dst = &s.Duplicated
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Stats{}, fmt.Errorf("frames: bad progress line %q", sc.Text())
+		}
+		*dst = n
+	}
+	if !seen {
+		return Stats{}, errors.New("frames: ffmpeg reported no progress")
+	}
+	return s, nil
+}
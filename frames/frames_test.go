@@ -0,0 +1,157 @@
+package frames
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const progressOut = `frame=2
+fps=0.00
+dup_frames=0
+drop_frames=0
+progress=continue
+frame=3
+fps=12.5
+out_time=00:00:06.000000
+dup_frames=1
+drop_frames=4
+progress=end
+`
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	pattern := filepath.Join(dir, "frame_%05d.jpg")
+	var ran []string
+	e := Extractor{FFmpeg: "/opt/ffmpeg", Output: func(name string, args ...string) ([]byte, error) {
+		ran = append([]string{name}, args...)
+		return []byte(progressOut), nil
+	}}
+	st, err := e.Extract("in.mp4", pattern, 0.5, 4)
+	if err != nil || st != (Stats{Frames: 3, Dropped: 4, Duplicated: 1}) {
+		t.Fatalf("Extract = %+v, %v; want 3 frames, 4 dropped, 1 duplicated", st, err)
+	}
+	if ran[0] != "/opt/ffmpeg" || ran[len(ran)-1] != pattern {
+		t.Errorf("ran %v", ran)
+	}
+	for _, want := range []string{"fps=0.5:round=up:start_time=0", "in.mp4", "pipe:1"} {
+		if !slices.Contains(ran, want) {
+			t.Errorf("args %v lack %q", ran, want)
+		}
+	}
+	if i := slices.Index(ran, "-q:v"); i < 0 || ran[i+1] != "4" {
+		t.Errorf("args %v lack -q:v 4", ran)
+	}
+
+	e.Filter = "crop=iw/2:ih:0:0,hflip"
+	if _, err := e.Extract("in.mp4", pattern, 2, 4); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(ran, "fps=2:round=up:start_time=0,crop=iw/2:ih:0:0,hflip") {
+		t.Errorf("args %v lack the filter after fps", ran)
+	}
+
+	// the preparing chain runs ahead of the fps filter, and replaces
+	// ffmpeg's own rotation
+	e.Prepare, e.NoAutorotate = "transpose=clock", true
+	if _, err := e.Extract("in.mp4", pattern, 2, 4); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(ran, "transpose=clock,fps=2:round=up:start_time=0,crop=iw/2:ih:0:0,hflip") {
+		t.Errorf("args %v lack the preparing chain before fps", ran)
+	}
+	if i, j := slices.Index(ran, "-noautorotate"), slices.Index(ran, "-i"); i < 0 || i > j {
+		t.Errorf("args %v lack -noautorotate before the input", ran)
+	}
+	e.Prepare, e.NoAutorotate = "", false
+
+	// every frame: no fps filter, and ffmpeg keeps the source's timing
+	e.Filter = ""
+	if _, err := e.Extract("in.gif", pattern, 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(ran, "-vf") {
+		t.Errorf("args %v filter the frames", ran)
+	}
+	if i := slices.Index(ran, "-vsync"); i < 0 || ran[i+1] != "passthrough" {
+		t.Errorf("args %v lack -vsync passthrough", ran)
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	boom := errors.New("boom")
+	e := Extractor{Output: func(string, ...string) ([]byte, error) { return nil, boom }}
+	if _, err := e.Extract("in.mp4", filepath.Join(t.TempDir(), "f_%05d.jpg"), 1, 2); err != boom {
+		t.Errorf("Extract error = %v, want %v", err, boom)
+	}
+	if _, err := e.Extract("in.mp4", "frame.jpg", 1, 2); err == nil {
+		t.Error("Extract accepted a pattern without %05d")
+	}
+	silent := Extractor{Output: func(string, ...string) ([]byte, error) { return nil, nil }}
+	if _, err := silent.Extract("in.mp4", "f_%05d.jpg", 1, 2); err == nil {
+		t.Error("Extract accepted a run without a progress report")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	got := Files("d/frame_%05d.jpg", 3)
+	want := []string{"d/frame_00001.jpg", "d/frame_00002.jpg", "d/frame_00003.jpg"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Files = %v, want %v", got, want)
+	}
+	// past 99999 the numbers just grow a digit, as ffmpeg writes them
+	if got := Files("frame_%05d.jpg", 100000)[99999]; got != "frame_100000.jpg" {
+		t.Errorf("Files[99999] = %q", got)
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, shade uint8, mark bool) string {
+		img := image.NewGray(image.Rect(0, 0, 160, 90))
+		for i := range img.Pix {
+			img.Pix[i] = shade
+		}
+		if mark {
+			// a bright box over a sixth of the picture
+			for y := 0; y < 30; y++ {
+				for x := 0; x < 80; x++ {
+					img.SetGray(x, y, color.Gray{Y: 255})
+				}
+			}
+		}
+		p := filepath.Join(dir, name)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 60}); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	files := []string{
+		write("1.jpg", 40, false),
+		write("2.jpg", 41, false), // compression-level change
+		write("3.jpg", 40, true),
+		write("4.jpg", 40, true),
+		write("5.jpg", 40, false),
+	}
+	got, err := Distinct(files, 0.02)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{files[0], files[2], files[4]}
+	if !slices.Equal(got, want) {
+		t.Errorf("Distinct = %v, want %v", got, want)
+	}
+	if _, err := Distinct([]string{filepath.Join(dir, "missing.jpg")}, 0.02); err == nil {
+		t.Error("Distinct accepted a missing file")
+	}
+}
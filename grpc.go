@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The gRPC service of framespdf.proto, served with -grpc-addr on its own
+// listener over cleartext HTTP/2, or over TLS when HTTPS is on (tls.go).
+// There is no grpc-go here: calls are framed by hand and the messages
+// encoded with protowire. Each call is translated
+// into a request to the /api/v1 routes and run through the same gin engine
+// in-process, so authentication (an "authorization: Bearer" metadata entry),
+// quotas, idempotency keys, logging and tracing behave exactly as over HTTP.
+var grpcAddr = ""
+
+const (
+	grpcService = "framespdf.v1.MediaStudio"
+	// maxGRPCMessage caps a single message, as grpc-go does by default;
+	// uploads are streamed in chunks below it.
+	maxGRPCMessage = 4 << 20
+	// grpcWatchInterval is how often WatchJob looks at the job.
+	grpcWatchInterval = 500 * time.Millisecond
+)
+
+// gRPC status codes used here.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcCodeFor maps the HTTP API's error statuses to gRPC codes.
+func grpcCodeFor(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcAborted
+	case http.StatusGone:
+		return grpcFailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	if status >= 500 {
+		return grpcInternal
+	}
+	return grpcUnknown
+}
+
+// grpcServer serves the gRPC methods on top of api, the HTTP engine.
+type grpcServer struct {
+	api http.Handler
+}
+
+// grpcCall is one gRPC request in progress.
+type grpcCall struct {
+	s           *grpcServer
+	w           http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+}
+
+var grpcMethods = map[string]func(*grpcCall) error{
+	"Upload":       (*grpcCall).upload,
+	"ProcessVideo": (*grpcCall).processVideo,
+	"BuildPDF":     (*grpcCall).buildPDF,
+	"ConvertAudio": (*grpcCall).convertAudio,
+	"GetJob":       (*grpcCall).getJob,
+	"WatchJob":     (*grpcCall).watchJob,
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only; the HTTP API is on -addr", http.StatusUnsupportedMediaType)
+		return
+	}
+	call := &grpcCall{s: s, w: w, r: r}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	var err error
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+grpcService+"/")
+	if m := grpcMethods[name]; ok && m != nil {
+		err = m(call)
+	} else {
+		err = grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+	call.writeHeader()
+	code, msg := grpcOK, ""
+	if err != nil {
+		var ge *grpcError
+		if !errors.As(err, &ge) {
+			ge = &grpcError{grpcInternal, err.Error()}
+		}
+		if r.Context().Err() != nil {
+			ge = &grpcError{grpcCanceled, "canceled"}
+		}
+		code, msg = ge.code, ge.msg
+		slog.Warn("grpc call failed", "method", name, "code", code, "error", msg)
+	}
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+func (call *grpcCall) writeHeader() {
+	if !call.wroteHeader {
+		call.wroteHeader = true
+		call.w.WriteHeader(http.StatusOK)
+	}
+}
+
+// recv reads the next length-prefixed message; io.EOF means the client has
+// no more.
+func (call *grpcCall) recv() ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(call.r.Body, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, grpcErrorf(grpcInvalidArgument, "reading message: %v", err)
+	}
+	if hdr[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes exceeds %d", n, maxGRPCMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(call.r.Body, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading message: %v", err)
+	}
+	return msg, nil
+}
+
+// recvOne reads the single request message of a unary call.
+func (call *grpcCall) recvOne() ([]byte, error) {
+	msg, err := call.recv()
+	if err == io.EOF {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	return msg, err
+}
+
+func (call *grpcCall) send(msg []byte) error {
+	call.writeHeader()
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := call.w.Write(append(hdr[:], msg...)); err != nil {
+		return err
+	}
+	http.NewResponseController(call.w).Flush()
+	return nil
+}
+
+// api runs method path on the HTTP engine with the caller's credentials and
+// decodes the JSON answer into out, returning the raw body as well.
+func (call *grpcCall) api(method, path, contentType string, body io.Reader, out any) ([]byte, error) {
+	req, err := http.NewRequestWithContext(call.r.Context(), method, apiPrefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"Authorization", "Cookie", "X-Request-ID", "Traceparent", idempotencyHeader} {
+		if v := call.r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.RemoteAddr = call.r.RemoteAddr
+	rec := httptest.NewRecorder()
+	call.s.api.ServeHTTP(rec, req)
+	if !call.wroteHeader {
+		// surfaced as response metadata
+		for _, h := range []string{"X-Request-ID", "Set-Cookie", "Idempotent-Replayed"} {
+			if v := rec.Header().Values(h); len(v) > 0 {
+				call.w.Header()[http.CanonicalHeaderKey(h)] = v
+			}
+		}
+	}
+	raw := rec.Body.Bytes()
+	if rec.Code >= 400 {
+		var e apiError
+		if json.Unmarshal(raw, &e) != nil || e.Message == "" {
+			e.Message = http.StatusText(rec.Code)
+		}
+		return nil, &grpcError{grpcCodeFor(rec.Code), e.Message}
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return nil, fmt.Errorf("decoding %s response: %v", path, err)
+		}
+	}
+	return raw, nil
+}
+
+// apiJSON posts req as JSON.
+func (call *grpcCall) apiJSON(path string, req, out any) ([]byte, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return call.api(http.MethodPost, path, "application/json", bytes.NewReader(b), out)
+}
+
+// ===== methods =====
+
+var uploadRoutes = map[string]struct{ path, field string }{
+	"video": {"/upload", "videos"},
+	"image": {"/upload_images", "images"},
+	"audio": {"/upload_audio", "audios"},
+}
+
+// upload pipes the streamed chunks into a multipart request to the upload
+// endpoint of their kind as they arrive.
+func (call *grpcCall) upload() error {
+	first, err := call.recvOne()
+	if err != nil {
+		return err
+	}
+	chunk, err := decodeUploadChunk(first)
+	if err != nil {
+		return err
+	}
+	route, ok := uploadRoutes[chunk.kind]
+	if !ok {
+		return grpcErrorf(grpcInvalidArgument, "kind must be video, image or audio")
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	type result struct {
+		out map[string][]map[string]any
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		_, res.err = call.api(http.MethodPost, route.path, mw.FormDataContentType(), pr, &res.out)
+		pr.CloseWithError(io.ErrClosedPipe) // unblock the writer if the handler stopped reading
+		done <- res
+	}()
+	werr := func() error {
+		for _, t := range chunk.tags {
+			if err := mw.WriteField("tags", t); err != nil {
+				return err
+			}
+		}
+		if chunk.projectID != "" {
+			if err := mw.WriteField("project_id", chunk.projectID); err != nil {
+				return err
+			}
+		}
+		var part io.Writer
+		for {
+			if chunk.name != "" {
+				if part, err = mw.CreateFormFile(route.field, chunk.name); err != nil {
+					return err
+				}
+			}
+			if len(chunk.data) > 0 {
+				if part == nil {
+					return grpcErrorf(grpcInvalidArgument, "data before the first file name")
+				}
+				if _, err := part.Write(chunk.data); err != nil {
+					return err
+				}
+			}
+			msg, err := call.recv()
+			if err == io.EOF {
+				return mw.Close()
+			}
+			if err != nil {
+				return err
+			}
+			if chunk, err = decodeUploadChunk(msg); err != nil {
+				return err
+			}
+		}
+	}()
+	if werr != nil {
+		pw.CloseWithError(werr)
+	} else {
+		pw.Close()
+	}
+	res := <-done
+	var ge *grpcError
+	if errors.As(werr, &ge) {
+		return werr
+	}
+	if res.err != nil {
+		return res.err
+	}
+	if werr != nil {
+		return werr
+	}
+	var reply pbWriter
+	for _, u := range res.out[route.field] {
+		var m pbWriter
+		m.str(1, jsonString(u["id"]))
+		m.str(2, jsonString(u["name"]))
+		m.int(3, int64(jsonNumber(u["size_bytes"])))
+		m.double(4, jsonNumber(u["duration_seconds"]))
+		m.str(5, jsonString(u["sha256"]))
+		m.str(6, jsonString(u["mime_type"]))
+		m.str(7, jsonString(u["type_warning"]))
+		reply.msg(1, m)
+	}
+	return call.send(reply.b)
+}
+
+func (call *grpcCall) processVideo() error {
+	msg, err := call.recvOne()
+	if err != nil {
+		return err
+	}
+	var req processReq
+	err = eachField(msg, func(f pbField) error {
+		switch f.num {
+		case 1:
+			var it struct {
+				ID           string         `json:"id"`
+				FPS          float64        `json:"fps"`
+				EveryFrame   bool           `json:"every_frame"`
+				VideoFilter  string         `json:"video_filter"`
+				BurnChapters bool           `json:"burn_chapters"`
+				Chapters     []audioChapter `json:"chapters"`
+				NoPreprocess bool           `json:"no_preprocess"`
+			}
+			err := eachField(f.bytes, func(f pbField) error {
+				switch f.num {
+				case 1:
+					it.ID = string(f.bytes)
+				case 2:
+					it.FPS = f.double()
+				case 3:
+					it.VideoFilter = string(f.bytes)
+				case 4:
+					it.EveryFrame = f.varint != 0
+				case 5:
+					it.BurnChapters = f.varint != 0
+				case 6:
+					it.NoPreprocess = f.varint != 0
+				}
+				return nil
+			})
+			req.Items = append(req.Items, it)
+			return err
+		case 2:
+			req.JPEGQuality = int(int32(f.varint))
+		case 3:
+			req.Density = int(int32(f.varint))
+		case 4:
+			req.Quality = int(int32(f.varint))
+		case 5:
+			req.ProjectID = string(f.bytes)
+		case 6:
+			req.Priority = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return call.jobReply(call.apiJSON("/process", req, nil))
+}
+
+func (call *grpcCall) buildPDF() error {
+	msg, err := call.recvOne()
+	if err != nil {
+		return err
+	}
+	var req imagesPDFReq
+	err = eachField(msg, func(f pbField) error {
+		switch f.num {
+		case 1:
+			req.Items = append(req.Items, struct {
+				ID    string `json:"id"`
+				Order int    `json:"order"`
+			}{string(f.bytes), len(req.Items) + 1})
+		case 2:
+			req.Density = int(int32(f.varint))
+		case 3:
+			req.Quality = int(int32(f.varint))
+		case 4:
+			req.OutName = string(f.bytes)
+		case 5:
+			req.ProjectID = string(f.bytes)
+		case 6:
+			req.Priority = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return call.jobReply(call.apiJSON("/images_pdf", req, nil))
+}
+
+func (call *grpcCall) convertAudio() error {
+	msg, err := call.recvOne()
+	if err != nil {
+		return err
+	}
+	// the subset of convertAudioReq the proto carries
+	type item struct {
+		ID          string   `json:"id"`
+		Format      string   `json:"format,omitempty"`
+		Formats     []string `json:"formats,omitempty"`
+		BitrateKbps int      `json:"bitrate_kbps,omitempty"`
+		SampleRate  int      `json:"sample_rate,omitempty"`
+		Channels    int      `json:"channels,omitempty"`
+		Normalize   string   `json:"normalize,omitempty"`
+		TargetLUFS  float64  `json:"target_lufs,omitempty"`
+		AudioFilter string   `json:"audio_filter,omitempty"`
+	}
+	var req struct {
+		Items     []item `json:"items"`
+		Async     bool   `json:"async"`
+		Priority  string `json:"priority,omitempty"`
+		ProjectID string `json:"project_id,omitempty"`
+	}
+	err = eachField(msg, func(f pbField) error {
+		switch f.num {
+		case 1:
+			var it item
+			err := eachField(f.bytes, func(f pbField) error {
+				switch f.num {
+				case 1:
+					it.ID = string(f.bytes)
+				case 2:
+					it.Format = string(f.bytes)
+				case 3:
+					it.Formats = append(it.Formats, string(f.bytes))
+				case 4:
+					it.BitrateKbps = int(int32(f.varint))
+				case 5:
+					it.SampleRate = int(int32(f.varint))
+				case 6:
+					it.Channels = int(int32(f.varint))
+				case 7:
+					it.Normalize = string(f.bytes)
+				case 8:
+					it.TargetLUFS = f.double()
+				case 9:
+					it.AudioFilter = string(f.bytes)
+				}
+				return nil
+			})
+			req.Items = append(req.Items, it)
+			return err
+		case 2:
+			req.Async = f.varint != 0
+		case 3:
+			req.Priority = string(f.bytes)
+		case 4:
+			req.ProjectID = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return call.jobReply(call.apiJSON("/convert_audio", req, nil))
+}
+
+// jobReply answers with a JobReply built from a job endpoint's response.
+func (call *grpcCall) jobReply(raw []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return err
+	}
+	var m pbWriter
+	m.str(1, jsonString(resp["job_id"]))
+	for _, u := range resultURLs(resp) {
+		m.str(2, u)
+	}
+	m.str(3, string(raw))
+	return call.send(m.b)
+}
+
+func (call *grpcCall) jobRequest() (string, error) {
+	msg, err := call.recvOne()
+	if err != nil {
+		return "", err
+	}
+	id := ""
+	err = eachField(msg, func(f pbField) error {
+		if f.num == 1 {
+			id = string(f.bytes)
+		}
+		return nil
+	})
+	if err == nil && id == "" {
+		err = grpcErrorf(grpcInvalidArgument, "job_id is required")
+	}
+	return id, err
+}
+
+func (call *grpcCall) fetchJob(id string) (*Job, error) {
+	var j Job
+	_, err := call.api(http.MethodGet, "/jobs/"+url.PathEscape(id), "", nil, &j)
+	return &j, err
+}
+
+func (call *grpcCall) getJob() error {
+	id, err := call.jobRequest()
+	if err != nil {
+		return err
+	}
+	j, err := call.fetchJob(id)
+	if err != nil {
+		return err
+	}
+	return call.send(encodeJob(j))
+}
+
+func (call *grpcCall) watchJob() error {
+	id, err := call.jobRequest()
+	if err != nil {
+		return err
+	}
+	var last []byte
+	t := time.NewTicker(grpcWatchInterval)
+	defer t.Stop()
+	for {
+		j, err := call.fetchJob(id)
+		if err != nil {
+			return err
+		}
+		if msg := encodeJob(j); !bytes.Equal(msg, last) {
+			if err := call.send(msg); err != nil {
+				return err
+			}
+			last = msg
+		}
+		if j.Status == jobDone || j.Status == jobFailed {
+			return nil
+		}
+		select {
+		case <-call.r.Context().Done():
+			return call.r.Context().Err()
+		case <-t.C:
+		}
+	}
+}
+
+func encodeJob(j *Job) []byte {
+	var m pbWriter
+	m.str(1, j.ID)
+	m.str(2, j.Type)
+	m.str(3, j.Status)
+	m.double(4, j.Progress)
+	m.str(5, j.Error)
+	for _, it := range j.Items {
+		var im pbWriter
+		im.str(1, it.ID)
+		im.str(2, it.Name)
+		im.str(3, it.Status)
+		im.double(4, it.Progress)
+		m.msg(6, im)
+	}
+	m.str(7, j.Created)
+	m.str(8, j.Started)
+	m.str(9, j.Finished)
+	if j.Result != nil {
+		for _, u := range resultURLs(j.Result) {
+			m.str(10, u)
+		}
+		if b, err := json.Marshal(j.Result); err == nil {
+			m.str(11, string(b))
+		}
+	}
+	return m.b
+}
+
+type uploadChunk struct {
+	kind, name, projectID string
+	data                  []byte
+	tags                  []string
+}
+
+func decodeUploadChunk(msg []byte) (uploadChunk, error) {
+	var c uploadChunk
+	err := eachField(msg, func(f pbField) error {
+		switch f.num {
+		case 1:
+			c.kind = string(f.bytes)
+		case 2:
+			c.name = string(f.bytes)
+		case 3:
+			c.data = f.bytes
+		case 4:
+			c.tags = append(c.tags, string(f.bytes))
+		case 5:
+			c.projectID = string(f.bytes)
+		}
+		return nil
+	})
+	return c, err
+}
+
+func jsonString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func jsonNumber(v any) float64 {
+	f, _ := v.(float64)
+	return f
+}
+
+// ===== protobuf wire format =====
+
+// pbField is one decoded field: varint and fixed values in varint, length
+// delimited ones (strings, bytes, messages, packed lists) in bytes.
+type pbField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	bytes  []byte
+}
+
+func (f pbField) double() float64 {
+	if f.typ != protowire.Fixed64Type {
+		return 0
+	}
+	return math.Float64frombits(f.varint)
+}
+
+// eachField calls fn for every field of the encoded message b.
+func eachField(b []byte, fn func(pbField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return grpcErrorf(grpcInvalidArgument, "bad message: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := pbField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.varint, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.varint = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return grpcErrorf(grpcInvalidArgument, "bad message: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbWriter encodes a message; zero values are left out as proto3 does.
+type pbWriter struct{ b []byte }
+
+func (w *pbWriter) str(num protowire.Number, s string) {
+	if s != "" {
+		w.b = protowire.AppendTag(w.b, num, protowire.BytesType)
+		w.b = protowire.AppendString(w.b, s)
+	}
+}
+
+func (w *pbWriter) int(num protowire.Number, v int64) {
+	if v != 0 {
+		w.b = protowire.AppendTag(w.b, num, protowire.VarintType)
+		w.b = protowire.AppendVarint(w.b, uint64(v))
+	}
+}
+
+func (w *pbWriter) double(num protowire.Number, v float64) {
+	if v != 0 {
+		w.b = protowire.AppendTag(w.b, num, protowire.Fixed64Type)
+		w.b = protowire.AppendFixed64(w.b, math.Float64bits(v))
+	}
+}
+
+func (w *pbWriter) msg(num protowire.Number, m pbWriter) {
+	w.b = protowire.AppendTag(w.b, num, protowire.BytesType)
+	w.b = protowire.AppendBytes(w.b, m.b)
+}
+
+// grpcHTTPServer is the gRPC listener, nil unless -grpc-addr is set. With
+// tlsConf (the HTTPS listener's) it serves over TLS too, else cleartext
+// HTTP/2.
+func grpcHTTPServer(api http.Handler, tlsConf *tls.Config) *http.Server {
+	if grpcAddr == "" {
+		return nil
+	}
+	var p http.Protocols
+	if tlsConf != nil {
+		p.SetHTTP2(true)
+		tlsConf = tlsConf.Clone()
+	} else {
+		p.SetUnencryptedHTTP2(true)
+	}
+	return &http.Server{Addr: grpcAddr, Handler: &grpcServer{api: api}, Protocols: &p, TLSConfig: tlsConf}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Idempotency-Key support for the processing endpoints: a request repeated
+// with the same key (a client retrying after a dropped connection, a
+// double-click) gets the first request's response replayed instead of
+// launching the same job again. A repeat arriving while the first is still
+// running waits for it. Only small JSON bodies are kept; a binary response
+// is kept as the output file it sent, and a replay sends that file again.
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyTTL    = 24 * time.Hour
+	maxIdempotencyKey = 255
+	// maxIdempotentBody caps the response bodies kept for replay.
+	maxIdempotentBody = 64 << 10
+)
+
+type idemEntry struct {
+	// bodySum fingerprints the request, so a key reused for a different
+	// request is rejected rather than answered with the wrong response.
+	bodySum     [32]byte
+	done        chan struct{}
+	status      int
+	contentType string
+	body        []byte
+	// jobID and output are the job and file URL of a binary response.
+	jobID   string
+	output  string
+	expires time.Time
+}
+
+var (
+	idemMu      sync.Mutex
+	idemEntries = map[string]*idemEntry{}
+)
+
+// idemWriter keeps a copy of the response written through it, up to
+// maxIdempotentBody; over is set once the response is bigger.
+type idemWriter struct {
+	gin.ResponseWriter
+	buf  bytes.Buffer
+	over bool
+}
+
+// keep reports whether n more bytes fit in the copy.
+func (w *idemWriter) keep(n int) bool {
+	if w.over || w.buf.Len()+n > maxIdempotentBody {
+		w.over = true
+		w.buf.Reset()
+		return false
+	}
+	return true
+}
+
+func (w *idemWriter) Write(b []byte) (int, error) {
+	if w.keep(len(b)) {
+		w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idemWriter) WriteString(s string) (int, error) {
+	if w.keep(len(s)) {
+		w.buf.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idemOutput marks c's response as the file at url from job jobID, so a
+// replay sends the file again instead of a kept copy of it.
+func idemOutput(c *gin.Context, jobID, url string) {
+	c.Set("idem_output", [2]string{jobID, url})
+}
+
+// idempotent is middleware for POST endpoints that start work. Keys are
+// scoped to the route and the caller, so users can't see each other's
+// responses. Server errors aren't kept: retrying those should run again.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader(idempotencyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		fail(c, http.StatusBadRequest, "%s too long", idempotencyHeader)
+		c.Abort()
+		return
+	}
+	raw, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "read body: %v", err)
+		c.Abort()
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+	sum := sha256.Sum256(raw)
+	id := ownerOf(c) + "\x00" + c.FullPath() + "\x00" + key
+
+	idemMu.Lock()
+	now := time.Now()
+	for k, e := range idemEntries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(idemEntries, k)
+		}
+	}
+	e, ok := idemEntries[id]
+	if !ok {
+		e = &idemEntry{bodySum: sum, done: make(chan struct{})}
+		idemEntries[id] = e
+	}
+	idemMu.Unlock()
+
+	if ok {
+		if e.bodySum != sum {
+			failCode(c, http.StatusUnprocessableEntity, errKeyReused, "%s already used for a different request", idempotencyHeader)
+			c.Abort()
+			return
+		}
+		select {
+		case <-e.done:
+		case <-c.Request.Context().Done():
+			c.Abort()
+			return
+		}
+		idemMu.Lock()
+		replay := idemEntries[id] == e
+		idemMu.Unlock()
+		if !replay {
+			// the first attempt failed and was forgotten: run this one
+			idempotent(c)
+			return
+		}
+		c.Header("Idempotent-Replayed", "true")
+		if e.output != "" {
+			sendOutput(c, e.jobID, e.output)
+		} else {
+			c.Data(e.status, e.contentType, e.body)
+		}
+		c.Abort()
+		return
+	}
+
+	w := &idemWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	defer func() {
+		c.Writer = w.ResponseWriter
+		out, isFile := c.Get("idem_output")
+		ctype := w.Header().Get("Content-Type")
+		idemMu.Lock()
+		switch status := w.Status(); {
+		case status >= http.StatusInternalServerError:
+			delete(idemEntries, id)
+		case isFile:
+			e.status = status
+			e.jobID, e.output = out.([2]string)[0], out.([2]string)[1]
+			e.expires = time.Now().Add(idempotencyTTL)
+		case !w.over && (w.buf.Len() == 0 || strings.HasPrefix(ctype, gin.MIMEJSON)):
+			e.status = status
+			e.contentType = ctype
+			e.body = w.buf.Bytes()
+			e.expires = time.Now().Add(idempotencyTTL)
+		default:
+			// too big, or not JSON, to keep: a retry runs again
+			delete(idemEntries, id)
+		}
+		idemMu.Unlock()
+		close(e.done)
+	}()
+	c.Next()
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ingestCommon holds the settings shared by the ingest endpoints, which
+// register sources the server fetches itself rather than the client
+// uploading them.
+type ingestCommon struct {
+	// Kind is video, image or audio.
+	Kind      string   `json:"kind"`
+	Tags      []string `json:"tags"`
+	ProjectID string   `json:"project_id"`
+	Async     bool     `json:"async"`
+	Priority  string   `json:"priority"`
+}
+
+// ingestReq registers sources stored in S3 (or an S3-compatible service).
+type ingestReq struct {
+	ingestCommon
+	Items []struct {
+		// URL is s3://bucket/key; alternatively set Bucket and Key.
+		URL    string `json:"url"`
+		Bucket string `json:"bucket"`
+		Key    string `json:"key"`
+		// Name overrides the file name taken from the key.
+		Name string `json:"name"`
+	} `json:"items"`
+}
+
+// ingestSource is one validated ingest item.
+type ingestSource struct {
+	// name is the file name; fetchers that only learn it while downloading
+	// return the real one.
+	name string
+	// label identifies the source in errors.
+	label string
+	// fetch downloads the source into dir, reporting progress in percent,
+	// and returns the file's name and size.
+	fetch func(ctx context.Context, dir string, progress func(float64)) (string, int64, error)
+}
+
+// maxIngestBytes is the size limit of one ingested file of kind, 0 if kind
+// is unknown.
+func maxIngestBytes(kind string) int64 {
+	_, file := uploadLimits(kind)
+	return file
+}
+
+// parseIngest validates the shared settings.
+func parseIngest(c *gin.Context, req ingestCommon) (tags []string, proj *Project, prio string, ok bool) {
+	if maxIngestBytes(req.Kind) == 0 {
+		fail(c, http.StatusBadRequest, "kind must be video, image or audio")
+		return nil, nil, "", false
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return nil, nil, "", false
+	}
+	proj = lookupProject(c, req.ProjectID)
+	if req.ProjectID != "" && proj == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", req.ProjectID)
+		return nil, nil, "", false
+	}
+	if prio, err = parsePriority(req.Priority); err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return nil, nil, "", false
+	}
+	return tags, proj, prio, true
+}
+
+// parseS3URL splits s3://bucket/key.
+func parseS3URL(s string) (bucket, key string, err error) {
+	rest, ok := strings.CutPrefix(s, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("not an s3:// URL: %s", s)
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("s3 URL needs a bucket and key: %s", s)
+	}
+	return bucket, key, nil
+}
+
+// ingestAllowed reports whether bucket may be read from (storage's
+// ingest_buckets; "*" allows any).
+func ingestAllowed(bucket string) bool {
+	return slices.Contains(storageConfig.IngestBuckets, "*") || slices.Contains(storageConfig.IngestBuckets, bucket)
+}
+
+// ingestClient is the S3 client sources are read with: the output
+// backend's when that is S3 or GCS, otherwise one built from the storage
+// settings and AWS credentials. Without credentials requests go unsigned,
+// which works for public buckets.
+func ingestClient() (*s3Client, error) {
+	if s, ok := objects.(*s3Store); ok {
+		return s.client, nil
+	}
+	sc := storageConfig
+	region := cmp.Or(sc.Region, "us-east-1")
+	endpoint := "https://s3." + region + ".amazonaws.com"
+	ak, sk := sc.AccessKey, sc.SecretKey
+	if sc.Backend == "azure" {
+		ak, sk = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	} else if sc.Endpoint != "" {
+		endpoint = sc.Endpoint
+	}
+	return newS3Client(endpoint, region, ak, sk)
+}
+
+func handleIngestS3(c *gin.Context) {
+	var req ingestReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if len(storageConfig.IngestBuckets) == 0 {
+		fail(c, http.StatusForbidden, "S3 ingest is disabled (set storage.ingest_buckets)")
+		return
+	}
+	if len(req.Items) == 0 {
+		fail(c, http.StatusBadRequest, "no items provided")
+		return
+	}
+	tags, proj, prio, ok := parseIngest(c, req.ingestCommon)
+	if !ok {
+		return
+	}
+	client, err := ingestClient()
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	maxBytes := maxIngestBytes(req.Kind)
+	srcs := make([]ingestSource, 0, len(req.Items))
+	var total int64
+	for _, it := range req.Items {
+		bucket, key := it.Bucket, it.Key
+		if it.URL != "" {
+			if bucket, key, err = parseS3URL(it.URL); err != nil {
+				fail(c, http.StatusBadRequest, "%v", err)
+				return
+			}
+		}
+		if bucket == "" || key == "" {
+			fail(c, http.StatusBadRequest, "each item needs url or bucket and key")
+			return
+		}
+		if !ingestAllowed(bucket) {
+			fail(c, http.StatusForbidden, "bucket not allowed: %s", bucket)
+			return
+		}
+		size, err := client.headObject(c.Request.Context(), bucket, key)
+		if err != nil {
+			fail(c, http.StatusBadGateway, "s3://%s/%s: %v", bucket, key, err)
+			return
+		}
+		if size > maxBytes {
+			failTooLarge(c, &sizeLimit{Scope: "file", Bytes: maxBytes, File: "s3://" + bucket + "/" + key})
+			return
+		}
+		total += size
+		name := sanitizeName(cmp.Or(it.Name, path.Base(key)))
+		srcs = append(srcs, ingestSource{
+			name:  name,
+			label: "s3://" + bucket + "/" + key,
+			fetch: func(ctx context.Context, dir string, progress func(float64)) (string, int64, error) {
+				n, err := client.getObject(ctx, bucket, key, filepath.Join(dir, name), func(n int64) {
+					if size > 0 {
+						progress(float64(n) * 100 / float64(size))
+					}
+				})
+				return name, n, err
+			},
+		})
+	}
+	if quota, used := ownerQuota(c); quota > 0 && used+total > quota {
+		failCode(c, http.StatusRequestEntityTooLarge, errQuotaExceeded, "storage quota exceeded (%.1f of %.1f MB used)", float64(used)/(1<<20), float64(quota)/(1<<20))
+		return
+	}
+	runIngest(c, "ingest_s3", req.ingestCommon, prio, srcs, tags, proj)
+}
+
+// runIngest fetches srcs as a job of type typ and answers like the other
+// job endpoints: 202 with the job's URL when async, else the result.
+func runIngest(c *gin.Context, typ string, req ingestCommon, prio string, srcs []ingestSource, tags []string, proj *Project) {
+	ids := make([]string, len(srcs))
+	names := make([]string, len(srcs))
+	for i, s := range srcs {
+		names[i] = s.name
+	}
+	job := newJob(ownerOf(c), requestID(c), typ, prio, ids, names)
+	job.Params = req
+	// kept across retries, so sources already ingested aren't fetched twice
+	registered := make([]any, len(srcs))
+	run := func() (gin.H, error) {
+		return runJob(job, func() (gin.H, error) {
+			if err := ingestSources(job, req.Kind, srcs, registered, tags, proj); err != nil {
+				return nil, err
+			}
+			return gin.H{"job_id": job.ID, req.Kind + "s": registered}, nil
+		})
+	}
+	if req.Async {
+		go run()
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := run()
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ingestSources fetches srcs and registers them like uploads of kind,
+// storing each in registered. Sources registered already are skipped.
+func ingestSources(job *Job, kind string, srcs []ingestSource, registered []any, tags []string, proj *Project) error {
+	for i, s := range srcs {
+		if registered[i] != nil {
+			job.setItem(i, jobDone, 100)
+			continue
+		}
+		job.setItem(i, jobRunning, 0)
+		id := randID(8)
+		// downloads land in scratch space and move into uploads once whole
+		dir, err := job.scratch("ingest-" + id)
+		if err != nil {
+			return err
+		}
+		job.setItemID(i, id)
+		name, size, err := s.fetch(workCtx, dir, job.progressFunc(i))
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.label, err)
+		}
+		if err := os.Rename(dir, filepath.Join(uploadDir, id)); err != nil {
+			return err
+		}
+		meta, err := registerSource(kind, job.Owner, id, name, size, tags, proj)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.label, err)
+		}
+		registered[i] = meta
+		job.setItem(i, jobDone, 100)
+	}
+	return nil
+}
+
+// registerSource registers the file uploadDir/id/name as an upload of kind
+// and returns its metadata. If the owner has uploaded the same bytes under
+// the same name before, the file is dropped and that record returned.
+// Content that fails the type check is deleted and an error returned.
+func registerSource(kind, owner, id, name string, size int64, tags []string, proj *Project) (any, error) {
+	rel := filepath.Join(id, storedName(name))
+	abs := filepath.Join(uploadDir, rel)
+	if !kindOn(kind) {
+		os.RemoveAll(filepath.Join(uploadDir, id))
+		return nil, fmt.Errorf("%s uploads are disabled on this server", kind)
+	}
+	if err := os.Rename(filepath.Join(uploadDir, id, name), abs); err != nil {
+		os.RemoveAll(filepath.Join(uploadDir, id))
+		return nil, err
+	}
+	now := time.Now().Format(time.RFC3339)
+	mt, typeWarn, err := checkUploadType(kind, name, abs)
+	if err != nil {
+		os.RemoveAll(filepath.Join(uploadDir, id))
+		return nil, err
+	}
+	sum, err := internBlob(abs, "")
+	if err != nil {
+		slog.Warn("intern upload failed", "source_id", id, "path", abs, "error", err.Error())
+	}
+	switch dup := sameUpload(kind, owner, name, sum).(type) {
+	case *VideoMeta:
+		os.RemoveAll(filepath.Join(uploadDir, id))
+		addToProject(proj, "videos", dup.ID)
+		return dup, nil
+	case *ImgMeta:
+		os.RemoveAll(filepath.Join(uploadDir, id))
+		addToProject(proj, "images", dup.ID)
+		return dup, nil
+	case *AudioMeta:
+		os.RemoveAll(filepath.Join(uploadDir, id))
+		addToProject(proj, "audios", dup.ID)
+		return dup, nil
+	}
+	switch kind {
+	case "video":
+		dur, _ := probeDuration(abs)
+		vm := &VideoMeta{ID: id, Name: name, RelPath: rel, AbsPath: abs, SizeBytes: size, DurationS: dur, Uploaded: now}
+		vm.AudioTracks = probeAudioTracks(abs)
+		vm.Picture = probePicture(abs)
+		vm.Validation = validateMedia(abs, dur, true)
+		vm.Tags, vm.Owner, vm.SHA256 = tags, owner, sum
+		vm.MIMEType, vm.TypeWarning = mt, typeWarn
+		mu.Lock()
+		videos[id] = vm
+		mu.Unlock()
+		putVideo(vm)
+		addToProject(proj, "videos", id)
+		return vm, nil
+	case "image":
+		im := &ImgMeta{ID: id, Name: name, RelPath: rel, AbsPath: abs, SizeBytes: size, Uploaded: now, URL: "/uploads/" + filepath.ToSlash(rel), Tags: tags, Owner: owner, SHA256: sum, MIMEType: mt, TypeWarning: typeWarn}
+		mu.Lock()
+		images[id] = im
+		mu.Unlock()
+		putImage(im)
+		addToProject(proj, "images", id)
+		return im, nil
+	default:
+		pa := probeAudio(abs)
+		am := &AudioMeta{ID: id, Name: name, RelPath: rel, AbsPath: abs, SizeBytes: size, Uploaded: now, DurationS: pa.DurationS, Codec: pa.Codec, Channels: pa.Channels, SampleRate: pa.SampleRate, BitrateKbps: pa.BitrateKbps, ProbeJSON: pa.JSON}
+		am.Validation = validateMedia(abs, pa.DurationS, false)
+		am.Tags, am.Owner, am.SHA256 = tags, owner, sum
+		am.MIMEType, am.TypeWarning = mt, typeWarn
+		if coverRel, err := extractCoverArt(abs, pa.JSON, id); err == nil && coverRel != "" {
+			am.CoverURL = "/uploads/" + filepath.ToSlash(coverRel)
+		}
+		mu.Lock()
+		audios[id] = am
+		mu.Unlock()
+		putAudio(am)
+		addToProject(proj, "audios", id)
+		return am, nil
+	}
+}
+
+// headObject returns the size of bucket/key.
+func (s *s3Client) headObject(ctx context.Context, bucket, key string) (int64, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, bucket, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// getObject streams bucket/key into the file dst, reporting the bytes
+// written so far to progress.
+func (s *s3Client) getObject(ctx context.Context, bucket, key, dst string, progress func(int64)) (int64, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, bucket, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	n, err := ioCopyClose(f, &progressReader{r: resp.Body, fn: progress})
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("short read: %d of %d bytes", n, resp.ContentLength)
+	}
+	return n, err
+}
+
+// progressReader reports the running byte count after every read, at most
+// once per MB.
+type progressReader struct {
+	r       io.Reader
+	n, last int64
+	fn      func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if p.n-p.last >= 1<<20 || err == io.EOF {
+		p.last = p.n
+		p.fn(p.n)
+	}
+	return n, err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ingestPrivate lets /ingest_url fetch from loopback, private and
+// link-local addresses (FRAMESPDF_INGEST_PRIVATE, -ingest-private). Off by
+// default so the endpoint can't be used to reach internal services.
+var ingestPrivate bool
+
+type ingestURLReq struct {
+	ingestCommon
+	Items []struct {
+		URL string `json:"url"`
+		// Name overrides the file name from the response or URL.
+		Name string `json:"name"`
+	} `json:"items"`
+}
+
+var errPrivateAddr = errors.New("address not allowed")
+
+// ingestHTTP is the client remote sources are fetched with. Its dialer
+// refuses internal addresses unless ingestPrivate is set; checking at dial
+// time also covers redirects and DNS answers.
+var ingestHTTP = &http.Client{
+	Transport: &http.Transport{
+		// no proxy: the dialer would check the proxy's address rather than
+		// the source's
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if ingestPrivate {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+					return fmt.Errorf("%s: %w", host, errPrivateAddr)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s not allowed", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// ingestTypeOK reports whether a response's Content-Type fits kind. Servers
+// that don't know the type send octet-stream, which is let through; the
+// file is probed like any upload.
+func ingestTypeOK(kind, contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "application/octet-stream" || mt == "binary/octet-stream" {
+		return true
+	}
+	if strings.HasPrefix(mt, kind+"/") {
+		return true
+	}
+	// containers some servers label as application/*
+	return kind != "image" && (mt == "application/ogg" || mt == "application/mp4" || mt == "application/x-matroska" || mt == "application/vnd.apple.mpegurl")
+}
+
+func handleIngestURL(c *gin.Context) {
+	var req ingestURLReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if len(req.Items) == 0 {
+		fail(c, http.StatusBadRequest, "no items provided")
+		return
+	}
+	tags, proj, prio, ok := parseIngest(c, req.ingestCommon)
+	if !ok {
+		return
+	}
+	// every source counts against what is left of the quota as it arrives
+	var left atomic.Int64
+	left.Store(-1)
+	if quota, used := ownerQuota(c); quota > 0 {
+		left.Store(max(quota-used, 0))
+	}
+	maxBytes := maxIngestBytes(req.Kind)
+	srcs := make([]ingestSource, 0, len(req.Items))
+	for _, it := range req.Items {
+		u, err := url.Parse(it.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail(c, http.StatusBadRequest, "not an http(s) URL: %s", it.URL)
+			return
+		}
+		name := sanitizeName(cmp.Or(it.Name, path.Base(u.Path)))
+		if name == "." || name == "_" {
+			name = "file"
+		}
+		srcs = append(srcs, ingestSource{
+			name:  name,
+			label: u.Redacted(),
+			fetch: func(ctx context.Context, dir string, progress func(float64)) (string, int64, error) {
+				return fetchURL(ctx, u.String(), dir, name, it.Name != "", req.Kind, maxBytes, &left, progress)
+			},
+		})
+	}
+	runIngest(c, "ingest_url", req.ingestCommon, prio, srcs, tags, proj)
+}
+
+// fetchURL downloads src into dir. The file is named after the response's
+// Content-Disposition unless keepName is set, else name. Responses of the
+// wrong type, over maxBytes or over the remaining quota (left, -1 for
+// none) are refused.
+func fetchURL(ctx context.Context, src, dir, name string, keepName bool, kind string, maxBytes int64, left *atomic.Int64, progress func(float64)) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := ingestHTTP.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !ingestTypeOK(kind, ct) {
+		return "", 0, fmt.Errorf("content type %s is not %s", ct, kind)
+	}
+	limit := maxBytes
+	if l := left.Load(); l >= 0 {
+		limit = min(limit, l)
+	}
+	if resp.ContentLength > limit {
+		return "", 0, fmt.Errorf("%.1f MB is over the %.1f MB limit", float64(resp.ContentLength)/(1<<20), float64(limit)/(1<<20))
+	}
+	if !keepName {
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+			name = sanitizeName(filepath.Base(params["filename"]))
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return "", 0, err
+	}
+	body := &progressReader{r: io.LimitReader(resp.Body, limit+1), fn: func(n int64) {
+		if resp.ContentLength > 0 {
+			progress(float64(n) * 100 / float64(resp.ContentLength))
+		}
+	}}
+	n, err := ioCopyClose(f, body)
+	if err == nil && n > limit {
+		err = fmt.Errorf("over the %.1f MB limit", float64(limit)/(1<<20))
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if left.Load() >= 0 {
+		left.Add(-n)
+	}
+	return name, n, nil
+}
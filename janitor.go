@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention is configured in the config file's retention section (keys
+// default, interval, uploads, ...) or, overriding it, the environment:
+//
+//	FRAMESPDF_RETENTION           default for every category (7d)
+//	FRAMESPDF_RETENTION_OUTPUTS   default for pdfs, audio, transcripts and
+//	                              renders
+//	FRAMESPDF_RETENTION_<TYPE>    override for uploads, frames, pdfs, audio,
+//	                              transcripts, renders or jobs
+//	FRAMESPDF_JANITOR_INTERVAL    how often the janitor runs (1h)
+//
+// Values are Go durations ("36h") or days ("14d"); "0" or "off" keeps
+// that category forever. Pinned items (see pins.go) are kept regardless.
+const defaultRetention = 7 * 24 * time.Hour
+
+// retentionKinds are the categories the janitor knows about.
+var retentionKinds = []string{"uploads", "frames", "pdfs", "audio", "transcripts", "renders", "jobs"}
+
+// outputKinds are the generated-file categories the "outputs" setting
+// covers.
+var outputKinds = []string{"pdfs", "audio", "transcripts", "renders"}
+
+type retentionPolicy struct {
+	Interval time.Duration
+	PerKind  map[string]time.Duration
+}
+
+// parseRetention parses a retention value; 0 means keep forever.
+func parseRetention(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "0", "off", "never":
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad retention: %s", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad retention: %s", s)
+	}
+	return d, nil
+}
+
+// loadRetention reads the retention policy from the config file and the
+// environment.
+func loadRetention() (retentionPolicy, error) {
+	p := retentionPolicy{Interval: time.Hour, PerKind: map[string]time.Duration{}}
+	// setting returns the env value, else the config file's, else "".
+	setting := func(env, key string) (string, string) {
+		if v := os.Getenv(env); v != "" {
+			return v, env
+		}
+		return retentionConfig[key], "retention." + key
+	}
+	def := defaultRetention
+	if v, src := setting("FRAMESPDF_RETENTION", "default"); v != "" {
+		d, err := parseRetention(v)
+		if err != nil {
+			return p, fmt.Errorf("%s: %w", src, err)
+		}
+		def = d
+	}
+	outputs := def
+	if v, src := setting("FRAMESPDF_RETENTION_OUTPUTS", "outputs"); v != "" {
+		d, err := parseRetention(v)
+		if err != nil {
+			return p, fmt.Errorf("%s: %w", src, err)
+		}
+		outputs = d
+	}
+	for _, k := range retentionKinds {
+		p.PerKind[k] = def
+		if slices.Contains(outputKinds, k) {
+			p.PerKind[k] = outputs
+		}
+		if v, src := setting("FRAMESPDF_RETENTION_"+strings.ToUpper(k), k); v != "" {
+			d, err := parseRetention(v)
+			if err != nil {
+				return p, fmt.Errorf("%s: %w", src, err)
+			}
+			p.PerKind[k] = d
+		}
+	}
+	for k := range retentionConfig {
+		if k != "default" && k != "interval" && k != "outputs" && !slices.Contains(retentionKinds, k) {
+			return p, fmt.Errorf("retention: unknown key %q", k)
+		}
+	}
+	if v, _ := setting("FRAMESPDF_JANITOR_INTERVAL", "interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return p, fmt.Errorf("FRAMESPDF_JANITOR_INTERVAL must be a duration of at least 1m")
+		}
+		p.Interval = d
+	}
+	return p, nil
+}
+
+// janitorPolicy is the policy the janitor sweeps with; scheduled retention
+// runs (see schedules.go) use it too.
+var janitorPolicy retentionPolicy
+
+// startJanitor runs a sweep right away and then every p.Interval.
+func startJanitor(p retentionPolicy) {
+	janitorPolicy = p
+	go func() {
+		for {
+			sweepExpired(p, time.Now())
+			time.Sleep(p.Interval)
+		}
+	}()
+}
+
+// sweepResult is what one category sweep reclaimed.
+type sweepResult struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (r *sweepResult) add(o sweepResult) {
+	r.Files += o.Files
+	r.Bytes += o.Bytes
+}
+
+// sweepExpired deletes everything older than its category's retention and
+// logs what was reclaimed per category.
+func sweepExpired(p retentionPolicy, now time.Time) map[string]sweepResult {
+	out := map[string]sweepResult{}
+	dirs := map[string]string{"frames": framesDir, "pdfs": pdfsDir, "audio": audioDir, "transcripts": transcriptsDir, "renders": rendersDir}
+	for _, kind := range retentionKinds {
+		ttl := p.PerKind[kind]
+		if ttl <= 0 {
+			continue
+		}
+		cutoff := now.Add(-ttl)
+		var r sweepResult
+		switch kind {
+		case "uploads":
+			r = expireUploads(cutoff)
+		case "jobs":
+			r.Files = expireJobs(cutoff)
+		default:
+			r = removeOlderThan(dirs[kind], cutoff)
+		}
+		if r.Files > 0 {
+			slog.Info("janitor removed expired items", "kind", kind, "files", r.Files, "bytes", r.Bytes)
+		}
+		out[kind] = r
+	}
+	if r := pruneAllFrameRuns(); r.Files > 0 {
+		slog.Info("janitor removed frames of earlier runs", "files", r.Files, "bytes", r.Bytes)
+	}
+	if r := pruneScratch(); r.Files > 0 {
+		slog.Info("janitor removed scratch space of finished jobs", "files", r.Files, "bytes", r.Bytes)
+	}
+	if r := pruneJobLogs(); r.Files > 0 {
+		slog.Info("janitor removed logs of forgotten jobs", "files", r.Files, "bytes", r.Bytes)
+	}
+	if r := pruneBlobs(now); r.Files > 0 {
+		slog.Info("janitor removed unreferenced blobs", "files", r.Files, "bytes", r.Bytes)
+	}
+	pruneOutputs()
+	pruneClaims(now)
+	pruneResults()
+	pruneProbes()
+	pruneSessions(now)
+	pruneShares(now)
+	prunePins(now)
+	return out
+}
+
+// removeOlderThan deletes files under dir last modified before cutoff,
+// except pinned ones, then any directories left empty. dir itself is kept.
+func removeOlderThan(dir string, cutoff time.Time) sweepResult {
+	var r sweepResult
+	now := time.Now()
+	var subdirs []string
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if d.IsDir() {
+			subdirs = append(subdirs, path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(cutoff) || pinnedPath(path, now) {
+			return nil
+		}
+		if os.Remove(path) == nil {
+			r.Files++
+			r.Bytes += info.Size()
+		}
+		return nil
+	})
+	// deepest first so parents become empty before we get to them
+	for i := len(subdirs) - 1; i >= 0; i-- {
+		_ = os.Remove(subdirs[i]) // fails unless empty
+	}
+	return r
+}
+
+// expireUploads forgets and deletes registered uploads older than cutoff,
+// unless pinned, plus upload directories nothing refers to anymore.
+func expireUploads(cutoff time.Time) sweepResult {
+	var r sweepResult
+	now := time.Now()
+	old := func(id, uploaded string) bool {
+		t, err := time.Parse(time.RFC3339, uploaded)
+		return err == nil && t.Before(cutoff) && !pinned(id, now)
+	}
+	type victim struct{ bucket, id string }
+	var victims []victim
+	mu.Lock()
+	known := map[string]bool{}
+	for id, v := range videos {
+		known[id] = true
+		if old(id, v.Uploaded) {
+			victims = append(victims, victim{bucketVideos, id})
+			delete(videos, id)
+		}
+	}
+	for id, im := range images {
+		known[id] = true
+		if old(id, im.Uploaded) {
+			victims = append(victims, victim{bucketImages, id})
+			delete(images, id)
+		}
+	}
+	for id, am := range audios {
+		known[id] = true
+		if old(id, am.Uploaded) {
+			victims = append(victims, victim{bucketAudios, id})
+			delete(audios, id)
+		}
+	}
+	mu.Unlock()
+	for _, v := range victims {
+		storeDelete(v.bucket, v.id)
+		r.add(removeTree(filepath.Join(uploadDir, v.id)))
+	}
+	r.add(removeOrphans(uploadDir, known, cutoff))
+	return r
+}
+
+// removeOrphans deletes the entries of dir whose name isn't in known and
+// that were last modified before cutoff.
+func removeOrphans(dir string, known map[string]bool, cutoff time.Time) sweepResult {
+	var r sweepResult
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if known[e.Name()] {
+			continue
+		}
+		if info, err := e.Info(); err == nil && info.ModTime().Before(cutoff) {
+			r.add(removeTree(filepath.Join(dir, e.Name())))
+		}
+	}
+	return r
+}
+
+// pruneFrameRuns removes the frames of earlier runs on video id: every
+// run directory except keep ("" for the newest) and those of jobs still
+// queued or running, plus frames from before runs had directories.
+func pruneFrameRuns(id, keep string) sweepResult {
+	var r sweepResult
+	dir := filepath.Join(framesDir, id)
+	entries, _ := os.ReadDir(dir)
+	if keep == "" {
+		var newest time.Time
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil && e.IsDir() && info.ModTime().After(newest) {
+				keep, newest = e.Name(), info.ModTime()
+			}
+		}
+	}
+	for _, e := range entries {
+		if e.Name() == keep || (e.IsDir() && jobActive(e.Name())) {
+			continue
+		}
+		r.add(removeTree(filepath.Join(dir, e.Name())))
+	}
+	return r
+}
+
+// pruneAllFrameRuns is pruneFrameRuns for every video with frames.
+func pruneAllFrameRuns() sweepResult {
+	var r sweepResult
+	entries, _ := os.ReadDir(framesDir)
+	for _, e := range entries {
+		if e.IsDir() {
+			r.add(pruneFrameRuns(e.Name(), ""))
+		}
+	}
+	return r
+}
+
+// removeTree deletes path and reports how much it held.
+func removeTree(path string) sweepResult {
+	var r sweepResult
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				r.Files++
+				r.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	if err := os.RemoveAll(path); err != nil {
+		slog.Warn("janitor", "error", err.Error())
+	}
+	return r
+}
+
+// expireJobs drops finished jobs older than cutoff and returns how many.
+func expireJobs(cutoff time.Time) int {
+	var ids []string
+	jobsMu.Lock()
+	for id, j := range jobs {
+		if j.Status != jobDone && j.Status != jobFailed {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, j.Finished); err == nil && t.Before(cutoff) {
+			ids = append(ids, id)
+			delete(jobs, id)
+		}
+	}
+	jobsMu.Unlock()
+	for _, id := range ids {
+		storeDelete(bucketJobs, id)
+		removeJobLog(id)
+	}
+	return len(ids)
+}
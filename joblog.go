@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job logs: everything the tools run for a job print to stderr is appended,
+// as it is printed, to logsDir/<job ID>.log, each run headed by its command
+// line and closed by how it ended. GET /jobs/:id/log returns the log,
+// ?tail=N its last N lines, and ?follow=1 keeps the response open and
+// sends what is appended until the job is done. A worker writes the log of
+// a job it runs into the shared work directory, so the web node serves it
+// the same way. Logs go when their job expires.
+
+// maxJobLogBytes caps a job's log; past it the log is cut off with a note.
+const maxJobLogBytes = 4 << 20
+
+// jobLogPoll is how often a followed log is checked for more.
+const jobLogPoll = 500 * time.Millisecond
+
+// jobLogMu serializes appends so that concurrent runs' chunks don't
+// interleave mid-write.
+var jobLogMu sync.Mutex
+
+func jobLogPath(id string) string { return filepath.Join(logsDir, id+".log") }
+
+// appendJobLog adds p to the logs of jobs.
+func appendJobLog(jobs []*Job, p []byte) {
+	jobLogMu.Lock()
+	defer jobLogMu.Unlock()
+	for _, j := range jobs {
+		path := jobLogPath(j.ID)
+		var size int64
+		if st, err := os.Stat(path); err == nil {
+			size = st.Size()
+		}
+		if size >= maxJobLogBytes {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			continue
+		}
+		if size+int64(len(p)) > maxJobLogBytes {
+			_, _ = f.Write(append(p[:maxJobLogBytes-size:maxJobLogBytes-size], "\n[log cut off]\n"...))
+		} else {
+			_, _ = f.Write(p)
+		}
+		f.Close()
+	}
+}
+
+// jobLogWriter sends what it is given to the logs of jobs.
+type jobLogWriter []*Job
+
+func (w jobLogWriter) Write(p []byte) (int, error) {
+	appendJobLog(w, p)
+	return len(p), nil
+}
+
+// logToolStart heads p's output in its jobs' logs with its command line.
+func logToolStart(p *toolProc) {
+	if len(p.jobs) == 0 {
+		return
+	}
+	appendJobLog(p.jobs, fmt.Appendf(nil, "\n[%s] $ %s %s\n", p.started.Format(time.RFC3339), filepath.Base(p.Path), strings.Join(p.Args[1:], " ")))
+}
+
+// logToolEnd closes p's output in its jobs' logs with how the run ended.
+func logToolEnd(p *toolProc, run ToolRun) {
+	if len(p.jobs) == 0 {
+		return
+	}
+	if run.Error != "" {
+		appendJobLog(p.jobs, fmt.Appendf(nil, "\n[%s failed after %d ms: %s]\n", run.Tool, run.DurationMS, run.Error))
+		return
+	}
+	appendJobLog(p.jobs, fmt.Appendf(nil, "\n[%s finished in %d ms]\n", run.Tool, run.DurationMS))
+}
+
+// removeJobLog deletes the log of job id.
+func removeJobLog(id string) { _ = os.Remove(jobLogPath(id)) }
+
+// handleJobLog serves GET /jobs/:id/log as plain text.
+func handleJobLog(c *gin.Context) {
+	id := c.Param("id")
+	jobsMu.Lock()
+	j := jobs[id]
+	jobsMu.Unlock()
+	if j == nil || !canAccess(c, j.Owner) {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown job id: %s", id)
+		return
+	}
+	tail := 0
+	if s := c.Query("tail"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			fail(c, http.StatusBadRequest, "tail must be a positive number of lines")
+			return
+		}
+		tail = n
+	}
+	data, err := os.ReadFile(jobLogPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fail(c, http.StatusInternalServerError, "read log: %v", err)
+		return
+	}
+	offset := int64(len(data))
+	if tail > 0 {
+		data = lastLines(data, tail)
+	}
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	follow := c.Query("follow") == "1" || c.Query("follow") == "true"
+	if !follow || !jobActive(id) {
+		c.Status(http.StatusOK)
+		_, _ = c.Writer.Write(data)
+		return
+	}
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	_, _ = c.Writer.Write(data)
+	c.Writer.Flush()
+	t := time.NewTicker(jobLogPoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-t.C:
+		}
+		// read what was appended before checking the job, so the last
+		// lines of a job that just ended aren't missed
+		active := jobActive(id)
+		n, err := copyFrom(c.Writer, jobLogPath(id), offset)
+		offset += n
+		if err != nil || !active {
+			return
+		}
+		if n > 0 {
+			c.Writer.Flush()
+		}
+	}
+}
+
+// copyFrom writes what follows offset in file to w.
+func copyFrom(w io.Writer, file string, offset int64) (int64, error) {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, f)
+}
+
+// lastLines returns the last n lines of data.
+func lastLines(data []byte, n int) []byte {
+	var lines [][]byte
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, maxJobLogBytes)
+	for sc.Scan() {
+		lines = append(lines, append([]byte{}, sc.Bytes()...))
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return append(bytes.Join(lines, []byte("\n")), '\n')
+}
+
+// pruneJobLogs removes the logs of jobs the server no longer knows.
+func pruneJobLogs() sweepResult {
+	var r sweepResult
+	entries, _ := os.ReadDir(logsDir)
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".log")
+		if !ok {
+			continue
+		}
+		jobsMu.Lock()
+		known := jobs[id] != nil
+		jobsMu.Unlock()
+		if !known {
+			r.add(removeTree(filepath.Join(logsDir, e.Name())))
+		}
+	}
+	return r
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job status values.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// JobItem tracks one source file inside a job.
+type JobItem struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+}
+
+// Job is a processing request whose progress can be polled via GET /jobs/:id.
+type Job struct {
+	ID       string     `json:"id"`
+	Type     string     `json:"type"`
+	Status   string     `json:"status"`
+	Progress float64    `json:"progress"`
+	Items    []*JobItem `json:"items"`
+	Error    string     `json:"error,omitempty"`
+	Result   any        `json:"result,omitempty"`
+	Created  string     `json:"created_at"`
+	Started  string     `json:"started_at,omitempty"`
+	Finished string     `json:"finished_at,omitempty"`
+	// Owner is the ID of the user that submitted the job.
+	Owner    string `json:"owner,omitempty"`
+	Priority string `json:"priority"`
+	// Attempts lists every run of the job; more than one means it was
+	// retried after a transient failure.
+	Attempts []JobAttempt `json:"attempts,omitempty"`
+	// Params are the request settings the job was started with.
+	Params any `json:"params,omitempty"`
+	// RequestID is the X-Request-ID of the request that queued the job.
+	RequestID string `json:"request_id,omitempty"`
+	// Tools lists the latest tool runs made for the job, with their stderr.
+	Tools []ToolRun `json:"tools,omitempty"`
+	// LogURL serves everything the job's tool runs printed; see joblog.go.
+	LogURL string `json:"log_url,omitempty"`
+
+	// sources are upload IDs the job works on besides its items' IDs.
+	sources []string
+	// parent is the span of the request that queued the job; span is the
+	// job's own from start to finish (nil with tracing off).
+	parent spanContext
+	span   *span
+	// counted is set from start to finish, while the job is in activeJobs and
+	// holds (or waits for) a job slot.
+	counted bool
+	// procs are the tools running for the job; timedOut is set once it has
+	// run out of time (see timeouts.go).
+	procs    map[*toolProc]bool
+	timedOut *timeoutError
+}
+
+// JobAttempt is one run of a job.
+type JobAttempt struct {
+	N        int    `json:"n"`
+	Started  string `json:"started_at"`
+	Finished string `json:"finished_at"`
+	Error    string `json:"error,omitempty"`
+	// Transient is set when the error looked retryable.
+	Transient bool `json:"transient,omitempty"`
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*Job{}
+)
+
+// Retry policy for transient job failures (retries section of the config
+// file, FRAMESPDF_JOB_ATTEMPTS, FRAMESPDF_JOB_RETRY_BACKOFF): a job runs up
+// to jobMaxAttempts times, waiting jobRetryBackoff, doubling up to
+// maxRetryBackoff, between attempts.
+var (
+	jobMaxAttempts  = 3
+	jobRetryBackoff = 10 * time.Second
+)
+
+const maxRetryBackoff = 5 * time.Minute
+
+// transientMarkers are error texts of failures worth retrying: tools killed
+// by the OOM killer, full or flaky disks, and network hiccups of remote
+// backends. Errors are mostly flattened to text by the time they reach the
+// job, so this matches on the message.
+var transientMarkers = []string{
+	"signal: killed",
+	"cannot allocate memory",
+	"out of memory",
+	"no space left on device",
+	"input/output error",
+	"resource temporarily unavailable",
+	"too many open files",
+	"connection reset",
+	"connection refused",
+	"i/o timeout",
+	"tls handshake timeout",
+	"status 429",
+	"status 502",
+	"status 503",
+	"status 504",
+	// a worker that died or lost its connection mid-task
+	"stopped responding",
+}
+
+// isTransient reports whether err is worth another attempt. Nothing is
+// retried once shutdown has cancelled the tools.
+func isTransient(err error) bool {
+	if err == nil || workCtx.Err() != nil {
+		return false
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) && (errno == syscall.ENOSPC || errno == syscall.EIO || errno == syscall.ENOMEM || errno == syscall.EAGAIN) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range transientMarkers {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// runJob starts job, runs work and finishes the job with its outcome.
+// Transient failures are retried with backoff; every attempt is recorded.
+// The job's scratch space is removed after each attempt.
+func runJob(job *Job, work func() (gin.H, error)) (gin.H, error) {
+	if err := job.start(); err != nil {
+		job.finish(nil, err)
+		return nil, err
+	}
+	defer job.removeScratch()
+	defer job.watch()()
+	backoff := jobRetryBackoff
+	for n := 1; ; n++ {
+		started := time.Now()
+		resp, err := work()
+		if terr := job.timeout(); terr != nil {
+			// whatever the killed tools reported, the cause is the timeout
+			resp, err = nil, terr
+		}
+		job.removeScratch()
+		if err == nil {
+			err = publishOutputs(resp)
+		}
+		if err == nil && len(deliveryTargets) > 0 {
+			deliverOutputs(job, resp)
+		}
+		if err == nil && len(resultURLs(resp)) > 1 {
+			resp["bundle_url"] = bundleURL(job.ID)
+		}
+		transient := isTransient(err)
+		job.addAttempt(JobAttempt{N: n, Started: started.Format(time.RFC3339), Finished: time.Now().Format(time.RFC3339), Error: errString(err), Transient: transient})
+		if err == nil {
+			job.finish(resp, nil)
+			return resp, nil
+		}
+		if !transient || n >= jobMaxAttempts {
+			job.finish(nil, err)
+			return nil, err
+		}
+		job.logger().Warn("job attempt failed, retrying", "attempt", n, "error", err.Error(), "retry_in", backoff.String())
+		select {
+		case <-time.After(backoff):
+		case <-workCtx.Done():
+			job.finish(nil, err)
+			return nil, err
+		}
+		if terr := job.timeout(); terr != nil {
+			job.finish(nil, terr)
+			return nil, terr
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+		job.resetItems()
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// errInterrupted marks jobs that were in flight when the server stopped.
+var errInterrupted = errors.New("interrupted by server restart")
+
+// newJob registers a queued job of owner with one item per (id, name) pair.
+// requestID is the request that queued it, "" for background work.
+func newJob(owner, requestID, typ, prio string, ids, names []string) *Job {
+	j := &Job{ID: randID(8), Type: typ, Status: jobQueued, Created: time.Now().Format(time.RFC3339), Owner: owner, Priority: prio, RequestID: requestID}
+	j.LogURL = "/jobs/" + j.ID + "/log"
+	for i := range ids {
+		j.Items = append(j.Items, &JobItem{ID: ids[i], Name: names[i], Status: jobQueued})
+	}
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+	putJob(j)
+	j.parent = spanByRequest(requestID)
+	j.logger().Info("job queued", "priority", prio)
+	return j
+}
+
+// logger returns a logger tagged with the job's IDs.
+func (j *Job) logger() *slog.Logger {
+	jobsMu.Lock()
+	ids := j.sourceIDs()
+	jobsMu.Unlock()
+	l := slog.With("job_id", j.ID, "job_type", j.Type)
+	if j.RequestID != "" {
+		l = l.With("request_id", j.RequestID)
+	}
+	if len(ids) > 0 {
+		l = l.With("source_ids", ids)
+	}
+	return l
+}
+
+// sourceIDs returns the upload IDs the job works on. jobsMu must be held.
+func (j *Job) sourceIDs() []string {
+	var ids []string
+	for _, it := range j.Items {
+		if it.ID != "" {
+			ids = append(ids, it.ID)
+		}
+	}
+	return append(ids, j.sources...)
+}
+
+// addSources adds upload IDs the job works on that aren't item IDs.
+func (j *Job) addSources(ids ...string) {
+	jobsMu.Lock()
+	j.sources = append(j.sources, ids...)
+	j.span.bind(ids...)
+	jobsMu.Unlock()
+}
+
+// setItemID sets the ID of item i once its source is known.
+func (j *Job) setItemID(i int, id string) {
+	jobsMu.Lock()
+	if i >= 0 && i < len(j.Items) {
+		j.Items[i].ID = id
+		j.span.bind(id)
+	}
+	jobsMu.Unlock()
+}
+
+// addToolRun records a tool run, keeping the latest maxJobTools.
+func (j *Job) addToolRun(r ToolRun) {
+	jobsMu.Lock()
+	j.Tools = append(j.Tools, r)
+	if over := len(j.Tools) - maxJobTools; over > 0 {
+		j.Tools = append(j.Tools[:0], j.Tools[over:]...)
+	}
+	jobsMu.Unlock()
+}
+
+// runningJobsFor returns the running jobs working on any of the upload ids.
+func runningJobsFor(ids []string) []*Job {
+	if len(ids) == 0 {
+		return nil
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	var out []*Job
+	for _, j := range jobs {
+		if j.Status != jobRunning {
+			continue
+		}
+		for _, id := range j.sourceIDs() {
+			if slices.Contains(ids, id) {
+				out = append(out, j)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// start waits for a job slot (see acquireJobSlot) and marks the job running.
+// It refuses with errShuttingDown once shutdown has started.
+func (j *Job) start() error {
+	jobsMu.Lock()
+	if j.counted {
+		jobsMu.Unlock()
+		return nil
+	}
+	if !beginWork() {
+		jobsMu.Unlock()
+		return errShuttingDown
+	}
+	j.counted = true
+	jobsMu.Unlock()
+	if !j.remote() {
+		// remote jobs are limited by the workers instead
+		acquireJobSlot(j.ID, j.Priority)
+	}
+	jobsMu.Lock()
+	j.Status = jobRunning
+	j.Started = time.Now().Format(time.RFC3339)
+	j.span = startSpan(j.parent, "job "+j.Type, spanInternal, j.sourceIDs()...)
+	jobsMu.Unlock()
+	j.span.set("framespdf.job_id", j.ID)
+	j.span.set("framespdf.priority", j.Priority)
+	putJob(j)
+	j.logger().Info("job started")
+	return nil
+}
+
+func (j *Job) addAttempt(a JobAttempt) {
+	jobsMu.Lock()
+	j.Attempts = append(j.Attempts, a)
+	jobsMu.Unlock()
+	putJob(j)
+}
+
+// resetItems clears item progress before another attempt.
+func (j *Job) resetItems() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, it := range j.Items {
+		it.Status = jobQueued
+		it.Progress = 0
+	}
+	j.Progress = 0
+}
+
+// setItem updates the status and progress (0..100) of item i and recomputes
+// the overall progress.
+func (j *Job) setItem(i int, status string, pct float64) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if i < 0 || i >= len(j.Items) {
+		return
+	}
+	it := j.Items[i]
+	if status != "" {
+		it.Status = status
+	}
+	if pct > 100 {
+		pct = 100
+	}
+	if pct > it.Progress {
+		it.Progress = pct
+	}
+	total := 0.0
+	for _, it := range j.Items {
+		total += it.Progress
+	}
+	if len(j.Items) > 0 {
+		j.Progress = total / float64(len(j.Items))
+	}
+}
+
+// progressFunc returns a callback reporting progress for item i.
+func (j *Job) progressFunc(i int) func(float64) {
+	return func(pct float64) { j.setItem(i, jobRunning, pct) }
+}
+
+// finish records the outcome and persists the job; it is flushed to the
+// store before the job stops counting as active for shutdown.
+func (j *Job) finish(result any, err error) {
+	jobsMu.Lock()
+	counted := j.counted
+	j.counted = false
+	attempts := len(j.Attempts)
+	j.Finished = time.Now().Format(time.RFC3339)
+	if err != nil {
+		j.Status = jobFailed
+		j.Error = err.Error()
+		for _, it := range j.Items {
+			if it.Status != jobDone {
+				it.Status = jobFailed
+			}
+		}
+	} else {
+		j.Status = jobDone
+		j.Progress = 100
+		j.Result = result
+	}
+	jobsMu.Unlock()
+	putJob(j)
+	if counted {
+		if !j.remote() {
+			releaseJobSlot(j.Priority)
+		}
+		activeJobs.Done()
+	}
+	j.span.set("framespdf.attempts", attempts)
+	j.span.end(err)
+	if err != nil {
+		j.logger().Error("job failed", "error", err.Error())
+	} else {
+		j.logger().Info("job done")
+	}
+	snap := j.snapshot()
+	recordAudit(snap)
+	notifyJob(snap)
+}
+
+// snapshot returns a copy that is safe to serialize without holding jobsMu.
+func (j *Job) snapshot() Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	cp := *j
+	cp.Attempts = append([]JobAttempt(nil), j.Attempts...)
+	cp.Tools = append([]ToolRun(nil), j.Tools...)
+	cp.Items = make([]*JobItem, len(j.Items))
+	for i, it := range j.Items {
+		v := *it
+		cp.Items[i] = &v
+	}
+	return cp
+}
+
+// jobActive reports whether job id is queued or running.
+func jobActive(id string) bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j := jobs[id]
+	return j != nil && (j.Status == jobQueued || j.Status == jobRunning)
+}
+
+func handleGetJob(c *gin.Context) {
+	jobsMu.Lock()
+	j := jobs[c.Param("id")]
+	jobsMu.Unlock()
+	if j == nil || !canAccess(c, j.Owner) {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown job id: %s", c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, j.snapshot())
+}
+
+// jobSummary is a job as GET /jobs lists it.
+type jobSummary struct {
+	ID       string  `json:"id"`
+	Type     string  `json:"type"`
+	Status   string  `json:"status"`
+	Priority string  `json:"priority"`
+	Progress float64 `json:"progress"`
+	// Sources are the uploads the job works on.
+	Sources []jobSource `json:"sources"`
+	Owner   string      `json:"owner,omitempty"`
+	// Submitter is the owner's username, when they have an account.
+	Submitter string `json:"submitter,omitempty"`
+	Created   string `json:"created_at"`
+	Started   string `json:"started_at,omitempty"`
+	// QueuePosition is the job's place among the jobs waiting for a slot,
+	// 1 being the next to start; 0 when it isn't waiting for one.
+	QueuePosition int `json:"queue_position,omitempty"`
+	// Remote jobs wait for a worker instead of a slot here.
+	Remote bool `json:"remote,omitempty"`
+}
+
+type jobSource struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// handleListJobs serves GET /jobs: the queued and running jobs the caller
+// can see, running ones first, then the queued ones in the order they will
+// start, with the server-wide counts so a caller can tell how busy it is.
+func handleListJobs(c *gin.Context) {
+	status, typ := c.Query("status"), c.Query("type")
+	if status != "" && status != jobQueued && status != jobRunning {
+		fail(c, http.StatusBadRequest, "status must be queued or running")
+		return
+	}
+	pos := queuePositions()
+	jobsMu.Lock()
+	out := []jobSummary{}
+	for _, j := range jobs {
+		if (j.Status != jobQueued && j.Status != jobRunning) || !canAccess(c, j.Owner) {
+			continue
+		}
+		if (status != "" && j.Status != status) || (typ != "" && j.Type != typ) {
+			continue
+		}
+		s := jobSummary{ID: j.ID, Type: j.Type, Status: j.Status, Priority: j.Priority, Progress: j.Progress, Sources: []jobSource{}, Owner: j.Owner, Created: j.Created, Started: j.Started, QueuePosition: pos[j.ID], Remote: j.remote()}
+		seen := map[string]bool{}
+		for _, it := range j.Items {
+			if it.ID != "" && !seen[it.ID] {
+				seen[it.ID] = true
+				s.Sources = append(s.Sources, jobSource{ID: it.ID, Name: it.Name})
+			}
+		}
+		out = append(out, s)
+	}
+	jobsMu.Unlock()
+	// items may be named after what they do (pipeline steps); prefer the
+	// upload's name
+	mu.Lock()
+	for _, s := range out {
+		for k, src := range s.Sources {
+			if v := videos[src.ID]; v != nil {
+				s.Sources[k].Name = v.Name
+			} else if a := audios[src.ID]; a != nil {
+				s.Sources[k].Name = a.Name
+			} else if im := images[src.ID]; im != nil {
+				s.Sources[k].Name = im.Name
+			}
+		}
+	}
+	mu.Unlock()
+	usersMu.Lock()
+	for i, s := range out {
+		if u := users[s.Owner]; u != nil {
+			out[i].Submitter = u.Username
+		}
+	}
+	usersMu.Unlock()
+	// jobs queued but not in line (between attempts) go last
+	line := func(s jobSummary) int {
+		if s.QueuePosition == 0 {
+			return math.MaxInt
+		}
+		return s.QueuePosition
+	}
+	slices.SortFunc(out, func(a, b jobSummary) int {
+		// "running" sorts after "queued", so b before a puts it first
+		return cmp.Or(strings.Compare(b.Status, a.Status), cmp.Compare(line(a), line(b)), strings.Compare(a.Started, b.Started), strings.Compare(a.Created, b.Created))
+	})
+	running, waiting := jobSlotStats()
+	c.JSON(http.StatusOK, gin.H{"jobs": out, "total": len(out), "running": running, "waiting": waiting, "limit": maxJobs})
+}
+
+// runFFmpeg runs ffmpeg with args, reporting progress as a percentage of
+// totalS seconds of output via -progress. stderr, if set, also receives
+// ffmpeg's log.
+func runFFmpeg(args []string, totalS float64, onProgress func(float64), stderr io.Writer) error {
+	if onProgress == nil || totalS <= 0 {
+		cmd := toolCmd(ffmpegBin, args...)
+		cmd.Stderr = stderr
+		return cmd.Run()
+	}
+	cmd := toolCmd(ffmpegBin, append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "out_time_us", "out_time_ms": // both are microseconds
+			if us, err := strconv.ParseInt(v, 10, 64); err == nil && us > 0 {
+				onProgress(float64(us) / 1e6 / totalS * 100)
+			}
+		case "progress":
+			if v == "end" {
+				onProgress(100)
+			}
+		}
+	}
+	return cmd.Wait()
+}
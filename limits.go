@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// toolLimits caps how many processes of each tool run at once; requests
+// beyond that wait for a slot. 0 means unlimited. Set with the config file's
+// limits section, FRAMESPDF_MAX_<TOOL> or -max-<tool>.
+var toolLimits = map[string]int{
+	// ffmpeg and ImageMagick are multi-threaded already
+	"ffmpeg":  max(1, runtime.NumCPU()/2),
+	"ffprobe": runtime.NumCPU(),
+	"magick":  max(1, runtime.NumCPU()/2),
+}
+
+// toolSlots is the semaphore of one limited tool.
+type toolSlots struct {
+	sem     chan struct{}
+	waiting atomic.Int64
+}
+
+// allSlots builds the semaphores on first use, after the config is loaded.
+var allSlots = sync.OnceValue(func() map[string]*toolSlots {
+	m := map[string]*toolSlots{}
+	for tool, n := range toolLimits {
+		if n > 0 {
+			m[tool] = &toolSlots{sem: make(chan struct{}, n)}
+		}
+	}
+	return m
+})
+
+// slotsFor returns the semaphore for the binary name, nil if unlimited.
+func slotsFor(name string) *toolSlots {
+	switch name {
+	case ffmpegBin:
+		return allSlots()["ffmpeg"]
+	case ffprobeBin:
+		return allSlots()["ffprobe"]
+	case magickBin:
+		return allSlots()["magick"]
+	}
+	return nil
+}
+
+// toolProc is an exec.Cmd that holds a slot of its tool's semaphore from
+// Start until Wait returns. It also keeps the tail of the tool's stderr
+// (besides any Stderr the caller set), copies it to the logs of the jobs
+// it works for and logs the run; see logToolRun and joblog.go.
+type toolProc struct {
+	*exec.Cmd
+	slots   *toolSlots
+	stderr  tailBuffer
+	started time.Time
+	// jobs are the running jobs the run works for.
+	jobs []*Job
+}
+
+// capture routes stderr through p.stderr and the jobs' logs. A caller's
+// *os.File (a pipe it reads itself) is left alone.
+func (p *toolProc) capture() error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	switch w := p.Stderr.(type) {
+	case nil:
+		p.Stderr = io.MultiWriter(&p.stderr, jobLogWriter(p.jobs))
+	case *os.File:
+	default:
+		p.Stderr = io.MultiWriter(w, &p.stderr, jobLogWriter(p.jobs))
+	}
+	return nil
+}
+
+// begin notes the start of the run and the jobs it works for; it fails
+// when one of them has run out of time (see timeouts.go).
+func (p *toolProc) begin() error {
+	p.started = time.Now()
+	p.jobs = toolJobs(p.Args[1:])
+	if err := trackTool(p); err != nil {
+		return err
+	}
+	logToolStart(p)
+	return nil
+}
+
+func (p *toolProc) acquire() error {
+	if p.slots == nil {
+		return nil
+	}
+	p.slots.waiting.Add(1)
+	defer p.slots.waiting.Add(-1)
+	select {
+	case p.slots.sem <- struct{}{}:
+		return nil
+	case <-workCtx.Done():
+		return workCtx.Err()
+	}
+}
+
+func (p *toolProc) release() {
+	if p.slots != nil {
+		<-p.slots.sem
+	}
+}
+
+func (p *toolProc) Start() error {
+	if err := p.acquire(); err != nil {
+		return err
+	}
+	if err := p.capture(); err != nil {
+		p.release()
+		return err
+	}
+	if err := p.Cmd.Start(); err != nil {
+		p.release()
+		logToolRun(p, p.started, err, "")
+		return p.failed(err, "")
+	}
+	if trackTool(p) != nil {
+		// a job ran out of time while the tool was starting
+		_ = p.Process.Kill()
+	}
+	return nil
+}
+
+func (p *toolProc) Wait() error {
+	defer p.release()
+	err := p.Cmd.Wait()
+	tail := p.stderr.String()
+	logToolRun(p, p.started, err, tail)
+	return p.failed(err, tail)
+}
+
+func (p *toolProc) Run() error {
+	if err := p.Start(); err != nil {
+		return err
+	}
+	return p.Wait()
+}
+
+func (p *toolProc) Output() ([]byte, error) {
+	if err := p.acquire(); err != nil {
+		return nil, err
+	}
+	defer p.release()
+	if err := p.capture(); err != nil {
+		return nil, err
+	}
+	out, err := p.Cmd.Output()
+	tail := p.stderr.String()
+	if ee, ok := err.(*exec.ExitError); ok {
+		ee.Stderr = []byte(tail)
+	}
+	logToolRun(p, p.started, err, tail)
+	return out, p.failed(err, tail)
+}
+
+func (p *toolProc) CombinedOutput() ([]byte, error) {
+	if err := p.acquire(); err != nil {
+		return nil, err
+	}
+	defer p.release()
+	if err := p.begin(); err != nil {
+		return nil, err
+	}
+	out, err := p.Cmd.CombinedOutput()
+	appendJobLog(p.jobs, out)
+	tail := out
+	if len(tail) > toolTailBytes {
+		tail = tail[len(tail)-toolTailBytes:]
+	}
+	stderr := strings.TrimSpace(strings.ToValidUTF8(string(tail), ""))
+	logToolRun(p, p.started, err, stderr)
+	return out, p.failed(err, stderr)
+}
+
+// failed wraps a run's error in a toolError carrying its stderr.
+func (p *toolProc) failed(err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	return &toolError{Tool: filepath.Base(p.Path), Stderr: stderr, err: err}
+}
+
+// handleAdminTools reports the limit, running and waiting processes per tool
+// and the job slots.
+func handleAdminTools(c *gin.Context) {
+	out := gin.H{}
+	for tool, n := range toolLimits {
+		st := gin.H{"limit": n, "running": 0, "waiting": 0}
+		if s := allSlots()[tool]; s != nil {
+			st["running"] = len(s.sem)
+			st["waiting"] = s.waiting.Load()
+		}
+		out[tool] = st
+	}
+	running, waiting := jobSlotStats()
+	c.JSON(http.StatusOK, gin.H{"tools": out, "jobs": gin.H{"limit": maxJobs, "bulk_limit": bulkCap(), "running": running, "waiting": waiting}, "load": currentLoad()})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pdfItem is a generated PDF as listed by GET /pdfs.
+type pdfItem struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"size_bytes"`
+	Created   string `json:"created_at"`
+	URL       string `json:"url"`
+}
+
+// listQuery is the pagination/sort/filter query shared by the listing
+// endpoints: page, limit, sort (name|size|date), order (asc|desc), q (name
+// substring), from/to (RFC3339 or YYYY-MM-DD upload date), min_duration and
+// tag (repeatable; items must carry every tag).
+type listQuery struct {
+	Page, Limit  int
+	Sort         string
+	Desc         bool
+	Q            string
+	From, To     time.Time
+	MinDurationS float64
+	Tags         []string
+}
+
+// listKey is what a listing can be sorted and filtered on.
+type listKey struct {
+	Name      string
+	SizeBytes int64
+	Date      string
+	// DurationS is negative for items without a duration (images, PDFs).
+	DurationS float64
+	Tags      []string
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// defaultListQuery is the first page, newest first, unfiltered.
+func defaultListQuery() listQuery {
+	return listQuery{Page: 1, Limit: defaultListLimit, Sort: "date", Desc: true}
+}
+
+func parseListQuery(c *gin.Context) (listQuery, error) {
+	q := defaultListQuery()
+	q.Q = strings.ToLower(strings.TrimSpace(c.Query("q")))
+	var err error
+	if v := c.Query("page"); v != "" {
+		if q.Page, err = strconv.Atoi(v); err != nil || q.Page < 1 {
+			return q, fmt.Errorf("bad page: %s", v)
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+	switch v := c.DefaultQuery("sort", "date"); v {
+	case "name", "size", "date":
+		q.Sort = v
+		// names read naturally A→Z; sizes and dates newest/largest first
+		q.Desc = v != "name"
+	default:
+		return q, fmt.Errorf("sort must be name, size or date")
+	}
+	switch c.Query("order") {
+	case "":
+	case "asc":
+		q.Desc = false
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("order must be asc or desc")
+	}
+	if q.From, err = parseListDate(c.Query("from"), false); err != nil {
+		return q, err
+	}
+	if q.To, err = parseListDate(c.Query("to"), true); err != nil {
+		return q, err
+	}
+	if v := c.Query("min_duration"); v != "" {
+		if q.MinDurationS, err = strconv.ParseFloat(v, 64); err != nil || q.MinDurationS < 0 {
+			return q, fmt.Errorf("bad min_duration: %s", v)
+		}
+	}
+	q.Tags = c.QueryArray("tag")
+	return q, nil
+}
+
+// parseListDate accepts RFC3339 or a bare date; a bare `to` date includes the
+// whole day.
+func parseListDate(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad date: %s (use RFC3339 or YYYY-MM-DD)", v)
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// applyListQuery filters, sorts and pages items. It returns the page and the
+// number of items that matched the filters.
+func applyListQuery[T any](items []T, q listQuery, key func(T) listKey) ([]T, int) {
+	out := items[:0]
+	for _, it := range items {
+		k := key(it)
+		if q.Q != "" && !strings.Contains(strings.ToLower(k.Name), q.Q) {
+			continue
+		}
+		if !q.From.IsZero() || !q.To.IsZero() {
+			t, err := time.Parse(time.RFC3339, k.Date)
+			if err != nil || (!q.From.IsZero() && t.Before(q.From)) || (!q.To.IsZero() && t.After(q.To)) {
+				continue
+			}
+		}
+		if q.MinDurationS > 0 && k.DurationS < q.MinDurationS {
+			continue
+		}
+		if len(q.Tags) > 0 && !hasAllTags(k.Tags, q.Tags) {
+			continue
+		}
+		out = append(out, it)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := key(out[i]), key(out[j])
+		var d int
+		switch q.Sort {
+		case "name":
+			d = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		case "size":
+			d = cmp.Compare(a.SizeBytes, b.SizeBytes)
+		default:
+			d = strings.Compare(a.Date, b.Date)
+		}
+		if q.Desc {
+			return d > 0
+		}
+		return d < 0
+	})
+	total := len(out)
+	start := min((q.Page-1)*q.Limit, total)
+	end := min(start+q.Limit, total)
+	return out[start:end], total
+}
+
+// listResponse wraps a page of items under key with the paging info.
+func listResponse(key string, items any, total int, q listQuery) gin.H {
+	return gin.H{key: items, "total": total, "page": q.Page, "limit": q.Limit}
+}
+
+func handleListVideos(c *gin.Context) {
+	q, err := parseListQuery(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	page, total := listVideos(c, q)
+	c.JSON(http.StatusOK, listResponse("videos", page, total, q))
+}
+
+// listVideos is the page of q among the videos c may see, and their total.
+// The page holds copies, taken under mu, so it can be sorted and sent
+// while the records change.
+func listVideos(c *gin.Context, q listQuery) ([]*VideoMeta, int) {
+	mu.Lock()
+	out := make([]*VideoMeta, 0, len(videos))
+	for _, v := range videos {
+		if canAccess(c, v.Owner) {
+			cp := *v
+			out = append(out, &cp)
+		}
+	}
+	mu.Unlock()
+	return applyListQuery(out, q, func(v *VideoMeta) listKey {
+		return listKey{Name: v.Name, SizeBytes: v.SizeBytes, Date: v.Uploaded, DurationS: v.DurationS, Tags: v.Tags}
+	})
+}
+
+func handleListImages(c *gin.Context) {
+	q, err := parseListQuery(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	page, total := listImages(c, q)
+	c.JSON(http.StatusOK, listResponse("images", page, total, q))
+}
+
+// listImages is the page of q among the images c may see, and their total.
+func listImages(c *gin.Context, q listQuery) ([]*ImgMeta, int) {
+	mu.Lock()
+	out := make([]*ImgMeta, 0, len(images))
+	for _, im := range images {
+		if canAccess(c, im.Owner) {
+			cp := *im
+			out = append(out, &cp)
+		}
+	}
+	mu.Unlock()
+	return applyListQuery(out, q, func(im *ImgMeta) listKey {
+		return listKey{Name: im.Name, SizeBytes: im.SizeBytes, Date: im.Uploaded, DurationS: -1, Tags: im.Tags}
+	})
+}
+
+func handleListAudios(c *gin.Context) {
+	q, err := parseListQuery(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	page, total := listAudios(c, q)
+	c.JSON(http.StatusOK, listResponse("audios", page, total, q))
+}
+
+// listAudios is the page of q among the audios c may see, and their total.
+func listAudios(c *gin.Context, q listQuery) ([]*AudioMeta, int) {
+	mu.Lock()
+	out := make([]*AudioMeta, 0, len(audios))
+	for _, am := range audios {
+		if canAccess(c, am.Owner) {
+			cp := *am
+			out = append(out, &cp)
+		}
+	}
+	mu.Unlock()
+	return applyListQuery(out, q, func(am *AudioMeta) listKey {
+		return listKey{Name: am.Name, SizeBytes: am.SizeBytes, Date: am.Uploaded, DurationS: am.DurationS, Tags: am.Tags}
+	})
+}
+
+// handleListPDFs lists the files in pdfsDir; PDFs aren't tracked in the
+// store, the directory is the source of truth (filtered by outputOwners with
+// accounts on).
+func handleListPDFs(c *gin.Context) {
+	q, err := parseListQuery(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	entries, err := os.ReadDir(pdfsDir)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "read pdfs: %v", err)
+		return
+	}
+	out := make([]pdfItem, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".pdf") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		mu.Lock()
+		owner := outputOwners["/download/"+e.Name()]
+		mu.Unlock()
+		if !canAccess(c, owner) {
+			continue
+		}
+		out = append(out, pdfItem{Name: e.Name(), SizeBytes: info.Size(), Created: info.ModTime().Format(time.RFC3339), URL: "/download/" + e.Name()})
+	}
+	page, total := applyListQuery(out, q, func(p pdfItem) listKey {
+		return listKey{Name: p.Name, SizeBytes: p.SizeBytes, Date: p.Created, DurationS: -1}
+	})
+	c.JSON(http.StatusOK, listResponse("pdfs", page, total, q))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logs are structured (log/slog) lines on stderr, as text or JSON
+// (-log-format). The log package and gin's debug output go through the same
+// handler. Every request gets an X-Request-ID and one line when it
+// completes; jobs log with their job and source IDs and the request that
+// queued them, and every tool run is logged with the stderr it produced
+// instead of that stderr going to the server's own.
+var (
+	logFormat = "text"
+	logLevel  = "info"
+)
+
+// setupLogging installs the slog handler chosen by logFormat and logLevel.
+func setupLogging() error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("-log-level must be debug, info, warn or error")
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(logFormat) {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("-log-format must be text or json")
+	}
+	slog.SetDefault(slog.New(h))
+	gin.DebugPrintFunc = func(format string, values ...any) {
+		slog.Debug(strings.TrimSpace(fmt.Sprintf(format, values...)))
+	}
+	return nil
+}
+
+// requestLog tags the request with an ID (the caller's X-Request-ID if it
+// sent a sane one), echoes it in the response and logs the request once it
+// is done.
+func requestLog(c *gin.Context) {
+	id := c.GetHeader("X-Request-ID")
+	if id == "" || len(id) > 64 || strings.ContainsAny(id, " \t\r\n") {
+		id = randID(8)
+	}
+	c.Set("request_id", id)
+	c.Header("X-Request-ID", id)
+	start := time.Now()
+	c.Next()
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.Int("status", status),
+		slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+		slog.String("client", c.ClientIP()),
+	}
+	if owner := ownerOf(c); owner != "" {
+		attrs = append(attrs, slog.String("owner", owner))
+	}
+	if s := requestSpan(c); s != nil {
+		attrs = append(attrs, slog.String("trace_id", s.TraceID))
+	}
+	if errs := c.Errors.String(); errs != "" {
+		attrs = append(attrs, slog.String("error", strings.TrimSpace(errs)))
+	}
+	slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+}
+
+// requestID returns the ID requestLog gave the request.
+func requestID(c *gin.Context) string { return c.GetString("request_id") }
+
+// recoverPanics answers 500 and logs the panic with its request ID and
+// stack.
+var recoverPanics = gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+	slog.Error("panic", "request_id", requestID(c), "path", c.Request.URL.Path, "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+	fail(c, http.StatusInternalServerError, "internal error")
+})
+
+// Tool output kept per run: the tail of stderr, and the number of runs a
+// job keeps.
+const (
+	toolTailBytes = 4 << 10
+	maxJobTools   = 20
+)
+
+// ToolRun is one ffmpeg/ImageMagick/... run made for a job.
+type ToolRun struct {
+	Tool       string `json:"tool"`
+	Started    string `json:"started_at"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	// Stderr is the end of what the tool printed to stderr.
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// tailBuffer keeps the last toolTailBytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - toolTailBytes; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.TrimSpace(strings.ToValidUTF8(string(t.buf), ""))
+}
+
+// sourceIDsIn returns the upload IDs the tool arguments refer to, through
+// paths under uploadDir or framesDir, or frames in scratch space.
+func sourceIDsIn(args []string) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, a := range args {
+		// ffmpeg filters and magick specs wrap paths, e.g. "text:/x/y"
+		for _, f := range strings.FieldsFunc(a, func(r rune) bool { return r == ':' || r == '=' || r == '\'' || r == ',' }) {
+			for _, dir := range []string{uploadDir, framesDir, scratchDir} {
+				rel, err := filepath.Rel(dir, f)
+				if err != nil || rel == "." || strings.HasPrefix(rel, "..") || !filepath.IsAbs(f) {
+					continue
+				}
+				id, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+				if dir == scratchDir {
+					// <job>/frames-<video id>/...
+					name, _, _ := strings.Cut(rest, "/")
+					var ok bool
+					if id, ok = strings.CutPrefix(name, "frames-"); !ok {
+						continue
+					}
+				}
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// toolJobs returns the running jobs tool arguments work for: those working
+// on the uploads they refer to, and those whose scratch space they use.
+func toolJobs(args []string) []*Job {
+	js := runningJobsFor(sourceIDsIn(args))
+	for _, a := range args {
+		rel, err := filepath.Rel(scratchDir, a)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") || !filepath.IsAbs(a) {
+			continue
+		}
+		id, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		jobsMu.Lock()
+		j := jobs[id]
+		jobsMu.Unlock()
+		if j != nil && !slices.Contains(js, j) {
+			js = append(js, j)
+		}
+	}
+	return js
+}
+
+// logToolRun logs a finished tool run and records it on the jobs it
+// worked for.
+func logToolRun(p *toolProc, started time.Time, err error, stderr string) {
+	untrackTool(p)
+	run := ToolRun{
+		Tool:       filepath.Base(p.Path),
+		Started:    started.Format(time.RFC3339),
+		DurationMS: time.Since(started).Milliseconds(),
+		Error:      errString(err),
+		Stderr:     stderr,
+	}
+	ids := sourceIDsIn(p.Args[1:])
+	traceToolRun(run, ids, started, p.Args[1:])
+	logToolEnd(p, run)
+	jobIDs := make([]string, len(p.jobs))
+	for i, j := range p.jobs {
+		jobIDs[i] = j.ID
+		j.addToolRun(run)
+	}
+	attrs := []any{"tool", run.Tool, "duration_ms", run.DurationMS}
+	if len(ids) > 0 {
+		attrs = append(attrs, "source_ids", ids)
+	}
+	if len(jobIDs) > 0 {
+		attrs = append(attrs, "job_ids", jobIDs)
+	}
+	if err != nil {
+		attrs = append(attrs, "error", run.Error, "stderr", stderr)
+		slog.Error("tool failed", attrs...)
+		return
+	}
+	if stderr != "" {
+		attrs = append(attrs, "stderr", stderr)
+	}
+	slog.Debug("tool finished", attrs...)
+}
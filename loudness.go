@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// loudnessTarget is an EBU R128 loudnorm target.
+type loudnessTarget struct {
+	I   float64 `json:"integrated_lufs"`
+	TP  float64 `json:"true_peak_dbtp"`
+	LRA float64 `json:"loudness_range_lu"`
+}
+
+// loudnessPresets maps the `normalize` request values to targets.
+var loudnessPresets = map[string]loudnessTarget{
+	"podcast":   {I: -16, TP: -1.5, LRA: 11},
+	"broadcast": {I: -23, TP: -1, LRA: 15},
+}
+
+// resolveLoudnessTarget turns a preset name and/or explicit LUFS value into a
+// target. It returns nil when no normalization was requested.
+func resolveLoudnessTarget(preset string, lufs float64) (*loudnessTarget, error) {
+	preset = strings.ToLower(strings.TrimSpace(preset))
+	if preset == "" && lufs == 0 {
+		return nil, nil
+	}
+	t := loudnessPresets["podcast"]
+	if preset != "" && preset != "custom" {
+		p, ok := loudnessPresets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown normalize preset: %s", preset)
+		}
+		t = p
+	}
+	if lufs != 0 {
+		if lufs < -70 || lufs > -5 {
+			return nil, fmt.Errorf("target_lufs out of range (-70..-5): %g", lufs)
+		}
+		t.I = lufs
+	}
+	return &t, nil
+}
+
+// loudnormStats is the JSON block printed by the loudnorm filter.
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureLoudnorm runs the first loudnorm pass over inAbs (after the optional
+// pre-filters) and returns the measured values. onProgress (optional)
+// receives the percentage of totalS seconds processed.
+func measureLoudnorm(inAbs string, preFilters []string, t loudnessTarget, totalS float64, onProgress func(float64)) (*loudnormStats, error) {
+	filters := append(append([]string{}, preFilters...), fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:print_format=json", t.I, t.TP, t.LRA))
+	var stderr bytes.Buffer
+	args := []string{"-hide_banner", "-nostdin", "-i", inAbs, "-vn", "-af", strings.Join(filters, ","), "-f", "null", "-"}
+	if err := runFFmpeg(args, totalS, onProgress, &stderr); err != nil {
+		return nil, fmt.Errorf("loudnorm measure: %w", err)
+	}
+	out := stderr.String()
+	i := strings.LastIndex(out, "{")
+	j := strings.LastIndex(out, "}")
+	if i < 0 || j < i {
+		return nil, errors.New("loudnorm measure: no stats in ffmpeg output")
+	}
+	var st loudnormStats
+	if err := json.Unmarshal([]byte(out[i:j+1]), &st); err != nil {
+		return nil, fmt.Errorf("loudnorm measure: %w", err)
+	}
+	if _, err := strconv.ParseFloat(st.InputI, 64); err != nil {
+		return nil, fmt.Errorf("loudnorm measure: bad input_i %q", st.InputI)
+	}
+	return &st, nil
+}
+
+// silent reports whether the measured input is silence, which loudnorm
+// measures as -inf and its second pass then rejects.
+func (m *loudnormStats) silent() bool {
+	return parseLUFS(m.InputI) <= silenceLUFS
+}
+
+// loudnormFilter builds the second-pass loudnorm filter from measured stats.
+func loudnormFilter(t loudnessTarget, m *loudnormStats) string {
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		t.I, t.TP, t.LRA, m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset)
+}
+
+// loudnessPoint is one sample of the short-term loudness timeline.
+type loudnessPoint struct {
+	T         float64 `json:"t"`
+	Momentary float64 `json:"momentary_lufs"`
+	ShortTerm float64 `json:"short_term_lufs"`
+}
+
+// loudnessReport is the result of an ebur128 scan.
+type loudnessReport struct {
+	IntegratedLUFS   float64            `json:"integrated_lufs"`
+	TruePeakDBTP     float64            `json:"true_peak_dbtp"`
+	LRA              float64            `json:"loudness_range_lu"`
+	LRALowLUFS       float64            `json:"lra_low_lufs"`
+	LRAHighLUFS      float64            `json:"lra_high_lufs"`
+	MaxMomentaryLUFS float64            `json:"max_momentary_lufs"`
+	MaxShortTermLUFS float64            `json:"max_short_term_lufs"`
+	SuggestedGainDB  map[string]float64 `json:"suggested_gain_db"`
+	Timeline         []loudnessPoint    `json:"timeline"`
+}
+
+var (
+	ebuFrameRe   = regexp.MustCompile(`t:\s*([\d.]+)\s+TARGET:.*?M:\s*(-?[\d.]+|-inf|nan)\s+S:\s*(-?[\d.]+|-inf|nan)`)
+	ebuSummaryRe = regexp.MustCompile(`(?s)Integrated loudness:\s*I:\s*(-?[\d.]+|-inf) LUFS.*?Loudness range:\s*LRA:\s*(-?[\d.]+) LU.*?LRA low:\s*(-?[\d.]+|-inf) LUFS\s*LRA high:\s*(-?[\d.]+|-inf) LUFS(?:.*?Peak:\s*(-?[\d.]+|-inf) dBFS)?`)
+)
+
+// analyzeLoudness runs ffmpeg's ebur128 filter over inAbs and returns the
+// integrated/peak/range summary plus a short-term loudness timeline sampled
+// every interval seconds.
+func analyzeLoudness(inAbs string, interval float64) (*loudnessReport, error) {
+	if !(interval > 0) {
+		interval = 1
+	}
+	cmd := toolCmd(ffmpegBin, "-hide_banner", "-nostdin", "-nostats", "-i", inAbs, "-vn", "-af", "ebur128=peak=true:framelog=info", "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ebur128: %w", err)
+	}
+	out := stderr.String()
+
+	rep := &loudnessReport{MaxMomentaryLUFS: math.Inf(-1), MaxShortTermLUFS: math.Inf(-1), Timeline: []loudnessPoint{}}
+	next := interval
+	for _, m := range ebuFrameRe.FindAllStringSubmatch(out, -1) {
+		t, _ := strconv.ParseFloat(m[1], 64)
+		mom := parseLUFS(m[2])
+		st := parseLUFS(m[3])
+		rep.MaxMomentaryLUFS = math.Max(rep.MaxMomentaryLUFS, mom)
+		rep.MaxShortTermLUFS = math.Max(rep.MaxShortTermLUFS, st)
+		if t+1e-6 >= next {
+			rep.Timeline = append(rep.Timeline, loudnessPoint{T: math.Round(t*10) / 10, Momentary: mom, ShortTerm: st})
+			for next <= t+1e-6 {
+				next += interval
+			}
+		}
+	}
+	sum := ebuSummaryRe.FindStringSubmatch(out[strings.LastIndex(out, "Summary:")+1:])
+	if sum == nil {
+		return nil, errors.New("ebur128: no summary in ffmpeg output")
+	}
+	rep.IntegratedLUFS = parseLUFS(sum[1])
+	rep.LRA = parseLUFS(sum[2])
+	rep.LRALowLUFS = parseLUFS(sum[3])
+	rep.LRAHighLUFS = parseLUFS(sum[4])
+	rep.TruePeakDBTP = parseLUFS(sum[5])
+	rep.MaxMomentaryLUFS = math.Max(rep.MaxMomentaryLUFS, silenceLUFS)
+	rep.MaxShortTermLUFS = math.Max(rep.MaxShortTermLUFS, silenceLUFS)
+	rep.SuggestedGainDB = map[string]float64{}
+	for name, t := range loudnessPresets {
+		rep.SuggestedGainDB[name] = math.Round((t.I-rep.IntegratedLUFS)*10) / 10
+	}
+	return rep, nil
+}
+
+// silenceLUFS is reported instead of -inf so the report stays valid JSON.
+const silenceLUFS = -120.0
+
+func parseLUFS(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) || f < silenceLUFS {
+		return silenceLUFS
+	}
+	return f
+}
+
+// replayGainRefLUFS is the ReplayGain 2.0 reference loudness; Opus R128 gain
+// tags are relative to EBU R128's -23 LUFS instead.
+const (
+	replayGainRefLUFS = -18.0
+	r128RefLUFS       = -23.0
+)
+
+// replayGainFormats are the outputs whose containers carry gain tags.
+var replayGainFormats = map[string]bool{"mp3": true, "flac": true, "ogg": true, "opus": true, "m4a": true, "alac": true}
+
+// replayGain is what was written to a file's tags.
+type replayGain struct {
+	TrackGainDB float64 `json:"track_gain_db"`
+	TrackPeak   float64 `json:"track_peak"`
+	// R128TrackGain is set for Opus, in Q7.8 fixed point as stored.
+	R128TrackGain *int `json:"r128_track_gain,omitempty"`
+}
+
+// writeReplayGain measures path and rewrites its tags with ReplayGain (or
+// R128 for Opus) values by remuxing, without re-encoding the audio.
+func writeReplayGain(path, format string) (*replayGain, error) {
+	if !replayGainFormats[format] {
+		return nil, fmt.Errorf("replaygain tags are not supported for %s", format)
+	}
+	m, err := measureLoudnorm(path, nil, loudnessPresets["broadcast"], 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	inI := parseLUFS(m.InputI)
+	inTP, _ := strconv.ParseFloat(m.InputTP, 64)
+	rg := &replayGain{
+		TrackGainDB: math.Round((replayGainRefLUFS-inI)*100) / 100,
+		TrackPeak:   math.Round(math.Pow(10, inTP/20)*1e6) / 1e6,
+	}
+
+	tmp := stripExt(path) + ".rg" + filepath.Ext(path)
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", path, "-map", "0", "-c", "copy", "-map_metadata", "0"}
+	// Vorbis comments live on the stream for Ogg/Opus
+	tagFlag := "-metadata"
+	if format == "ogg" || format == "opus" {
+		tagFlag = "-metadata:s:a:0"
+	}
+	if format == "opus" {
+		q := int(math.Round((r128RefLUFS - inI) * 256))
+		q = max(-32768, min(32767, q))
+		rg.R128TrackGain = &q
+		args = append(args, tagFlag, "R128_TRACK_GAIN="+strconv.Itoa(q))
+	} else {
+		args = append(args,
+			tagFlag, fmt.Sprintf("REPLAYGAIN_TRACK_GAIN=%.2f dB", rg.TrackGainDB),
+			tagFlag, fmt.Sprintf("REPLAYGAIN_TRACK_PEAK=%.6f", rg.TrackPeak))
+	}
+	switch format {
+	case "mp3":
+		args = append(args, "-id3v2_version", "3")
+	case "m4a", "alac":
+		// custom keys are dropped by the mp4 muxer unless asked for
+		args = append(args, "-movflags", "+use_metadata_tags+faststart")
+	}
+	args = append(args, tmp)
+	cmd := toolCmd(ffmpegBin, args...)
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(tmp)
+		return nil, fmt.Errorf("replaygain tag: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return rg, nil
+}
@@ -7,6 +7,9 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"cmp"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -14,11 +17,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,18 +32,28 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-)
 
-const (
-	addr     = ":5060"
-	workRoot = "./work"
+	"video-to-pdf/audioconv"
+	"video-to-pdf/frames"
+	"video-to-pdf/pdfgen"
+	"video-to-pdf/probe"
 )
 
+// Work directories; setWorkRoot re-roots them when -workdir is given.
 var (
 	uploadDir = filepath.Join(workRoot, "uploads")
 	framesDir = filepath.Join(workRoot, "frames")
 	pdfsDir   = filepath.Join(workRoot, "pdfs")
 	audioDir  = filepath.Join(workRoot, "audio")
+	// transcriptsDir holds SRT/VTT/TXT/PDF transcripts.
+	transcriptsDir = filepath.Join(workRoot, "transcripts")
+	// rendersDir holds generated videos (e.g. waveform renders, slideshows).
+	rendersDir = filepath.Join(workRoot, "renders")
+	// scratchDir holds the intermediate files of running jobs; see
+	// scratch.go.
+	scratchDir = filepath.Join(workRoot, "scratch")
+	// logsDir holds the tool logs of jobs; see joblog.go.
+	logsDir = filepath.Join(workRoot, "logs")
 )
 
 type VideoMeta struct {
@@ -47,17 +63,41 @@ type VideoMeta struct {
 	AbsPath   string  `json:"-"`
 	SizeBytes int64   `json:"size_bytes"`
 	DurationS float64 `json:"duration_seconds"`
-	Uploaded  string  `json:"uploaded_at"`
+	// Frames is the frame count of an animated GIF or APNG upload; 0 for
+	// videos.
+	Frames int `json:"frames,omitempty"`
+	// AudioTracks are the audio streams, for choosing one by audio_track.
+	AudioTracks []audioTrack `json:"audio_tracks,omitempty"`
+	// Picture is how the frames are stored and meant to be shown; see
+	// footage.go.
+	Picture  *videoPicture `json:"picture,omitempty"`
+	Uploaded string        `json:"uploaded_at"`
+	// Validation is the decode check run at upload.
+	Validation *mediaValidation `json:"validation,omitempty"`
+	Tags       []string         `json:"tags,omitempty"`
+	// Owner is the uploading user's ID (empty without accounts).
+	Owner string `json:"owner,omitempty"`
+	// SHA256 is the content hash; identical uploads share one blob.
+	SHA256 string `json:"sha256,omitempty"`
+	// MIMEType is sniffed from the content; TypeWarning is set when it
+	// doesn't look like what the endpoint takes (see typeCheck).
+	MIMEType    string `json:"mime_type,omitempty"`
+	TypeWarning string `json:"type_warning,omitempty"`
 }
 
 type ImgMeta struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	RelPath   string `json:"rel_path"`
-	AbsPath   string `json:"-"`
-	SizeBytes int64  `json:"size_bytes"`
-	Uploaded  string `json:"uploaded_at"`
-	URL       string `json:"url"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	RelPath     string   `json:"rel_path"`
+	AbsPath     string   `json:"-"`
+	SizeBytes   int64    `json:"size_bytes"`
+	Uploaded    string   `json:"uploaded_at"`
+	URL         string   `json:"url"`
+	Tags        []string `json:"tags,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+	SHA256      string   `json:"sha256,omitempty"`
+	MIMEType    string   `json:"mime_type,omitempty"`
+	TypeWarning string   `json:"type_warning,omitempty"`
 }
 
 type AudioMeta struct {
@@ -73,6 +113,18 @@ type AudioMeta struct {
 	SampleRate  int     `json:"sample_rate"`
 	BitrateKbps int     `json:"bitrate_kbps"`
 	ProbeJSON   string  `json:"probe_json"`
+	CoverURL    string  `json:"cover_url,omitempty"`
+	// Validation is the decode check run at upload.
+	Validation *mediaValidation `json:"validation,omitempty"`
+	Tags       []string         `json:"tags,omitempty"`
+	// Owner is the uploading user's ID (empty without accounts).
+	Owner string `json:"owner,omitempty"`
+	// SHA256 is the content hash; identical uploads share one blob.
+	SHA256 string `json:"sha256,omitempty"`
+	// MIMEType is sniffed from the content; TypeWarning is set when it
+	// doesn't look like what the endpoint takes (see typeCheck).
+	MIMEType    string `json:"mime_type,omitempty"`
+	TypeWarning string `json:"type_warning,omitempty"`
 }
 
 var (
@@ -83,52 +135,103 @@ var (
 )
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if err := loadConfig(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
 
 	must(os.MkdirAll(uploadDir, 0o755))
 	must(os.MkdirAll(framesDir, 0o755))
 	must(os.MkdirAll(pdfsDir, 0o755))
 	must(os.MkdirAll(audioDir, 0o755))
+	must(os.MkdirAll(transcriptsDir, 0o755))
+	must(os.MkdirAll(rendersDir, 0o755))
+	must(os.MkdirAll(scratchDir, 0o755))
+	must(os.MkdirAll(logsDir, 0o755))
+	if !workerMode {
+		// workers share the work directory but not the store, which only
+		// one process can hold open
+		must(openStore())
+	}
+	must(openObjectStore())
+	must(checkDeliveryTargets())
 
-	// tools
-	if _, err := exec.LookPath("ffmpeg"); err != nil {
-		log.Fatal("ffmpeg not found in PATH")
+	// tools; an images-only deployment has no use for ffmpeg
+	if needsFFmpeg() {
+		if _, err := exec.LookPath(ffmpegBin); err != nil {
+			log.Fatalf("ffmpeg not found: %s", ffmpegBin)
+		}
+		if _, err := exec.LookPath(ffprobeBin); err != nil {
+			log.Fatalf("ffprobe not found: %s", ffprobeBin)
+		}
 	}
-	if _, err := exec.LookPath("ffprobe"); err != nil {
-		log.Fatal("ffprobe not found in PATH")
+	if p, err := exec.LookPath(magickBin); err != nil {
+		log.Fatalf("ImageMagick not found: %s", magickBin)
+	} else if isSystemConvert(p) {
+		log.Fatalf("ImageMagick not found: %s is Windows' disk converter; install ImageMagick 7 or set -magick", p)
 	}
-	if _, err := exec.LookPath("magick"); err != nil {
-		if _, err2 := exec.LookPath("convert"); err2 != nil {
-			log.Fatal("ImageMagick not found (magick/convert)")
-		}
+	startAdmission()
+	if workerMode {
+		runWorker()
+		return
 	}
 
-	r := gin.Default()
-	r.GET("/", func(c *gin.Context) {
-		c.Header("Content-Type", "text/html; charset=utf-8")
-		c.String(http.StatusOK, indexHTML)
-	})
-
-	// videos
-	r.POST("/upload", handleUploadVideos)
-	r.POST("/process", handleProcessVideos)
-
-	// images
-	r.POST("/upload_images", handleUploadImages)
-	r.POST("/images_pdf", handleImagesPDF)
-
-	// audio
-	r.POST("/upload_audio", handleUploadAudio)
-	r.POST("/convert_audio", handleConvertAudio)
-
-	// static
-	r.StaticFS("/download", http.Dir(pdfsDir))
-	r.StaticFS("/uploads", http.Dir(uploadDir))
-	r.StaticFS("/audio", http.Dir(audioDir))
+	if authEnabled {
+		must(ensureAdmin())
+	} else if anonSessions {
+		must(loadSessionSecret())
+	}
+	must(checkWatchFolders())
 
-	log.Printf("📦 work dir: %s", workRoot)
-	log.Printf("🌐 open: http://localhost%s", addr)
-	_ = r.Run(addr)
+	retention, err := loadRetention()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startJanitor(retention)
+	startWatchers()
+	startSchedules()
+	startTraceExporter()
+
+	r := gin.New()
+	r.Use(requestLog, traceRequest, recoverPanics, authRequired, anonSession)
+	r.SetHTMLTemplate(pageTemplates)
+	r.GET("/", handleIndex)
+	r.StaticFS("/static", staticFiles())
+
+	// login page and public share links; everything else machine-facing is
+	// in api.go, at its path and under /api/v1
+	r.GET("/login", handleLoginPage)
+	r.GET("/s/:token", handleShareDownload)
+	r.POST("/s/:token", handleShareDownload)
+	registerAPI(r)
+
+	// static (owner-checked with auth enabled)
+	r.Group("/download", guardFiles, downloadName).StaticFS("/", http.Dir(pdfsDir))
+	r.Group("/uploads", serveUploadProgress, guardFiles, downloadName).StaticFS("/", http.Dir(uploadDir))
+	r.Group("/audio", guardFiles, downloadName).StaticFS("/", http.Dir(audioDir))
+	r.Group("/transcripts", guardFiles, downloadName).StaticFS("/", http.Dir(transcriptsDir))
+	r.Group("/renders", guardFiles, downloadName).StaticFS("/", http.Dir(rendersDir))
+	r.Group("/frames", guardFiles).StaticFS("/", http.Dir(framesDir))
+
+	slog.Info("listening", "addr", addr, "workdir", workRoot, "https", tlsEnabled())
+	srvs := []*http.Server{{Addr: addr, Handler: r}}
+	if tlsEnabled() {
+		plain, err := setupTLS(srvs[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if plain != nil {
+			slog.Info("http redirect listening", "addr", httpAddr)
+			srvs = append(srvs, plain)
+		}
+	}
+	if g := grpcHTTPServer(r, srvs[0].TLSConfig); g != nil {
+		slog.Info("grpc listening", "addr", grpcAddr)
+		srvs = append(srvs, g)
+	}
+	serveUntilSignal(srvs...)
 }
 
 // ===== videos =====
@@ -137,10 +240,37 @@ type processReq struct {
 	Items []struct {
 		ID  string  `json:"id"`
 		FPS float64 `json:"fps"`
+		// EveryFrame extracts each frame of an animated GIF or APNG once
+		// instead of sampling at FPS.
+		EveryFrame bool `json:"every_frame"`
+		// VideoFilter is a custom ffmpeg filter chain run on the frames;
+		// see customfilters.go.
+		VideoFilter string `json:"video_filter"`
+		// BurnChapters draws the current chapter's title onto each frame;
+		// Chapters is a label list to use instead of the video's own
+		// chapters, and implies it. See chapterburn.go.
+		BurnChapters bool           `json:"burn_chapters"`
+		Chapters     []audioChapter `json:"chapters"`
+		// NoPreprocess extracts phone footage without straightening it
+		// out first; see footage.go.
+		NoPreprocess bool `json:"no_preprocess"`
 	} `json:"items"`
 	JPEGQuality int `json:"jpeg_quality"`
 	Density     int `json:"pdf_density"`
 	Quality     int `json:"pdf_quality"`
+	// Preset names a preset (see presets.go) whose settings fill in the
+	// unset ones, ahead of the project's defaults.
+	Preset string `json:"preset"`
+	// ProjectID fills unset settings from the project's defaults and
+	// records the PDFs on it.
+	ProjectID string `json:"project_id"`
+	Priority  string `json:"priority"`
+	// NoCache runs every video even if it was converted with the same
+	// settings before; see cache.go.
+	NoCache bool `json:"no_cache"`
+	// FramesOnly extracts and keeps the frames without building PDFs, to
+	// be looked over and bound later; see framebrowser.go.
+	FramesOnly bool `json:"frames_only"`
 }
 
 type processItem struct {
@@ -150,52 +280,87 @@ type processItem struct {
 	FPS         float64 `json:"fps"`
 	EstFrames   int     `json:"estimated_frames"`
 	FramesWrote int     `json:"frames_wrote"`
-	PDFURL      string  `json:"pdf_url"`
+	// FramesDropped and FramesDuplicated are the source frames ffmpeg
+	// skipped or repeated to hold the frame rate.
+	FramesDropped    int    `json:"frames_dropped"`
+	FramesDuplicated int    `json:"frames_duplicated"`
+	PDFURL           string `json:"pdf_url"`
+	// FramesURL is the object-storage prefix of the frames (storage.frames).
+	FramesURL string `json:"frames_url,omitempty"`
+	// Cached is set when the PDF came from the result cache.
+	Cached bool `json:"cached,omitempty"`
+	// Preprocessed lists how the frames were straightened out before
+	// sampling: vfr, tonemap, rotate.
+	Preprocessed []string `json:"preprocessed,omitempty"`
 }
 
 func handleUploadVideos(c *gin.Context) {
-	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 20<<30)
-	if err := c.Request.ParseMultipartForm(64 << 20); err != nil {
-		c.String(http.StatusBadRequest, "failed to parse form: %v", err)
+	files, form, ok := receiveUpload(c, "video", "videos")
+	if !ok {
 		return
 	}
-	files := c.Request.MultipartForm.File["videos"]
+	tags, err := normalizeTags(form["tags"])
+	if err != nil {
+		discardUploads(files)
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var proj *Project
+	if pid := form.Get("project_id"); pid != "" {
+		if proj = lookupProject(c, pid); proj == nil {
+			discardUploads(files)
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", pid)
+			return
+		}
+	}
 	if len(files) == 0 {
-		c.String(http.StatusBadRequest, "no files uploaded (field must be 'videos')")
+		fail(c, http.StatusBadRequest, "no files uploaded (field must be 'videos')")
 		return
 	}
 	out := make([]*VideoMeta, 0, len(files))
-	for _, fh := range files {
-		fr, err := fh.Open()
+	for i, f := range files {
+		id, safe, rel, abs, wrote, sum := f.ID, f.Name, f.Rel, f.Abs, f.Size, f.SHA256
+		mt, typeWarn, err := checkUploadType("video", safe, abs)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "open: %v", err)
-			return
-		}
-		defer fr.Close()
-		id := randID(8)
-		safe := sanitizeName(fh.Filename)
-		rel := filepath.Join(id, safe)
-		abs := filepath.Join(uploadDir, rel)
-		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
-			c.String(http.StatusInternalServerError, "mkdir: %v", err)
+			discardUploads(files[i:])
+			fail(c, http.StatusUnsupportedMediaType, "%v", err)
 			return
 		}
-		fw, err := os.Create(abs)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "create: %v", err)
-			return
+		if dup, ok := sameUpload("video", ownerOf(c), safe, sum).(*VideoMeta); ok {
+			os.RemoveAll(filepath.Dir(abs))
+			out = append(out, dup)
+			addToProject(proj, "videos", dup.ID)
+			continue
 		}
-		wrote, cpErr := ioCopyClose(fw, fr)
-		if cpErr != nil {
-			c.String(http.StatusInternalServerError, "write: %v", cpErr)
+		if _, err := internBlob(abs, sum); err != nil {
+			discardUploads(files[i:])
+			fail(c, http.StatusInternalServerError, "store: %v", err)
 			return
 		}
+		traceSources(c, id)
+		probe := startStage("probe", id)
 		dur, _ := probeDuration(abs)
 		vm := &VideoMeta{ID: id, Name: safe, RelPath: rel, AbsPath: abs, SizeBytes: wrote, DurationS: dur, Uploaded: time.Now().Format(time.RFC3339)}
+		if animationExts[strings.ToLower(filepath.Ext(safe))] {
+			vm.Frames = probeFrames(abs)
+			if vm.Frames == 1 && typeWarn == "" {
+				typeWarn = safe + " is a still image, not an animation"
+			}
+		}
+		vm.AudioTracks = probeAudioTracks(abs)
+		if vm.Frames == 0 {
+			vm.Picture = probePicture(abs)
+		}
+		vm.Validation = validateMedia(abs, dur, true)
+		probe.end(nil)
+		vm.Tags, vm.Owner, vm.SHA256 = tags, ownerOf(c), sum
+		vm.MIMEType, vm.TypeWarning = mt, typeWarn
 		mu.Lock()
 		videos[id] = vm
 		mu.Unlock()
+		putVideo(vm)
 		out = append(out, vm)
+		addToProject(proj, "videos", vm.ID)
 	}
 	c.JSON(http.StatusOK, gin.H{"videos": out})
 }
@@ -203,65 +368,282 @@ func handleUploadVideos(c *gin.Context) {
 func handleProcessVideos(c *gin.Context) {
 	var req processReq
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.String(http.StatusBadRequest, "bad json: %v", err)
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
 		return
 	}
 	if len(req.Items) == 0 {
-		c.String(http.StatusBadRequest, "no items provided")
+		fail(c, http.StatusBadRequest, "no items provided")
 		return
 	}
+	proj := lookupProject(c, req.ProjectID)
+	if req.ProjectID != "" && proj == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", req.ProjectID)
+		return
+	}
+	pr, ok := presetFor(c, req.Preset)
+	if !ok {
+		return
+	}
+	defs := requestDefaults(pr, proj)
 	if req.JPEGQuality == 0 {
-		req.JPEGQuality = 2
+		req.JPEGQuality = cmp.Or(defs.JPEGQuality, processDefaults.JPEGQuality)
 	}
 	if req.Density == 0 {
-		req.Density = 150
+		req.Density = cmp.Or(defs.Density, processDefaults.Density)
 	}
 	if req.Quality == 0 {
-		req.Quality = 92
+		req.Quality = cmp.Or(defs.Quality, processDefaults.Quality)
 	}
-	results := make([]processItem, 0, len(req.Items))
-	for _, it := range req.Items {
-		mu.Lock()
-		vm := videos[it.ID]
-		mu.Unlock()
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	vms := make([]*VideoMeta, 0, len(req.Items))
+	ids := make([]string, 0, len(req.Items))
+	names := make([]string, 0, len(req.Items))
+	burns := make([][]chapterLabel, 0, len(req.Items))
+	var bad itemErrors
+	for i, it := range req.Items {
+		vm := getVideo(c, it.ID)
 		if vm == nil {
-			c.String(http.StatusBadRequest, "unknown video id: %s", it.ID)
-			return
+			bad.add(i, it.ID, errUnknownID, "unknown video id: %s", it.ID)
+			continue
+		}
+		if it.VideoFilter != "" {
+			if err := checkFilterChain(it.VideoFilter, safeVideoFilters); err != nil {
+				bad.add(i, it.ID, "", "%s: video_filter: %v", vm.Name, err)
+				continue
+			}
+		}
+		if it.EveryFrame && vm.Frames == 0 {
+			bad.add(i, it.ID, "", "%s: every_frame takes an animated GIF or APNG", vm.Name)
+			continue
+		}
+		var labels []chapterLabel
+		switch {
+		case len(it.Chapters) > 0:
+			chs, err := sortChapters(it.Chapters)
+			if err != nil {
+				bad.add(i, it.ID, "", "%s: %v", vm.Name, err)
+				continue
+			}
+			labels = chapterLabels(chs)
+		case it.BurnChapters:
+			labels, err = videoChapterLabels(vm)
+			if err != nil {
+				bad.add(i, it.ID, "", "%s: reading chapters: %v", vm.Name, err)
+				continue
+			}
+			if len(labels) == 0 {
+				bad.add(i, it.ID, "", "%s has no titled chapters; send chapters to label its frames", vm.Name)
+				continue
+			}
 		}
+		if len(labels) > maxBurnChapters {
+			bad.add(i, it.ID, "", "%s: at most %d chapters can be burnt in", vm.Name, maxBurnChapters)
+			continue
+		}
+		vms = append(vms, vm)
+		burns = append(burns, labels)
+		ids = append(ids, vm.ID)
+		names = append(names, vm.Name)
+	}
+	if bad.fail(c) {
+		return
+	}
+	binary := wantsBinary(c, "application/pdf")
+	if binary && len(req.Items) > 1 {
+		fail(c, http.StatusBadRequest, "a binary response takes a single item")
+		return
+	}
+	if binary && req.FramesOnly {
+		fail(c, http.StatusBadRequest, "frames_only builds no PDF to send")
+		return
+	}
+	owner := ownerOf(c)
+	// videos already converted with the same settings are answered from the
+	// cache; the task gets the rest
+	task := processTask{JPEGQuality: req.JPEGQuality, Density: req.Density, Quality: req.Quality, FramesOnly: req.FramesOnly}
+	results := make([]processItem, len(vms))
+	keys := make([]string, len(vms))
+	steps := make([][]string, len(vms))
+	for i, it := range req.Items {
+		vm := vms[i]
 		fps := it.FPS
 		if !(fps > 0) {
-			fps = 1
+			fps = cmp.Or(defs.FPS, processDefaults.FPS)
 		}
-		frameDir := filepath.Join(framesDir, vm.ID)
-		_ = os.MkdirAll(frameDir, 0o755)
-		pattern := filepath.Join(frameDir, "frame_%05d.jpg")
-		wrote, err := extractFrames(vm.AbsPath, pattern, fps, req.JPEGQuality)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "ffmpeg extraction failed for %s: %v", vm.Name, err)
-			return
+		if it.EveryFrame {
+			// fps 0 has the extractor keep every frame
+			fps = 0
 		}
-		imgs, _ := filepath.Glob(filepath.Join(frameDir, "frame_*.jpg"))
-		sort.Strings(imgs)
-		if len(imgs) == 0 {
-			c.String(http.StatusInternalServerError, "no frames extracted")
-			return
+		params := gin.H{"fps": fps, "jpeg_quality": req.JPEGQuality, "pdf_density": req.Density, "pdf_quality": req.Quality, "video_filter": it.VideoFilter}
+		if len(burns[i]) > 0 {
+			params["chapters"] = burns[i]
 		}
-		pdfPath := filepath.Join(pdfsDir, vm.ID+"_"+stripExt(vm.Name)+".pdf")
-		if err := imagesToPDF(imgs, pdfPath, req.Density, req.Quality); err != nil {
-			c.String(http.StatusInternalServerError, "pdf build failed: %v", err)
-			return
+		var prep framePrep
+		if !it.NoPreprocess {
+			prep = framePrepFor(vm, fps)
+		}
+		if prep.Chain != "" {
+			params["prepare"] = prep.Chain
+		}
+		steps[i] = prep.Steps
+		keys[i] = resultKey(owner, "process", []string{vm.SHA256}, params)
+		// the cache holds PDFs, not frames
+		if !req.NoCache && !req.FramesOnly {
+			if hit := lookupResult(keys[i]); hit != nil {
+				results[i] = newProcessItem(vm, fps, frames.Stats{Frames: hit.FramesWrote, Dropped: hit.FramesDropped, Duplicated: hit.FramesDuplicated}, hit.URL, hit.FramesURL)
+				results[i].Cached = true
+				results[i].Preprocessed = steps[i]
+				continue
+			}
+		}
+		task.Videos = append(task.Videos, vm)
+		task.FPS = append(task.FPS, fps)
+		task.Filters = append(task.Filters, it.VideoFilter)
+		task.Chapters = append(task.Chapters, burns[i])
+		task.Prep = append(task.Prep, prep)
+		task.Items = append(task.Items, i)
+	}
+	// the work runs as a job so it queues by priority like async jobs
+	job := newJob(owner, requestID(c), "process", prio, ids, names)
+	job.Params = req
+	resp, err := runJob(job, func() (gin.H, error) {
+		for i, r := range results {
+			if r.Cached {
+				job.setItem(i, jobDone, 100)
+			}
+		}
+		if len(task.Videos) > 0 {
+			fresh, err := runWork[[]processItem](job, task)
+			if err != nil {
+				return nil, err
+			}
+			for k, r := range fresh {
+				i := task.Items[k]
+				results[i] = r
+				if !req.FramesOnly {
+					storeResult(keys[i], cachedResult{URL: r.PDFURL, FramesWrote: r.FramesWrote, FramesDropped: r.FramesDropped, FramesDuplicated: r.FramesDuplicated, FramesURL: r.FramesURL})
+				}
+				pruneFrameRuns(r.ID, job.ID)
+			}
+		}
+		if req.FramesOnly {
+			return gin.H{"job_id": job.ID, "results": results, "frames_list_url": framesListURL(job.ID)}, nil
+		}
+		for _, r := range results {
+			recordProjectOutputs(proj, r.PDFURL)
+			recordOutputs(owner, r.PDFURL)
+		}
+		return gin.H{"job_id": job.ID, "results": results}, nil
+	})
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if binary {
+		sendOutput(c, job.ID, resp["results"].([]processItem)[0].PDFURL)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// processTask is the work of a /process job: a PDF per video.
+type processTask struct {
+	Videos []*VideoMeta `json:"videos"`
+	// FPS holds each video's frame rate, Filters its custom filter chain
+	// and Items its job item.
+	FPS     []float64 `json:"fps"`
+	Filters []string  `json:"filters"`
+	// Chapters holds each video's chapter titles to burn in, if any, and
+	// Prep how to prepare its frames.
+	Chapters    [][]chapterLabel `json:"chapters,omitempty"`
+	Prep        []framePrep      `json:"prep,omitempty"`
+	Items       []int            `json:"items"`
+	JPEGQuality int              `json:"jpeg_quality"`
+	Density     int              `json:"pdf_density"`
+	Quality     int              `json:"pdf_quality"`
+	// FramesOnly keeps the frames and builds no PDF.
+	FramesOnly bool `json:"frames_only"`
+}
+
+func (t processTask) run(job *Job) ([]processItem, error) {
+	results := make([]processItem, 0, len(t.Videos))
+	for i, vm := range t.Videos {
+		if vm.AbsPath == "" {
+			// decoded on a worker
+			vm.AbsPath = filepath.Join(uploadDir, vm.RelPath)
+		}
+		item := t.Items[i]
+		job.setItem(item, jobRunning, 0)
+		fps := t.FPS[i]
+		vf := t.Filters[i]
+		if i < len(t.Chapters) && len(t.Chapters[i]) > 0 {
+			dir, err := jobScratch(job.ID, "chapters-"+vm.ID)
+			if err != nil {
+				return nil, err
+			}
+			burn, err := chapterFilter(t.Chapters[i], dir)
+			if err != nil {
+				return nil, err
+			}
+			// the titles go on last, so filters like crop don't cut them off
+			vf = strings.Trim(vf+","+burn, ",")
 		}
-		results = append(results, processItem{
-			ID:          vm.ID,
-			Name:        vm.Name,
-			DurationS:   vm.DurationS,
-			FPS:         fps,
-			EstFrames:   int(math.Ceil(vm.DurationS * fps)),
-			FramesWrote: wrote,
-			PDFURL:      "/download/" + filepath.Base(pdfPath),
-		})
+		var prep framePrep
+		if i < len(t.Prep) {
+			prep = t.Prep[i]
+		}
+		var pdfURL string
+		var imgs []string
+		var st frames.Stats
+		var err error
+		if t.FramesOnly {
+			imgs, st, err = extractToKeep(vm, job.ID, fps, prep, vf, t.JPEGQuality)
+		} else {
+			var pdfPath string
+			pdfPath, imgs, st, err = videoToPDF(vm, job.ID, fps, prep, vf, t.JPEGQuality, t.Density, t.Quality, job.progressFunc(item))
+			pdfURL = "/download/" + filepath.Base(pdfPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		framesURL, err := publishFrames(frameRunDir(vm.ID, job.ID), imgs)
+		if err != nil {
+			return nil, err
+		}
+		job.setItem(item, jobDone, 100)
+		r := newProcessItem(vm, fps, st, pdfURL, framesURL)
+		r.Preprocessed = prep.Steps
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func newProcessItem(vm *VideoMeta, fps float64, st frames.Stats, pdfURL, framesURL string) processItem {
+	return processItem{
+		ID:               vm.ID,
+		Name:             vm.Name,
+		DurationS:        vm.DurationS,
+		FPS:              fps,
+		EstFrames:        estimateFrames(vm, fps),
+		FramesWrote:      st.Frames,
+		FramesDropped:    st.Dropped,
+		FramesDuplicated: st.Duplicated,
+		PDFURL:           pdfURL,
+		FramesURL:        framesURL,
+	}
+}
+
+// estimateFrames is how many frames extracting vm at fps should give; fps
+// 0 is every frame of an animation.
+func estimateFrames(vm *VideoMeta, fps float64) int {
+	if fps == 0 {
+		return vm.Frames
 	}
-	c.JSON(http.StatusOK, gin.H{"results": results})
+	return int(math.Ceil(vm.DurationS * fps))
 }
 
 // ===== images =====
@@ -275,53 +657,66 @@ type imagesPDFReq struct {
 		ID    string `json:"id"`
 		Order int    `json:"order"`
 	} `json:"items"`
-	Density int    `json:"pdf_density"`
-	Quality int    `json:"pdf_quality"`
-	OutName string `json:"out_name"`
+	Density   int    `json:"pdf_density"`
+	Quality   int    `json:"pdf_quality"`
+	OutName   string `json:"out_name"`
+	Preset    string `json:"preset"`
+	ProjectID string `json:"project_id"`
+	Priority  string `json:"priority"`
+	// NoCache builds the PDF even if the same one was built before.
+	NoCache bool `json:"no_cache"`
 }
 
 func handleUploadImages(c *gin.Context) {
-	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 5<<30)
-	if err := c.Request.ParseMultipartForm(64 << 20); err != nil {
-		c.String(http.StatusBadRequest, "failed to parse form: %v", err)
+	files, form, ok := receiveUpload(c, "image", "images")
+	if !ok {
 		return
 	}
-	files := c.Request.MultipartForm.File["images"]
+	tags, err := normalizeTags(form["tags"])
+	if err != nil {
+		discardUploads(files)
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var proj *Project
+	if pid := form.Get("project_id"); pid != "" {
+		if proj = lookupProject(c, pid); proj == nil {
+			discardUploads(files)
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", pid)
+			return
+		}
+	}
 	if len(files) == 0 {
-		c.String(http.StatusBadRequest, "no files uploaded (field must be 'images')")
+		fail(c, http.StatusBadRequest, "no files uploaded (field must be 'images')")
 		return
 	}
 	out := make([]*ImgMeta, 0, len(files))
-	for _, fh := range files {
-		fr, err := fh.Open()
+	for i, f := range files {
+		id, safe, rel, abs, wrote, sum := f.ID, f.Name, f.Rel, f.Abs, f.Size, f.SHA256
+		mt, typeWarn, err := checkUploadType("image", safe, abs)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "open: %v", err)
-			return
-		}
-		defer fr.Close()
-		id := randID(8)
-		safe := sanitizeName(fh.Filename)
-		rel := filepath.Join(id, safe)
-		abs := filepath.Join(uploadDir, rel)
-		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
-			c.String(http.StatusInternalServerError, "mkdir: %v", err)
+			discardUploads(files[i:])
+			fail(c, http.StatusUnsupportedMediaType, "%v", err)
 			return
 		}
-		fw, err := os.Create(abs)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "create: %v", err)
-			return
+		if dup, ok := sameUpload("image", ownerOf(c), safe, sum).(*ImgMeta); ok {
+			os.RemoveAll(filepath.Dir(abs))
+			out = append(out, dup)
+			addToProject(proj, "images", dup.ID)
+			continue
 		}
-		wrote, cpErr := ioCopyClose(fw, fr)
-		if cpErr != nil {
-			c.String(http.StatusInternalServerError, "write: %v", cpErr)
+		if _, err := internBlob(abs, sum); err != nil {
+			discardUploads(files[i:])
+			fail(c, http.StatusInternalServerError, "store: %v", err)
 			return
 		}
-		im := &ImgMeta{ID: id, Name: safe, RelPath: rel, AbsPath: abs, SizeBytes: wrote, Uploaded: time.Now().Format(time.RFC3339), URL: "/uploads/" + rel}
+		im := &ImgMeta{ID: id, Name: safe, RelPath: rel, AbsPath: abs, SizeBytes: wrote, Uploaded: time.Now().Format(time.RFC3339), URL: "/uploads/" + filepath.ToSlash(rel), Tags: tags, Owner: ownerOf(c), SHA256: sum, MIMEType: mt, TypeWarning: typeWarn}
 		mu.Lock()
 		images[id] = im
 		mu.Unlock()
+		putImage(im)
 		out = append(out, im)
+		addToProject(proj, "images", im.ID)
 	}
 	c.JSON(http.StatusOK, imagesUploadResp{Images: out})
 }
@@ -329,33 +724,59 @@ func handleUploadImages(c *gin.Context) {
 func handleImagesPDF(c *gin.Context) {
 	var req imagesPDFReq
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.String(http.StatusBadRequest, "bad json: %v", err)
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
 		return
 	}
 	if len(req.Items) == 0 {
-		c.String(http.StatusBadRequest, "no items provided")
+		fail(c, http.StatusBadRequest, "no items provided")
+		return
+	}
+	proj := lookupProject(c, req.ProjectID)
+	if req.ProjectID != "" && proj == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", req.ProjectID)
+		return
+	}
+	pr, ok := presetFor(c, req.Preset)
+	if !ok {
 		return
 	}
+	defs := requestDefaults(pr, proj)
 	if req.Density == 0 {
-		req.Density = 150
+		req.Density = cmp.Or(defs.Density, processDefaults.Density)
 	}
 	if req.Quality == 0 {
-		req.Quality = 92
+		req.Quality = cmp.Or(defs.Quality, processDefaults.Quality)
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var bad itemErrors
+	for i, it := range req.Items {
+		if getImage(c, it.ID) == nil {
+			bad.add(i, it.ID, errUnknownID, "unknown image id: %s", it.ID)
+		}
+	}
+	if bad.fail(c) {
+		return
 	}
 	sort.SliceStable(req.Items, func(i, j int) bool { return req.Items[i].Order < req.Items[j].Order })
 	paths := make([]string, 0, len(req.Items))
+	imageIDs := make([]string, 0, len(req.Items))
+	sums := make([]string, 0, len(req.Items))
 	for _, it := range req.Items {
-		mu.Lock()
-		im := images[it.ID]
-		mu.Unlock()
+		im := getImage(c, it.ID)
 		if im == nil {
-			c.String(http.StatusBadRequest, "unknown image id: %s", it.ID)
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown image id: %s", it.ID)
 			return
 		}
-		paths = append(paths, im.AbsPath)
+		paths = append(paths, im.RelPath)
+		imageIDs = append(imageIDs, im.ID)
+		sums = append(sums, im.SHA256)
 	}
 	if len(paths) == 0 {
-		c.String(http.StatusBadRequest, "no valid images")
+		fail(c, http.StatusBadRequest, "no valid images")
 		return
 	}
 	name := sanitizeName(req.OutName)
@@ -365,12 +786,72 @@ func handleImagesPDF(c *gin.Context) {
 	if !strings.HasSuffix(strings.ToLower(name), ".pdf") {
 		name += ".pdf"
 	}
-	pdfPath := filepath.Join(pdfsDir, name)
-	if err := imagesToPDF(paths, pdfPath, req.Density, req.Quality); err != nil {
-		c.String(http.StatusInternalServerError, "pdf build failed: %v", err)
+	owner := ownerOf(c)
+	// a random default name doesn't make the PDF a different one
+	key := resultKey(owner, "images_pdf", sums, gin.H{"pdf_density": req.Density, "pdf_quality": req.Quality, "out_name": strings.TrimSpace(req.OutName)})
+	var hit *cachedResult
+	if !req.NoCache {
+		hit = lookupResult(key)
+	}
+	var pdfURL string
+	if hit != nil {
+		pdfURL = hit.URL
+	} else {
+		pdfURL = "/download/" + filepath.Base(claimOutput(owner, filepath.Join(pdfsDir, name)))
+	}
+	job := newJob(owner, requestID(c), "images_pdf", prio, []string{""}, []string{filepath.Base(pdfURL)})
+	job.Params = req
+	job.addSources(imageIDs...)
+	task := imagesPDFTask{Images: paths, Out: filepath.Base(pdfURL), Density: req.Density, Quality: req.Quality}
+	resp, err := runJob(job, func() (gin.H, error) {
+		if hit != nil {
+			job.setItem(0, jobDone, 100)
+		} else {
+			if _, err := runWork[struct{}](job, task); err != nil {
+				return nil, err
+			}
+			storeResult(key, cachedResult{URL: pdfURL})
+		}
+		recordProjectOutputs(proj, pdfURL)
+		recordOutputs(owner, pdfURL)
+		resp := gin.H{"job_id": job.ID, "pdf_url": pdfURL, "count": len(paths)}
+		if hit != nil {
+			resp["cached"] = true
+		}
+		return resp, nil
+	})
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if wantsBinary(c, "application/pdf") {
+		sendOutput(c, job.ID, resp["pdf_url"].(string))
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"pdf_url": "/download/" + filepath.Base(pdfPath), "count": len(paths)})
+	c.JSON(http.StatusOK, resp)
+}
+
+// imagesPDFTask is the work of an /images_pdf job.
+type imagesPDFTask struct {
+	// Images are paths under uploadDir, in page order; Out is the PDF's
+	// name in pdfsDir.
+	Images  []string `json:"images"`
+	Out     string   `json:"out"`
+	Density int      `json:"pdf_density"`
+	Quality int      `json:"pdf_quality"`
+}
+
+func (t imagesPDFTask) run(job *Job) (struct{}, error) {
+	job.setItem(0, jobRunning, 0)
+	paths := make([]string, len(t.Images))
+	for i, rel := range t.Images {
+		paths[i] = filepath.Join(uploadDir, rel)
+	}
+	if err := imagesToPDF(paths, filepath.Join(pdfsDir, t.Out), t.Density, t.Quality); err != nil {
+		return struct{}{}, fmt.Errorf("pdf build failed: %w", err)
+	}
+	job.setItem(0, jobDone, 100)
+	return struct{}{}, nil
 }
 
 // ===== audio =====
@@ -381,12 +862,58 @@ type audioUploadResp struct {
 
 type convertAudioReq struct {
 	Items []struct {
-		ID          string `json:"id"`
-		Format      string `json:"format"`
-		BitrateKbps int    `json:"bitrate_kbps"`
-		SampleRate  int    `json:"sample_rate"`
-		Channels    int    `json:"channels"`
+		ID     string `json:"id"`
+		Format string `json:"format"`
+		// Formats produces several outputs from one decode (overrides Format).
+		Formats     []string `json:"formats"`
+		BitrateKbps int      `json:"bitrate_kbps"`
+		SampleRate  int      `json:"sample_rate"`
+		Channels    int      `json:"channels"`
+		// Normalize is a loudness preset ("podcast", "broadcast") or "custom"
+		// together with TargetLUFS.
+		Normalize  string  `json:"normalize"`
+		TargetLUFS float64 `json:"target_lufs"`
+		FadeInS    float64 `json:"fade_in_seconds"`
+		FadeOutS   float64 `json:"fade_out_seconds"`
+		// Speed changes tempo without affecting pitch (1.25 = 25% faster);
+		// PitchSemitones transposes without affecting tempo.
+		Speed          float64 `json:"speed"`
+		PitchSemitones float64 `json:"pitch_semitones"`
+		// Tags are written on top of the source tags, which are kept unless
+		// StripTags is set.
+		Tags      *audioTags `json:"tags"`
+		StripTags bool       `json:"strip_tags"`
+		// CoverImageID embeds an uploaded image as cover art (MP3/M4A/FLAC).
+		CoverImageID string `json:"cover_image_id"`
+		// Downmix selects how surround sources are folded to stereo/mono
+		// ("default", "itu", "dialog", "dplii"); DownmixGainDB is makeup gain.
+		Downmix       string  `json:"downmix"`
+		DownmixGainDB float64 `json:"downmix_gain_db"`
+		// ReplayGain measures the output and writes ReplayGain (R128 for
+		// Opus) tags instead of changing the audio.
+		ReplayGain bool `json:"replaygain"`
+		// Chapters are embedded as chapter metadata (M4A/ALAC/MP3). Start
+		// times are on the output timeline.
+		Chapters []audioChapter `json:"chapters"`
+		// SplitChannels writes each source channel to its own mono file
+		// ("all") or extracts just one side ("left", "right").
+		SplitChannels string `json:"split_channels"`
+		// TwoPass encodes twice so lossy outputs average close to
+		// BitrateKbps, for a predictable size.
+		TwoPass bool `json:"two_pass"`
+		// AudioFilter is a custom ffmpeg filter chain; see customfilters.go.
+		AudioFilter string `json:"audio_filter"`
 	} `json:"items"`
+	// Async returns 202 with a job id right away; poll GET /jobs/:id for
+	// per-item progress and the final results.
+	Async bool `json:"async"`
+	// Priority is interactive, normal (default) or bulk; see scheduler.go.
+	Priority string `json:"priority"`
+	// Preset supplies settings the items leave unset, ahead of the
+	// project's defaults.
+	Preset string `json:"preset"`
+	// ProjectID supplies default format/bitrate and records the outputs.
+	ProjectID string `json:"project_id"`
 }
 
 type convertAudioItem struct {
@@ -394,51 +921,170 @@ type convertAudioItem struct {
 	Name   string `json:"name"`
 	Format string `json:"format"`
 	OutURL string `json:"out_url"`
+	// Channel names the extracted source channel for split_channels.
+	Channel    string          `json:"channel,omitempty"`
+	Normalized *loudnessTarget `json:"normalized,omitempty"`
+	ReplayGain *replayGain     `json:"replaygain,omitempty"`
+}
+
+// audioTags are the metadata fields that can be set on converted output.
+type audioTags struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	Track  string `json:"track"`
+	Year   string `json:"year"`
+	Genre  string `json:"genre"`
+}
+
+// args returns ffmpeg -metadata arguments for the non-empty fields.
+func (t *audioTags) args() []string {
+	if t == nil {
+		return nil
+	}
+	var args []string
+	for _, kv := range [][2]string{{"title", t.Title}, {"artist", t.Artist}, {"album", t.Album}, {"track", t.Track}, {"date", t.Year}, {"genre", t.Genre}} {
+		if v := strings.TrimSpace(kv[1]); v != "" {
+			args = append(args, "-metadata", kv[0]+"="+v)
+		}
+	}
+	return args
+}
+
+// audioConvertOpts are the per-item settings for convertAudio.
+type audioConvertOpts struct {
+	Format      string
+	BitrateKbps int
+	SampleRate  int
+	Channels    int
+	Loudness    *loudnessTarget
+	FadeInS     float64
+	FadeOutS    float64
+	Speed       float64
+	PitchSemis  float64
+	// DownmixFilters fold the source down before any other processing.
+	DownmixFilters []string
+	// DurationS and SourceRate describe the input; they are needed to place
+	// the fade-out and to pitch-shift.
+	DurationS  float64
+	SourceRate int
+	Tags       *audioTags
+	StripTags  bool
+	// TagSource is the -map_metadata spec the source tags live under.
+	TagSource string
+	// CoverPath is an image file to embed as attached picture.
+	CoverPath string
+	// Progress, when set, receives the completion percentage.
+	Progress func(float64)
+	Chapters []audioChapter
+	// Formats, when set, encodes every listed format from a single decode;
+	// Format is ignored then.
+	Formats []string
+	// OutSuffix is appended to the output base name (e.g. "_FL").
+	OutSuffix string
+	// Owner claims the output names (see claimOutput).
+	Owner string
+	// TwoPass encodes once into Scratch to measure the bitrate each encoder
+	// actually reaches, then again with the bitrate corrected, so outputs
+	// come out at close to BitrateKbps on average.
+	TwoPass bool
+	Scratch string
+	// Filter is a custom filter chain, run after tempo and pitch and
+	// before the fades.
+	Filter string
+}
+
+// audioChapter is one chapter marker; it runs until the next chapter's start
+// (or the end of the output).
+type audioChapter struct {
+	Title  string  `json:"title"`
+	StartS float64 `json:"start_seconds"`
 }
 
+// chapterFormats are the outputs whose muxers write chapters.
+var chapterFormats = map[string]bool{"m4a": true, "alac": true, "mp3": true}
+
+// ffmetadataChapters renders sorted chapters as an FFMETADATA1 document.
+func ffmetadataChapters(chs []audioChapter, totalS float64) string {
+	esc := strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n")
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	for i, ch := range chs {
+		start := int64(ch.StartS * 1000)
+		end := start + 1
+		if i+1 < len(chs) {
+			end = int64(chs[i+1].StartS * 1000)
+		} else if totalS*1000 > float64(start) {
+			end = int64(totalS * 1000)
+		}
+		fmt.Fprintf(&b, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n", start, end, esc.Replace(ch.Title))
+	}
+	return b.String()
+}
+
+// coverArtFormats are the output formats that can carry an attached picture.
+var coverArtFormats = map[string]bool{"mp3": true, "m4a": true, "alac": true, "flac": true}
+
 func handleUploadAudio(c *gin.Context) {
-	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 5<<30)
-	if err := c.Request.ParseMultipartForm(64 << 20); err != nil {
-		c.String(http.StatusBadRequest, "failed to parse form: %v", err)
+	files, form, ok := receiveUpload(c, "audio", "audios")
+	if !ok {
+		return
+	}
+	tags, err := normalizeTags(form["tags"])
+	if err != nil {
+		discardUploads(files)
+		fail(c, http.StatusBadRequest, "%v", err)
 		return
 	}
-	files := c.Request.MultipartForm.File["audios"]
+	var proj *Project
+	if pid := form.Get("project_id"); pid != "" {
+		if proj = lookupProject(c, pid); proj == nil {
+			discardUploads(files)
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", pid)
+			return
+		}
+	}
 	if len(files) == 0 {
-		c.String(http.StatusBadRequest, "no files uploaded (field must be 'audios')")
+		fail(c, http.StatusBadRequest, "no files uploaded (field must be 'audios')")
 		return
 	}
 	out := make([]*AudioMeta, 0, len(files))
-	for _, fh := range files {
-		fr, err := fh.Open()
+	for i, f := range files {
+		id, safe, rel, abs, wrote, sum := f.ID, f.Name, f.Rel, f.Abs, f.Size, f.SHA256
+		mt, typeWarn, err := checkUploadType("audio", safe, abs)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "open: %v", err)
+			discardUploads(files[i:])
+			fail(c, http.StatusUnsupportedMediaType, "%v", err)
 			return
 		}
-		defer fr.Close()
-		id := randID(8)
-		safe := sanitizeName(fh.Filename)
-		rel := filepath.Join(id, safe)
-		abs := filepath.Join(uploadDir, rel)
-		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
-			c.String(http.StatusInternalServerError, "mkdir: %v", err)
-			return
+		if dup, ok := sameUpload("audio", ownerOf(c), safe, sum).(*AudioMeta); ok {
+			os.RemoveAll(filepath.Dir(abs))
+			out = append(out, dup)
+			addToProject(proj, "audios", dup.ID)
+			continue
 		}
-		fw, err := os.Create(abs)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "create: %v", err)
+		if _, err := internBlob(abs, sum); err != nil {
+			discardUploads(files[i:])
+			fail(c, http.StatusInternalServerError, "store: %v", err)
 			return
 		}
-		wrote, cpErr := ioCopyClose(fw, fr)
-		if cpErr != nil {
-			c.String(http.StatusInternalServerError, "write: %v", cpErr)
-			return
+		traceSources(c, id)
+		probe := startStage("probe", id)
+		pa := probeAudio(abs)
+		am := &AudioMeta{ID: id, Name: safe, RelPath: rel, AbsPath: abs, SizeBytes: wrote, Uploaded: time.Now().Format(time.RFC3339), DurationS: pa.DurationS, Codec: pa.Codec, Channels: pa.Channels, SampleRate: pa.SampleRate, BitrateKbps: pa.BitrateKbps, ProbeJSON: pa.JSON}
+		am.Validation = validateMedia(abs, pa.DurationS, false)
+		am.Tags, am.Owner, am.SHA256 = tags, ownerOf(c), sum
+		am.MIMEType, am.TypeWarning = mt, typeWarn
+		if coverRel, err := extractCoverArt(abs, pa.JSON, id); err == nil && coverRel != "" {
+			am.CoverURL = "/uploads/" + filepath.ToSlash(coverRel)
 		}
-		dur, codec, ch, sr, br, raw, _ := probeAudioJSON(abs)
-		am := &AudioMeta{ID: id, Name: safe, RelPath: rel, AbsPath: abs, SizeBytes: wrote, Uploaded: time.Now().Format(time.RFC3339), DurationS: dur, Codec: codec, Channels: ch, SampleRate: sr, BitrateKbps: br, ProbeJSON: raw}
+		probe.end(nil)
 		mu.Lock()
 		audios[id] = am
 		mu.Unlock()
+		putAudio(am)
 		out = append(out, am)
+		addToProject(proj, "audios", am.ID)
 	}
 	c.JSON(http.StatusOK, audioUploadResp{Audios: out})
 }
@@ -446,60 +1092,679 @@ func handleUploadAudio(c *gin.Context) {
 func handleConvertAudio(c *gin.Context) {
 	var req convertAudioReq
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.String(http.StatusBadRequest, "bad json: %v", err)
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
 		return
 	}
 	if len(req.Items) == 0 {
-		c.String(http.StatusBadRequest, "no items provided")
+		fail(c, http.StatusBadRequest, "no items provided")
 		return
 	}
-	res := make([]convertAudioItem, 0, len(req.Items))
-	for _, it := range req.Items {
-		mu.Lock()
-		am := audios[it.ID]
-		mu.Unlock()
+	proj := lookupProject(c, req.ProjectID)
+	if req.ProjectID != "" && proj == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", req.ProjectID)
+		return
+	}
+	pr, ok := presetFor(c, req.Preset)
+	if !ok {
+		return
+	}
+	defs := requestDefaults(pr, proj)
+	tasks := make([]convertTask, 0, len(req.Items))
+	var bad itemErrors
+items:
+	for idx, it := range req.Items {
+		if it.Format == "" && len(it.Formats) == 0 {
+			it.Format = cmp.Or(defs.AudioFormat, processDefaults.AudioFormat)
+		}
+		if it.BitrateKbps == 0 {
+			it.BitrateKbps = cmp.Or(defs.AudioBitrateKbps, processDefaults.AudioBitrateKbps)
+		}
+		it.SampleRate = cmp.Or(it.SampleRate, defs.SampleRate)
+		if it.SplitChannels == "" {
+			it.Channels = cmp.Or(it.Channels, defs.Channels)
+		}
+		if it.Normalize == "" && it.TargetLUFS == 0 {
+			it.Normalize, it.TargetLUFS = defs.Normalize, defs.TargetLUFS
+		}
+		am := getAudio(c, it.ID)
 		if am == nil {
-			c.String(http.StatusBadRequest, "unknown audio id: %s", it.ID)
-			return
+			bad.add(idx, it.ID, errUnknownID, "unknown audio id: %s", it.ID)
+			continue items
 		}
-		outPath, err := convertAudio(am.AbsPath, am.Name, it.Format, it.BitrateKbps, it.SampleRate, it.Channels)
+		formats, err := audioconv.NormalizeFormats(it.Format, it.Formats)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "convert failed for %s: %v", am.Name, err)
-			return
+			bad.add(idx, it.ID, "", "%s: %v", am.Name, err)
+			continue items
+		}
+		target, err := resolveLoudnessTarget(it.Normalize, it.TargetLUFS)
+		if err != nil {
+			bad.add(idx, it.ID, "", "%s: %v", am.Name, err)
+			continue items
 		}
-		res = append(res, convertAudioItem{ID: am.ID, Name: am.Name, Format: strings.ToUpper(it.Format), OutURL: "/audio/" + filepath.Base(outPath)})
+		if it.FadeInS < 0 || it.FadeOutS < 0 {
+			bad.add(idx, it.ID, "", "%s: fade durations must not be negative", am.Name)
+			continue items
+		}
+		if it.FadeOutS > 0 && am.DurationS <= 0 {
+			bad.add(idx, it.ID, "", "%s: fade out needs a known duration", am.Name)
+			continue items
+		}
+		if it.Speed != 0 && (it.Speed < 0.25 || it.Speed > 4) {
+			bad.add(idx, it.ID, "", "%s: speed must be between 0.25 and 4", am.Name)
+			continue items
+		}
+		if math.Abs(it.PitchSemitones) > 12 {
+			bad.add(idx, it.ID, "", "%s: pitch_semitones must be between -12 and 12", am.Name)
+			continue items
+		}
+		if it.PitchSemitones != 0 && am.SampleRate <= 0 {
+			bad.add(idx, it.ID, "", "%s: pitch_semitones needs the sample rate, which couldn't be read from the file", am.Name)
+			continue items
+		}
+		if it.AudioFilter != "" {
+			if err := checkFilterChain(it.AudioFilter, safeAudioFilters); err != nil {
+				bad.add(idx, it.ID, "", "%s: audio_filter: %v", am.Name, err)
+				continue items
+			}
+		}
+		coverPath := ""
+		if it.CoverImageID != "" {
+			im := getImage(c, it.CoverImageID)
+			if im == nil {
+				bad.add(idx, it.ID, errUnknownID, "unknown image id: %s", it.CoverImageID)
+				continue items
+			}
+			if !anyFormat(formats, coverArtFormats) {
+				bad.add(idx, it.ID, "", "%s: cover art is only supported for mp3, m4a, alac and flac", am.Name)
+				continue items
+			}
+			coverPath = im.AbsPath
+		}
+		if it.Channels != 0 {
+			if _, ok := audioconv.ChannelLayouts[it.Channels]; !ok {
+				bad.add(idx, it.ID, "", "%s: channels must be 1, 2, 6 (5.1) or 8 (7.1)", am.Name)
+				continue items
+			}
+			for _, f := range formats {
+				if af := audioconv.Formats[f]; af.MaxChannels > 0 && it.Channels > af.MaxChannels {
+					bad.add(idx, it.ID, "", "%s: %s supports at most %d channels", am.Name, f, af.MaxChannels)
+					continue items
+				}
+			}
+		}
+		var downmix []string
+		if am.Channels > 2 && (it.Downmix != "" || it.DownmixGainDB != 0) {
+			target := it.Channels
+			if target == 0 {
+				target = 2
+			}
+			if downmix, err = downmixFilters(it.Downmix, audioStreamLayout(am.ProbeJSON), target, it.DownmixGainDB); err != nil {
+				bad.add(idx, it.ID, "", "%s: %v", am.Name, err)
+				continue items
+			}
+			if it.Channels == 0 {
+				it.Channels = 2
+			}
+		}
+		opts := audioConvertOpts{Format: formats[0], Formats: formats, BitrateKbps: it.BitrateKbps, SampleRate: it.SampleRate, Channels: it.Channels, Loudness: target, FadeInS: it.FadeInS, FadeOutS: it.FadeOutS, Speed: it.Speed, PitchSemis: it.PitchSemitones, DownmixFilters: downmix, DurationS: am.DurationS, SourceRate: am.SampleRate, Tags: it.Tags, StripTags: it.StripTags, TagSource: tagSource(am.ProbeJSON), CoverPath: coverPath, Filter: it.AudioFilter}
+		if target != nil && opts.SampleRate == 0 {
+			// loudnorm upsamples to 192 kHz internally; keep the source rate
+			opts.SampleRate = am.SampleRate
+		}
+		if it.TwoPass {
+			if !slices.ContainsFunc(formats, func(f string) bool { return audioconv.Formats[f].TwoPass() }) {
+				bad.add(idx, it.ID, "", "%s: two_pass needs a format encoded at a target bitrate (mp3, aac, m4a, ogg, opus, wma)", am.Name)
+				continue items
+			}
+			if am.DurationS <= 0 {
+				bad.add(idx, it.ID, "", "%s: two_pass needs a known duration", am.Name)
+				continue items
+			}
+			opts.TwoPass = true
+		}
+		if it.ReplayGain && !anyFormat(formats, replayGainFormats) {
+			bad.add(idx, it.ID, "", "%s: replaygain tags are not supported for %s", am.Name, strings.Join(formats, ", "))
+			continue items
+		}
+		if len(it.Chapters) > 0 {
+			if !anyFormat(formats, chapterFormats) {
+				bad.add(idx, it.ID, "", "%s: chapters are only supported for m4a, alac and mp3", am.Name)
+				continue items
+			}
+			chs, err := sortChapters(it.Chapters)
+			if err != nil {
+				bad.add(idx, it.ID, "", "%s: %v", am.Name, err)
+				continue items
+			}
+			opts.Chapters = chs
+		}
+		if it.SplitChannels != "" {
+			if len(downmix) > 0 || it.Channels > 1 {
+				bad.add(idx, it.ID, "", "%s: split_channels cannot be combined with downmix or multichannel output", am.Name)
+				continue items
+			}
+			split, err := splitChannels(it.SplitChannels, audioStreamLayout(am.ProbeJSON), am.Channels)
+			if err != nil {
+				bad.add(idx, it.ID, "", "%s: %v", am.Name, err)
+				continue items
+			}
+			for _, ch := range split {
+				o := opts
+				o.DownmixFilters = []string{panExtract(ch.Index)}
+				o.Channels = 1
+				o.OutSuffix = "_" + ch.Label
+				tasks = append(tasks, convertTask{am: am, opts: o, replayGain: it.ReplayGain, channel: ch.Label})
+			}
+			continue
+		}
+		tasks = append(tasks, convertTask{am: am, opts: opts, replayGain: it.ReplayGain})
 	}
-	c.JSON(http.StatusOK, gin.H{"results": res})
-}
-
-// ===== helpers / exec =====
-
-func must(err error) {
+	if bad.fail(c) {
+		return
+	}
+	ids := make([]string, len(tasks))
+	names := make([]string, len(tasks))
+	for i, t := range tasks {
+		ids[i], names[i] = t.am.ID, t.am.Name
+	}
+	prio, err := parsePriority(req.Priority)
 	if err != nil {
-		log.Fatal(err)
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
 	}
-}
-
-func ioCopyClose(dst *os.File, src io.Reader) (int64, error) {
-	wrote, cpErr := io.Copy(dst, src)
-	closeErr := dst.Close()
-	if cpErr != nil {
-		return wrote, cpErr
+	binary := wantsBinary(c, "audio/*")
+	if binary && (req.Async || len(tasks) != 1 || len(tasks[0].opts.Formats) != 1) {
+		fail(c, http.StatusBadRequest, "a binary response takes a single, synchronous item with one output format")
+		return
 	}
-	return wrote, closeErr
+	job := newJob(ownerOf(c), requestID(c), "convert_audio", prio, ids, names)
+	job.Params = req
+	if req.Async {
+		go runConvertAudio(job, tasks, proj)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runConvertAudio(job, tasks, proj)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if binary {
+		sendOutput(c, job.ID, resp["results"].([]convertAudioItem)[0].OutURL)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
-func sanitizeName(s string) string {
-	s = strings.ReplaceAll(s, "\\", "_")
-	s = strings.ReplaceAll(s, "/", "_")
-	s = strings.TrimSpace(s)
-	if s == "" {
-		s = "file"
-	}
-	return s
+// convertTask is one validated /convert_audio item.
+type convertTask struct {
+	am         *AudioMeta
+	opts       audioConvertOpts
+	replayGain bool
+	channel    string
 }
 
-func stripExt(s string) string {
+// runConvertAudio converts every task under job, reporting per-item progress,
+// and returns the response body (also stored as the job result). Outputs are
+// recorded on proj when set.
+func runConvertAudio(job *Job, tasks []convertTask, proj *Project) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		res := make([]convertAudioItem, 0, len(tasks))
+		outPaths := make([]string, 0, len(tasks))
+		for i, t := range tasks {
+			job.setItem(i, jobRunning, 0)
+			t.opts.Progress = job.progressFunc(i)
+			t.opts.Owner = job.Owner
+			if t.opts.TwoPass {
+				dir, err := job.scratch(fmt.Sprintf("twopass%d", i))
+				if err != nil {
+					return nil, err
+				}
+				t.opts.Scratch = dir
+			}
+			outs, err := convertAudio(t.am.AbsPath, t.am.Name, t.opts)
+			if err != nil {
+				return nil, fmt.Errorf("convert failed for %s: %w", t.am.Name, err)
+			}
+			for k, outPath := range outs {
+				format := t.opts.Formats[k]
+				item := convertAudioItem{ID: t.am.ID, Name: t.am.Name, Format: strings.ToUpper(format), OutURL: "/audio/" + filepath.Base(outPath), Normalized: t.opts.Loudness, Channel: t.channel}
+				if t.replayGain && replayGainFormats[format] {
+					if item.ReplayGain, err = writeReplayGain(outPath, format); err != nil {
+						return nil, fmt.Errorf("replaygain failed for %s: %w", t.am.Name, err)
+					}
+				}
+				res = append(res, item)
+				outPaths = append(outPaths, outPath)
+			}
+			job.setItem(i, jobDone, 100)
+		}
+		resp := gin.H{"job_id": job.ID, "results": res}
+		if len(outPaths) > 1 {
+			zipPath := filepath.Join(audioDir, "audio_"+time.Now().Format("20060102_150405")+"_"+randID(4)+".zip")
+			if err := zipFiles(zipPath, outPaths); err != nil {
+				return nil, fmt.Errorf("zip failed: %w", err)
+			}
+			resp["zip_url"] = "/audio/" + filepath.Base(zipPath)
+			recordOutputs(job.Owner, "/audio/"+filepath.Base(zipPath))
+		}
+		for _, it := range res {
+			recordProjectOutputs(proj, it.OutURL)
+			recordOutputs(job.Owner, it.OutURL)
+		}
+		return resp, nil
+	})
+}
+
+type trimAudioReq struct {
+	Items []struct {
+		ID       string  `json:"id"`
+		StartS   float64 `json:"start_seconds"`
+		EndS     float64 `json:"end_seconds"`
+		FadeInS  float64 `json:"fade_in_seconds"`
+		FadeOutS float64 `json:"fade_out_seconds"`
+		Format   string  `json:"format"`
+	} `json:"items"`
+}
+
+type trimAudioItem struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	StartS    float64 `json:"start_seconds"`
+	EndS      float64 `json:"end_seconds"`
+	DurationS float64 `json:"duration_seconds"`
+	Format    string  `json:"format"`
+	OutURL    string  `json:"out_url"`
+}
+
+func handleTrimAudio(c *gin.Context) {
+	var req trimAudioReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if len(req.Items) == 0 {
+		fail(c, http.StatusBadRequest, "no items provided")
+		return
+	}
+	res := make([]trimAudioItem, 0, len(req.Items))
+	for _, it := range req.Items {
+		am := getAudio(c, it.ID)
+		if am == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", it.ID)
+			return
+		}
+		start, end := it.StartS, it.EndS
+		if start < 0 {
+			start = 0
+		}
+		if end <= 0 || (am.DurationS > 0 && end > am.DurationS) {
+			end = am.DurationS
+		}
+		if !(end > start) {
+			fail(c, http.StatusBadRequest, "invalid range for %s: start=%g end=%g", am.Name, start, end)
+			return
+		}
+		format := it.Format
+		if strings.TrimSpace(format) == "" {
+			format = strings.TrimPrefix(strings.ToLower(filepath.Ext(am.Name)), ".")
+			if _, err := audioconv.Lookup(format); err != nil {
+				format = "mp3"
+			}
+		}
+		format = strings.ToLower(strings.TrimSpace(format))
+		af, err := audioconv.Lookup(format)
+		if err != nil {
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		out := claimOutput(ownerOf(c), filepath.Join(audioDir, fmt.Sprintf("%s_trim_%s-%s%s", stripExt(sanitizeName(am.Name)), fmtSeconds(start), fmtSeconds(end), af.Ext)))
+		outPath, err := trimAudio(am.AbsPath, out, format, start, end, it.FadeInS, it.FadeOutS)
+		if err != nil {
+			fail(c, http.StatusInternalServerError, "trim failed for %s: %v", am.Name, err)
+			return
+		}
+		res = append(res, trimAudioItem{ID: am.ID, Name: am.Name, StartS: start, EndS: end, DurationS: end - start, Format: strings.ToUpper(format), OutURL: "/audio/" + filepath.Base(outPath)})
+		recordOutputs(ownerOf(c), "/audio/"+filepath.Base(outPath))
+	}
+	resp := gin.H{"results": res}
+	if err := publishOutputs(resp); err != nil {
+		fail(c, http.StatusBadGateway, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type analyzeAudioReq struct {
+	ID        string  `json:"id"`
+	IntervalS float64 `json:"interval_seconds"`
+}
+
+func handleAnalyzeAudio(c *gin.Context) {
+	var req analyzeAudioReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	am := getAudio(c, req.ID)
+	if am == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", req.ID)
+		return
+	}
+	rep, err := analyzeLoudness(am.AbsPath, req.IntervalS)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "analysis failed for %s: %v", am.Name, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": am.ID, "name": am.Name, "duration_seconds": am.DurationS, "loudness": rep})
+}
+
+type concatAudioReq struct {
+	Items []struct {
+		ID    string `json:"id"`
+		Order int    `json:"order"`
+	} `json:"items"`
+	Format      string `json:"format"`
+	BitrateKbps int    `json:"bitrate_kbps"`
+	SampleRate  int    `json:"sample_rate"`
+	Channels    int    `json:"channels"`
+	OutName     string `json:"out_name"`
+	// CrossfadeS overlaps consecutive segments with acrossfade instead of a
+	// hard cut; CrossfadeCurve is any acrossfade curve name (default "tri").
+	CrossfadeS     float64 `json:"crossfade_seconds"`
+	CrossfadeCurve string  `json:"crossfade_curve"`
+}
+
+func handleConcatAudio(c *gin.Context) {
+	var req concatAudioReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if len(req.Items) < 2 {
+		fail(c, http.StatusBadRequest, "need at least two items to concatenate")
+		return
+	}
+	sort.SliceStable(req.Items, func(i, j int) bool { return req.Items[i].Order < req.Items[j].Order })
+	if req.CrossfadeS < 0 || req.CrossfadeS > 60 {
+		fail(c, http.StatusBadRequest, "crossfade_seconds must be between 0 and 60")
+		return
+	}
+	if req.CrossfadeCurve != "" && !crossfadeCurves[req.CrossfadeCurve] {
+		fail(c, http.StatusBadRequest, "unsupported crossfade_curve: %s", req.CrossfadeCurve)
+		return
+	}
+	paths := make([]string, 0, len(req.Items))
+	total := 0.0
+	// without a requested rate the output takes the highest of the inputs'
+	maxRate := 0
+	for i, it := range req.Items {
+		am := getAudio(c, it.ID)
+		if am == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", it.ID)
+			return
+		}
+		// a middle segment is overlapped at both ends
+		need := req.CrossfadeS
+		if i > 0 && i < len(req.Items)-1 {
+			need *= 2
+		}
+		if req.CrossfadeS > 0 && am.DurationS > 0 && am.DurationS <= need {
+			fail(c, http.StatusBadRequest, "%s is shorter than its crossfades (%gs)", am.Name, need)
+			return
+		}
+		maxRate = max(maxRate, am.SampleRate)
+		paths = append(paths, am.AbsPath)
+		total += am.DurationS
+	}
+	if req.SampleRate == 0 {
+		req.SampleRate = maxRate
+	}
+	format := strings.ToLower(strings.TrimSpace(req.Format))
+	if format == "" {
+		format = "mp3"
+	}
+	name := stripExt(sanitizeName(req.OutName))
+	if strings.TrimSpace(req.OutName) == "" {
+		name = "concat_" + time.Now().Format("20060102_150405") + "_" + randID(4)
+	}
+	af, err := audioconv.Lookup(format)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	outPath, err := concatAudio(paths, claimOutput(ownerOf(c), filepath.Join(audioDir, name+af.Ext)), audioConvertOpts{Format: format, BitrateKbps: req.BitrateKbps, SampleRate: req.SampleRate, Channels: req.Channels}, req.CrossfadeS, req.CrossfadeCurve)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "concat failed: %v", err)
+		return
+	}
+	total -= float64(len(paths)-1) * req.CrossfadeS
+	recordOutputs(ownerOf(c), "/audio/"+filepath.Base(outPath))
+	resp := gin.H{"out_url": "/audio/" + filepath.Base(outPath), "count": len(paths), "format": strings.ToUpper(format), "duration_seconds": total}
+	if err := publishOutputs(resp); err != nil {
+		fail(c, http.StatusBadGateway, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type splitAudioReq struct {
+	ID          string  `json:"id"`
+	NoiseDB     float64 `json:"noise_db"`
+	MinSilenceS float64 `json:"min_silence_seconds"`
+	MinSegmentS float64 `json:"min_segment_seconds"`
+	Format      string  `json:"format"`
+}
+
+func handleSplitAudio(c *gin.Context) {
+	var req splitAudioReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if req.NoiseDB == 0 {
+		req.NoiseDB = -35
+	}
+	if req.MinSilenceS <= 0 {
+		req.MinSilenceS = 1
+	}
+	if req.MinSegmentS <= 0 {
+		req.MinSegmentS = 0.5
+	}
+	src := getAudio(c, req.ID)
+	if src == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", req.ID)
+		return
+	}
+	format := strings.ToLower(strings.TrimSpace(req.Format))
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(src.Name)), ".")
+		if _, err := audioconv.Lookup(format); err != nil {
+			format = "wav"
+		}
+	}
+	af, err := audioconv.Lookup(format)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	silences, err := detectSilence(src.AbsPath, req.NoiseDB, req.MinSilenceS)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "silence detection failed for %s: %v", src.Name, err)
+		return
+	}
+	segs := segmentsBetween(silences, src.DurationS, req.MinSegmentS)
+	if len(segs) == 0 {
+		fail(c, http.StatusUnprocessableEntity, "no segments longer than %gs found", req.MinSegmentS)
+		return
+	}
+	out := make([]*AudioMeta, 0, len(segs))
+	for i, seg := range segs {
+		id := randID(8)
+		name := fmt.Sprintf("%s_part%02d%s", stripExt(src.Name), i+1, af.Ext)
+		rel := filepath.Join(id, storedName(name))
+		abs := filepath.Join(uploadDir, rel)
+		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+			fail(c, http.StatusInternalServerError, "mkdir: %v", err)
+			return
+		}
+		if _, err := trimAudio(src.AbsPath, abs, format, seg[0], seg[1], 0, 0); err != nil {
+			fail(c, http.StatusInternalServerError, "split failed for %s part %d: %v", src.Name, i+1, err)
+			return
+		}
+		out = append(out, registerDerivedAudio(src.Owner, id, name, rel))
+	}
+	c.JSON(http.StatusOK, audioUploadResp{Audios: out})
+}
+
+type previewAudioReq struct {
+	ID          string  `json:"id"`
+	StartS      float64 `json:"start_seconds"`
+	LengthS     float64 `json:"seconds"`
+	BitrateKbps int     `json:"bitrate_kbps"`
+}
+
+func handlePreviewAudio(c *gin.Context) {
+	var req previewAudioReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	am := getAudio(c, req.ID)
+	if am == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", req.ID)
+		return
+	}
+	if req.StartS < 0 || (am.DurationS > 0 && req.StartS >= am.DurationS) {
+		fail(c, http.StatusBadRequest, "start_seconds out of range")
+		return
+	}
+	if req.LengthS <= 0 {
+		req.LengthS = 30
+	}
+	req.LengthS = math.Min(req.LengthS, 120)
+	if am.DurationS > 0 {
+		req.LengthS = math.Min(req.LengthS, am.DurationS-req.StartS)
+	}
+	if req.BitrateKbps <= 0 {
+		req.BitrateKbps = 64
+	}
+	name := fmt.Sprintf("%s_%s_%s_%dk.mp3", am.ID, fmtSeconds(req.StartS), fmtSeconds(req.LengthS), req.BitrateKbps)
+	out := filepath.Join(audioDir, "previews", name)
+	if _, err := os.Stat(out); err != nil {
+		if err := renderPreview(am.AbsPath, out, req.StartS, req.LengthS, req.BitrateKbps); err != nil {
+			fail(c, http.StatusInternalServerError, "preview failed for %s: %v", am.Name, err)
+			return
+		}
+	}
+	recordOutputs(am.Owner, "/audio/previews/"+name)
+	c.JSON(http.StatusOK, gin.H{"id": am.ID, "name": am.Name, "start_seconds": req.StartS, "duration_seconds": req.LengthS, "preview_url": "/audio/previews/" + name})
+}
+
+// registerDerivedAudio probes a file the server produced under
+// uploadDir/rel and registers it like an upload of owner so it can be
+// converted.
+func registerDerivedAudio(owner, id, name, rel string) *AudioMeta {
+	abs := filepath.Join(uploadDir, rel)
+	var size int64
+	if st, err := os.Stat(abs); err == nil {
+		size = st.Size()
+	}
+	pa := probeAudio(abs)
+	am := &AudioMeta{ID: id, Name: name, RelPath: rel, AbsPath: abs, SizeBytes: size, Uploaded: time.Now().Format(time.RFC3339), DurationS: pa.DurationS, Codec: pa.Codec, Channels: pa.Channels, SampleRate: pa.SampleRate, BitrateKbps: pa.BitrateKbps, ProbeJSON: pa.JSON, Owner: owner}
+	mu.Lock()
+	audios[id] = am
+	mu.Unlock()
+	putAudio(am)
+	return am
+}
+
+// ===== helpers / exec =====
+
+func must(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ioCopyClose(dst *os.File, src io.Reader) (int64, error) {
+	wrote, cpErr := io.Copy(dst, src)
+	closeErr := dst.Close()
+	if cpErr != nil {
+		return wrote, cpErr
+	}
+	return wrote, closeErr
+}
+
+// zipFiles bundles files into a new ZIP at out, storing each under its base
+// name (suffixed when two files share one).
+func zipFiles(out string, files []string) error {
+	tmp := out + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	seen := map[string]int{}
+	for _, p := range files {
+		name := filepath.Base(p)
+		if n := seen[name]; n > 0 {
+			name = fmt.Sprintf("%s_%d%s", stripExt(name), n+1, filepath.Ext(name))
+		}
+		seen[filepath.Base(p)]++
+		if err = addFileToZip(zw, p, name); err != nil {
+			break
+		}
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+func addFileToZip(zw *zip.Writer, path, name string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(st)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	// media is already compressed; storing avoids burning CPU for nothing
+	hdr.Method = zip.Store
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+func sanitizeName(s string) string {
+	s = strings.ReplaceAll(s, "\\", "_")
+	s = strings.ReplaceAll(s, "/", "_")
+	s = strings.TrimSpace(s)
+	if s == "" {
+		s = "file"
+	}
+	return platformName(s)
+}
+
+func stripExt(s string) string {
 	ext := filepath.Ext(s)
 	return strings.TrimSuffix(s, ext)
 }
@@ -510,562 +1775,531 @@ func randID(n int) string {
 	return hex.EncodeToString(b)
 }
 
+// The library packages run their tools through toolCmd, so the concurrency
+// limits, shutdown cancellation and tool logging apply to them as well.
+func toolRun(name string, args ...string) error { return toolCmd(name, args...).Run() }
+
+func toolOutput(name string, args ...string) ([]byte, error) {
+	return toolCmd(name, args...).Output()
+}
+
 func probeDuration(file string) (float64, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=nw=1:nk=1", file)
-	out, err := cmd.Output()
+	return prober(false).Duration(file)
+}
+
+// probeFrames counts the frames of an animated image; 0 when ffprobe can't
+// read it.
+func probeFrames(file string) int {
+	v, _ := prober(false).Video(file)
+	return v.Frames
+}
+
+// probeAudio describes file's audio; on failure the fields are left zero.
+func probeAudio(file string) probe.Audio {
+	a, _ := prober(false).Audio(file)
+	return a
+}
+
+// frameRunDir holds the frames extracted from video id by run (a job ID).
+// Every run gets its own, so reprocessing a video with other settings
+// can't mix its frames with an earlier run's; see pruneFrameRuns.
+func frameRunDir(id, run string) string {
+	return filepath.Join(framesDir, id, run)
+}
+
+// videoToPDF extracts vm's frames at fps, prepared by prep and through the
+// custom filter chain vf if there is one, into the frame directory of run and binds them into a
+// PDF under pdfsDir, named after the video and the run. progress gets 50
+// once the frames are out.
+func videoToPDF(vm *VideoMeta, run string, fps float64, prep framePrep, vf string, jpegQuality, density, quality int, progress func(float64)) (pdfPath string, imgs []string, st frames.Stats, err error) {
+	// the frames are extracted into the run's scratch space and only kept
+	// once the PDF is built, so a failed run leaves none behind
+	work, imgs, st, err := extractRunFrames(vm, run, fps, prep, vf, jpegQuality)
+	if err != nil {
+		return "", nil, st, err
+	}
+	progress(50)
+	pdfPath = filepath.Join(pdfsDir, vm.ID+"_"+stripExt(sanitizeName(vm.Name))+"_"+run+".pdf")
+	pdf := startStage("pdf", vm.ID)
+	err = imagesToPDF(imgs, pdfPath, density, quality)
+	pdf.end(err)
+	if err != nil {
+		return "", nil, st, fmt.Errorf("pdf build failed: %w", err)
+	}
+	if imgs, err = keepRunFrames(vm.ID, run, work, st.Frames); err != nil {
+		_ = os.Remove(pdfPath)
+		return "", nil, st, err
+	}
+	return pdfPath, imgs, st, nil
+}
+
+// extractRunFrames extracts vm's frames for run into the run's scratch
+// space and returns that directory and the frames.
+func extractRunFrames(vm *VideoMeta, run string, fps float64, prep framePrep, vf string, jpegQuality int) (work string, imgs []string, st frames.Stats, err error) {
+	work, err = jobScratch(run, "frames-"+vm.ID)
 	if err != nil {
-		return 0, err
+		return "", nil, st, err
 	}
-	s := strings.TrimSpace(string(out))
-	if s == "N/A" || s == "" {
-		return 0, errors.New("no duration")
+	pattern := filepath.Join(work, "frame_%05d.jpg")
+	extract := startStage("extract", vm.ID)
+	st, err = extractFrames(vm.AbsPath, pattern, fps, prep, vf, jpegQuality)
+	extract.set("framespdf.frames", st.Frames)
+	extract.set("framespdf.frames_dropped", st.Dropped)
+	extract.set("framespdf.frames_duplicated", st.Duplicated)
+	extract.end(err)
+	if err != nil {
+		return "", nil, st, fmt.Errorf("ffmpeg extraction failed for %s: %w", vm.Name, err)
+	}
+	imgs = frames.Files(pattern, st.Frames)
+	if len(imgs) == 0 {
+		return "", nil, st, errors.New("no frames extracted")
 	}
-	f, err := strconv.ParseFloat(s, 64)
+	return work, imgs, st, nil
+}
+
+// extractToKeep extracts vm's frames straight into the frame directory of
+// run, for a frames_only run.
+func extractToKeep(vm *VideoMeta, run string, fps float64, prep framePrep, vf string, jpegQuality int) ([]string, frames.Stats, error) {
+	work, _, st, err := extractRunFrames(vm, run, fps, prep, vf, jpegQuality)
 	if err != nil {
-		return 0, err
-	}
-	return f, nil
-}
-
-func extractFrames(inPath, outPattern string, fps float64, jpegQ int) (int, error) {
-	filter := fmt.Sprintf("fps=%g:round=up:start_time=0", fps)
-	args := []string{
-		"-hide_banner", "-loglevel", "error", "-nostdin", "-y",
-		"-fflags", "+genpts",
-		"-i", inPath,
-		"-map", "0:v:0",
-		"-vsync", "vfr",
-		"-vf", filter,
-		"-q:v", strconv.Itoa(jpegQ),
-		outPattern,
-	}
-	cmd := exec.Command("ffmpeg", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return 0, err
+		return nil, st, err
 	}
-	files, _ := filepath.Glob(strings.ReplaceAll(outPattern, "%05d", "*"))
-	return len(files), nil
+	imgs, err := keepRunFrames(vm.ID, run, work, st.Frames)
+	return imgs, st, err
 }
 
-func imagesToPDF(imgs []string, outPDF string, density int, quality int) error {
-	bin := "magick"
-	if _, err := exec.LookPath(bin); err != nil {
-		bin = "convert"
-	}
-	args := []string{}
-	for _, img := range imgs {
-		args = append(args, img, "-auto-orient")
-	}
-	args = append(args, "-density", strconv.Itoa(density), "-quality", strconv.Itoa(quality), outPDF)
-	cmd := exec.Command(bin, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
-func probeAudioJSON(file string) (duration float64, codec string, channels int, sampleRate int, bitrateKbps int, rawJSON string, err error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", file)
-	out, e := cmd.Output()
-	if e != nil {
-		err = e
-		return
+// keepRunFrames moves the n frames extracted into work to the frame
+// directory of video id's run and returns them there.
+func keepRunFrames(id, run, work string, n int) ([]string, error) {
+	frameDir := frameRunDir(id, run)
+	_ = os.RemoveAll(frameDir)
+	err := os.MkdirAll(filepath.Dir(frameDir), 0o755)
+	if err == nil {
+		err = os.Rename(work, frameDir)
 	}
-	rawJSON = string(out)
-	var pr struct {
-		Format struct {
-			Duration string `json:"duration"`
-			BitRate  string `json:"bit_rate"`
-		} `json:"format"`
-		Streams []struct {
-			CodecType  string `json:"codec_type"`
-			CodecName  string `json:"codec_name"`
-			Channels   int    `json:"channels"`
-			SampleRate string `json:"sample_rate"`
-			BitRate    string `json:"bit_rate"`
-		} `json:"streams"`
+	if err != nil {
+		return nil, fmt.Errorf("keep frames: %w", err)
 	}
-	_ = json.Unmarshal(out, &pr)
-	if pr.Format.Duration != "" {
-		f, _ := strconv.ParseFloat(pr.Format.Duration, 64)
-		if f > 0 {
-			duration = f
+	return frames.Files(filepath.Join(frameDir, "frame_%05d.jpg"), n), nil
+}
+
+func extractFrames(inPath, outPattern string, fps float64, prep framePrep, vf string, jpegQ int) (frames.Stats, error) {
+	return frames.Extractor{FFmpeg: ffmpegBin, Output: toolOutput, Filter: vf, Prepare: prep.Chain, NoAutorotate: prep.Manual}.Extract(inPath, outPattern, fps, jpegQ)
+}
+
+func imagesToPDF(imgs []string, outPDF string, density int, quality int) error {
+	return pdfgen.Builder{Magick: magickBin, Run: toolRun}.FromImages(imgs, outPDF, density, quality)
+}
+
+func pagesToPDF(pages []pdfgen.Page, outPDF string, density int, quality int) error {
+	return pdfgen.Builder{Magick: magickBin, Run: toolRun}.FromPages(pages, outPDF, density, quality)
+}
+
+// anyFormat reports whether one of formats is in set.
+func anyFormat(formats []string, set map[string]bool) bool {
+	for _, f := range formats {
+		if set[f] {
+			return true
 		}
 	}
-	if pr.Format.BitRate != "" {
-		b, _ := strconv.Atoi(pr.Format.BitRate)
-		if b > 0 {
-			bitrateKbps = b / 1000
+	return false
+}
+
+// convertAudio encodes inAbs into every format of o.Formats (or just
+// o.Format) with one ffmpeg run: the audio is decoded and filtered once and
+// split with asplit. It returns the outputs in format order.
+func convertAudio(inAbs string, inName string, o audioConvertOpts) ([]string, error) {
+	formats := append([]string{}, o.Formats...)
+	if len(formats) == 0 {
+		formats = []string{o.Format}
+	}
+	afs := make([]audioconv.Format, len(formats))
+	outs := make([]string, len(formats))
+	for k, f := range formats {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			f = "mp3"
 		}
+		af, err := audioconv.Lookup(f)
+		if err != nil {
+			return nil, err
+		}
+		formats[k] = f
+		afs[k] = af
+		outs[k] = filepath.Join(audioDir, stripExt(sanitizeName(inName))+o.OutSuffix+af.Ext)
 	}
-	for _, s := range pr.Streams {
-		if s.CodecType == "audio" {
-			codec = s.CodecName
-			if s.Channels > 0 {
-				channels = s.Channels
+	// alac shares .m4a with m4a
+	for k := range outs {
+		for l := 0; l < k; l++ {
+			if outs[l] == outs[k] {
+				outs[k] = stripExt(outs[k]) + "_" + formats[k] + afs[k].Ext
 			}
-			if s.SampleRate != "" {
-				v, _ := strconv.Atoi(s.SampleRate)
-				if v > 0 {
-					sampleRate = v
+		}
+	}
+	for k := range outs {
+		outs[k] = claimOutput(o.Owner, outs[k])
+	}
+
+	sampleRate := o.SampleRate
+	filters := append([]string{}, o.DownmixFilters...)
+	tempo, err := audioconv.TempoPitchFilters(o.Speed, o.PitchSemis, o.SourceRate)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, tempo...)
+	if o.Filter != "" {
+		filters = append(filters, o.Filter)
+	}
+	outDur := o.DurationS
+	if o.Speed > 0 {
+		outDur /= o.Speed
+	}
+	filters = append(filters, audioconv.FadeFilters(o.FadeInS, o.FadeOutS, outDur)...)
+	twoPass := o.TwoPass && o.Scratch != "" && outDur > 0
+	// every pass over the audio (loudness measuring, a first encode, the
+	// encode) is roughly the same share of the work
+	passes, pass := 1, 0
+	if o.Loudness != nil {
+		passes++
+	}
+	if twoPass {
+		passes++
+	}
+	passProgress := func() func(float64) {
+		if o.Progress == nil {
+			return nil
+		}
+		from := float64(pass) * 100 / float64(passes)
+		pass++
+		return func(p float64) { o.Progress(from + p/float64(passes)) }
+	}
+	if o.Loudness != nil {
+		m, err := measureLoudnorm(inAbs, filters, *o.Loudness, outDur, passProgress())
+		if err != nil {
+			return nil, err
+		}
+		// silence has no loudness to bring to the target
+		if !m.silent() {
+			filters = append(filters, loudnormFilter(*o.Loudness, m))
+		}
+		if sampleRate <= 0 {
+			sampleRate = 48000
+		}
+	}
+
+	// all inputs go first; -map and friends are output options
+	inputs := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", inAbs}
+	nextInput := 1
+	coverInput, chapterInput := -1, -1
+	if o.CoverPath != "" && anyFormat(formats, coverArtFormats) {
+		inputs = append(inputs, "-i", o.CoverPath)
+		coverInput = nextInput
+		nextInput++
+	}
+	if len(o.Chapters) > 0 && anyFormat(formats, chapterFormats) {
+		chapPath := outs[0] + ".chapters.txt"
+		if err := os.WriteFile(chapPath, []byte(ffmetadataChapters(o.Chapters, outDur)), 0o644); err != nil {
+			return nil, err
+		}
+		defer os.Remove(chapPath)
+		inputs = append(inputs, "-f", "ffmetadata", "-i", chapPath)
+		chapterInput = nextInput
+	}
+
+	audioMaps := []string{"0:a:0"}
+	var graph string
+	if len(formats) > 1 {
+		chain := append(append([]string{}, filters...), fmt.Sprintf("asplit=%d", len(formats)))
+		graph = "[0:a:0]" + strings.Join(chain, ",")
+		audioMaps = audioMaps[:0]
+		for k := range formats {
+			label := fmt.Sprintf("[a%d]", k)
+			graph += label
+			audioMaps = append(audioMaps, label)
+		}
+	}
+
+	// encode is the ffmpeg run writing each format k to outs[k] at
+	// bitrates[k]
+	encode := func(bitrates []int, outs []string) []string {
+		args := append([]string{}, inputs...)
+		if graph != "" {
+			args = append(args, "-filter_complex", graph)
+		}
+		for k, format := range formats {
+			args = append(args, "-map", audioMaps[k])
+			if coverInput >= 0 && coverArtFormats[format] {
+				coverCodec := "mjpeg"
+				if strings.EqualFold(filepath.Ext(o.CoverPath), ".png") {
+					coverCodec = "png"
 				}
+				args = append(args, "-map", strconv.Itoa(coverInput)+":v:0", "-c:v", coverCodec, "-disposition:v:0", "attached_pic")
+			}
+			if chapterInput >= 0 && chapterFormats[format] {
+				args = append(args, "-map_chapters", strconv.Itoa(chapterInput))
+			} else if chapterInput >= 0 {
+				args = append(args, "-map_chapters", "-1")
+			}
+			if len(formats) == 1 && len(filters) > 0 {
+				args = append(args, "-af", strings.Join(filters, ","))
 			}
-			if s.BitRate != "" {
-				b2, _ := strconv.Atoi(s.BitRate)
-				if b2 > 0 {
-					bitrateKbps = b2 / 1000
+			args = append(args, afs[k].EncodeArgs(bitrates[k], sampleRate, o.Channels)...)
+			if o.StripTags {
+				args = append(args, "-map_metadata", "-1")
+			} else {
+				src := o.TagSource
+				if src == "" {
+					src = "0"
 				}
+				args = append(args, "-map_metadata", src)
+			}
+			args = append(args, o.Tags.args()...)
+			if format == "mp3" {
+				args = append(args, "-id3v2_version", "3", "-write_id3v1", "1")
+			}
+			args = append(args, outs[k])
+		}
+		return args
+	}
+	bitrates := make([]int, len(formats))
+	for k := range bitrates {
+		bitrates[k] = o.BitrateKbps
+	}
+	if twoPass {
+		// the first pass encodes into scratch space to see how far each
+		// encoder lands from the bitrate; the second corrects for it
+		first := make([]string, len(outs))
+		for k := range outs {
+			first[k] = filepath.Join(o.Scratch, fmt.Sprintf("pass1_%d%s", k, afs[k].Ext))
+		}
+		if err := runFFmpeg(encode(bitrates, first), outDur, passProgress(), nil); err != nil {
+			return nil, fmt.Errorf("first pass: %w", err)
+		}
+		for k, f := range first {
+			if fi, err := os.Stat(f); err == nil {
+				bitrates[k] = afs[k].SecondPassKbps(o.BitrateKbps, float64(fi.Size())*8/1000/outDur)
+			}
+			_ = os.Remove(f)
+		}
+	}
+	if err := runFFmpeg(encode(bitrates, outs), outDur, passProgress(), nil); err != nil {
+		return nil, err
+	}
+	return outs, nil
+}
+
+// extractCoverArt writes the attached picture of an uploaded file (if any)
+// next to it and returns its path relative to uploadDir.
+func extractCoverArt(abs, probeJSON, id string) (string, error) {
+	var pr struct {
+		Streams []struct {
+			Index       int            `json:"index"`
+			CodecType   string         `json:"codec_type"`
+			CodecName   string         `json:"codec_name"`
+			Disposition map[string]int `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(probeJSON), &pr); err != nil {
+		return "", err
+	}
+	for _, st := range pr.Streams {
+		if st.CodecType != "video" || st.Disposition["attached_pic"] != 1 {
+			continue
+		}
+		ext := ".jpg"
+		if st.CodecName == "png" {
+			ext = ".png"
+		}
+		rel := filepath.Join(id, "cover_art"+ext)
+		args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", abs, "-map", "0:" + strconv.Itoa(st.Index), "-frames:v", "1"}
+		if st.CodecName == "mjpeg" || st.CodecName == "png" {
+			args = append(args, "-c", "copy")
+		}
+		args = append(args, filepath.Join(uploadDir, rel))
+		cmd := toolCmd(ffmpegBin, args...)
+		if err := cmd.Run(); err != nil {
+			return "", err
+		}
+		return rel, nil
+	}
+	return "", nil
+}
+
+// tagSource picks where the source's tags live: the container (format) for
+// most files, but the audio stream for Ogg/Opus, which store Vorbis comments
+// per stream.
+func tagSource(probeJSON string) string {
+	var pr struct {
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string            `json:"codec_type"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	if json.Unmarshal([]byte(probeJSON), &pr) != nil || len(pr.Format.Tags) > 0 {
+		return "0"
+	}
+	for _, st := range pr.Streams {
+		if st.CodecType == "audio" {
+			if len(st.Tags) > 0 {
+				return "0:s:a:0"
 			}
 			break
 		}
 	}
-	return
+	return "0"
 }
 
-func convertAudio(inAbs string, inName string, format string, bitrateKbps, sampleRate, channels int) (string, error) {
-	format = strings.ToLower(strings.TrimSpace(format))
-	if format == "" {
-		format = "mp3"
+// trimAudio cuts [start, end) out of inAbs and re-encodes it to out in format,
+// optionally fading in/out at the cut points.
+func trimAudio(inAbs string, out string, format string, start, end, fadeIn, fadeOut float64) (string, error) {
+	af, err := audioconv.Lookup(format)
+	if err != nil {
+		return "", err
+	}
+	length := end - start
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-ss", fmt.Sprintf("%.3f", start), "-t", fmt.Sprintf("%.3f", length), "-i", inAbs, "-vn"}
+	filters := audioconv.FadeFilters(fadeIn, fadeOut, length)
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	args = append(args, af.EncodeArgs(0, 0, 0)...)
+	args = append(args, out)
+	cmd := toolCmd(ffmpegBin, args...)
+	if err := cmd.Run(); err != nil {
+		return "", err
 	}
-	base := stripExt(inName)
-	ext := "." + format
-	out := filepath.Join(audioDir, base+ext)
+	return out, nil
+}
 
-	codec := ""
-	switch format {
-	case "mp3":
-		codec = "libmp3lame"
-	case "wav":
-		codec = "pcm_s16le"
-	case "flac":
-		codec = "flac"
-	case "aac":
-		codec = "aac"
-	case "ogg":
-		codec = "libvorbis"
-	case "opus":
-		codec = "libopus"
-	default:
-		return "", fmt.Errorf("unsupported format: %s", format)
+// renderPreview encodes a short low-bitrate stereo MP3 of [start, start+length)
+// with a brief fade-out so clips don't end mid-sound.
+func renderPreview(inAbs, out string, start, length float64, bitrateKbps int) error {
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return err
+	}
+	tmp := out + ".part"
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-ss", fmt.Sprintf("%.3f", start), "-t", fmt.Sprintf("%.3f", length), "-i", inAbs, "-map", "0:a:0",
+		"-af", strings.Join(audioconv.FadeFilters(0, math.Min(1, length/4), length), ",")}
+	args = append(args, audioconv.Formats["mp3"].EncodeArgs(bitrateKbps, 44100, 2)...)
+	args = append(args, "-f", "mp3", tmp)
+	cmd := toolCmd(ffmpegBin, args...)
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(tmp)
+		return err
 	}
+	return os.Rename(tmp, out)
+}
+
+// crossfadeCurves are the afade/acrossfade curve names accepted from clients.
+var crossfadeCurves = map[string]bool{
+	"tri": true, "qsin": true, "esin": true, "hsin": true, "log": true, "ipar": true, "qua": true,
+	"cub": true, "squ": true, "cbr": true, "par": true, "exp": true, "iqsin": true, "ihsin": true,
+	"dese": true, "desi": true, "losi": true, "nofade": true,
+}
 
-	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", inAbs, "-vn", "-c:a", codec}
-	if sampleRate > 0 {
-		args = append(args, "-ar", strconv.Itoa(sampleRate))
+// concatAudio joins ins in order into out. Every input is resampled to a
+// common sample rate and channel layout first so the concat filter accepts it.
+// With crossfade > 0 consecutive inputs overlap via acrossfade instead.
+func concatAudio(ins []string, out string, o audioConvertOpts, crossfade float64, curve string) (string, error) {
+	af, err := audioconv.Lookup(o.Format)
+	if err != nil {
+		return "", err
 	}
-	if channels == 1 || channels == 2 {
-		args = append(args, "-ac", strconv.Itoa(channels))
+	sampleRate := o.SampleRate
+	if sampleRate <= 0 {
+		sampleRate = 44100
 	}
-	if bitrateKbps > 0 {
-		if format == "mp3" || format == "aac" || format == "ogg" || format == "opus" {
-			args = append(args, "-b:a", fmt.Sprintf("%dk", bitrateKbps))
+	layout := "stereo"
+	if o.Channels == 1 {
+		layout = "mono"
+	}
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	var graph, labels strings.Builder
+	for i, in := range ins {
+		args = append(args, "-i", in)
+		fmt.Fprintf(&graph, "[%d:a:0]aresample=%d,aformat=sample_fmts=fltp:sample_rates=%d:channel_layouts=%s[a%d];", i, sampleRate, sampleRate, layout, i)
+		fmt.Fprintf(&labels, "[a%d]", i)
+	}
+	if crossfade > 0 {
+		if curve == "" {
+			curve = "tri"
+		}
+		if !crossfadeCurves[curve] {
+			return "", fmt.Errorf("unsupported crossfade curve: %s", curve)
 		}
+		prev := "a0"
+		for i := 1; i < len(ins); i++ {
+			next := fmt.Sprintf("x%d", i)
+			if i == len(ins)-1 {
+				next = "out"
+			}
+			fmt.Fprintf(&graph, "[%s][a%d]acrossfade=d=%.3f:c1=%s:c2=%s[%s];", prev, i, crossfade, curve, curve, next)
+			prev = next
+		}
+	} else {
+		fmt.Fprintf(&graph, "%sconcat=n=%d:v=0:a=1[out]", labels.String(), len(ins))
 	}
+	args = append(args, "-filter_complex", strings.TrimSuffix(graph.String(), ";"), "-map", "[out]")
+	args = append(args, af.EncodeArgs(o.BitrateKbps, sampleRate, o.Channels)...)
 	args = append(args, out)
-	cmd := exec.Command("ffmpeg", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := toolCmd(ffmpegBin, args...)
 	if err := cmd.Run(); err != nil {
 		return "", err
 	}
 	return out, nil
 }
 
-// ===== HTML =====
-
-const indexHTML = `<!doctype html>
-<html lang="en">
-<head>
-  <meta charset="utf-8" />
-  <meta name="viewport" content="width=device-width, initial-scale=1" />
-  <title>Frames & PDFs</title>
-  <script src="https://cdn.tailwindcss.com"></script>
-  <script>
-    tailwind.config = {
-      theme: {
-        extend: {
-          fontFamily: {
-            'mono': ['ui-monospace', 'SFMono-Regular', 'Menlo', 'Consolas', 'monospace']
-          }
-        }
-      }
-    }
-  </script>
-</head>
-<body class="bg-gray-50 font-sans text-gray-900 p-6 max-w-6xl mx-auto">
-  <div class="mb-8">
-    <h1 class="text-3xl font-bold text-gray-900 mb-2">Video → Frames → PDF</h1>
-    <p class="text-gray-600">Convert videos to frames and generate PDFs with advanced processing options</p>
-  </div>
-
-  <div class="bg-white rounded-xl shadow-sm border border-gray-200 p-6 mb-6">
-    <form id="upForm" class="space-y-4">
-      <div>
-        <label class="block text-sm font-semibold text-gray-700 mb-2">Select videos</label>
-        <p class="text-sm text-gray-500 mb-3">You can pick multiple files</p>
-        <div class="flex items-center gap-3">
-          <input id="videos" name="videos" type="file" accept="video/*" multiple 
-                 class="block w-full text-sm text-gray-500 file:mr-4 file:py-2 file:px-4 file:rounded-lg file:border-0 file:text-sm file:font-medium file:bg-blue-50 file:text-blue-700 hover:file:bg-blue-100 file:cursor-pointer" />
-          <button type="submit" class="px-6 py-2 bg-blue-600 text-white rounded-lg hover:bg-blue-700 transition-colors font-medium">
-            Upload
-          </button>
-        </div>
-      </div>
-    </form>
-    <div class="mt-4 p-3 bg-amber-50 border border-amber-200 rounded-lg">
-      <p class="text-sm text-amber-800">
-        <span class="font-medium">Requirements:</span> Requires ffmpeg & ImageMagick on the server. 
-        PDFs will be available under <span class="font-mono bg-amber-100 px-1 rounded">/download/…</span>
-      </p>
-    </div>
-  </div>
-
-  <div id="list" class="bg-white rounded-xl shadow-sm border border-gray-200 p-6 mb-6" style="display:none;">
-    <div class="grid grid-cols-5 gap-4 items-center pb-3 border-b border-gray-200 mb-4">
-      <div class="font-semibold text-gray-700">File</div>
-      <div class="font-semibold text-gray-700">Duration</div>
-      <div class="font-semibold text-gray-700">FPS</div>
-      <div class="font-semibold text-gray-700">Est. Frames</div>
-      <div class="font-semibold text-gray-700">Info</div>
-    </div>
-    <div id="rows" class="space-y-3"></div>
-    <div class="mt-6 pt-6 border-t border-gray-200">
-      <div class="flex flex-wrap items-center gap-4">
-        <div class="flex items-center gap-2">
-          <label class="text-sm font-medium text-gray-700">JPEG quality:</label>
-          <input id="jpegq" type="number" min="2" max="31" step="1" value="2" 
-                 class="w-20 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-blue-500 focus:border-blue-500" />
-        </div>
-        <div class="flex items-center gap-2">
-          <label class="text-sm font-medium text-gray-700">PDF density:</label>
-          <input id="density" type="number" min="72" step="1" value="150" 
-                 class="w-20 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-blue-500 focus:border-blue-500" />
-        </div>
-        <div class="flex items-center gap-2">
-          <label class="text-sm font-medium text-gray-700">PDF quality:</label>
-          <input id="pdfq" type="number" min="1" max="100" step="1" value="92" 
-                 class="w-20 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-blue-500 focus:border-blue-500" />
-        </div>
-        <button id="goBtn" class="px-6 py-2 bg-green-600 text-white rounded-lg hover:bg-green-700 transition-colors font-medium">
-          Process → PDF
-        </button>
-      </div>
-    </div>
-  </div>
-
-  <div id="results" class="bg-white rounded-xl shadow-sm border border-gray-200 p-6 mb-8" style="display:none;"></div>
-
-  <div class="mb-8">
-    <h2 class="text-3xl font-bold text-gray-900 mb-2">Images → PDF</h2>
-    <p class="text-gray-600">Combine multiple images into a single PDF document</p>
-  </div>
-
-  <div class="bg-white rounded-xl shadow-sm border border-gray-200 p-6 mb-6">
-    <form id="imgForm" class="space-y-4">
-      <div>
-        <label class="block text-sm font-semibold text-gray-700 mb-2">Select images</label>
-        <p class="text-sm text-gray-500 mb-3">You can pick multiple files in any order</p>
-        <div class="flex items-center gap-3">
-          <input id="imgs" name="images" type="file" accept="image/*" multiple 
-                 class="block w-full text-sm text-gray-500 file:mr-4 file:py-2 file:px-4 file:rounded-lg file:border-0 file:text-sm file:font-medium file:bg-purple-50 file:text-purple-700 hover:file:bg-purple-100 file:cursor-pointer" />
-          <button type="submit" class="px-6 py-2 bg-purple-600 text-white rounded-lg hover:bg-purple-700 transition-colors font-medium">
-            Upload
-          </button>
-        </div>
-      </div>
-    </form>
-    
-    <div id="imgList" class="mt-6" style="display:none;">
-      <div class="p-3 bg-blue-50 border border-blue-200 rounded-lg mb-4">
-        <p class="text-sm text-blue-800">
-          <span class="font-medium">Tip:</span> Set the <strong>Order</strong> for each image (1..N). Lower numbers appear first. You can leave gaps—ordering is sorted ascending.
-        </p>
-      </div>
-      <div id="thumbs" class="grid grid-cols-2 md:grid-cols-3 lg:grid-cols-4 xl:grid-cols-5 gap-4 mb-6"></div>
-      <div class="pt-6 border-t border-gray-200">
-        <div class="flex flex-wrap items-center gap-4">
-          <div class="flex items-center gap-2">
-            <label class="text-sm font-medium text-gray-700">PDF density:</label>
-            <input id="idensity" type="number" min="72" step="1" value="150" 
-                   class="w-20 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-purple-500 focus:border-purple-500" />
-          </div>
-          <div class="flex items-center gap-2">
-            <label class="text-sm font-medium text-gray-700">PDF quality:</label>
-            <input id="iquality" type="number" min="1" max="100" step="1" value="92" 
-                   class="w-20 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-purple-500 focus:border-purple-500" />
-          </div>
-          <div class="flex items-center gap-2">
-            <label class="text-sm font-medium text-gray-700">Output name:</label>
-            <input id="iname" type="text" placeholder="optional e.g. album.pdf" 
-                   class="w-40 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-purple-500 focus:border-purple-500" />
-          </div>
-          <button id="imgGo" type="button" class="px-6 py-2 bg-purple-600 text-white rounded-lg hover:bg-purple-700 transition-colors font-medium">
-            Build Images → PDF
-          </button>
-        </div>
-      </div>
-    </div>
-    <div id="imgResult" class="mt-6" style="display:none;"></div>
-  </div>
-
-  <div class="mb-8">
-    <h2 class="text-3xl font-bold text-gray-900 mb-2">Audio → Inspect & Convert</h2>
-    <p class="text-gray-600">Analyze audio files and convert between different formats</p>
-  </div>
-
-  <div class="bg-white rounded-xl shadow-sm border border-gray-200 p-6 mb-6">
-    <form id="audForm" class="space-y-4">
-      <div>
-        <label class="block text-sm font-semibold text-gray-700 mb-2">Select audio</label>
-        <p class="text-sm text-gray-500 mb-3">You can pick multiple files</p>
-        <div class="flex items-center gap-3">
-          <input id="audios" name="audios" type="file" accept="audio/*" multiple 
-                 class="block w-full text-sm text-gray-500 file:mr-4 file:py-2 file:px-4 file:rounded-lg file:border-0 file:text-sm file:font-medium file:bg-emerald-50 file:text-emerald-700 hover:file:bg-emerald-100 file:cursor-pointer" />
-          <button type="submit" class="px-6 py-2 bg-emerald-600 text-white rounded-lg hover:bg-emerald-700 transition-colors font-medium">
-            Upload
-          </button>
-        </div>
-      </div>
-    </form>
-
-    <div id="audList" class="mt-6" style="display:none;">
-      <div class="grid grid-cols-11 gap-2 items-center pb-3 border-b border-gray-200 mb-4 text-sm font-semibold text-gray-700">
-        <div>File</div><div>Dur</div><div>Codec</div><div>Ch</div><div>Rate</div><div>Bitrate</div><div>Format</div><div>BR kbps</div><div>SR Hz</div><div>Ch</div><div>Details</div>
-      </div>
-      <div id="audRows" class="space-y-3"></div>
-      <div class="mt-6 pt-6 border-t border-gray-200">
-        <button id="audGo" type="button" class="px-6 py-2 bg-emerald-600 text-white rounded-lg hover:bg-emerald-700 transition-colors font-medium">
-          Convert Selected
-        </button>
-      </div>
-    </div>
-    <div id="audResults" class="mt-6" style="display:none;"></div>
-  </div>
-
-<script>
-// ----- Videos -----
-const rowsDiv = document.getElementById('rows');
-const listDiv = document.getElementById('list');
-const resultsDiv = document.getElementById('results');
-const upForm = document.getElementById('upForm');
-const goBtn = document.getElementById('goBtn');
-let uploads = [];
-
-upForm.addEventListener('submit', async function(e) {
-  e.preventDefault();
-  const files = document.getElementById('videos').files;
-  if (!files || files.length === 0) { alert('Pick at least one video'); return; }
-  const fd = new FormData();
-  for (const f of files) fd.append('videos', f, f.name);
-  const res = await fetch('/upload', { method: 'POST', body: fd });
-  if (!res.ok) { alert('Upload failed: ' + await res.text()); return; }
-  const data = await res.json();
-  uploads = data.videos || [];
-  renderList();
-});
-
-function renderList() {
-  rowsDiv.innerHTML = '';
-  if (uploads.length === 0) { listDiv.style.display='none'; return; }
-  listDiv.style.display = 'block';
-  for (const v of uploads) {
-    const row = document.createElement('div'); 
-    row.className = 'grid grid-cols-5 gap-4 items-center py-3 border-b border-gray-100 last:border-b-0';
-    const dur = v.duration_seconds || 0; const hms = toHMS(dur);
-    const fpsInput = document.createElement('input'); 
-    fpsInput.type = 'number'; fpsInput.min = '0.1'; fpsInput.step = '0.1'; fpsInput.value = '1';
-    fpsInput.className = 'w-20 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-blue-500 focus:border-blue-500';
-    const estSpan = document.createElement('div'); 
-    estSpan.className = 'font-mono text-sm text-gray-600'; 
-    estSpan.textContent = Math.ceil(1 * dur);
-    fpsInput.oninput = function(){ estSpan.textContent = Math.ceil((Number(fpsInput.value)||0) * dur); };
-    
-    const fileDiv = document.createElement('div');
-    fileDiv.innerHTML = '<span class="font-mono text-sm text-gray-900">'+escapeHTML(v.name)+'</span>';
-    
-    const durDiv = document.createElement('div');
-    durDiv.innerHTML = '<span class="font-mono text-sm text-gray-600">'+hms+'</span>';
-    
-    const info = document.createElement('div'); 
-    info.className = 'text-xs text-gray-500'; 
-    info.textContent = 'id=' + v.id;
-    
-    row.appendChild(fileDiv);
-    row.appendChild(durDiv);
-    row.appendChild(fpsInput); 
-    row.appendChild(estSpan);
-    row.appendChild(info);
-    row.dataset.id = v.id; row.dataset.duration = dur; rowsDiv.appendChild(row);
-  }
-}
-
-goBtn?.addEventListener('click', async function(){
-  const items = []; const jpegq = Number(document.getElementById('jpegq').value || '2'); const density = Number(document.getElementById('density').value || '150'); const pdfq = Number(document.getElementById('pdfq').value || '92');
-  for (const row of rowsDiv.children) { const id = row.dataset.id; const fps = Number(row.querySelector('input[type=number]').value || '1'); items.push({ id: id, fps: fps }); }
-  const payload = { items: items, jpeg_quality: jpegq, pdf_density: density, pdf_quality: pdfq };
-  resultsDiv.style.display = 'block'; resultsDiv.innerHTML = '<div class="text-gray-500 text-center py-4">Processing…</div>';
-  const res = await fetch('/process', { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify(payload) });
-  if (!res.ok) { resultsDiv.innerHTML = '<div class="text-red-600 p-4 bg-red-50 border border-red-200 rounded-lg">'+escapeHTML(await res.text())+'</div>'; return; }
-  const data = await res.json();
-  const headerRow = '<div class="grid grid-cols-5 gap-4 items-center pb-3 border-b border-gray-200 mb-4 font-semibold text-gray-700"><div>File</div><div>Duration</div><div>FPS</div><div>Frames</div><div>PDF</div></div>';
-  const rows = (data.results||[]).map(function(r){ 
-    return '<div class="grid grid-cols-5 gap-4 items-center py-3 border-b border-gray-100 last:border-b-0">' + 
-           '<div><span class="font-mono text-sm text-gray-900">'+escapeHTML(r.name)+'</span></div>' + 
-           '<div><span class="font-mono text-sm text-gray-600">'+toHMS(r.duration_seconds)+'</span></div>' + 
-           '<div><span class="font-mono text-sm text-gray-600">'+r.fps+'</span></div>' + 
-           '<div><span class="font-mono text-sm text-gray-600">'+r.frames_wrote+' (est '+r.estimated_frames+')</span></div>' + 
-           '<div><a href="'+r.pdf_url+'" download class="inline-flex items-center px-3 py-1.5 bg-blue-600 text-white text-sm rounded-lg hover:bg-blue-700 transition-colors">Download PDF</a></div>' + 
-           '</div>'; 
-  }).join('');
-  resultsDiv.innerHTML = headerRow + rows;
-});
-
-// ----- Images -----
-const imgForm = document.getElementById('imgForm');
-const thumbsDiv = document.getElementById('thumbs');
-const imgList = document.getElementById('imgList');
-const imgResult = document.getElementById('imgResult');
-let imgUploads = [];
-
-imgForm.addEventListener('submit', async function(e){
-  e.preventDefault();
-  const files = document.getElementById('imgs').files;
-  if (!files || files.length === 0) { alert('Pick at least one image'); return; }
-  const fd = new FormData(); for (const f of files) fd.append('images', f, f.name);
-  const res = await fetch('/upload_images', { method: 'POST', body: fd });
-  if (!res.ok) { alert('Upload failed: ' + await res.text()); return; }
-  const data = await res.json(); imgUploads = data.images || []; renderThumbs();
-});
-
-function renderThumbs(){
-  thumbsDiv.innerHTML = ''; if (imgUploads.length === 0) { imgList.style.display = 'none'; return; } imgList.style.display = 'block';
-  for (let i=0;i<imgUploads.length;i++){
-    const it = imgUploads[i];
-    const wrap = document.createElement('div'); 
-    wrap.className = 'bg-white border border-gray-200 rounded-lg p-4 text-center hover:shadow-md transition-shadow';
-    const im = document.createElement('img'); 
-    im.src = it.url; 
-    im.className = 'w-full h-32 object-contain mx-auto mb-3 rounded';
-    wrap.appendChild(im);
-    const caption = document.createElement('div'); 
-    caption.className = 'text-xs font-mono text-gray-600 mb-2 truncate'; 
-    caption.textContent = it.name; 
-    wrap.appendChild(caption);
-    const lab = document.createElement('label'); 
-    lab.className='text-xs font-medium text-gray-700 block mb-1'; 
-    lab.textContent = 'Order:'; 
-    wrap.appendChild(lab);
-    const order = document.createElement('input'); 
-    order.type='number'; order.step='1'; order.min='1'; order.value = String(i+1); 
-    order.className='orderInput w-full px-2 py-1 border border-gray-300 rounded text-sm focus:ring-2 focus:ring-purple-500 focus:border-purple-500'; 
-    wrap.appendChild(order);
-    wrap.dataset.id = it.id; thumbsDiv.appendChild(wrap);
-  }
-}
-
-document.getElementById('imgGo').addEventListener('click', async function(){
-  const density = Number(document.getElementById('idensity').value || '150'); const quality = Number(document.getElementById('iquality').value || '92'); const outName = document.getElementById('iname').value || '';
-  const items = []; const cards = thumbsDiv.children; for (let i=0;i<cards.length;i++){ const id = cards[i].dataset.id; const ord = Number(cards[i].querySelector('input.orderInput').value || (i+1)); items.push({ id: id, order: ord }); }
-  imgResult.style.display='block'; imgResult.innerHTML = '<div class="text-gray-500 text-center py-4">Building PDF…</div>';
-  const payload = { items: items, pdf_density: density, pdf_quality: quality, out_name: outName };
-  const res = await fetch('/images_pdf', { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify(payload) });
-  if (!res.ok) { imgResult.innerHTML = '<div class="text-red-600 p-4 bg-red-50 border border-red-200 rounded-lg">'+escapeHTML(await res.text())+'</div>'; return; }
-  const dat = await res.json(); 
-  imgResult.innerHTML = '<div class="p-4 bg-green-50 border border-green-200 rounded-lg"><a href="'+dat.pdf_url+'" download class="inline-flex items-center px-4 py-2 bg-green-600 text-white rounded-lg hover:bg-green-700 transition-colors font-medium">Download Images PDF</a> <span class="ml-3 text-green-700">('+dat.count+' pages)</span></div>';
-});
-
-// ----- Audio -----
-const audForm = document.getElementById('audForm');
-const audList = document.getElementById('audList');
-const audRows = document.getElementById('audRows');
-const audGo = document.getElementById('audGo');
-const audResults = document.getElementById('audResults');
-let audUploads = [];
-
-audForm.addEventListener('submit', async function(e){
-  e.preventDefault();
-  const files = document.getElementById('audios').files;
-  if (!files || files.length === 0) { alert('Pick at least one audio'); return; }
-  const fd = new FormData(); for (const f of files) fd.append('audios', f, f.name);
-  const res = await fetch('/upload_audio', { method: 'POST', body: fd });
-  if (!res.ok) { alert('Upload failed: ' + await res.text()); return; }
-  const data = await res.json(); audUploads = data.audios || []; renderAud();
-});
-
-function renderAud(){
-  audRows.innerHTML=''; if (audUploads.length===0){audList.style.display='none'; return;} audList.style.display='block';
-  for (let i=0;i<audUploads.length;i++){
-    const a = audUploads[i];
-    const row = document.createElement('div'); 
-    row.className='grid grid-cols-11 gap-2 items-center py-3 border-b border-gray-100 last:border-b-0 text-sm';
-    const dur = toHMS(a.duration_seconds||0);
-    const br = (a.bitrate_kbps||0) ? (a.bitrate_kbps+' kbps') : '-';
-    
-    const fileDiv = document.createElement('div');
-    fileDiv.innerHTML = '<span class="font-mono text-gray-900 text-xs truncate block">'+escapeHTML(a.name)+'</span>';
-    
-    row.appendChild(fileDiv);
-    row.innerHTML += '<div class="font-mono text-gray-600">'+dur+'</div>'+
-      '<div class="font-mono text-gray-600">'+(a.codec||'-')+'</div>'+
-      '<div class="font-mono text-gray-600">'+(a.channels||'-')+'</div>'+
-      '<div class="font-mono text-gray-600">'+(a.sample_rate||'-')+'</div>'+
-      '<div class="font-mono text-gray-600">'+br+'</div>';
-    
-    const fmt = document.createElement('select');
-    fmt.className = 'px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
-    ;['mp3','wav','flac','aac','ogg','opus'].forEach(function(opt){ const o=document.createElement('option'); o.value=opt; o.textContent=opt; if(opt==='mp3') o.selected=true; fmt.appendChild(o); });
-    
-    const brI = document.createElement('input'); 
-    brI.type='number'; brI.min='32'; brI.max='512'; brI.step='16'; brI.value= String(a.bitrate_kbps||192);
-    brI.className = 'w-16 px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
-    
-    const srI = document.createElement('input'); 
-    srI.type='number'; srI.min='8000'; srI.max='192000'; srI.step='1000'; srI.value= String(a.sample_rate||44100);
-    srI.className = 'w-16 px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
-    
-    const chI = document.createElement('input'); 
-    chI.type='number'; chI.min='1'; chI.max='2'; chI.step='1'; chI.value= String(a.channels||2);
-    chI.className = 'w-12 px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
-    
-    const det = document.createElement('button'); 
-    det.type='button'; det.textContent='Details';
-    det.className = 'px-2 py-1 bg-gray-100 text-gray-700 rounded text-xs hover:bg-gray-200 transition-colors';
-    
-    const pre = document.createElement('pre'); 
-    pre.className='bg-gray-50 p-3 rounded-lg text-xs overflow-auto max-h-64 mt-2 border border-gray-200 col-span-11'; 
-    pre.style.display='none'; 
-    pre.textContent = a.probe_json||'';
-    det.onclick = function(){ pre.style.display = (pre.style.display==='none'?'block':'none'); };
-
-    row.appendChild(fmt); row.appendChild(brI); row.appendChild(srI); row.appendChild(chI); row.appendChild(det);
-    audRows.appendChild(row); audRows.appendChild(pre);
-
-    row.dataset.id = a.id;
-  }
-}
-
-audGo.addEventListener('click', async function(){
-  const items = []; const children = audRows.children;
-  for (let i=0;i<children.length;i+=2){
-    const row = children[i]; if (!row || !row.classList.contains('grid')) continue;
-    const id = row.dataset.id; const selects = row.getElementsByTagName('select'); const inputs = row.getElementsByTagName('input');
-    const fmt = selects[0].value; const br = Number(inputs[0].value||'192'); const sr = Number(inputs[1].value||'44100'); const ch = Number(inputs[2].value||'2');
-    items.push({ id: id, format: fmt, bitrate_kbps: br, sample_rate: sr, channels: ch });
-  }
-  audResults.style.display='block'; audResults.innerHTML='<div class="text-gray-500 text-center py-4">Converting…</div>';
-  const res = await fetch('/convert_audio', { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify({ items: items }) });
-  if (!res.ok) { audResults.innerHTML = '<div class="text-red-600 p-4 bg-red-50 border border-red-200 rounded-lg">'+escapeHTML(await res.text())+'</div>'; return; }
-  const data = await res.json();
-  const rows = (data.results||[]).map(function(r){ 
-    return '<div class="p-3 bg-gray-50 border border-gray-200 rounded-lg mb-2"><a href="'+r.out_url+'" download class="inline-flex items-center px-3 py-1.5 bg-emerald-600 text-white text-sm rounded-lg hover:bg-emerald-700 transition-colors">'+escapeHTML(r.name)+' → '+escapeHTML(r.format)+'</a></div>'; 
-  }).join('');
-  audResults.innerHTML = rows || '<div class="text-gray-500 text-center py-4">No results</div>';
-});
-
-function toHMS(sec) { sec = Number(sec||0); const h = Math.floor(sec/3600); const m = Math.floor((sec%3600)/60); const s = (sec - h*3600 - m*60).toFixed(3); return pad(h)+":"+pad(m)+":"+s.padStart(6,'0'); }
-function pad(n){ return String(n).padStart(2,'0'); }
-function escapeHTML(s){ return (s||'').replace(/[&<>"']/g, function(c){ return {"&":"&amp;","<":"&lt;",">":"&gt;","\"":"&quot;","'":"&#39;"}[c]; }); }
-</script>
-</body>
-</html>`
+var (
+	silenceStartRe = regexp.MustCompile(`silence_start:\s*(-?[\d.]+)`)
+	silenceEndRe   = regexp.MustCompile(`silence_end:\s*(-?[\d.]+)`)
+)
+
+// detectSilence returns the [start, end] ranges silencedetect reports for
+// stretches quieter than noiseDB lasting at least minSilence seconds. A
+// trailing silence without an end is closed at math.Inf(1).
+func detectSilence(inAbs string, noiseDB, minSilence float64) ([][2]float64, error) {
+	filter := fmt.Sprintf("silencedetect=noise=%gdB:d=%g", noiseDB, minSilence)
+	cmd := toolCmd(ffmpegBin, "-hide_banner", "-nostdin", "-nostats", "-i", inAbs, "-vn", "-af", filter, "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	var out [][2]float64
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if m := silenceStartRe.FindStringSubmatch(line); m != nil {
+			f, _ := strconv.ParseFloat(m[1], 64)
+			out = append(out, [2]float64{math.Max(f, 0), math.Inf(1)})
+		} else if m := silenceEndRe.FindStringSubmatch(line); m != nil && len(out) > 0 {
+			f, _ := strconv.ParseFloat(m[1], 64)
+			out[len(out)-1][1] = f
+		}
+	}
+	return out, nil
+}
+
+// segmentsBetween returns the non-silent ranges of a recording of the given
+// duration, dropping any shorter than minLen.
+func segmentsBetween(silences [][2]float64, duration, minLen float64) [][2]float64 {
+	var segs [][2]float64
+	cur := 0.0
+	for _, s := range silences {
+		if s[0]-cur >= minLen {
+			segs = append(segs, [2]float64{cur, s[0]})
+		}
+		cur = s[1]
+	}
+	if duration > 0 && duration-cur >= minLen {
+		segs = append(segs, [2]float64{cur, duration})
+	}
+	return segs
+}
+
+// fmtSeconds renders seconds for use in file names, e.g. 83.5 -> "83.5s".
+func fmtSeconds(f float64) string {
+	return strconv.FormatFloat(math.Round(f*1000)/1000, 'f', -1, 64) + "s"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Modules: a deployment can switch off whole parts of the service with
+// -modules (FRAMESPDF_MODULES, or modules: in the config file), a
+// comma-separated list of the ones to keep: video, images and audio, all
+// on by default. A module that is off has no routes, no section in the
+// web UI and takes no uploads of its kind, and the uploads of its kind
+// already stored read as unknown. ffmpeg and ffprobe are only needed when
+// video or audio is on, so "-modules images" runs with ImageMagick alone.
+
+// allModules are the modules, in the order the UI shows them.
+var allModules = []string{"video", "images", "audio"}
+
+// modules are the enabled modules.
+var modules = append([]string{}, allModules...)
+
+// kindModules maps an upload kind to the module that handles it.
+var kindModules = map[string]string{"video": "video", "image": "images", "audio": "audio"}
+
+// parseModules reads a -modules list.
+func parseModules(list []string) ([]string, error) {
+	var out []string
+	for _, m := range list {
+		for _, name := range strings.Split(m, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" || slices.Contains(out, name) {
+				continue
+			}
+			if !slices.Contains(allModules, name) {
+				return nil, fmt.Errorf("unknown module %q: modules are %s", name, strings.Join(allModules, ", "))
+			}
+			out = append(out, name)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("-modules must enable at least one of %s", strings.Join(allModules, ", "))
+	}
+	return out, nil
+}
+
+// moduleOn reports whether the module name is enabled.
+func moduleOn(name string) bool {
+	return slices.Contains(modules, name)
+}
+
+// kindOn reports whether uploads of kind (video, image, audio) are taken.
+func kindOn(kind string) bool {
+	return moduleOn(kindModules[kind])
+}
+
+// enabledModules is which modules are on, for the UI's templates.
+func enabledModules() map[string]bool {
+	on := map[string]bool{}
+	for _, m := range allModules {
+		on[m] = moduleOn(m)
+	}
+	return on
+}
+
+// needsFFmpeg reports whether an enabled module runs ffmpeg and ffprobe.
+func needsFFmpeg() bool {
+	return moduleOn("video") || moduleOn("audio")
+}
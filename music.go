@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Analysis runs on a mono, low-rate decode of at most musicMaxSeconds.
+const (
+	musicRate       = 11025
+	musicMaxSeconds = 600
+)
+
+// Krumhansl-Schmuckler key profiles, starting at the tonic.
+var (
+	majorProfile = [12]float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minorProfile = [12]float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+	pitchNames   = [12]string{"C", "C#", "D", "Eb", "E", "F", "F#", "G", "Ab", "A", "Bb", "B"}
+)
+
+type analyzeMusicReq struct {
+	IDs      []string `json:"ids"`
+	Async    bool     `json:"async"`
+	Priority string   `json:"priority"`
+}
+
+// musicAnalysis is the tempo/key estimate for one upload. Confidences are
+// 0..1 and mostly useful for ranking; low values mean "don't trust this".
+type musicAnalysis struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	BPM           float64 `json:"bpm"`
+	BPMConfidence float64 `json:"bpm_confidence"`
+	Key           string  `json:"key"`
+	Camelot       string  `json:"camelot"`
+	KeyConfidence float64 `json:"key_confidence"`
+}
+
+func handleAnalyzeMusic(c *gin.Context) {
+	var req analyzeMusicReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if len(req.IDs) == 0 {
+		fail(c, http.StatusBadRequest, "no ids provided")
+		return
+	}
+	list := make([]*AudioMeta, 0, len(req.IDs))
+	names := make([]string, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		am := getAudio(c, id)
+		if am == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", id)
+			return
+		}
+		list = append(list, am)
+		names = append(names, am.Name)
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	job := newJob(ownerOf(c), requestID(c), "analyze_music", prio, req.IDs, names)
+	job.Params = req
+	if req.Async {
+		go runAnalyzeMusic(job, list)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runAnalyzeMusic(job, list)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func runAnalyzeMusic(job *Job, list []*AudioMeta) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		res := make([]musicAnalysis, 0, len(list))
+		for i, am := range list {
+			job.setItem(i, jobRunning, 0)
+			a, err := analyzeMusic(am.AbsPath)
+			if err != nil {
+				return nil, fmt.Errorf("analysis failed for %s: %w", am.Name, err)
+			}
+			a.ID, a.Name = am.ID, am.Name
+			res = append(res, *a)
+			job.setItem(i, jobDone, 100)
+		}
+		resp := gin.H{"job_id": job.ID, "results": res}
+		return resp, nil
+	})
+}
+
+// analyzeMusic estimates tempo and key of inAbs.
+func analyzeMusic(inAbs string) (*musicAnalysis, error) {
+	pcm, err := decodeMono(inAbs, musicRate, musicMaxSeconds)
+	if err != nil {
+		return nil, err
+	}
+	if len(pcm) < musicRate*5 {
+		return nil, fmt.Errorf("need at least 5 seconds of audio")
+	}
+	a := &musicAnalysis{}
+	a.BPM, a.BPMConfidence = estimateBPM(pcm, musicRate)
+	var tonic int
+	var minor bool
+	tonic, minor, a.KeyConfidence = estimateKey(pcm, musicRate)
+	a.Key, a.Camelot = keyName(tonic, minor)
+	return a, nil
+}
+
+// decodeMono decodes up to maxS seconds of inAbs to mono float32 PCM at rate.
+func decodeMono(inAbs string, rate, maxS int) ([]float32, error) {
+	cmd := toolCmd(ffmpegBin, "-hide_banner", "-loglevel", "error", "-nostdin", "-i", inAbs,
+		"-vn", "-t", fmt.Sprint(maxS), "-ac", "1", "-ar", fmt.Sprint(rate), "-f", "f32le", "pipe:1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("decode: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	pcm := make([]float32, stdout.Len()/4)
+	if err := binary.Read(&stdout, binary.LittleEndian, pcm); err != nil {
+		return nil, err
+	}
+	return pcm, nil
+}
+
+// estimateBPM autocorrelates an energy-flux onset envelope and picks the
+// strongest period between 60 and 200 BPM, weighted towards 120 BPM to
+// avoid half/double tempo picks.
+func estimateBPM(pcm []float32, rate int) (float64, float64) {
+	const hop = 256
+	fps := float64(rate) / hop
+	n := len(pcm) / hop
+	env := make([]float64, n)
+	prev := 0.0
+	for i := 0; i < n; i++ {
+		e := 0.0
+		for _, v := range pcm[i*hop : (i+1)*hop] {
+			e += float64(v) * float64(v)
+		}
+		e = math.Log1p(1000 * e / hop)
+		if d := e - prev; d > 0 {
+			env[i] = d
+		}
+		prev = e
+	}
+	mean := 0.0
+	for _, v := range env {
+		mean += v
+	}
+	mean /= float64(n)
+	for i := range env {
+		env[i] -= mean
+	}
+	ac := func(lag int) float64 {
+		s := 0.0
+		for i := lag; i < n; i++ {
+			s += env[i] * env[i-lag]
+		}
+		return s / float64(n-lag)
+	}
+	ac0 := ac(0)
+	if ac0 <= 0 {
+		return 0, 0
+	}
+	minLag := int(60 * fps / 200)
+	maxLag := int(math.Ceil(60 * fps / 60))
+	vals := make([]float64, maxLag+2)
+	best, bestScore := 0, math.Inf(-1)
+	for lag := minLag; lag <= maxLag+1; lag++ {
+		vals[lag] = ac(lag)
+	}
+	for lag := minLag + 1; lag <= maxLag; lag++ {
+		bpm := 60 * fps / float64(lag)
+		w := math.Exp(-0.5 * math.Pow(math.Log2(bpm/120)/0.9, 2))
+		if score := vals[lag] * w; score > bestScore {
+			best, bestScore = lag, score
+		}
+	}
+	if best == 0 {
+		return 0, 0
+	}
+	// parabolic interpolation around the peak for sub-frame precision
+	lag := float64(best)
+	if y0, y1, y2 := vals[best-1], vals[best], vals[best+1]; y0-2*y1+y2 != 0 {
+		lag += 0.5 * (y0 - y2) / (y0 - 2*y1 + y2)
+	}
+	bpm := math.Round(60*fps/lag*10) / 10
+	conf := math.Max(0, math.Min(1, vals[best]/ac0))
+	return bpm, math.Round(conf*100) / 100
+}
+
+// estimateKey builds a chromagram with Goertzel filters over MIDI notes
+// 40..88 and correlates it with the 24 rotated key profiles.
+func estimateKey(pcm []float32, rate int) (tonic int, minor bool, conf float64) {
+	const frame = 4096
+	win := make([]float64, frame)
+	for i := range win {
+		win[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frame-1))
+	}
+	var chroma [12]float64
+	buf := make([]float64, frame)
+	for off := 0; off+frame <= len(pcm); off += frame {
+		for i := range buf {
+			buf[i] = float64(pcm[off+i]) * win[i]
+		}
+		for note := 40; note <= 88; note++ {
+			f := 440 * math.Pow(2, float64(note-69)/12)
+			coef := 2 * math.Cos(2*math.Pi*f/float64(rate))
+			var s1, s2 float64
+			for _, x := range buf {
+				s1, s2 = x+coef*s1-s2, s1
+			}
+			chroma[note%12] += math.Sqrt(math.Max(0, s1*s1+s2*s2-coef*s1*s2))
+		}
+	}
+	best := math.Inf(-1)
+	for k := 0; k < 12; k++ {
+		for _, m := range []bool{false, true} {
+			prof := majorProfile
+			if m {
+				prof = minorProfile
+			}
+			var rot [12]float64
+			for i := range rot {
+				rot[i] = prof[(i-k+12)%12]
+			}
+			if r := pearson(chroma[:], rot[:]); r > best {
+				best, tonic, minor = r, k, m
+			}
+		}
+	}
+	return tonic, minor, math.Round(math.Max(0, best)*100) / 100
+}
+
+func pearson(a, b []float64) float64 {
+	var ma, mb float64
+	for i := range a {
+		ma += a[i]
+		mb += b[i]
+	}
+	ma /= float64(len(a))
+	mb /= float64(len(b))
+	var num, da, db float64
+	for i := range a {
+		num += (a[i] - ma) * (b[i] - mb)
+		da += (a[i] - ma) * (a[i] - ma)
+		db += (b[i] - mb) * (b[i] - mb)
+	}
+	if da == 0 || db == 0 {
+		return 0
+	}
+	return num / math.Sqrt(da*db)
+}
+
+// keyName returns e.g. "A minor" and its Camelot wheel code ("8A").
+func keyName(tonic int, minor bool) (string, string) {
+	if minor {
+		// a minor key shares its Camelot number with the relative major
+		return pitchNames[tonic] + " minor", fmt.Sprintf("%dA", ((tonic+3)%12*7+7)%12+1)
+	}
+	return pitchNames[tonic] + " major", fmt.Sprintf("%dB", (tonic*7+7)%12+1)
+}
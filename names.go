@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// File names: an upload keeps the name it was sent with as its Name,
+// Unicode and right-to-left scripts included, but is stored as
+// uploads/<id>/source<.ext>, so the name never has to be valid on the
+// server's file system or survive in a URL. Downloads carry the name in
+// their Content-Disposition header instead (RFC 6266, with the RFC 5987
+// filename* for anything beyond ASCII). Outputs named after an upload go
+// through sanitizeName.
+
+// maxNameBytes bounds a display name, like most file systems bound one.
+const maxNameBytes = 255
+
+// displayName is the name of an uploaded file as sent: its last path
+// element (browsers on Windows may send C:\fakepath\...), without control
+// characters and surrounding space.
+func displayName(raw string) string {
+	if i := strings.LastIndexAny(raw, `/\`); i >= 0 {
+		raw = raw[i+1:]
+	}
+	s := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, raw))
+	if len(s) > maxNameBytes {
+		ext := filepath.Ext(s)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		s = strings.ToValidUTF8(s[:maxNameBytes-len(ext)], "") + ext
+	}
+	if s == "" || s == "." || s == ".." {
+		return "file"
+	}
+	return s
+}
+
+var storedExtRe = regexp.MustCompile(`^\.[A-Za-z0-9]{1,10}$`)
+
+// storedName is the file name an upload called name is stored under:
+// "source" plus name's extension when it is a plain one, which tools like
+// ImageMagick go by.
+func storedName(name string) string {
+	if ext := filepath.Ext(name); storedExtRe.MatchString(ext) {
+		return "source" + strings.ToLower(ext)
+	}
+	return "source"
+}
+
+// contentDisposition is a Content-Disposition header value for name: an
+// ASCII filename for old clients and, when name needs more, filename* in
+// UTF-8.
+func contentDisposition(disposition, name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	v := disposition + `; filename="` + ascii + `"`
+	if ascii == name {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		// RFC 5987 attr-char
+		if c := name[i]; c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return v + "; filename*=UTF-8''" + b.String()
+}
+
+// downloadName sets the Content-Disposition of a static file: an upload's
+// own file is named by its Name, everything else by its file name.
+// ?download=1 makes it an attachment; otherwise it's shown inline.
+func downloadName(c *gin.Context) {
+	p := c.Request.URL.Path
+	name := filepath.Base(filepath.FromSlash(p))
+	if rest, ok := strings.CutPrefix(p, "/uploads/"); ok {
+		id, file, _ := strings.Cut(rest, "/")
+		mu.Lock()
+		var rel, upName string
+		if vm := videos[id]; vm != nil {
+			rel, upName = vm.RelPath, vm.Name
+		} else if im := images[id]; im != nil {
+			rel, upName = im.RelPath, im.Name
+		} else if am := audios[id]; am != nil {
+			rel, upName = am.RelPath, am.Name
+		}
+		mu.Unlock()
+		if rel != "" && file == filepath.ToSlash(filepath.Base(rel)) {
+			name = upName
+		}
+	}
+	disposition := "inline"
+	if c.Query("download") != "" {
+		disposition = "attachment"
+	}
+	if name != "" && name != "." && name != "/" {
+		c.Header("Content-Disposition", contentDisposition(disposition, name))
+	}
+	c.Next()
+}
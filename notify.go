@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notifications announce finished jobs on Slack, Discord and/or by email,
+// with links to the outputs. Configured with the config file's
+// notifications section or FRAMESPDF_SLACK_WEBHOOK, FRAMESPDF_DISCORD_WEBHOOK
+// and FRAMESPDF_SMTP_*; nothing is sent unless a channel is set up.
+var (
+	slackWebhook   string
+	discordWebhook string
+	smtpConfig     smtpSettings
+	// publicURL is prepended to output links, e.g. "https://frames.example.com".
+	publicURL string
+	// notifyFailedOnly skips jobs that succeeded.
+	notifyFailedOnly bool
+	// notifyMinDuration skips jobs that ran shorter, so quick conversions
+	// don't flood the channel.
+	notifyMinDuration time.Duration
+)
+
+// smtpSettings is the mail server notifications are sent through.
+type smtpSettings struct {
+	Addr     string   `yaml:"addr"` // host:port
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+var notifyClient = &http.Client{Timeout: 15 * time.Second}
+
+func notificationsEnabled() bool {
+	return slackWebhook != "" || discordWebhook != "" || smtpConfig.Addr != "" && len(smtpConfig.To) > 0
+}
+
+// notifyJob sends j's outcome to every configured channel. It runs in the
+// background; failures are only logged.
+func notifyJob(j Job) {
+	if !notificationsEnabled() || j.Status == jobDone && notifyFailedOnly {
+		return
+	}
+	if started, err := time.Parse(time.RFC3339, j.Started); err == nil && notifyMinDuration > 0 {
+		if finished, err := time.Parse(time.RFC3339, j.Finished); err == nil && finished.Sub(started) < notifyMinDuration {
+			return
+		}
+	}
+	subject, text := jobMessage(j)
+	go func() {
+		if slackWebhook != "" {
+			if err := postWebhook(slackWebhook, map[string]string{"text": text}); err != nil {
+				slog.Warn("notify failed", "channel", "slack", "job_id", j.ID, "error", err.Error())
+			}
+		}
+		if discordWebhook != "" {
+			// Discord caps messages at 2000 characters
+			msg := text
+			if len(msg) > 2000 {
+				msg = strings.ToValidUTF8(msg[:1997], "") + "..."
+			}
+			if err := postWebhook(discordWebhook, map[string]string{"content": msg}); err != nil {
+				slog.Warn("notify failed", "channel", "discord", "job_id", j.ID, "error", err.Error())
+			}
+		}
+		if smtpConfig.Addr != "" && len(smtpConfig.To) > 0 {
+			if err := sendMail(subject, text); err != nil {
+				slog.Warn("notify failed", "channel", "email", "job_id", j.ID, "error", err.Error())
+			}
+		}
+	}()
+}
+
+// jobMessage renders the subject and plain-text body announcing j.
+func jobMessage(j Job) (subject, text string) {
+	names := make([]string, 0, len(j.Items))
+	for _, it := range j.Items {
+		if it.Name != "" {
+			names = append(names, it.Name)
+		}
+	}
+	what := j.Type
+	if len(names) > 0 {
+		what += " of " + strings.Join(names, ", ")
+		if len(what) > 120 {
+			what = strings.ToValidUTF8(what[:117], "") + "..."
+		}
+	}
+	var b strings.Builder
+	if j.Status == jobDone {
+		subject = "✅ Job finished: " + what
+		fmt.Fprintf(&b, "%s\n", subject)
+	} else {
+		subject = "❌ Job failed: " + what
+		fmt.Fprintf(&b, "%s\nError: %s\n", subject, j.Error)
+	}
+	if len(j.Attempts) > 1 {
+		fmt.Fprintf(&b, "Attempts: %d\n", len(j.Attempts))
+	}
+	for _, u := range resultURLs(j.Result) {
+		fmt.Fprintf(&b, "%s%s\n", publicURL, u)
+	}
+	fmt.Fprintf(&b, "Status: %s/jobs/%s\n", publicURL, j.ID)
+	return subject, b.String()
+}
+
+// resultURLs collects the output links anywhere in a job result.
+func resultURLs(result any) []string {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	var v any
+	if json.Unmarshal(raw, &v) != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var walk func(any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for _, x := range v {
+				walk(x)
+			}
+		case []any:
+			for _, x := range v {
+				walk(x)
+			}
+		case string:
+			if outputPath(v) != "" || strings.HasPrefix(v, "/uploads/") {
+				seen[v] = true
+			}
+		}
+	}
+	walk(v)
+	out := make([]string, 0, len(seen))
+	for u := range seen {
+		out = append(out, u)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func postWebhook(target string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func sendMail(subject, text string) error {
+	host, _, _ := strings.Cut(smtpConfig.Addr, ":")
+	var auth smtp.Auth
+	if smtpConfig.Username != "" {
+		auth = smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, host)
+	}
+	from := smtpConfig.From
+	if from == "" {
+		from = "framespdf@" + host
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", from, strings.Join(smtpConfig.To, ", "), mime.QEncoding.Encode("utf-8", subject))
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(smtpConfig.Addr, auth, from, smtpConfig.To, msg.Bytes())
+}
+
+// validateNotifyURL checks a webhook setting.
+func validateNotifyURL(name, v string) error {
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("bad %s: must be an http(s) URL", name)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Package pdfgen binds images into a PDF with ImageMagick.
+package pdfgen
+
+import (
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+)
+
+// Builder runs ImageMagick.
+type Builder struct {
+	// Magick is the ImageMagick binary, "magick" or the legacy "convert";
+	// "magick" when empty.
+	Magick string
+	// Run runs a command to completion; exec.Command's Run when nil.
+	Run func(name string, args ...string) error
+}
+
+// Page is one page of a PDF: an image, turned clockwise by Rotate degrees
+// (a multiple of 90) after its EXIF orientation is applied.
+type Page struct {
+	Image  string
+	Rotate int
+}
+
+// FromImages writes imgs, one page each in order and rotated by their EXIF
+// orientation, to out at density DPI and JPEG quality (1-100). The PDF is
+// written under a temporary name and renamed when complete, so an
+// interrupted run never leaves a truncated file at out.
+func (b Builder) FromImages(imgs []string, out string, density, quality int) error {
+	pages := make([]Page, len(imgs))
+	for i, img := range imgs {
+		pages[i] = Page{Image: img}
+	}
+	return b.FromPages(pages, out, density, quality)
+}
+
+// FromPages is FromImages with a rotation per page.
+func (b Builder) FromPages(pages []Page, out string, density, quality int) error {
+	return b.build(args(pages, out+".part", density, quality), out)
+}
+
+// ContactSheet writes imgs to out as contact sheet pages: thumbnails
+// width pixels wide, cols to a row and rows rows to a page, in order. Like
+// FromImages it writes under a temporary name.
+func (b Builder) ContactSheet(imgs []string, out string, cols, rows, width, density, quality int) error {
+	return b.build(sheetArgs(imgs, out+".part", cols, rows, width, density, quality), out)
+}
+
+// Thumbnails writes a JPEG thumbnail width pixels wide of each of imgs to
+// the matching path of outs, with one ImageMagick run. Each is written
+// under a temporary name and renamed once all are done.
+func (b Builder) Thumbnails(imgs, outs []string, width int) error {
+	var a []string
+	for i, img := range imgs {
+		a = append(a, "(", img, "-auto-orient", "-thumbnail", strconv.Itoa(width)+"x", "-write", "jpg:"+outs[i]+".part", "+delete", ")")
+	}
+	if err := b.runner()(b.bin(), append(a, "null:")...); err != nil {
+		for _, out := range outs {
+			_ = os.Remove(out + ".part")
+		}
+		return err
+	}
+	for _, out := range outs {
+		if err := os.Rename(out+".part", out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build runs ImageMagick with args, which write tmp, out's temporary
+// name, and renames the result into place.
+func (b Builder) build(args []string, out string) error {
+	tmp := out + ".part"
+	if err := b.runner()(b.bin(), args...); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+func (b Builder) bin() string {
+	if b.Magick == "" {
+		return "magick"
+	}
+	return b.Magick
+}
+
+func (b Builder) runner() func(name string, args ...string) error {
+	if b.Run == nil {
+		return func(name string, args ...string) error { return exec.Command(name, args...).Run() }
+	}
+	return b.Run
+}
+
+func args(pages []Page, out string, density, quality int) []string {
+	var a []string
+	for _, p := range pages {
+		if r := ((p.Rotate % 360) + 360) % 360; r != 0 {
+			// parenthesized so the rotation applies to this page alone
+			a = append(a, "(", p.Image, "-auto-orient", "-rotate", strconv.Itoa(r), ")")
+			continue
+		}
+		a = append(a, p.Image, "-auto-orient")
+	}
+	return append(a, "-density", strconv.Itoa(density), "-quality", strconv.Itoa(quality), "pdf:"+out)
+}
+
+// sheetArgs builds each page with parentheses, which both magick and the
+// legacy convert take: thumbnails appended side by side into rows, rows
+// appended top to bottom into a page.
+func sheetArgs(imgs []string, out string, cols, rows, width, density, quality int) []string {
+	a := []string{"-background", "white", "-bordercolor", "white", "-gravity", "center"}
+	thumb := strconv.Itoa(width) + "x"
+	for page := range slices.Chunk(imgs, cols*rows) {
+		a = append(a, "(")
+		for row := range slices.Chunk(page, cols) {
+			a = append(a, "(")
+			for _, img := range row {
+				a = append(a, "(", img, "-auto-orient", "-thumbnail", thumb, "-border", "6", ")")
+			}
+			a = append(a, "+append", ")")
+		}
+		a = append(a, "-append", "-border", "18", ")")
+	}
+	return append(a, "-density", strconv.Itoa(density), "-quality", strconv.Itoa(quality), "pdf:"+out)
+}
@@ -0,0 +1,135 @@
+package pdfgen
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFromImages(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.pdf")
+	var ran []string
+	b := Builder{Magick: "convert", Run: func(name string, args ...string) error {
+		ran = append([]string{name}, args...)
+		return os.WriteFile(out+".part", []byte("%PDF"), 0o644)
+	}}
+	if err := b.FromImages([]string{"b.jpg", "a.jpg"}, out, 150, 92); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"convert", "b.jpg", "-auto-orient", "a.jpg", "-auto-orient", "-density", "150", "-quality", "92", "pdf:" + out + ".part"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("output not renamed into place: %v", err)
+	}
+}
+
+func TestFromImagesFailureLeavesNothing(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.pdf")
+	boom := errors.New("boom")
+	b := Builder{Run: func(name string, args ...string) error {
+		_ = os.WriteFile(out+".part", []byte("%PD"), 0o644)
+		return boom
+	}}
+	if err := b.FromImages([]string{"a.jpg"}, out, 150, 92); err != boom {
+		t.Fatalf("FromImages error = %v, want %v", err, boom)
+	}
+	for _, p := range []string{out, out + ".part"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", p)
+		}
+	}
+}
+
+func TestContactSheet(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "sheet.pdf")
+	var ran []string
+	b := Builder{Run: func(name string, args ...string) error {
+		ran = append([]string{name}, args...)
+		return os.WriteFile(out+".part", []byte("%PDF"), 0o644)
+	}}
+	imgs := []string{"1.jpg", "2.jpg", "3.jpg", "4.jpg", "5.jpg"}
+	if err := b.ContactSheet(imgs, out, 2, 2, 240, 150, 92); err != nil {
+		t.Fatal(err)
+	}
+	if ran[0] != "magick" || ran[len(ran)-1] != "pdf:"+out+".part" {
+		t.Errorf("ran %v", ran)
+	}
+	// two pages: two full rows, then a row holding the fifth image
+	if n := countArg(ran, "-append"); n != 2 {
+		t.Errorf("%d pages, want 2: %v", n, ran)
+	}
+	if n := countArg(ran, "+append"); n != 3 {
+		t.Errorf("%d rows, want 3: %v", n, ran)
+	}
+	if n := countArg(ran, "240x"); n != len(imgs) {
+		t.Errorf("%d thumbnails, want %d: %v", n, len(imgs), ran)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("output not renamed into place: %v", err)
+	}
+}
+
+func countArg(args []string, a string) int {
+	n := 0
+	for _, x := range args {
+		if x == a {
+			n++
+		}
+	}
+	return n
+}
+
+func TestThumbnails(t *testing.T) {
+	dir := t.TempDir()
+	outs := []string{filepath.Join(dir, "1.jpg"), filepath.Join(dir, "2.jpg")}
+	var ran []string
+	b := Builder{Run: func(name string, args ...string) error {
+		ran = append([]string{name}, args...)
+		for _, out := range outs {
+			if err := os.WriteFile(out+".part", []byte("jpg"), 0o644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	if err := b.Thumbnails([]string{"a.jpg", "b.jpg"}, outs, 320); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"magick",
+		"(", "a.jpg", "-auto-orient", "-thumbnail", "320x", "-write", "jpg:" + outs[0] + ".part", "+delete", ")",
+		"(", "b.jpg", "-auto-orient", "-thumbnail", "320x", "-write", "jpg:" + outs[1] + ".part", "+delete", ")",
+		"null:"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	for _, out := range outs {
+		if _, err := os.Stat(out); err != nil {
+			t.Errorf("thumbnail not renamed into place: %v", err)
+		}
+	}
+}
+
+func TestFromPages(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.pdf")
+	var ran []string
+	b := Builder{Run: func(name string, args ...string) error {
+		ran = append([]string{name}, args...)
+		return os.WriteFile(out+".part", []byte("%PDF"), 0o644)
+	}}
+	pages := []Page{{Image: "a.jpg", Rotate: 90}, {Image: "b.jpg"}, {Image: "c.jpg", Rotate: -90}}
+	if err := b.FromPages(pages, out, 150, 92); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"magick",
+		"(", "a.jpg", "-auto-orient", "-rotate", "90", ")",
+		"b.jpg", "-auto-orient",
+		"(", "c.jpg", "-auto-orient", "-rotate", "270", ")",
+		"-density", "150", "-quality", "92", "pdf:" + out + ".part"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+}
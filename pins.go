@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pin exempts one item from retention: a generated file by URL, or an
+// upload (and its extracted frames) by ID. Until bounds the exemption;
+// empty keeps the item until it is unpinned.
+type Pin struct {
+	Key     string `json:"key"`
+	Owner   string `json:"owner,omitempty"`
+	Until   string `json:"until,omitempty"`
+	Created string `json:"created_at"`
+}
+
+var (
+	pinsMu sync.Mutex
+	pins   = map[string]*Pin{}
+)
+
+// pinned reports whether key (an output URL or upload ID) is pinned now.
+func pinned(key string, now time.Time) bool {
+	pinsMu.Lock()
+	p := pins[key]
+	pinsMu.Unlock()
+	if p == nil {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339, p.Until)
+	return err != nil || now.Before(until)
+}
+
+// pinnedPath reports whether a file the janitor is about to delete belongs
+// to a pinned output or to the frames of a pinned video.
+func pinnedPath(path string, now time.Time) bool {
+	if u := outputURL(path); u != "" {
+		return pinned(u, now)
+	}
+	if rel, err := filepath.Rel(framesDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		id, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		return pinned(id, now)
+	}
+	return false
+}
+
+// prunePins drops pins that have run out.
+func prunePins(now time.Time) {
+	var keys []string
+	pinsMu.Lock()
+	for k, p := range pins {
+		if until, err := time.Parse(time.RFC3339, p.Until); err == nil && !now.Before(until) {
+			delete(pins, k)
+			keys = append(keys, k)
+		}
+	}
+	pinsMu.Unlock()
+	for _, k := range keys {
+		storeDelete(bucketPins, k)
+	}
+}
+
+type pinReq struct {
+	// URL is a generated file; ID an upload. Exactly one is set.
+	URL string `json:"url"`
+	ID  string `json:"id"`
+	// KeepFor is a Go duration or days ("30d"); empty pins indefinitely.
+	KeepFor string `json:"keep_for"`
+}
+
+// pinKey validates req against what the caller may access and returns the
+// key to pin under.
+func pinKey(c *gin.Context, req pinReq) (string, bool) {
+	switch {
+	case req.URL != "" && req.ID == "":
+		mu.Lock()
+		owner := outputOwners[req.URL]
+		mu.Unlock()
+		path := outputPath(req.URL)
+		if outputURL(path) != req.URL || !fileExists(path) || !canAccess(c, owner) {
+			fail(c, http.StatusBadRequest, "not a generated file: %s", req.URL)
+			return "", false
+		}
+		return req.URL, true
+	case req.ID != "" && req.URL == "":
+		if getVideo(c, req.ID) == nil && getImage(c, req.ID) == nil && getAudio(c, req.ID) == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown upload id: %s", req.ID)
+			return "", false
+		}
+		return req.ID, true
+	}
+	fail(c, http.StatusBadRequest, "set either url or id")
+	return "", false
+}
+
+func handlePin(c *gin.Context) {
+	var req pinReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	key, ok := pinKey(c, req)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	p := &Pin{Key: key, Owner: ownerOf(c), Created: now.Format(time.RFC3339)}
+	if req.KeepFor != "" {
+		d, err := parseRetention(req.KeepFor)
+		if err != nil || d <= 0 {
+			fail(c, http.StatusBadRequest, "bad keep_for: %s", req.KeepFor)
+			return
+		}
+		p.Until = now.Add(d).Format(time.RFC3339)
+	}
+	pinsMu.Lock()
+	pins[key] = p
+	pinsMu.Unlock()
+	storePut(bucketPins, key, p)
+	c.JSON(http.StatusOK, p)
+}
+
+func handleUnpin(c *gin.Context) {
+	var req pinReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	key := req.URL + req.ID
+	pinsMu.Lock()
+	p := pins[key]
+	if p == nil || !canAccess(c, p.Owner) {
+		pinsMu.Unlock()
+		fail(c, http.StatusNotFound, "not pinned: %s", key)
+		return
+	}
+	delete(pins, key)
+	pinsMu.Unlock()
+	storeDelete(bucketPins, key)
+	c.Status(http.StatusNoContent)
+}
+
+func handleListPins(c *gin.Context) {
+	pinsMu.Lock()
+	out := make([]Pin, 0, len(pins))
+	for _, p := range pins {
+		if canAccess(c, p.Owner) {
+			out = append(out, *p)
+		}
+	}
+	pinsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Created > out[j].Created })
+	c.JSON(http.StatusOK, gin.H{"pins": out})
+}
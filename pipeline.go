@@ -0,0 +1,484 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"video-to-pdf/audioconv"
+	"video-to-pdf/frames"
+	"video-to-pdf/pdfgen"
+)
+
+// Pipelines: POST /pipeline runs a chain of steps on one upload as a
+// single job. The job carries up to three artifacts, a video, its frames
+// and an audio file; each step works on the kind it takes and replaces
+// it, so trim → frames → dedupe → contact_sheet → extract_audio →
+// convert_audio builds a contact sheet of the trimmed video's distinct
+// frames and converts the trimmed video's sound. pdf, contact_sheet and
+// convert_audio write the pipeline's outputs and leave their input to the
+// steps after them. The intermediate artifacts live in the job's scratch
+// space and are described in the result; "keep" on a step publishes its
+// artifact as well.
+
+// pipelineOps maps each step to the artifact kind it takes; "media" is
+// the video and the audio, whichever are there.
+var pipelineOps = map[string]string{
+	"trim":          "media",
+	"frames":        "video",
+	"dedupe":        "frames",
+	"pdf":           "frames",
+	"contact_sheet": "frames",
+	"extract_audio": "video",
+	"convert_audio": "audio",
+}
+
+const maxPipelineSteps = 32
+
+type pipelineStep struct {
+	// Op is trim, frames, dedupe, pdf, contact_sheet, extract_audio or
+	// convert_audio.
+	Op string `json:"op"`
+	// StartS and EndS are trim's range; EndS 0 runs to the end.
+	StartS float64 `json:"start_seconds"`
+	EndS   float64 `json:"end_seconds"`
+	// VideoBitrateKbps encodes trim's video at that average bitrate
+	// instead of at constant quality.
+	VideoBitrateKbps int `json:"video_bitrate_kbps"`
+	// FPS and JPEGQuality are frames' settings, as for /process.
+	FPS         float64 `json:"fps"`
+	JPEGQuality int     `json:"jpeg_quality"`
+	// Threshold is how different a frame must look from the last one kept
+	// for dedupe to keep it, 0-1; 0.02 when unset.
+	Threshold float64 `json:"threshold"`
+	// Density and Quality are the PDF settings of pdf and contact_sheet.
+	Density int `json:"pdf_density"`
+	Quality int `json:"pdf_quality"`
+	// Columns, Rows and ThumbWidth lay out contact_sheet pages; 4 by 5
+	// thumbnails 320 pixels wide when unset.
+	Columns    int `json:"columns"`
+	Rows       int `json:"rows"`
+	ThumbWidth int `json:"thumb_width"`
+	// Format to Normalize are convert_audio's settings, as for
+	// /convert_audio.
+	Format      string   `json:"format"`
+	Formats     []string `json:"formats"`
+	BitrateKbps int      `json:"bitrate_kbps"`
+	SampleRate  int      `json:"sample_rate"`
+	Channels    int      `json:"channels"`
+	Normalize   string   `json:"normalize"`
+	TargetLUFS  float64  `json:"target_lufs"`
+	// TwoPass encodes trim's video (at VideoBitrateKbps) or convert_audio's
+	// lossy outputs (at BitrateKbps) in two passes, for a predictable size.
+	TwoPass bool `json:"two_pass"`
+	// Keep publishes the artifact of trim, frames, dedupe or extract_audio:
+	// the trimmed video under /renders, trimmed or extracted audio under
+	// /audio, frames as a ZIP under /download.
+	Keep bool `json:"keep"`
+}
+
+type pipelineReq struct {
+	// VideoID or AudioID is the upload the pipeline starts from.
+	VideoID string `json:"video_id"`
+	AudioID string `json:"audio_id"`
+	// AudioTrack chooses the video's audio track by index or language.
+	AudioTrack string         `json:"audio_track"`
+	Steps      []pipelineStep `json:"steps"`
+	Async      bool           `json:"async"`
+	Priority   string         `json:"priority"`
+}
+
+// pipelineArtifact describes what a step left for the steps after it.
+type pipelineArtifact struct {
+	Kind      string  `json:"kind"`
+	Files     int     `json:"files"`
+	Bytes     int64   `json:"bytes"`
+	DurationS float64 `json:"duration_seconds,omitempty"`
+}
+
+type pipelineStepResult struct {
+	Index    int               `json:"index"`
+	Op       string            `json:"op"`
+	Artifact *pipelineArtifact `json:"artifact,omitempty"`
+	// URLs are the files the step published.
+	URLs []string `json:"urls,omitempty"`
+}
+
+// pipelineState is the artifacts of a running pipeline.
+type pipelineState struct {
+	name         string
+	video, audio string
+	// durations of video and audio, 0 when unknown
+	videoS, audioS float64
+	// audioMap maps the video's chosen audio track
+	audioMap string
+	frames   []string
+}
+
+func handlePipeline(c *gin.Context) {
+	var req pipelineReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if (req.VideoID == "") == (req.AudioID == "") {
+		fail(c, http.StatusBadRequest, "give one of video_id and audio_id")
+		return
+	}
+	if len(req.Steps) == 0 || len(req.Steps) > maxPipelineSteps {
+		fail(c, http.StatusBadRequest, "a pipeline takes 1 to %d steps", maxPipelineSteps)
+		return
+	}
+	var st pipelineState
+	var srcID string
+	if req.VideoID != "" {
+		vm := getVideo(c, req.VideoID)
+		if vm == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown video id: %s", req.VideoID)
+			return
+		}
+		audioMap, err := audioTrackMap(vm, req.AudioTrack)
+		if err != nil {
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		srcID, st.name, st.video, st.videoS, st.audioMap = vm.ID, vm.Name, vm.AbsPath, vm.DurationS, audioMap
+	} else {
+		am := getAudio(c, req.AudioID)
+		if am == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", req.AudioID)
+			return
+		}
+		srcID, st.name, st.audio, st.audioS = am.ID, am.Name, am.AbsPath, am.DurationS
+	}
+	var bad itemErrors
+	have := map[string]bool{"video": st.video != "", "audio": st.audio != ""}
+	for i := range req.Steps {
+		s := &req.Steps[i]
+		s.Op = strings.ToLower(strings.TrimSpace(s.Op))
+		takes, ok := pipelineOps[s.Op]
+		switch {
+		case !ok:
+			bad.add(i, s.Op, "", "step %d: unknown op %q", i, s.Op)
+			continue
+		case takes == "media" && !have["video"] && !have["audio"], takes != "media" && !have[takes]:
+			bad.add(i, s.Op, "", "step %d: %s needs %s, which no earlier step provides", i, s.Op, takes)
+			continue
+		}
+		if err := s.validate(); err != nil {
+			bad.add(i, s.Op, "", "step %d: %s: %v", i, s.Op, err)
+			continue
+		}
+		switch s.Op {
+		case "frames":
+			have["frames"] = true
+		case "extract_audio":
+			have["audio"] = true
+		}
+	}
+	if bad.fail(c) {
+		return
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ids := make([]string, len(req.Steps))
+	names := make([]string, len(req.Steps))
+	for i, s := range req.Steps {
+		ids[i], names[i] = srcID, s.Op
+	}
+	job := newJob(ownerOf(c), requestID(c), "pipeline", prio, ids, names)
+	job.Params = req
+	if req.Async {
+		go runPipeline(job, srcID, st, req.Steps)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runPipeline(job, srcID, st, req.Steps)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// validate checks s's settings and fills in the defaults.
+func (s *pipelineStep) validate() error {
+	switch s.Op {
+	case "trim":
+		if s.StartS < 0 || s.EndS < 0 || (s.EndS > 0 && s.EndS <= s.StartS) {
+			return fmt.Errorf("start_seconds must be non-negative and before end_seconds")
+		}
+		if s.VideoBitrateKbps < 0 || s.VideoBitrateKbps > 100000 {
+			return fmt.Errorf("video_bitrate_kbps must be at most 100000")
+		}
+		if s.TwoPass && s.VideoBitrateKbps == 0 {
+			return fmt.Errorf("two_pass needs video_bitrate_kbps")
+		}
+	case "frames":
+		s.FPS = cmp.Or(s.FPS, processDefaults.FPS)
+		s.JPEGQuality = cmp.Or(s.JPEGQuality, processDefaults.JPEGQuality)
+		if s.FPS <= 0 || s.FPS > 60 {
+			return fmt.Errorf("fps must be above 0 and at most 60")
+		}
+		if s.JPEGQuality < 2 || s.JPEGQuality > 31 {
+			return fmt.Errorf("jpeg_quality must be between 2 and 31")
+		}
+	case "dedupe":
+		s.Threshold = cmp.Or(s.Threshold, 0.02)
+		if s.Threshold <= 0 || s.Threshold >= 1 {
+			return fmt.Errorf("threshold must be between 0 and 1")
+		}
+	case "pdf", "contact_sheet":
+		s.Density = cmp.Or(s.Density, processDefaults.Density)
+		s.Quality = cmp.Or(s.Quality, processDefaults.Quality)
+		if s.Op == "pdf" {
+			break
+		}
+		s.Columns, s.Rows, s.ThumbWidth = cmp.Or(s.Columns, 4), cmp.Or(s.Rows, 5), cmp.Or(s.ThumbWidth, 320)
+		if s.Columns < 1 || s.Columns > 12 || s.Rows < 1 || s.Rows > 20 {
+			return fmt.Errorf("columns must be 1-12 and rows 1-20")
+		}
+		if s.ThumbWidth < 64 || s.ThumbWidth > 1920 {
+			return fmt.Errorf("thumb_width must be between 64 and 1920")
+		}
+	case "convert_audio":
+		if s.Format == "" && len(s.Formats) == 0 {
+			s.Format = processDefaults.AudioFormat
+		}
+		s.BitrateKbps = cmp.Or(s.BitrateKbps, processDefaults.AudioBitrateKbps)
+		formats, err := audioconv.NormalizeFormats(s.Format, s.Formats)
+		if err != nil {
+			return err
+		}
+		s.Formats = formats
+		if s.TwoPass && !slices.ContainsFunc(formats, func(f string) bool { return audioconv.Formats[f].TwoPass() }) {
+			return fmt.Errorf("two_pass needs a format encoded at a target bitrate (mp3, aac, m4a, ogg, opus, wma)")
+		}
+		if _, err := resolveLoudnessTarget(s.Normalize, s.TargetLUFS); err != nil {
+			return err
+		}
+		if _, ok := audioconv.ChannelLayouts[s.Channels]; s.Channels != 0 && !ok {
+			return fmt.Errorf("channels must be 1, 2, 6 (5.1) or 8 (7.1)")
+		}
+	}
+	return nil
+}
+
+// runPipeline runs steps in order on the artifacts of st and returns the
+// response body (also stored as the job result).
+func runPipeline(job *Job, srcID string, st pipelineState, steps []pipelineStep) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		// a retry starts again from the source
+		st := st
+		results := make([]pipelineStepResult, 0, len(steps))
+		var outputs []string
+		for i, s := range steps {
+			job.setItem(i, jobRunning, 0)
+			r, err := st.run(job, i, s)
+			if err != nil {
+				return nil, fmt.Errorf("step %d (%s) failed for %s: %w", i, s.Op, st.name, err)
+			}
+			recordOutputs(job.Owner, r.URLs...)
+			outputs = append(outputs, r.URLs...)
+			results = append(results, r)
+			job.setItem(i, jobDone, 100)
+		}
+		return gin.H{"job_id": job.ID, "id": srcID, "name": st.name, "steps": results, "outputs": outputs}, nil
+	})
+}
+
+// run does step i, s, of job.
+func (st *pipelineState) run(job *Job, i int, s pipelineStep) (pipelineStepResult, error) {
+	r := pipelineStepResult{Index: i, Op: s.Op}
+	dir, err := job.scratch(fmt.Sprintf("step%d", i))
+	if err != nil {
+		return r, err
+	}
+	base := stripExt(sanitizeName(st.name))
+	progress := job.progressFunc(i)
+	switch s.Op {
+	case "trim":
+		if st.video != "" {
+			out := filepath.Join(dir, "video.mp4")
+			if s.Keep {
+				out = claimOutput(job.Owner, filepath.Join(rendersDir, base+"_trim.mp4"))
+			}
+			passLog := ""
+			if s.TwoPass {
+				passLog = filepath.Join(dir, "x264")
+			}
+			if err := trimMedia(st.video, out, st.audioMap, s.StartS, s.EndS, true, s.VideoBitrateKbps, passLog, trimmedLength(st.videoS, s), progress); err != nil {
+				return r, err
+			}
+			// the trimmed video keeps only the chosen track
+			st.video, st.videoS, st.audioMap = out, trimmedLength(st.videoS, s), "0:a:0"
+			r.Artifact = mediaArtifact("video", out, st.videoS)
+			r.URLs = keptURL(s.Keep, out, r.URLs)
+		}
+		if st.audio != "" {
+			out := filepath.Join(dir, "audio.flac")
+			if s.Keep {
+				out = claimOutput(job.Owner, filepath.Join(audioDir, base+"_trim.flac"))
+			}
+			if err := trimMedia(st.audio, out, "0:a:0", s.StartS, s.EndS, false, 0, "", trimmedLength(st.audioS, s), progress); err != nil {
+				return r, err
+			}
+			st.audio, st.audioS = out, trimmedLength(st.audioS, s)
+			if r.Artifact == nil {
+				r.Artifact = mediaArtifact("audio", out, st.audioS)
+			}
+			r.URLs = keptURL(s.Keep, out, r.URLs)
+		}
+	case "frames":
+		pattern := filepath.Join(dir, "frame_%05d.jpg")
+		fs, err := extractFrames(st.video, pattern, s.FPS, framePrep{}, "", s.JPEGQuality)
+		if err != nil {
+			return r, err
+		}
+		if fs.Frames == 0 {
+			return r, fmt.Errorf("no frames extracted")
+		}
+		st.frames = frames.Files(pattern, fs.Frames)
+	case "dedupe":
+		kept, err := frames.Distinct(st.frames, s.Threshold)
+		if err != nil {
+			return r, err
+		}
+		st.frames = kept
+	case "pdf":
+		out := claimOutput(job.Owner, filepath.Join(pdfsDir, base+"_frames.pdf"))
+		if err := imagesToPDF(st.frames, out, s.Density, s.Quality); err != nil {
+			return r, err
+		}
+		r.URLs = []string{"/download/" + filepath.Base(out)}
+	case "contact_sheet":
+		out := claimOutput(job.Owner, filepath.Join(pdfsDir, base+"_contact_sheet.pdf"))
+		if err := contactSheetPDF(st.frames, out, s.Columns, s.Rows, s.ThumbWidth, s.Density, s.Quality); err != nil {
+			return r, err
+		}
+		r.URLs = []string{"/download/" + filepath.Base(out)}
+	case "extract_audio":
+		out := filepath.Join(dir, "audio.flac")
+		if s.Keep {
+			out = claimOutput(job.Owner, filepath.Join(audioDir, base+".flac"))
+		}
+		args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", st.video, "-map", st.audioMap, "-vn", "-c:a", "flac", out}
+		if err := runFFmpeg(args, st.videoS, progress, nil); err != nil {
+			return r, err
+		}
+		st.audio, st.audioS = out, st.videoS
+		r.Artifact = mediaArtifact("audio", out, st.audioS)
+		r.URLs = keptURL(s.Keep, out, r.URLs)
+	case "convert_audio":
+		target, _ := resolveLoudnessTarget(s.Normalize, s.TargetLUFS)
+		pa := probeAudio(st.audio)
+		o := audioConvertOpts{Format: s.Formats[0], Formats: s.Formats, BitrateKbps: s.BitrateKbps, SampleRate: s.SampleRate, Channels: s.Channels, Loudness: target, DurationS: cmp.Or(pa.DurationS, st.audioS), SourceRate: pa.SampleRate, Progress: progress, Owner: job.Owner, TwoPass: s.TwoPass, Scratch: dir}
+		if target != nil && o.SampleRate == 0 {
+			o.SampleRate = pa.SampleRate
+		}
+		outs, err := convertAudio(st.audio, st.name, o)
+		if err != nil {
+			return r, err
+		}
+		for _, out := range outs {
+			r.URLs = append(r.URLs, "/audio/"+filepath.Base(out))
+		}
+	}
+	if s.Op == "frames" || s.Op == "dedupe" {
+		r.Artifact = framesArtifact(st.frames)
+		if s.Keep {
+			out := claimOutput(job.Owner, filepath.Join(pdfsDir, base+"_"+s.Op+".zip"))
+			if err := zipFiles(out, st.frames); err != nil {
+				return r, fmt.Errorf("zip failed: %w", err)
+			}
+			r.URLs = []string{"/download/" + filepath.Base(out)}
+		}
+	}
+	return r, nil
+}
+
+// trimmedLength is the length of the media, of length total, that trim
+// step s leaves; 0 when unknown.
+func trimmedLength(total float64, s pipelineStep) float64 {
+	end := s.EndS
+	if end == 0 || (total > 0 && end > total) {
+		end = total
+	}
+	return max(0, end-s.StartS)
+}
+
+// trimMedia cuts [start, end) out of in, the whole rest when end is 0,
+// re-encoding so the cut is frame-accurate: H.264/AAC for video, FLAC for
+// audio, taking the audio stream audioMap maps. Video is encoded at constant quality, or at videoKbps when that
+// is set; with a passLog too it takes two passes, x264 keeping the first
+// pass's statistics in files starting with passLog.
+func trimMedia(in, out, audioMap string, start, end float64, video bool, videoKbps int, passLog string, totalS float64, progress func(float64)) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-ss", fmt.Sprintf("%.3f", start)}
+	if end > 0 {
+		args = append(args, "-t", fmt.Sprintf("%.3f", end-start))
+	}
+	args = append(args, "-i", in)
+	if !video {
+		return runFFmpeg(append(args, "-map", audioMap, "-vn", "-c:a", "flac", out), totalS, progress, nil)
+	}
+	venc := []string{"-c:v", "libx264", "-preset", "veryfast", "-crf", "18", "-pix_fmt", "yuv420p"}
+	if videoKbps > 0 {
+		venc = []string{"-c:v", "libx264", "-preset", "veryfast", "-b:v", fmt.Sprintf("%dk", videoKbps), "-pix_fmt", "yuv420p"}
+	}
+	if videoKbps > 0 && passLog != "" {
+		var firstProgress func(float64)
+		if progress != nil {
+			p := progress
+			firstProgress = func(v float64) { p(v / 2) }
+			progress = func(v float64) { p(50 + v/2) }
+		}
+		// the first pass only analyses the video, so it writes nothing
+		first := append(append(append([]string{}, args...), "-map", "0:v:0"), venc...)
+		first = append(first, "-pass", "1", "-passlogfile", passLog, "-an", "-f", "null", os.DevNull)
+		if err := runFFmpeg(first, totalS, firstProgress, nil); err != nil {
+			return fmt.Errorf("first pass: %w", err)
+		}
+		venc = append(venc, "-pass", "2", "-passlogfile", passLog)
+	}
+	args = append(append(args, "-map", "0:v:0", "-map", audioMap+"?"), venc...)
+	return runFFmpeg(append(args, "-c:a", "aac", "-b:a", "192k", out), totalS, progress, nil)
+}
+
+func contactSheetPDF(imgs []string, outPDF string, cols, rows, width, density, quality int) error {
+	return pdfgen.Builder{Magick: magickBin, Run: toolRun}.ContactSheet(imgs, outPDF, cols, rows, width, density, quality)
+}
+
+// keptURL adds the URL of out to urls when the step keeps its artifact.
+func keptURL(keep bool, out string, urls []string) []string {
+	if !keep {
+		return urls
+	}
+	return append(urls, outputURL(out))
+}
+
+func mediaArtifact(kind, path string, durS float64) *pipelineArtifact {
+	a := &pipelineArtifact{Kind: kind, Files: 1, DurationS: durS}
+	if fi, err := os.Stat(path); err == nil {
+		a.Bytes = fi.Size()
+	}
+	return a
+}
+
+func framesArtifact(files []string) *pipelineArtifact {
+	a := &pipelineArtifact{Kind: "frames", Files: len(files)}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			a.Bytes += fi.Size()
+		}
+	}
+	return a
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// See platform_windows.go; elsewhere names, paths and tool arguments are
+// used as they are.
+
+func platformName(s string) string { return s }
+
+func platformWorkRoot(root string) string { return root }
+
+func platformArgs(args []string) []string { return args }
+
+func isSystemConvert(string) bool { return false }
+
+// diskFree is the space unprivileged users can still write on the file
+// system holding path, in bytes.
+func diskFree(path string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
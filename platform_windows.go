@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Windows specifics: file names valid for NTFS, absolute paths past
+// MAX_PATH handed to tools in their extended form, and never mistaking
+// System32's convert.exe (the FAT-to-NTFS converter) for ImageMagick.
+
+// windowsReserved are device names Windows won't use as file names, with
+// or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// platformName makes a sanitized name valid on NTFS: no drive colons or
+// other reserved characters, no trailing dots or spaces and no device
+// names.
+func platformName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.TrimRight(s, ". ")
+	if s == "" {
+		return "file"
+	}
+	if base, _, _ := strings.Cut(s, "."); windowsReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		s = "_" + s
+	}
+	return s
+}
+
+// platformWorkRoot makes the work directory absolute, so tool arguments
+// under it can be given in extended form (see platformArgs).
+func platformWorkRoot(root string) string {
+	if abs, err := filepath.Abs(root); err == nil {
+		return abs
+	}
+	return root
+}
+
+// maxPath is where Windows' MAX_PATH (260, including the terminating NUL)
+// starts to bite; directories are limited to 12 characters less.
+const maxPath = 248
+
+// platformArgs gives absolute paths among a tool's arguments that are too
+// long for MAX_PATH the \\?\ prefix, which lifts the limit.
+func platformArgs(args []string) []string {
+	args = append([]string(nil), args...)
+	for i, a := range args {
+		if len(a) < maxPath || !filepath.IsAbs(a) || strings.HasPrefix(a, `\\?\`) {
+			continue
+		}
+		a = filepath.Clean(a)
+		if rest, ok := strings.CutPrefix(a, `\\`); ok {
+			args[i] = `\\?\UNC\` + rest
+		} else {
+			args[i] = `\\?\` + a
+		}
+	}
+	return args
+}
+
+// isSystemConvert reports whether path is Windows' own convert.exe.
+func isSystemConvert(path string) bool {
+	sys := os.Getenv("SystemRoot")
+	if sys == "" {
+		sys = `C:\Windows`
+	}
+	rel, err := filepath.Rel(sys, path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskFree is the space the process's user can still write on the volume
+// holding path, in bytes.
+func diskFree(path string) (int64, bool) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, false
+	}
+	var avail uint64
+	if r, _, _ := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0); r == 0 {
+		return 0, false
+	}
+	return int64(avail), true
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"video-to-pdf/audioconv"
+)
+
+// Presets are named bundles of processing and conversion settings
+// ("lecture-slides", "podcast-mp3") that /process, /images_pdf and
+// /convert_audio requests pick by name. A preset's settings fill in what the
+// request leaves unset, ahead of the project's defaults and the server's.
+// Each user has their own presets.
+
+// presetSettings are the project defaults plus the audio settings a preset
+// can carry.
+type presetSettings struct {
+	projectDefaults
+	SampleRate int `json:"sample_rate,omitempty"`
+	Channels   int `json:"channels,omitempty"`
+	// Normalize is a loudness preset ("podcast", "broadcast") or "custom"
+	// together with TargetLUFS.
+	Normalize  string  `json:"normalize,omitempty"`
+	TargetLUFS float64 `json:"target_lufs,omitempty"`
+}
+
+// Preset is a named set of settings.
+type Preset struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Settings    presetSettings `json:"settings"`
+	Created     string         `json:"created_at"`
+	Updated     string         `json:"updated_at"`
+	Owner       string         `json:"owner,omitempty"`
+}
+
+// presets is keyed by presetKey and guarded by mu like the upload maps.
+var presets = map[string]*Preset{}
+
+var presetNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+type presetReq struct {
+	Name        *string         `json:"name"`
+	Description *string         `json:"description"`
+	Settings    *presetSettings `json:"settings"`
+}
+
+func presetKey(owner, name string) string { return owner + "/" + name }
+
+func putPreset(p *Preset) { storePut(bucketPresets, presetKey(p.Owner, p.Name), p) }
+
+// lookupPreset returns the request's user's preset called name, or nil; an
+// empty name is not an error.
+func lookupPreset(c *gin.Context, name string) *Preset {
+	if name == "" {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return presets[presetKey(ownerOf(c), name)]
+}
+
+// requestDefaults are the settings a request with preset pr and project
+// proj starts from: the preset's where it has them, then the project's.
+func requestDefaults(pr *Preset, proj *Project) presetSettings {
+	var s presetSettings
+	if pr != nil {
+		s = pr.Settings
+	}
+	if proj != nil {
+		d := proj.Defaults
+		s.FPS = cmp.Or(s.FPS, d.FPS)
+		s.JPEGQuality = cmp.Or(s.JPEGQuality, d.JPEGQuality)
+		s.Density = cmp.Or(s.Density, d.Density)
+		s.Quality = cmp.Or(s.Quality, d.Quality)
+		s.AudioFormat = cmp.Or(s.AudioFormat, d.AudioFormat)
+		s.AudioBitrateKbps = cmp.Or(s.AudioBitrateKbps, d.AudioBitrateKbps)
+	}
+	return s
+}
+
+// presetFor looks up the preset a request names, answering 400 and
+// returning false when there is none by that name.
+func presetFor(c *gin.Context, name string) (*Preset, bool) {
+	pr := lookupPreset(c, name)
+	if name != "" && pr == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown preset: %s", name)
+		return nil, false
+	}
+	return pr, true
+}
+
+// check rejects settings no request could use.
+func (s presetSettings) check() error {
+	switch {
+	case s.FPS < 0 || s.FPS > 60:
+		return fmt.Errorf("fps must be at most 60")
+	case s.JPEGQuality != 0 && (s.JPEGQuality < 2 || s.JPEGQuality > 31):
+		return fmt.Errorf("jpeg_quality must be between 2 and 31")
+	case s.Density < 0 || s.Quality < 0 || s.Quality > 100:
+		return fmt.Errorf("pdf_density must be positive and pdf_quality at most 100")
+	case s.AudioBitrateKbps < 0 || s.SampleRate < 0:
+		return fmt.Errorf("audio_bitrate_kbps and sample_rate must be positive")
+	}
+	if s.AudioFormat != "" {
+		if _, err := audioconv.Lookup(strings.ToLower(s.AudioFormat)); err != nil {
+			return err
+		}
+	}
+	if _, ok := audioconv.ChannelLayouts[s.Channels]; s.Channels != 0 && !ok {
+		return fmt.Errorf("channels must be 1, 2, 6 (5.1) or 8 (7.1)")
+	}
+	_, err := resolveLoudnessTarget(s.Normalize, s.TargetLUFS)
+	return err
+}
+
+func handleCreatePreset(c *gin.Context) {
+	var req presetReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if req.Name == nil || !presetNameRe.MatchString(*req.Name) {
+		fail(c, http.StatusBadRequest, "name is required: lowercase letters, digits, '.', '_' and '-', up to 64")
+		return
+	}
+	now := time.Now().Format(time.RFC3339)
+	p := &Preset{Name: *req.Name, Created: now, Updated: now, Owner: ownerOf(c)}
+	if req.Description != nil {
+		p.Description = *req.Description
+	}
+	if req.Settings != nil {
+		if err := req.Settings.check(); err != nil {
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		p.Settings = *req.Settings
+	}
+	key := presetKey(p.Owner, p.Name)
+	mu.Lock()
+	if presets[key] != nil {
+		mu.Unlock()
+		failCode(c, http.StatusConflict, errExists, "preset %s already exists", p.Name)
+		return
+	}
+	presets[key] = p
+	snap := *p
+	mu.Unlock()
+	putPreset(&snap)
+	c.JSON(http.StatusOK, snap)
+}
+
+func handleListPresets(c *gin.Context) {
+	q, err := parseListQuery(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	mu.Lock()
+	out := make([]Preset, 0, len(presets))
+	for _, p := range presets {
+		if canAccess(c, p.Owner) {
+			out = append(out, *p)
+		}
+	}
+	mu.Unlock()
+	page, total := applyListQuery(out, q, func(p Preset) listKey {
+		return listKey{Name: p.Name, Date: p.Created, DurationS: -1}
+	})
+	c.JSON(http.StatusOK, listResponse("presets", page, total, q))
+}
+
+func handleGetPreset(c *gin.Context) {
+	p := lookupPreset(c, c.Param("name"))
+	if p == nil {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown preset: %s", c.Param("name"))
+		return
+	}
+	mu.Lock()
+	snap := *p
+	mu.Unlock()
+	c.JSON(http.StatusOK, snap)
+}
+
+// handleUpdatePreset changes a preset's description or replaces its
+// settings; a preset keeps its name.
+func handleUpdatePreset(c *gin.Context) {
+	var req presetReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if req.Name != nil && *req.Name != c.Param("name") {
+		fail(c, http.StatusBadRequest, "a preset can't be renamed; create one under the new name")
+		return
+	}
+	if req.Settings != nil {
+		if err := req.Settings.check(); err != nil {
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	mu.Lock()
+	p := presets[presetKey(ownerOf(c), c.Param("name"))]
+	if p == nil {
+		mu.Unlock()
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown preset: %s", c.Param("name"))
+		return
+	}
+	if req.Description != nil {
+		p.Description = *req.Description
+	}
+	if req.Settings != nil {
+		p.Settings = *req.Settings
+	}
+	p.Updated = time.Now().Format(time.RFC3339)
+	snap := *p
+	mu.Unlock()
+	putPreset(&snap)
+	c.JSON(http.StatusOK, snap)
+}
+
+func handleDeletePreset(c *gin.Context) {
+	name := c.Param("name")
+	key := presetKey(ownerOf(c), name)
+	mu.Lock()
+	p := presets[key]
+	delete(presets, key)
+	mu.Unlock()
+	if p == nil {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown preset: %s", name)
+		return
+	}
+	storeDelete(bucketPresets, key)
+	c.JSON(http.StatusOK, gin.H{"deleted": name})
+}
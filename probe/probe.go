@@ -0,0 +1,421 @@
+// Package probe reads durations, audio stream details, audio tracks,
+// chapters, attachments, video frame counts and picture details with
+// ffprobe.
+package probe
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prober runs ffprobe.
+type Prober struct {
+	// FFprobe is the ffprobe binary; "ffprobe" when empty.
+	FFprobe string
+	// Output runs a command and returns its stdout; exec.Command's Output
+	// when nil. Set it to apply limits or logging to the runs.
+	Output func(name string, args ...string) ([]byte, error)
+}
+
+func (p Prober) output(args ...string) ([]byte, error) {
+	bin := p.FFprobe
+	if bin == "" {
+		bin = "ffprobe"
+	}
+	if p.Output != nil {
+		return p.Output(bin, args...)
+	}
+	return exec.Command(bin, args...).Output()
+}
+
+// Duration returns the container duration of file in seconds.
+func (p Prober) Duration(file string) (float64, error) {
+	out, err := p.output("-v", "error", "-show_entries", "format=duration", "-of", "default=nw=1:nk=1", file)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "N/A" || s == "" {
+		return 0, errors.New("no duration")
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Audio describes the first audio stream of a file. Fields ffprobe doesn't
+// report are left zero.
+type Audio struct {
+	DurationS   float64
+	Codec       string
+	Channels    int
+	SampleRate  int
+	BitrateKbps int
+	// JSON is ffprobe's full -show_format -show_streams output.
+	JSON string
+}
+
+// Audio probes file's format and streams.
+func (p Prober) Audio(file string) (Audio, error) {
+	out, err := p.output("-v", "error", "-print_format", "json", "-show_format", "-show_streams", file)
+	if err != nil {
+		return Audio{}, err
+	}
+	return ParseAudio(out), nil
+}
+
+// ParseAudio extracts Audio from ffprobe's JSON output. The stream's bitrate
+// wins over the container's.
+func ParseAudio(out []byte) Audio {
+	a := Audio{JSON: string(out)}
+	var pr struct {
+		Format struct {
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType  string `json:"codec_type"`
+			CodecName  string `json:"codec_name"`
+			Channels   int    `json:"channels"`
+			SampleRate string `json:"sample_rate"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"streams"`
+	}
+	_ = json.Unmarshal(out, &pr)
+	if f, _ := strconv.ParseFloat(pr.Format.Duration, 64); f > 0 {
+		a.DurationS = f
+	}
+	if b, _ := strconv.Atoi(pr.Format.BitRate); b > 0 {
+		a.BitrateKbps = b / 1000
+	}
+	for _, s := range pr.Streams {
+		if s.CodecType != "audio" {
+			continue
+		}
+		a.Codec = s.CodecName
+		if s.Channels > 0 {
+			a.Channels = s.Channels
+		}
+		if v, _ := strconv.Atoi(s.SampleRate); v > 0 {
+			a.SampleRate = v
+		}
+		if b, _ := strconv.Atoi(s.BitRate); b > 0 {
+			a.BitrateKbps = b / 1000
+		}
+		break
+	}
+	return a
+}
+
+// AudioTrack is one audio stream of a file. Index counts audio streams
+// only, as ffmpeg's "a:N" stream specifier does; Stream is the stream's
+// index among all of the file's streams.
+type AudioTrack struct {
+	Index      int
+	Stream     int
+	Codec      string
+	Channels   int
+	SampleRate int
+	// Language is the stream's language tag ("eng", "fre"), if it has one.
+	Language string
+	Title    string
+	Default  bool
+}
+
+// AudioTracks lists file's audio streams in order.
+func (p Prober) AudioTracks(file string) ([]AudioTrack, error) {
+	out, err := p.output("-v", "error", "-select_streams", "a", "-show_entries", "stream=index,codec_name,channels,sample_rate:stream_tags=language,title:stream_disposition=default", "-print_format", "json", file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAudioTracks(out), nil
+}
+
+// ParseAudioTracks extracts the audio tracks from ffprobe's JSON output;
+// streams of other kinds are skipped.
+func ParseAudioTracks(out []byte) []AudioTrack {
+	var pr struct {
+		Streams []struct {
+			Index      int    `json:"index"`
+			CodecType  string `json:"codec_type"`
+			CodecName  string `json:"codec_name"`
+			Channels   int    `json:"channels"`
+			SampleRate string `json:"sample_rate"`
+			Tags       struct {
+				Language string `json:"language"`
+				Title    string `json:"title"`
+			} `json:"tags"`
+			Disposition struct {
+				Default int `json:"default"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}
+	_ = json.Unmarshal(out, &pr)
+	tracks := []AudioTrack{}
+	for _, s := range pr.Streams {
+		// -select_streams leaves codec_type out unless asked for it
+		if s.CodecType != "" && s.CodecType != "audio" {
+			continue
+		}
+		t := AudioTrack{Index: len(tracks), Stream: s.Index, Codec: s.CodecName, Channels: s.Channels, Title: s.Tags.Title, Default: s.Disposition.Default == 1}
+		if lang := strings.ToLower(s.Tags.Language); lang != "und" {
+			t.Language = lang
+		}
+		t.SampleRate, _ = strconv.Atoi(s.SampleRate)
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+// Attachment is a file embedded in a media container: cover art stored as
+// an attached picture stream (MP3 APIC, MP4 covr, FLAC pictures) or a
+// Matroska attachment.
+type Attachment struct {
+	// Stream is the stream's index among all of the file's streams.
+	Stream int
+	// Cover is set for an attached picture.
+	Cover bool
+	Codec string
+	// Filename and MIMEType are a Matroska attachment's tags.
+	Filename string
+	MIMEType string
+	// Comment is a picture's description ("Cover (front)").
+	Comment string
+}
+
+// Attachments lists file's embedded pictures and attachments in stream
+// order.
+func (p Prober) Attachments(file string) ([]Attachment, error) {
+	out, err := p.output("-v", "error", "-show_entries", "stream=index,codec_type,codec_name:stream_tags=filename,mimetype,comment:stream_disposition=attached_pic", "-print_format", "json", file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAttachments(out), nil
+}
+
+// ParseAttachments extracts the attached pictures and attachments from
+// ffprobe's JSON output; other streams are skipped.
+func ParseAttachments(out []byte) []Attachment {
+	var pr struct {
+		Streams []struct {
+			Index     int    `json:"index"`
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Tags      struct {
+				Filename string `json:"filename"`
+				MIMEType string `json:"mimetype"`
+				Comment  string `json:"comment"`
+			} `json:"tags"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}
+	_ = json.Unmarshal(out, &pr)
+	atts := []Attachment{}
+	for _, s := range pr.Streams {
+		cover := s.CodecType == "video" && s.Disposition.AttachedPic == 1
+		if !cover && s.CodecType != "attachment" {
+			continue
+		}
+		atts = append(atts, Attachment{Stream: s.Index, Cover: cover, Codec: s.CodecName, Filename: s.Tags.Filename, MIMEType: strings.ToLower(s.Tags.MIMEType), Comment: s.Tags.Comment})
+	}
+	return atts
+}
+
+// Chapter is one chapter of a file, from StartS to EndS seconds.
+type Chapter struct {
+	StartS float64
+	EndS   float64
+	Title  string
+}
+
+// Chapters lists file's chapters in order; none is an empty list.
+func (p Prober) Chapters(file string) ([]Chapter, error) {
+	out, err := p.output("-v", "error", "-show_chapters", "-print_format", "json", file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseChapters(out), nil
+}
+
+// ParseChapters extracts the chapters from ffprobe's -show_chapters JSON
+// output, sorted by start.
+func ParseChapters(out []byte) []Chapter {
+	var pr struct {
+		Chapters []struct {
+			StartTime string `json:"start_time"`
+			EndTime   string `json:"end_time"`
+			Tags      struct {
+				Title string `json:"title"`
+			} `json:"tags"`
+		} `json:"chapters"`
+	}
+	_ = json.Unmarshal(out, &pr)
+	chs := []Chapter{}
+	for _, c := range pr.Chapters {
+		ch := Chapter{Title: strings.TrimSpace(c.Tags.Title)}
+		ch.StartS, _ = strconv.ParseFloat(c.StartTime, 64)
+		ch.EndS, _ = strconv.ParseFloat(c.EndTime, 64)
+		chs = append(chs, ch)
+	}
+	sort.SliceStable(chs, func(i, j int) bool { return chs[i].StartS < chs[j].StartS })
+	return chs
+}
+
+// Video describes the first video stream of a file. Fields ffprobe doesn't
+// report are left zero.
+type Video struct {
+	// Frames is the number of frames, counted by reading the stream.
+	Frames int
+	// FPS is the average frame rate.
+	FPS       float64
+	DurationS float64
+}
+
+// Video probes file's first video stream. It reads the whole stream to
+// count the frames, so it is meant for short inputs such as animated GIFs.
+func (p Prober) Video(file string) (Video, error) {
+	out, err := p.output("-v", "error", "-select_streams", "v:0", "-count_packets", "-show_entries", "stream=nb_read_packets,avg_frame_rate,duration:format=duration", "-print_format", "json", file)
+	if err != nil {
+		return Video{}, err
+	}
+	return ParseVideo(out), nil
+}
+
+// ParseVideo extracts Video from ffprobe's JSON output. The stream's
+// duration wins over the container's.
+func ParseVideo(out []byte) Video {
+	var v Video
+	var pr struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			Packets  string `json:"nb_read_packets"`
+			Rate     string `json:"avg_frame_rate"`
+			Duration string `json:"duration"`
+		} `json:"streams"`
+	}
+	_ = json.Unmarshal(out, &pr)
+	if f, _ := strconv.ParseFloat(pr.Format.Duration, 64); f > 0 {
+		v.DurationS = f
+	}
+	if len(pr.Streams) == 0 {
+		return v
+	}
+	s := pr.Streams[0]
+	if n, _ := strconv.Atoi(s.Packets); n > 0 {
+		v.Frames = n
+	}
+	if f, _ := strconv.ParseFloat(s.Duration, 64); f > 0 {
+		v.DurationS = f
+	}
+	v.FPS = parseRate(s.Rate)
+	return v
+}
+
+// Picture describes how the first video stream of a file is stored and
+// meant to be shown: phone footage is often turned, HDR or of variable
+// frame rate.
+type Picture struct {
+	Width  int
+	Height int
+	// Rotation is how far the frames are turned clockwise for display: 0,
+	// 90, 180 or 270. It comes from the display matrix, or the legacy
+	// rotate tag.
+	Rotation int
+	PixFmt   string
+	// ColorTransfer and ColorPrimaries are the stream's colour tags, e.g.
+	// "smpte2084" (PQ) or "arib-std-b67" (HLG) and "bt2020".
+	ColorTransfer  string
+	ColorPrimaries string
+	// FPS is the average frame rate, BaseFPS the rate the timestamps are
+	// laid out on (ffprobe's r_frame_rate).
+	FPS     float64
+	BaseFPS float64
+}
+
+// HDR reports whether the stream uses an HDR transfer, PQ or HLG.
+func (p Picture) HDR() bool {
+	return p.ColorTransfer == "smpte2084" || p.ColorTransfer == "arib-std-b67"
+}
+
+// VFR reports whether the stream's frame rate varies: its average rate is
+// more than 2% off its base rate, as with phones that slow down in low
+// light.
+func (p Picture) VFR() bool {
+	return p.FPS > 0 && p.BaseFPS > 0 && math.Abs(p.BaseFPS-p.FPS) > 0.02*p.BaseFPS
+}
+
+// Picture probes file's first video stream.
+func (p Prober) Picture(file string) (Picture, error) {
+	out, err := p.output("-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height,pix_fmt,color_transfer,color_primaries,r_frame_rate,avg_frame_rate:stream_tags=rotate:stream_side_data=rotation", "-print_format", "json", file)
+	if err != nil {
+		return Picture{}, err
+	}
+	pic, ok := ParsePicture(out)
+	if !ok {
+		return Picture{}, errors.New("no video stream")
+	}
+	return pic, nil
+}
+
+// ParsePicture extracts Picture from ffprobe's JSON output; ok is false
+// when it lists no stream.
+func ParsePicture(out []byte) (pic Picture, ok bool) {
+	var pr struct {
+		Streams []struct {
+			Width          int    `json:"width"`
+			Height         int    `json:"height"`
+			PixFmt         string `json:"pix_fmt"`
+			ColorTransfer  string `json:"color_transfer"`
+			ColorPrimaries string `json:"color_primaries"`
+			RFrameRate     string `json:"r_frame_rate"`
+			AvgFrameRate   string `json:"avg_frame_rate"`
+			Tags           struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideData []struct {
+				Rotation *float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	_ = json.Unmarshal(out, &pr)
+	if len(pr.Streams) == 0 {
+		return Picture{}, false
+	}
+	s := pr.Streams[0]
+	pic = Picture{Width: s.Width, Height: s.Height, PixFmt: s.PixFmt, ColorTransfer: s.ColorTransfer, ColorPrimaries: s.ColorPrimaries, FPS: parseRate(s.AvgFrameRate), BaseFPS: parseRate(s.RFrameRate)}
+	// the display matrix's rotation is counter-clockwise, the rotate tag's
+	// clockwise
+	var turn float64
+	if r, err := strconv.ParseFloat(s.Tags.Rotate, 64); err == nil {
+		turn = r
+	}
+	for _, sd := range s.SideData {
+		if sd.Rotation != nil {
+			turn = -*sd.Rotation
+			break
+		}
+	}
+	pic.Rotation = (int(math.Round(turn/90))%4 + 4) % 4 * 90
+	return pic, true
+}
+
+// parseRate reads a "num/den" frame rate; "0/0" when unknown gives 0.
+func parseRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseFloat(num, 64)
+	d, _ := strconv.ParseFloat(den, 64)
+	if n > 0 && d > 0 {
+		return n / d
+	}
+	return 0
+}
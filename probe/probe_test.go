@@ -0,0 +1,158 @@
+package probe
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+const ffprobeJSON = `{
+  "streams": [
+    {"codec_type": "video", "codec_name": "mjpeg"},
+    {"codec_type": "audio", "codec_name": "mp3", "channels": 2, "sample_rate": "44100", "bit_rate": "192000"}
+  ],
+  "format": {"duration": "12.500000", "bit_rate": "256000"}
+}`
+
+func TestParseAudio(t *testing.T) {
+	a := ParseAudio([]byte(ffprobeJSON))
+	want := Audio{DurationS: 12.5, Codec: "mp3", Channels: 2, SampleRate: 44100, BitrateKbps: 192, JSON: ffprobeJSON}
+	if a != want {
+		t.Errorf("ParseAudio = %+v, want %+v", a, want)
+	}
+}
+
+func TestParseAudioFormatOnly(t *testing.T) {
+	a := ParseAudio([]byte(`{"format": {"duration": "N/A", "bit_rate": "128000"}}`))
+	if a.DurationS != 0 || a.BitrateKbps != 128 || a.Codec != "" {
+		t.Errorf("ParseAudio = %+v", a)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	for _, tc := range []struct {
+		out  string
+		want float64
+		ok   bool
+	}{
+		{"3.25\n", 3.25, true},
+		{"N/A\n", 0, false},
+		{"", 0, false},
+	} {
+		var gotArgs []string
+		p := Prober{FFprobe: "/opt/ffprobe", Output: func(name string, args ...string) ([]byte, error) {
+			gotArgs = append([]string{name}, args...)
+			return []byte(tc.out), nil
+		}}
+		d, err := p.Duration("in.mp4")
+		if (err == nil) != tc.ok || d != tc.want {
+			t.Errorf("Duration with output %q = %v, %v", tc.out, d, err)
+		}
+		if gotArgs[0] != "/opt/ffprobe" || gotArgs[len(gotArgs)-1] != "in.mp4" {
+			t.Errorf("ran %v", gotArgs)
+		}
+	}
+}
+
+func TestAudioError(t *testing.T) {
+	boom := errors.New("boom")
+	p := Prober{Output: func(string, ...string) ([]byte, error) { return nil, boom }}
+	if _, err := p.Audio("x.wav"); err != boom {
+		t.Errorf("Audio error = %v, want %v", err, boom)
+	}
+}
+
+func TestParseVideo(t *testing.T) {
+	v := ParseVideo([]byte(`{
+  "streams": [{"avg_frame_rate": "100/9", "duration": "2.160000", "nb_read_packets": "24"}],
+  "format": {"duration": "2.200000"}
+}`))
+	if v != (Video{Frames: 24, FPS: 100.0 / 9, DurationS: 2.16}) {
+		t.Errorf("ParseVideo = %+v", v)
+	}
+	v = ParseVideo([]byte(`{"streams": [{"avg_frame_rate": "0/0", "nb_read_packets": "1"}], "format": {"duration": "0.1"}}`))
+	if v != (Video{Frames: 1, DurationS: 0.1}) {
+		t.Errorf("ParseVideo of a still = %+v", v)
+	}
+}
+
+func TestParseAudioTracks(t *testing.T) {
+	out := `{"streams": [
+		{"index": 1, "codec_name": "aac", "channels": 6, "sample_rate": "48000", "tags": {"language": "ENG", "title": "Surround"}, "disposition": {"default": 1}},
+		{"index": 2, "codec_name": "ac3", "channels": 2, "sample_rate": "48000", "tags": {"language": "fre"}, "disposition": {"default": 0}},
+		{"index": 3, "codec_name": "opus", "channels": 2, "sample_rate": "48000", "tags": {"language": "und"}}
+	]}`
+	got := ParseAudioTracks([]byte(out))
+	want := []AudioTrack{
+		{Index: 0, Stream: 1, Codec: "aac", Channels: 6, SampleRate: 48000, Language: "eng", Title: "Surround", Default: true},
+		{Index: 1, Stream: 2, Codec: "ac3", Channels: 2, SampleRate: 48000, Language: "fre"},
+		{Index: 2, Stream: 3, Codec: "opus", Channels: 2, SampleRate: 48000},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseAudioTracks = %+v, want %+v", got, want)
+	}
+	if got := ParseAudioTracks([]byte(`{"streams": []}`)); got == nil || len(got) != 0 {
+		t.Errorf("no streams = %#v, want empty", got)
+	}
+}
+
+func TestParseChapters(t *testing.T) {
+	out := `{"chapters": [
+		{"id": 2, "time_base": "1/1000", "start": 95000, "start_time": "95.000000", "end": 180500, "end_time": "180.500000", "tags": {"title": "Q&A "}},
+		{"id": 1, "time_base": "1/1000", "start": 0, "start_time": "0.000000", "end": 95000, "end_time": "95.000000", "tags": {"title": "Intro"}},
+		{"id": 3, "time_base": "1/1000", "start": 180500, "start_time": "180.500000", "end": 200000, "end_time": "200.000000"}
+	]}`
+	got := ParseChapters([]byte(out))
+	want := []Chapter{{StartS: 0, EndS: 95, Title: "Intro"}, {StartS: 95, EndS: 180.5, Title: "Q&A"}, {StartS: 180.5, EndS: 200}}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseChapters = %+v, want %+v", got, want)
+	}
+	if got := ParseChapters([]byte(`{}`)); got == nil || len(got) != 0 {
+		t.Errorf("no chapters = %#v, want empty", got)
+	}
+}
+
+func TestParseAttachments(t *testing.T) {
+	out := `{"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "disposition": {"attached_pic": 0}},
+		{"index": 1, "codec_type": "audio", "codec_name": "mp3"},
+		{"index": 2, "codec_type": "video", "codec_name": "mjpeg", "tags": {"comment": "Cover (front)"}, "disposition": {"attached_pic": 1}},
+		{"index": 3, "codec_type": "attachment", "codec_name": "ttf", "tags": {"filename": "font.ttf", "mimetype": "application/x-truetype-font"}},
+		{"index": 4, "codec_type": "attachment", "tags": {"filename": "cover.png", "mimetype": "IMAGE/PNG"}}
+	]}`
+	got := ParseAttachments([]byte(out))
+	want := []Attachment{
+		{Stream: 2, Cover: true, Codec: "mjpeg", Comment: "Cover (front)"},
+		{Stream: 3, Codec: "ttf", Filename: "font.ttf", MIMEType: "application/x-truetype-font"},
+		{Stream: 4, Filename: "cover.png", MIMEType: "image/png"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseAttachments = %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePicture(t *testing.T) {
+	for _, tc := range []struct {
+		name, out string
+		want      Picture
+		hdr, vfr  bool
+	}{
+		{"phone portrait HLG", `{"streams": [{"width": 1920, "height": 1080, "pix_fmt": "yuv420p10le", "color_transfer": "arib-std-b67", "color_primaries": "bt2020", "r_frame_rate": "30/1", "avg_frame_rate": "30/1", "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]}]}`,
+			Picture{Width: 1920, Height: 1080, Rotation: 90, PixFmt: "yuv420p10le", ColorTransfer: "arib-std-b67", ColorPrimaries: "bt2020", FPS: 30, BaseFPS: 30}, true, false},
+		{"rotate tag, variable rate", `{"streams": [{"width": 1280, "height": 720, "pix_fmt": "yuv420p", "r_frame_rate": "30/1", "avg_frame_rate": "2400/100", "tags": {"rotate": "270"}}]}`,
+			Picture{Width: 1280, Height: 720, Rotation: 270, PixFmt: "yuv420p", FPS: 24, BaseFPS: 30}, false, true},
+		{"upside down", `{"streams": [{"width": 640, "height": 480, "r_frame_rate": "30000/1001", "avg_frame_rate": "2997/100", "side_data_list": [{"rotation": 180}]}]}`,
+			Picture{Width: 640, Height: 480, Rotation: 180, FPS: 29.97, BaseFPS: 30000.0 / 1001}, false, false},
+	} {
+		got, ok := ParsePicture([]byte(tc.out))
+		if !ok || got != tc.want {
+			t.Errorf("%s: ParsePicture = %+v, %v, want %+v", tc.name, got, ok, tc.want)
+		}
+		if got.HDR() != tc.hdr || got.VFR() != tc.vfr {
+			t.Errorf("%s: HDR, VFR = %v, %v, want %v, %v", tc.name, got.HDR(), got.VFR(), tc.hdr, tc.vfr)
+		}
+	}
+	if _, ok := ParsePicture([]byte(`{"streams": []}`)); ok {
+		t.Error("ParsePicture of no stream is ok")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+
+	"video-to-pdf/probe"
+)
+
+// Probe cache: ffprobe's output for a file is kept under the file's path,
+// size and modification time (and the probe's arguments), so probing an
+// unchanged file again doesn't run ffprobe. A file that was replaced or
+// rewritten misses and is probed afresh. POST /{videos,audios}/:id/probe
+// refreshes an upload's probed fields; "force" skips the cache.
+
+// cachedProbe is a stored ffprobe output.
+type cachedProbe struct {
+	Path    string `json:"path"`
+	Output  string `json:"output"`
+	Created string `json:"created_at"`
+}
+
+// probeKey identifies a probe of the file that is the last of args, as it
+// is now; "" if it can't be stat'ed.
+func probeKey(args []string) (key, path string) {
+	if len(args) == 0 {
+		return "", ""
+	}
+	path = args[len(args)-1]
+	st, err := os.Stat(path)
+	if err != nil || st.IsDir() {
+		return "", ""
+	}
+	h := sha256.New()
+	for _, a := range args {
+		h.Write([]byte(a))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(strconv.FormatInt(st.Size(), 10) + "\x00" + strconv.FormatInt(st.ModTime().UnixNano(), 10)))
+	return hex.EncodeToString(h.Sum(nil)), path
+}
+
+// prober runs ffprobe through the probe cache; fresh runs it regardless
+// and stores the new output.
+func prober(fresh bool) probe.Prober {
+	return probe.Prober{FFprobe: ffprobeBin, Output: func(name string, args ...string) ([]byte, error) {
+		key, path := probeKey(args)
+		var hit cachedProbe
+		if key != "" && !fresh && storeGet(bucketProbes, key, &hit) {
+			return []byte(hit.Output), nil
+		}
+		out, err := toolOutput(name, args...)
+		if err == nil && key != "" {
+			storePut(bucketProbes, key, cachedProbe{Path: path, Output: string(out), Created: time.Now().Format(time.RFC3339)})
+		}
+		return out, err
+	}}
+}
+
+// pruneProbes drops cached probes of files that are gone.
+func pruneProbes() {
+	if db == nil {
+		return
+	}
+	var stale []string
+	_ = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketProbes)).ForEach(func(k, v []byte) error {
+			var p cachedProbe
+			if json.Unmarshal(v, &p) != nil {
+				stale = append(stale, string(k))
+			} else if _, err := os.Stat(p.Path); err != nil {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+	})
+	for _, k := range stale {
+		storeDelete(bucketProbes, k)
+	}
+}
+
+type reprobeReq struct {
+	// Force runs ffprobe even if the file is unchanged since its last probe.
+	Force bool `json:"force"`
+}
+
+// handleReprobe serves POST /{videos,audios}/:id/probe: it reads the
+// upload's duration (and for audio its stream details, for an animation
+// its frame count) again, from the
+// cache unless the file changed or force is set, and stores them.
+func handleReprobe(kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req reprobeReq
+		if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength != 0 {
+			failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+			return
+		}
+		id := c.Param("id")
+		p := prober(req.Force)
+		switch kind {
+		case "videos":
+			vm := getVideo(c, id)
+			if vm == nil {
+				break
+			}
+			dur, err := p.Duration(vm.AbsPath)
+			if err != nil {
+				fail(c, http.StatusUnprocessableEntity, "probe failed for %s: %v", vm.Name, err)
+				return
+			}
+			frameCount := vm.Frames
+			if animationExts[strings.ToLower(filepath.Ext(vm.Name))] {
+				if v, err := p.Video(vm.AbsPath); err == nil {
+					frameCount = v.Frames
+				}
+			}
+			tracks := audioTracksOf(p.AudioTracks(vm.AbsPath))
+			var pic *videoPicture
+			if frameCount == 0 {
+				pic = pictureOf(p.Picture(vm.AbsPath))
+			}
+			mu.Lock()
+			vm.DurationS, vm.Frames, vm.AudioTracks, vm.Picture = dur, frameCount, tracks, pic
+			mu.Unlock()
+			putVideo(vm)
+			c.JSON(http.StatusOK, vm)
+			return
+		case "audios":
+			am := getAudio(c, id)
+			if am == nil {
+				break
+			}
+			pa, err := p.Audio(am.AbsPath)
+			if err != nil {
+				fail(c, http.StatusUnprocessableEntity, "probe failed for %s: %v", am.Name, err)
+				return
+			}
+			mu.Lock()
+			am.DurationS, am.Codec, am.Channels, am.SampleRate, am.BitrateKbps, am.ProbeJSON = pa.DurationS, pa.Codec, pa.Channels, pa.SampleRate, pa.BitrateKbps, pa.JSON
+			mu.Unlock()
+			putAudio(am)
+			c.JSON(http.StatusOK, am)
+			return
+		}
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown %s id: %s", strings.TrimSuffix(kind, "s"), id)
+	}
+}
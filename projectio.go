@@ -0,0 +1,450 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Project export and import move a project between instances, say from a
+// laptop to the shared server. GET /projects/:id/export returns the
+// project's manifest: its settings, its uploads' metadata and its outputs'
+// URLs. With ?include=sources, outputs or both it returns a ZIP instead,
+// holding project.json and those files. POST /projects/import takes either
+// form and creates a new project owned by the caller: archived sources are
+// registered like uploads, archived outputs are written under new names
+// where theirs are taken, and sources that aren't in the archive are
+// linked to the caller's uploads of the same name and content, if any.
+// Everything gets new IDs; the response maps the old ones to them.
+
+const (
+	projectExportVersion = 1
+	// maxProjectManifestBytes caps project.json and a JSON import.
+	maxProjectManifestBytes = 16 << 20
+)
+
+// projectExport is the manifest of an exported project.
+type projectExport struct {
+	Version  int          `json:"version"`
+	Exported string       `json:"exported_at"`
+	Project  Project      `json:"project"`
+	Videos   []*VideoMeta `json:"videos"`
+	Images   []*ImgMeta   `json:"images"`
+	Audios   []*AudioMeta `json:"audios"`
+	// Files maps the upload IDs and output URLs in the archive to their
+	// paths in it.
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// projectImport is the answer of POST /projects/import.
+type projectImport struct {
+	Project Project `json:"project"`
+	// IDs maps the exported uploads' IDs to the imported ones, and Outputs
+	// the exported output URLs to the imported ones.
+	IDs     map[string]string `json:"ids"`
+	Outputs map[string]string `json:"outputs"`
+	// Missing lists the uploads and outputs that were neither in the
+	// archive nor found here.
+	Missing []string `json:"missing,omitempty"`
+	// Errors lists the files that were in the archive but couldn't be
+	// imported.
+	Errors []string `json:"errors,omitempty"`
+}
+
+func handleExportProject(c *gin.Context) {
+	var withSources, withOutputs bool
+	for _, s := range strings.Split(c.Query("include"), ",") {
+		switch strings.TrimSpace(s) {
+		case "":
+		case "sources":
+			withSources = true
+		case "outputs":
+			withOutputs = true
+		default:
+			fail(c, http.StatusBadRequest, "include takes sources and outputs, got %q", s)
+			return
+		}
+	}
+	mu.Lock()
+	p := projects[c.Param("id")]
+	if p == nil || !canAccess(c, p.Owner) {
+		mu.Unlock()
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown project id: %s", c.Param("id"))
+		return
+	}
+	m := projectExport{Version: projectExportVersion, Exported: time.Now().Format(time.RFC3339), Project: *p, Videos: []*VideoMeta{}, Images: []*ImgMeta{}, Audios: []*AudioMeta{}}
+	m.Project.Owner = ""
+	// paths are the files to archive, by their path in the ZIP
+	paths := map[string]string{}
+	var names []string
+	add := func(key, name, path string) {
+		if !fileExists(path) {
+			return
+		}
+		if m.Files == nil {
+			m.Files = map[string]string{}
+		}
+		m.Files[key] = name
+		paths[name] = path
+		names = append(names, name)
+	}
+	for _, id := range p.VideoIDs {
+		if v := videos[id]; v != nil && canAccess(c, v.Owner) {
+			vm := *v
+			vm.Owner = ""
+			m.Videos = append(m.Videos, &vm)
+			if withSources {
+				add(id, "sources/videos/"+id+"/"+sanitizeName(v.Name), v.AbsPath)
+			}
+		}
+	}
+	for _, id := range p.ImageIDs {
+		if im := images[id]; im != nil && canAccess(c, im.Owner) {
+			cp := *im
+			cp.Owner = ""
+			m.Images = append(m.Images, &cp)
+			if withSources {
+				add(id, "sources/images/"+id+"/"+sanitizeName(im.Name), im.AbsPath)
+			}
+		}
+	}
+	for _, id := range p.AudioIDs {
+		if am := audios[id]; am != nil && canAccess(c, am.Owner) {
+			cp := *am
+			cp.Owner = ""
+			m.Audios = append(m.Audios, &cp)
+			if withSources {
+				add(id, "sources/audios/"+id+"/"+sanitizeName(am.Name), am.AbsPath)
+			}
+		}
+	}
+	mu.Unlock()
+	if withOutputs {
+		for _, u := range m.Project.Outputs {
+			if path := outputPath(u); path != "" {
+				add(u, "outputs"+u, path)
+			}
+		}
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "manifest: %v", err)
+		return
+	}
+	base := "project_" + sanitizeName(m.Project.Name)
+	if !withSources && !withOutputs {
+		c.Header("Content-Disposition", contentDisposition("attachment", base+".json"))
+		c.Data(http.StatusOK, "application/json; charset=utf-8", manifest)
+		return
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", contentDisposition("attachment", base+".zip"))
+	zw := zip.NewWriter(c.Writer)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "project.json", Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		_, err = w.Write(manifest)
+	}
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		err = addFileToZip(zw, paths[name], name)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// as with job bundles, the missing central directory marks the
+		// ZIP as cut short
+		_ = c.Error(err)
+	}
+}
+
+// handleImportProject creates a project from an export: a JSON manifest,
+// or a multipart form whose "archive" field is an exported ZIP. The
+// archive is held to the video upload limit.
+func handleImportProject(c *gin.Context) {
+	var m projectExport
+	var zr *zip.Reader
+	if c.ContentType() == "application/json" {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxProjectManifestBytes)
+		if err := json.NewDecoder(c.Request.Body).Decode(&m); err != nil {
+			failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+			return
+		}
+	} else {
+		files, _, ok := receiveUpload(c, "video", "archive")
+		if !ok {
+			return
+		}
+		defer discardUploads(files)
+		if len(files) != 1 {
+			fail(c, http.StatusBadRequest, "send one exported project as the archive field")
+			return
+		}
+		zf, err := zip.OpenReader(files[0].Abs)
+		if err != nil {
+			fail(c, http.StatusBadRequest, "archive is not a ZIP: %v", err)
+			return
+		}
+		defer zf.Close()
+		zr = &zf.Reader
+		if err := readZipJSON(zr, "project.json", &m); err != nil {
+			fail(c, http.StatusBadRequest, "archive: %v", err)
+			return
+		}
+	}
+	if m.Version < 1 || m.Version > projectExportVersion {
+		fail(c, http.StatusBadRequest, "unsupported export version %d", m.Version)
+		return
+	}
+	if strings.TrimSpace(m.Project.Name) == "" {
+		fail(c, http.StatusBadRequest, "the export has no project name")
+		return
+	}
+	quota, _ := ownerQuota(c)
+	c.JSON(http.StatusOK, importProject(ownerOf(c), quota, m, zr))
+}
+
+// importProject creates the project of m for owner, whose storage quota is
+// quota (0 for none), taking files from zr (nil for a manifest alone).
+func importProject(owner string, quota int64, m projectExport, zr *zip.Reader) projectImport {
+	now := time.Now().Format(time.RFC3339)
+	p := &Project{ID: randID(8), Name: strings.TrimSpace(m.Project.Name), Description: m.Project.Description, Defaults: m.Project.Defaults, Created: now, Updated: now, VideoIDs: []string{}, ImageIDs: []string{}, AudioIDs: []string{}, Outputs: []string{}, Owner: owner}
+	mu.Lock()
+	projects[p.ID] = p
+	snap := p.snapshot()
+	mu.Unlock()
+	putProject(snap)
+	res := projectImport{IDs: map[string]string{}, Outputs: map[string]string{}}
+	room := newImportRoom(owner, quota)
+
+	type source struct {
+		kind, id, name, sum string
+		tags                []string
+	}
+	var srcs []source
+	for _, v := range m.Videos {
+		srcs = append(srcs, source{"video", v.ID, v.Name, v.SHA256, v.Tags})
+	}
+	for _, im := range m.Images {
+		srcs = append(srcs, source{"image", im.ID, im.Name, im.SHA256, im.Tags})
+	}
+	for _, am := range m.Audios {
+		srcs = append(srcs, source{"audio", am.ID, am.Name, am.SHA256, am.Tags})
+	}
+	for _, s := range srcs {
+		if zf := zipEntry(zr, m.Files[s.id]); zf != nil {
+			if room.full() {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: storage quota exceeded", s.name))
+				continue
+			}
+			meta, size, err := importSource(zf, s.kind, owner, s.name, s.tags, p, room.limit(s.kind))
+			if err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", s.name, room.explain(err)))
+				continue
+			}
+			room.take(size)
+			res.IDs[s.id] = uploadID(meta)
+			continue
+		}
+		if dup := sameUpload(s.kind, owner, s.name, s.sum); dup != nil {
+			id := uploadID(dup)
+			addToProject(p, s.kind+"s", id)
+			res.IDs[s.id] = id
+			continue
+		}
+		res.Missing = append(res.Missing, s.id)
+	}
+	for _, u := range m.Project.Outputs {
+		zf := zipEntry(zr, m.Files[u])
+		if zf == nil {
+			res.Missing = append(res.Missing, u)
+			continue
+		}
+		if room.full() {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: storage quota exceeded", u))
+			continue
+		}
+		url, size, err := importOutput(zf, owner, u, room.limit("video"))
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", u, room.explain(err)))
+			continue
+		}
+		room.take(size)
+		recordOutputs(owner, url)
+		recordProjectOutputs(p, url)
+		res.Outputs[u] = url
+	}
+	mu.Lock()
+	res.Project = *p.snapshot()
+	mu.Unlock()
+	return res
+}
+
+// importSource registers the archived file zf as an upload of kind called
+// name, failing past limit bytes, and returns it with its size.
+func importSource(zf *zip.File, kind, owner, name string, tags []string, p *Project, limit int64) (any, int64, error) {
+	name = displayName(name)
+	if name == "" {
+		name = displayName(zf.Name)
+	}
+	id := randID(8)
+	dir := filepath.Join(uploadDir, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, 0, err
+	}
+	size, err := extractZipFile(zf, filepath.Join(dir, name), limit)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, 0, err
+	}
+	meta, err := registerSource(kind, owner, id, name, size, tags, p)
+	return meta, size, err
+}
+
+// importRoom is what an import may still write for its owner: what was
+// left of the quota when it started, less the files written since.
+type importRoom struct {
+	capped bool
+	left   int64
+}
+
+// newImportRoom starts the room of an import by owner, whose quota is
+// quota (0 for none).
+func newImportRoom(owner string, quota int64) *importRoom {
+	if quota <= 0 {
+		return &importRoom{}
+	}
+	return &importRoom{capped: true, left: quota - userUsage(owner)}
+}
+
+// full reports whether nothing more may be written.
+func (r *importRoom) full() bool { return r.capped && r.left <= 0 }
+
+// limit is the most the next file may take: the file limit of an upload
+// of kind, within the room left.
+func (r *importRoom) limit(kind string) int64 {
+	_, limit := uploadLimits(kind)
+	if r.capped {
+		limit = min(limit, r.left)
+	}
+	return limit
+}
+
+// take counts n bytes written.
+func (r *importRoom) take(n int64) { r.left -= n }
+
+// explain reports a file stopped by the room left, rather than by its
+// file limit, as over the quota.
+func (r *importRoom) explain(err error) error {
+	var l *sizeLimit
+	if r.capped && errors.As(err, &l) && l.Bytes == r.left {
+		return errors.New("storage quota exceeded")
+	}
+	return err
+}
+
+// importOutput writes the archived output zf, exported as url, to the
+// matching output directory, failing past limit bytes, and returns its new
+// URL and size.
+func importOutput(zf *zip.File, owner, url string, limit int64) (string, int64, error) {
+	for prefix, dir := range outputDirs() {
+		rest, ok := strings.CutPrefix(url, prefix)
+		if !ok {
+			continue
+		}
+		path := claimOutput(owner, filepath.Join(dir, sanitizeName(filepath.Base(rest))))
+		size, err := extractZipFile(zf, path, limit)
+		if err != nil {
+			os.Remove(path)
+			return "", 0, err
+		}
+		return outputURL(path), size, nil
+	}
+	return "", 0, fmt.Errorf("not an output URL")
+}
+
+// extractZipFile writes zf to path, failing past limit bytes (0 for no
+// limit), and returns its size.
+func extractZipFile(zf *zip.File, path string, limit int64) (int64, error) {
+	if limit > 0 && zf.UncompressedSize64 > uint64(limit) {
+		return 0, &sizeLimit{Scope: "file", Bytes: limit, File: filepath.Base(path)}
+	}
+	r, err := zf.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	src := io.Reader(r)
+	if limit > 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit > 0 && n > limit {
+		err = &sizeLimit{Scope: "file", Bytes: limit, File: filepath.Base(path)}
+	}
+	return n, err
+}
+
+// zipEntry is the file called name in zr, or nil.
+func zipEntry(zr *zip.Reader, name string) *zip.File {
+	if zr == nil || name == "" {
+		return nil
+	}
+	i := slices.IndexFunc(zr.File, func(f *zip.File) bool { return f.Name == name })
+	if i < 0 {
+		return nil
+	}
+	return zr.File[i]
+}
+
+// readZipJSON decodes the JSON file name of zr into v.
+func readZipJSON(zr *zip.Reader, name string, v any) error {
+	zf := zipEntry(zr, name)
+	if zf == nil {
+		return fmt.Errorf("no %s", name)
+	}
+	if zf.UncompressedSize64 > maxProjectManifestBytes {
+		return fmt.Errorf("%s is too large", name)
+	}
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(io.LimitReader(r, maxProjectManifestBytes)).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// uploadID is the ID of an upload's metadata.
+func uploadID(meta any) string {
+	switch m := meta.(type) {
+	case *VideoMeta:
+		return m.ID
+	case *ImgMeta:
+		return m.ID
+	case *AudioMeta:
+		return m.ID
+	}
+	return ""
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// projectDefaults are applied to processing requests that name the project
+// and leave the corresponding setting unset. The same shape holds the
+// server-wide defaults from the config file.
+type projectDefaults struct {
+	FPS              float64 `json:"fps,omitempty" yaml:"fps"`
+	JPEGQuality      int     `json:"jpeg_quality,omitempty" yaml:"jpeg_quality"`
+	Density          int     `json:"pdf_density,omitempty" yaml:"pdf_density"`
+	Quality          int     `json:"pdf_quality,omitempty" yaml:"pdf_quality"`
+	AudioFormat      string  `json:"audio_format,omitempty" yaml:"audio_format"`
+	AudioBitrateKbps int     `json:"audio_bitrate_kbps,omitempty" yaml:"audio_bitrate_kbps"`
+}
+
+// Project groups uploads and generated outputs for one client or job.
+type Project struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Created     string          `json:"created_at"`
+	Updated     string          `json:"updated_at"`
+	Defaults    projectDefaults `json:"defaults"`
+	VideoIDs    []string        `json:"video_ids"`
+	ImageIDs    []string        `json:"image_ids"`
+	AudioIDs    []string        `json:"audio_ids"`
+	// Outputs are the URLs of files generated for the project.
+	Outputs []string `json:"outputs"`
+	Owner   string   `json:"owner,omitempty"`
+}
+
+// projects is guarded by mu like the upload maps.
+var projects = map[string]*Project{}
+
+type projectReq struct {
+	Name        *string          `json:"name"`
+	Description *string          `json:"description"`
+	Defaults    *projectDefaults `json:"defaults"`
+}
+
+type projectItemsReq struct {
+	Videos []string `json:"videos"`
+	Images []string `json:"images"`
+	Audios []string `json:"audios"`
+}
+
+func putProject(p *Project) { storePut(bucketProjects, p.ID, p) }
+
+// snapshot copies p, lists included, to be stored or sent once mu is
+// released; call it with mu held.
+func (p *Project) snapshot() *Project {
+	snap := *p
+	snap.VideoIDs = slices.Clone(p.VideoIDs)
+	snap.ImageIDs = slices.Clone(p.ImageIDs)
+	snap.AudioIDs = slices.Clone(p.AudioIDs)
+	snap.Outputs = slices.Clone(p.Outputs)
+	return &snap
+}
+
+// lookupProject returns the project or nil if it doesn't exist or isn't
+// visible to the request; an empty id is not an error.
+func lookupProject(c *gin.Context, id string) *Project {
+	if id == "" {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if p := projects[id]; p != nil && canAccess(c, p.Owner) {
+		return p
+	}
+	return nil
+}
+
+// addToProject appends ids of kind ("videos", "images", "audios") to the
+// project, skipping ones already present.
+func addToProject(p *Project, kind string, ids ...string) {
+	if p == nil || len(ids) == 0 {
+		return
+	}
+	mu.Lock()
+	list := projectList(p, kind)
+	for _, id := range ids {
+		if !slices.Contains(*list, id) {
+			*list = append(*list, id)
+		}
+	}
+	p.Updated = time.Now().Format(time.RFC3339)
+	snap := p.snapshot()
+	mu.Unlock()
+	putProject(snap)
+}
+
+// recordProjectOutputs remembers generated files (by URL) on the project.
+func recordProjectOutputs(p *Project, urls ...string) {
+	if p == nil || len(urls) == 0 {
+		return
+	}
+	mu.Lock()
+	for _, u := range urls {
+		if !slices.Contains(p.Outputs, u) {
+			p.Outputs = append(p.Outputs, u)
+		}
+	}
+	p.Updated = time.Now().Format(time.RFC3339)
+	snap := p.snapshot()
+	mu.Unlock()
+	putProject(snap)
+}
+
+func projectList(p *Project, kind string) *[]string {
+	switch kind {
+	case "videos":
+		return &p.VideoIDs
+	case "images":
+		return &p.ImageIDs
+	default:
+		return &p.AudioIDs
+	}
+}
+
+func handleCreateProject(c *gin.Context) {
+	var req projectReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+		fail(c, http.StatusBadRequest, "name is required")
+		return
+	}
+	now := time.Now().Format(time.RFC3339)
+	p := &Project{ID: randID(8), Name: strings.TrimSpace(*req.Name), Created: now, Updated: now, VideoIDs: []string{}, ImageIDs: []string{}, AudioIDs: []string{}, Outputs: []string{}, Owner: ownerOf(c)}
+	if req.Description != nil {
+		p.Description = *req.Description
+	}
+	if req.Defaults != nil {
+		p.Defaults = *req.Defaults
+	}
+	mu.Lock()
+	projects[p.ID] = p
+	snap := p.snapshot()
+	mu.Unlock()
+	putProject(snap)
+	c.JSON(http.StatusOK, snap)
+}
+
+func handleListProjects(c *gin.Context) {
+	q, err := parseListQuery(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	mu.Lock()
+	out := make([]Project, 0, len(projects))
+	for _, p := range projects {
+		if canAccess(c, p.Owner) {
+			out = append(out, *p.snapshot())
+		}
+	}
+	mu.Unlock()
+	page, total := applyListQuery(out, q, func(p Project) listKey {
+		return listKey{Name: p.Name, Date: p.Created, DurationS: -1}
+	})
+	c.JSON(http.StatusOK, listResponse("projects", page, total, q))
+}
+
+// handleGetProject returns the project with its uploads resolved.
+func handleGetProject(c *gin.Context) {
+	mu.Lock()
+	defer mu.Unlock()
+	p := projects[c.Param("id")]
+	if p == nil || !canAccess(c, p.Owner) {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown project id: %s", c.Param("id"))
+		return
+	}
+	vs := make([]*VideoMeta, 0, len(p.VideoIDs))
+	for _, id := range p.VideoIDs {
+		if v := videos[id]; v != nil && canAccess(c, v.Owner) {
+			vs = append(vs, v)
+		}
+	}
+	ims := make([]*ImgMeta, 0, len(p.ImageIDs))
+	for _, id := range p.ImageIDs {
+		if im := images[id]; im != nil && canAccess(c, im.Owner) {
+			ims = append(ims, im)
+		}
+	}
+	as := make([]*AudioMeta, 0, len(p.AudioIDs))
+	for _, id := range p.AudioIDs {
+		if am := audios[id]; am != nil && canAccess(c, am.Owner) {
+			as = append(as, am)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"project": p, "videos": vs, "images": ims, "audios": as})
+}
+
+func handleUpdateProject(c *gin.Context) {
+	var req projectReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		fail(c, http.StatusBadRequest, "name must not be empty")
+		return
+	}
+	mu.Lock()
+	p := projects[c.Param("id")]
+	if p == nil || !canAccess(c, p.Owner) {
+		mu.Unlock()
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown project id: %s", c.Param("id"))
+		return
+	}
+	if req.Name != nil {
+		p.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Description != nil {
+		p.Description = *req.Description
+	}
+	if req.Defaults != nil {
+		p.Defaults = *req.Defaults
+	}
+	p.Updated = time.Now().Format(time.RFC3339)
+	snap := p.snapshot()
+	mu.Unlock()
+	putProject(snap)
+	c.JSON(http.StatusOK, snap)
+}
+
+// handleDeleteProject forgets the project; its uploads and outputs stay.
+func handleDeleteProject(c *gin.Context) {
+	id := c.Param("id")
+	mu.Lock()
+	p := projects[id]
+	if p != nil && !canAccess(c, p.Owner) {
+		p = nil
+	}
+	if p != nil {
+		delete(projects, id)
+	}
+	mu.Unlock()
+	if p == nil {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown project id: %s", id)
+		return
+	}
+	storeDelete(bucketProjects, id)
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleProjectItems adds (POST) or removes (DELETE) uploads.
+func handleProjectItems(c *gin.Context) {
+	var req projectItemsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	mu.Lock()
+	p := projects[c.Param("id")]
+	if p == nil || !canAccess(c, p.Owner) {
+		mu.Unlock()
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown project id: %s", c.Param("id"))
+		return
+	}
+	byKind := map[string][]string{"videos": req.Videos, "images": req.Images, "audios": req.Audios}
+	adding := c.Request.Method == http.MethodPost
+	if adding {
+		for _, id := range req.Videos {
+			if v := videos[id]; v == nil || !canAccess(c, v.Owner) {
+				mu.Unlock()
+				failCode(c, http.StatusBadRequest, errUnknownID, "unknown video id: %s", id)
+				return
+			}
+		}
+		for _, id := range req.Images {
+			if im := images[id]; im == nil || !canAccess(c, im.Owner) {
+				mu.Unlock()
+				failCode(c, http.StatusBadRequest, errUnknownID, "unknown image id: %s", id)
+				return
+			}
+		}
+		for _, id := range req.Audios {
+			if am := audios[id]; am == nil || !canAccess(c, am.Owner) {
+				mu.Unlock()
+				failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", id)
+				return
+			}
+		}
+	}
+	for kind, ids := range byKind {
+		list := projectList(p, kind)
+		for _, id := range ids {
+			if !adding {
+				*list = slices.DeleteFunc(*list, func(x string) bool { return x == id })
+			} else if !slices.Contains(*list, id) {
+				*list = append(*list, id)
+			}
+		}
+	}
+	p.Updated = time.Now().Format(time.RFC3339)
+	snap := p.snapshot()
+	mu.Unlock()
+	putProject(snap)
+	c.JSON(http.StatusOK, snap)
+}
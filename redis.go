@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisConn is a minimal Redis client (RESP2) for the job queue: one
+// connection, one command at a time.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+const redisDialTimeout = 10 * time.Second
+
+// dialRedis connects to a redis:// or rediss:// (TLS) URL of the form
+// redis://[user:password@]host[:port][/db].
+func dialRedis(rawURL string) (*redisConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("bad queue URL %q: want redis://host:port/db", redactURL(rawURL))
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	d := &net.Dialer{Timeout: redisDialTimeout, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	if u.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if pw, ok := u.User.Password(); ok {
+		args := []string{"AUTH", pw}
+		if name := u.User.Username(); name != "" {
+			args = []string{"AUTH", name, pw}
+		}
+		if _, err := rc.do(args...); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		if _, err := strconv.Atoi(db); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("bad queue URL: database %q is not a number", db)
+		}
+		if _, err := rc.do("SELECT", db); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// redactURL drops the password from a URL for logs and errors.
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return "?"
+}
+
+func (rc *redisConn) Close() error { return rc.conn.Close() }
+
+// do sends a command and reads its reply: a string for simple and bulk
+// strings, int64 for integers, []any for arrays, nil for null replies and
+// redisError for errors.
+func (rc *redisConn) do(args ...string) (any, error) {
+	return rc.doTimeout(10*time.Second, args...)
+}
+
+// doTimeout is do for commands that may block on the server, like BRPOP:
+// wait is how long the reply may take.
+func (rc *redisConn) doTimeout(wait time.Duration, args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_ = rc.conn.SetDeadline(time.Now().Add(wait))
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	v, err := rc.read()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := v.(redisError); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = rc.read(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: bad reply %q", line)
+}
+
+// pop is BRPOP/BLPOP over keys, waiting up to timeout. It returns the key
+// and the value, or "" and "" if nothing arrived in time.
+func (rc *redisConn) pop(cmd string, timeout time.Duration, keys ...string) (key, val string, err error) {
+	args := append([]string{cmd}, keys...)
+	args = append(args, strconv.Itoa(max(1, int(timeout.Seconds()))))
+	v, err := rc.doTimeout(timeout+10*time.Second, args...)
+	if err != nil || v == nil {
+		return "", "", err
+	}
+	kv, ok := v.([]any)
+	if !ok || len(kv) != 2 {
+		return "", "", fmt.Errorf("redis: unexpected %s reply", cmd)
+	}
+	key, _ = kv[0].(string)
+	val, _ = kv[1].(string)
+	return key, val, nil
+}
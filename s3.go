@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client talks to S3 and S3-compatible services (MinIO, R2, GCS's XML
+// API) with path-style URLs and Signature Version 4.
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+}
+
+func newS3Client(endpoint, region, accessKey, secretKey string) (*s3Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad storage endpoint %q", endpoint)
+	}
+	return &s3Client{
+		endpoint:     u,
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		http:         &http.Client{},
+	}, nil
+}
+
+// s3Escape percent-encodes s the way SigV4 canonical requests expect:
+// everything but unreserved characters, keeping "/" when path is set.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectURL is the path-style URL of key in bucket.
+func (s *s3Client) objectURL(bucket, key string) string {
+	return s.endpoint.String() + "/" + s3Escape(bucket, false) + "/" + s3Escape(key, true)
+}
+
+// newRequest builds a request for key in bucket ("" for the bucket itself),
+// signed unless the client has no credentials. body is sent unsigned, so it
+// may be streamed.
+func (s *s3Client) newRequest(ctx context.Context, method, bucket, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	path := "/" + s3Escape(bucket, false)
+	if key != "" {
+		path += "/" + s3Escape(key, true)
+	}
+	u := *s.endpoint
+	u.Path, _ = url.PathUnescape(s.endpoint.EscapedPath() + path)
+	u.RawPath = s.endpoint.EscapedPath() + path
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.accessKey != "" {
+		s.sign(req, u.RawPath, "UNSIGNED-PAYLOAD", time.Now().UTC())
+	}
+	return req, nil
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// sign adds the SigV4 Authorization header to req.
+func (s *s3Client) sign(req *http.Request, canonicalURI, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	var headers strings.Builder
+	for _, n := range names {
+		v := req.Header.Get(n)
+		if n == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(n + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, canonicalURI, req.URL.RawQuery, headers.String(), signed, payloadHash}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signed, sig))
+}
+
+// do sends req and turns non-2xx answers into errors carrying the
+// service's message.
+func (s *s3Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// s3Store is the s3/gcs output backend.
+type s3Store struct {
+	client *s3Client
+	bucket string
+}
+
+func (s *s3Store) put(ctx context.Context, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := s.client.newRequest(ctx, http.MethodPut, s.bucket, key, nil, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = st.Size()
+	if ct := mime.TypeByExtension(filepath.Ext(path)); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := s.client.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) url(key string) string { return s.client.objectURL(s.bucket, key) }
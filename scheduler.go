@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Job priorities. Waiting jobs start highest priority first, then in
+// submission order. Bulk jobs never take the last free slot, so interactive
+// and normal work can always start next.
+const (
+	prioBulk        = "bulk"
+	prioNormal      = "normal"
+	prioInteractive = "interactive"
+)
+
+var prioRank = map[string]int{prioBulk: 0, prioNormal: 1, prioInteractive: 2}
+
+// maxJobs caps how many jobs run at once (limits.jobs, FRAMESPDF_MAX_JOBS,
+// -max-jobs); the rest stay queued.
+var maxJobs = max(2, runtime.NumCPU())
+
+// parsePriority validates a request's priority; empty means normal.
+func parsePriority(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return prioNormal, nil
+	}
+	if _, ok := prioRank[s]; !ok {
+		return "", fmt.Errorf("priority must be interactive, normal or bulk")
+	}
+	return s, nil
+}
+
+type jobWaiter struct {
+	job   string
+	prio  string
+	seq   uint64
+	ready chan struct{}
+}
+
+var sched struct {
+	sync.Mutex
+	running, runningBulk int
+	seq                  uint64
+	waiting              []*jobWaiter
+}
+
+// bulkCap is how many bulk jobs may run at once.
+func bulkCap() int { return max(1, maxJobs-1) }
+
+// acquireJobSlot blocks until job, of priority prio, may run. Once the
+// shutdown grace period is over it returns right away; the job's tools then
+// fail fast.
+func acquireJobSlot(job, prio string) {
+	sched.Lock()
+	sched.seq++
+	w := &jobWaiter{job: job, prio: prio, seq: sched.seq, ready: make(chan struct{})}
+	sched.waiting = append(sched.waiting, w)
+	dispatchJobsLocked()
+	sched.Unlock()
+	select {
+	case <-w.ready:
+	case <-workCtx.Done():
+		sched.Lock()
+		for i, x := range sched.waiting {
+			if x == w {
+				sched.waiting = append(sched.waiting[:i], sched.waiting[i+1:]...)
+				// not admitted: don't let releaseJobSlot count it
+				sched.running++
+				if prio == prioBulk {
+					sched.runningBulk++
+				}
+				break
+			}
+		}
+		sched.Unlock()
+	}
+}
+
+func releaseJobSlot(prio string) {
+	sched.Lock()
+	sched.running--
+	if prio == prioBulk {
+		sched.runningBulk--
+	}
+	dispatchJobsLocked()
+	sched.Unlock()
+}
+
+// dispatchJobsLocked starts waiting jobs while there are free slots and the
+// box isn't overloaded (see admission.go).
+func dispatchJobsLocked() {
+	sort.SliceStable(sched.waiting, func(i, j int) bool { return startsBefore(sched.waiting[i], sched.waiting[j]) })
+	if len(overloaded()) > 0 {
+		return
+	}
+	keep := sched.waiting[:0]
+	for _, w := range sched.waiting {
+		bulk := w.prio == prioBulk
+		if sched.running < maxJobs && (!bulk || sched.runningBulk < bulkCap()) {
+			sched.running++
+			if bulk {
+				sched.runningBulk++
+			}
+			close(w.ready)
+			continue
+		}
+		keep = append(keep, w)
+	}
+	sched.waiting = keep
+}
+
+// startsBefore reports whether waiting job a gets a slot before b.
+func startsBefore(a, b *jobWaiter) bool {
+	if prioRank[a.prio] != prioRank[b.prio] {
+		return prioRank[a.prio] > prioRank[b.prio]
+	}
+	return a.seq < b.seq
+}
+
+// queuePositions maps each job waiting for a slot to its place in line, 1
+// being the next to start. A bulk job may be passed by later ones while
+// only one slot is free.
+func queuePositions() map[string]int {
+	sched.Lock()
+	defer sched.Unlock()
+	// dispatchJobsLocked keeps the list sorted
+	pos := make(map[string]int, len(sched.waiting))
+	for i, w := range sched.waiting {
+		pos[w.job] = i + 1
+	}
+	return pos
+}
+
+// jobSlotStats reports running and waiting jobs.
+func jobSlotStats() (running, waiting int) {
+	sched.Lock()
+	defer sched.Unlock()
+	return sched.running, len(sched.waiting)
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Schedules run tasks on a cron expression (minute hour day month weekday,
+// in the server's time zone, or @hourly, @daily, @weekly, @monthly,
+// @yearly). The tasks are:
+//
+//	retention    a janitor sweep with the configured retention
+//	watch_scan   one scan of a watch folder (params.dir), taking every file
+//	             that has been left alone for the watch interval
+//	images_pdf   a PDF of a project's images in their order
+//	             (params.project_id), as out_name or after the project
+//
+// Admins manage them under /schedules. A run that is due while the last
+// one is still going is skipped, as are runs that fell due while the
+// server was down. POST /schedules/:id/run starts one right away.
+
+// scheduleTasks are the tasks a schedule can run.
+var scheduleTasks = []string{"retention", "watch_scan", "images_pdf"}
+
+// Schedule is a task run on a cron expression.
+type Schedule struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name,omitempty"`
+	Cron    string         `json:"cron"`
+	Task    string         `json:"task"`
+	Params  scheduleParams `json:"params"`
+	Enabled bool           `json:"enabled"`
+	Owner   string         `json:"owner,omitempty"`
+	Created string         `json:"created_at"`
+	Updated string         `json:"updated_at"`
+	// NextRun is empty while the schedule is disabled.
+	NextRun string       `json:"next_run_at,omitempty"`
+	LastRun *scheduleRun `json:"last_run,omitempty"`
+
+	spec    cronSpec
+	next    time.Time
+	running bool
+}
+
+type scheduleParams struct {
+	// Dir is the watch folder of watch_scan.
+	Dir string `json:"dir,omitempty"`
+	// ProjectID, OutName, Density and Quality are images_pdf's.
+	ProjectID string `json:"project_id,omitempty"`
+	OutName   string `json:"out_name,omitempty"`
+	Density   int    `json:"pdf_density,omitempty"`
+	Quality   int    `json:"pdf_quality,omitempty"`
+}
+
+// scheduleRun is how a schedule's last run went.
+type scheduleRun struct {
+	Started  string `json:"started_at"`
+	Finished string `json:"finished_at,omitempty"`
+	JobID    string `json:"job_id,omitempty"`
+	Result   gin.H  `json:"result,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type scheduleReq struct {
+	Name    *string         `json:"name"`
+	Cron    *string         `json:"cron"`
+	Task    *string         `json:"task"`
+	Params  *scheduleParams `json:"params"`
+	Enabled *bool           `json:"enabled"`
+}
+
+// schedules is guarded by schedulesMu.
+var (
+	schedulesMu sync.Mutex
+	schedules   = map[string]*Schedule{}
+)
+
+func putSchedule(s *Schedule) { storePut(bucketSchedules, s.ID, s) }
+
+// check validates s's expression and task and works out its next run.
+func (s *Schedule) check(now time.Time) error {
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+	if spec.next(now).IsZero() {
+		return fmt.Errorf("cron %q never matches", s.Cron)
+	}
+	switch s.Task {
+	case "retention":
+	case "watch_scan":
+		if findWatchFolder(s.Params.Dir) == nil {
+			return fmt.Errorf("params.dir must be a configured watch folder")
+		}
+	case "images_pdf":
+		if !moduleOn("images") {
+			return fmt.Errorf("the images module is disabled")
+		}
+		mu.Lock()
+		p := projects[s.Params.ProjectID]
+		mu.Unlock()
+		if p == nil {
+			return fmt.Errorf("unknown project id: %s", s.Params.ProjectID)
+		}
+		if s.Params.Density < 0 || s.Params.Quality < 0 || s.Params.Quality > 100 {
+			return fmt.Errorf("pdf_density must be positive and pdf_quality at most 100")
+		}
+	default:
+		return fmt.Errorf("task must be one of %s", strings.Join(scheduleTasks, ", "))
+	}
+	s.spec = spec
+	s.next = time.Time{}
+	if s.Enabled {
+		s.next = spec.next(now)
+	}
+	s.NextRun = ""
+	if !s.next.IsZero() {
+		s.NextRun = s.next.Format(time.RFC3339)
+	}
+	return nil
+}
+
+// loadSchedules readies the stored schedules; one that no longer checks
+// out (its folder or project is gone) is kept but disabled.
+func loadSchedules() {
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+	now := time.Now()
+	for _, s := range schedules {
+		if err := s.check(now); err != nil {
+			slog.Warn("schedule disabled", "id", s.ID, "error", err.Error())
+			s.Enabled = false
+			s.NextRun = ""
+			putSchedule(s)
+		}
+	}
+}
+
+// startSchedules starts the schedules that fall due, checking at the top of
+// every minute.
+func startSchedules() {
+	loadSchedules()
+	go func() {
+		for {
+			now := time.Now()
+			select {
+			case <-workCtx.Done():
+				return
+			case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+			}
+			now = time.Now()
+			schedulesMu.Lock()
+			for _, s := range schedules {
+				if !s.Enabled || s.next.IsZero() || s.next.After(now) {
+					continue
+				}
+				s.next = s.spec.next(now)
+				s.NextRun = s.next.Format(time.RFC3339)
+				if s.running {
+					slog.Warn("schedule skipped, last run still going", "id", s.ID, "task", s.Task)
+					continue
+				}
+				startScheduleRunLocked(s)
+			}
+			schedulesMu.Unlock()
+		}
+	}()
+}
+
+// startScheduleRunLocked runs s in the background; schedulesMu is held.
+func startScheduleRunLocked(s *Schedule) *scheduleRun {
+	s.running = true
+	run := &scheduleRun{Started: time.Now().Format(time.RFC3339)}
+	s.LastRun = run
+	task, params := s.Task, s.Params
+	slog.Info("schedule run", "id", s.ID, "task", task)
+	go func() {
+		jobID, result, err := runScheduledTask(task, params)
+		// runs are replaced, not changed, as snapshots share them
+		done := *run
+		done.Finished = time.Now().Format(time.RFC3339)
+		done.JobID, done.Result = jobID, result
+		if err != nil {
+			done.Error = err.Error()
+			slog.Warn("schedule run failed", "id", s.ID, "task", task, "error", done.Error)
+		}
+		schedulesMu.Lock()
+		s.running = false
+		s.LastRun = &done
+		snap := *s
+		schedulesMu.Unlock()
+		putSchedule(&snap)
+	}()
+	return run
+}
+
+// runScheduledTask runs task and returns the job it ran as, if any, and
+// its result.
+func runScheduledTask(task string, p scheduleParams) (string, gin.H, error) {
+	switch task {
+	case "retention":
+		return "", gin.H{"removed": sweepExpired(janitorPolicy, time.Now())}, nil
+	case "watch_scan":
+		w := findWatchFolder(p.Dir)
+		if w == nil {
+			return "", nil, fmt.Errorf("%s is no longer a watch folder", p.Dir)
+		}
+		var wg sync.WaitGroup
+		w.scan(nil, &wg)
+		wg.Wait()
+		return "", gin.H{"dir": w.Dir}, nil
+	case "images_pdf":
+		return runScheduledImagesPDF(p)
+	}
+	return "", nil, fmt.Errorf("unknown task: %s", task)
+}
+
+// runScheduledImagesPDF builds the PDF of a project's images as a bulk
+// images_pdf job of the project's owner.
+func runScheduledImagesPDF(p scheduleParams) (string, gin.H, error) {
+	mu.Lock()
+	proj := projects[p.ProjectID]
+	var rels []string
+	name := ""
+	if proj != nil {
+		for _, id := range proj.ImageIDs {
+			if im := images[id]; im != nil {
+				rels = append(rels, im.RelPath)
+			}
+		}
+		name = proj.Name
+	}
+	mu.Unlock()
+	if proj == nil {
+		return "", nil, fmt.Errorf("unknown project id: %s", p.ProjectID)
+	}
+	if len(rels) == 0 {
+		return "", nil, fmt.Errorf("project %s has no images", name)
+	}
+	out := sanitizeName(cmp.Or(strings.TrimSpace(p.OutName), name))
+	if !strings.HasSuffix(strings.ToLower(out), ".pdf") {
+		out += ".pdf"
+	}
+	pdfURL := "/download/" + filepath.Base(claimOutput(proj.Owner, filepath.Join(pdfsDir, out)))
+	job := newJob(proj.Owner, "", "images_pdf", prioBulk, []string{""}, []string{filepath.Base(pdfURL)})
+	job.Params = p
+	task := imagesPDFTask{Images: rels, Out: filepath.Base(pdfURL), Density: cmp.Or(p.Density, processDefaults.Density), Quality: cmp.Or(p.Quality, processDefaults.Quality)}
+	resp, err := runJob(job, func() (gin.H, error) {
+		if _, err := runWork[struct{}](job, task); err != nil {
+			return nil, err
+		}
+		recordProjectOutputs(proj, pdfURL)
+		recordOutputs(proj.Owner, pdfURL)
+		return gin.H{"job_id": job.ID, "pdf_url": pdfURL, "count": len(rels)}, nil
+	})
+	return job.ID, resp, err
+}
+
+// apply copies the fields req sets onto s.
+func (req scheduleReq) apply(s *Schedule) {
+	if req.Name != nil {
+		s.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Cron != nil {
+		s.Cron = strings.TrimSpace(*req.Cron)
+	}
+	if req.Task != nil {
+		s.Task = strings.ToLower(strings.TrimSpace(*req.Task))
+	}
+	if req.Params != nil {
+		s.Params = *req.Params
+	}
+	if req.Enabled != nil {
+		s.Enabled = *req.Enabled
+	}
+}
+
+func handleCreateSchedule(c *gin.Context) {
+	var req scheduleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if req.Cron == nil || req.Task == nil {
+		fail(c, http.StatusBadRequest, "cron and task are required")
+		return
+	}
+	now := time.Now()
+	s := &Schedule{ID: randID(8), Enabled: true, Owner: ownerOf(c), Created: now.Format(time.RFC3339), Updated: now.Format(time.RFC3339)}
+	req.apply(s)
+	if err := s.check(now); err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	schedulesMu.Lock()
+	schedules[s.ID] = s
+	snap := *s
+	schedulesMu.Unlock()
+	putSchedule(&snap)
+	c.JSON(http.StatusOK, snap)
+}
+
+func handleListSchedules(c *gin.Context) {
+	schedulesMu.Lock()
+	out := make([]Schedule, 0, len(schedules))
+	for _, s := range schedules {
+		out = append(out, *s)
+	}
+	schedulesMu.Unlock()
+	slices.SortFunc(out, func(a, b Schedule) int { return strings.Compare(a.Created+a.ID, b.Created+b.ID) })
+	c.JSON(http.StatusOK, gin.H{"schedules": out})
+}
+
+func handleGetSchedule(c *gin.Context) {
+	schedulesMu.Lock()
+	s := schedules[c.Param("id")]
+	var snap Schedule
+	if s != nil {
+		snap = *s
+	}
+	schedulesMu.Unlock()
+	if s == nil {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown schedule id: %s", c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, snap)
+}
+
+// handleUpdateSchedule changes the fields the request sets; the next run
+// is worked out again.
+func handleUpdateSchedule(c *gin.Context) {
+	var req scheduleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	schedulesMu.Lock()
+	s := schedules[c.Param("id")]
+	if s == nil {
+		schedulesMu.Unlock()
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown schedule id: %s", c.Param("id"))
+		return
+	}
+	now := time.Now()
+	updated := *s
+	req.apply(&updated)
+	if err := updated.check(now); err != nil {
+		schedulesMu.Unlock()
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	updated.Updated = now.Format(time.RFC3339)
+	*s = updated
+	snap := *s
+	schedulesMu.Unlock()
+	putSchedule(&snap)
+	c.JSON(http.StatusOK, snap)
+}
+
+// handleDeleteSchedule removes a schedule; a run that is going finishes.
+func handleDeleteSchedule(c *gin.Context) {
+	id := c.Param("id")
+	schedulesMu.Lock()
+	s := schedules[id]
+	delete(schedules, id)
+	schedulesMu.Unlock()
+	if s == nil {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown schedule id: %s", id)
+		return
+	}
+	storeDelete(bucketSchedules, id)
+	c.JSON(http.StatusOK, gin.H{"deleted": id})
+}
+
+// handleRunSchedule starts a run now, outside the schedule.
+func handleRunSchedule(c *gin.Context) {
+	schedulesMu.Lock()
+	defer schedulesMu.Unlock()
+	s := schedules[c.Param("id")]
+	switch {
+	case s == nil:
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown schedule id: %s", c.Param("id"))
+	case s.running:
+		failCode(c, http.StatusConflict, errExists, "schedule %s is already running", s.ID)
+	default:
+		c.JSON(http.StatusAccepted, startScheduleRunLocked(s))
+	}
+}
+
+// ===== cron expressions =====
+
+// cronSpec is a parsed cron expression: a bit per value each field
+// matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for a "*" day field. When both day fields
+	// are restricted a day matching either runs, as in cron.
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// cronFields are the fields' bounds and names; weekday 7 is Sunday too.
+var cronFields = []struct {
+	name   string
+	lo, hi int
+	names  []string
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"weekday", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// parseCron parses a five-field expression or a macro. A field is "*" or a
+// comma-separated list of values and ranges ("1-5"), each optionally
+// stepped ("*/15", "0-30/10", "5/20" for 5 onwards).
+func parseCron(s string) (cronSpec, error) {
+	s = strings.TrimSpace(s)
+	if m, ok := cronMacros[strings.ToLower(s)]; ok {
+		s = m
+	}
+	f := strings.Fields(s)
+	if len(f) != len(cronFields) {
+		return cronSpec{}, fmt.Errorf("cron must have 5 fields (minute hour day month weekday) or be a macro such as @daily, got %q", s)
+	}
+	var c cronSpec
+	bits := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range f {
+		cf := cronFields[i]
+		b, err := parseCronField(strings.ToLower(field), cf.lo, cf.hi, cf.names)
+		if err != nil {
+			return cronSpec{}, fmt.Errorf("cron %s field %q: %w", cf.name, field, err)
+		}
+		*bits[i] = b
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = strings.HasPrefix(f[2], "*"), strings.HasPrefix(f[4], "*")
+	return c, nil
+}
+
+func parseCronField(s string, lo, hi int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepS, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepS)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", stepS)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = cronValue(a, lo, hi, names); err != nil {
+				return 0, err
+			}
+			to = from
+			switch {
+			case isRange:
+				if to, err = cronValue(b, lo, hi, names); err != nil {
+					return 0, err
+				}
+				if to < from {
+					return 0, fmt.Errorf("range %s runs backwards", rng)
+				}
+			case stepped:
+				to = hi
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, lo, hi int, names []string) (int, error) {
+	if i := slices.Index(names, s); i >= 0 {
+		return lo + i, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%q is not between %d and %d", s, lo, hi)
+	}
+	return n, nil
+}
+
+// next is the first minute after t that c matches, or the zero time if
+// none does within five years ("0 0 30 2 *").
+func (c cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			// a clock hour repeated when DST ends maps back to its first
+			// instance; step past it
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			if !next.After(t) {
+				next = t.Add(time.Hour)
+			}
+			t = next
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Scratch space: a job's intermediate files (frames before the PDF is
+// built, downloads before they are registered, demucs and transcription
+// working files) go under scratchDir/<job ID>/, never next to the outputs.
+// runJob removes the job's directory after every attempt, whatever its
+// outcome, and so does a worker after each task; directories left by a
+// crash, or by a shutdown that had to give up on a job, are removed at
+// shutdown and by the janitor once their job isn't queued or running.
+
+// jobScratch is a fresh, empty scratch directory name of job id.
+func jobScratch(id, name string) (string, error) {
+	dir := filepath.Join(scratchDir, id, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0o755)
+}
+
+// scratch is jobScratch for j.
+func (j *Job) scratch(name string) (string, error) { return jobScratch(j.ID, name) }
+
+// removeScratch deletes j's scratch directories.
+func (j *Job) removeScratch() {
+	_ = os.RemoveAll(filepath.Join(scratchDir, j.ID))
+}
+
+// pruneScratch removes the scratch directories of jobs that are neither
+// queued nor running.
+func pruneScratch() sweepResult {
+	var r sweepResult
+	entries, _ := os.ReadDir(scratchDir)
+	for _, e := range entries {
+		if !jobActive(e.Name()) {
+			r.add(removeTree(filepath.Join(scratchDir, e.Name())))
+		}
+	}
+	return r
+}
+
+// removeLocalScratch deletes the scratch directories of the jobs this
+// process runs itself, as it exits; those of jobs handed to workers, or on
+// a worker of other workers' jobs, are left alone.
+func removeLocalScratch() {
+	entries, _ := os.ReadDir(scratchDir)
+	for _, e := range entries {
+		jobsMu.Lock()
+		j := jobs[e.Name()]
+		jobsMu.Unlock()
+		if j != nil && !j.remote() {
+			j.removeScratch()
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share is a public link to one generated file. Like sessions, only the
+// SHA-256 of its token is stored; the token itself is shown once, when the
+// share is created.
+type Share struct {
+	ID        string `json:"id"`
+	TokenHash string `json:"token_hash,omitempty"`
+	// URL is the shared output, e.g. /download/x.pdf.
+	URL          string `json:"url"`
+	Owner        string `json:"owner,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Protected    bool   `json:"protected"`
+	// MaxDownloads caps Downloads; 0 is unlimited.
+	MaxDownloads int    `json:"max_downloads,omitempty"`
+	Downloads    int    `json:"downloads"`
+	Created      string `json:"created_at"`
+	Expires      string `json:"expires_at,omitempty"`
+}
+
+// public strips the hashes from API responses.
+func (s Share) public() Share {
+	s.TokenHash, s.PasswordHash = "", ""
+	return s
+}
+
+// usable reports why the share can't be downloaded anymore, or "".
+func (s *Share) usable(now time.Time) string {
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return "download limit reached"
+	}
+	if exp, err := time.Parse(time.RFC3339, s.Expires); err == nil && now.After(exp) {
+		return "link expired"
+	}
+	return ""
+}
+
+var (
+	sharesMu sync.Mutex
+	shares   = map[string]*Share{}
+)
+
+func putShare(s *Share) { storePut(bucketShares, s.ID, s) }
+
+type shareReq struct {
+	URL          string `json:"url"`
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"max_downloads"`
+	// ExpiresIn is a Go duration or days ("7d"); empty never expires.
+	ExpiresIn string `json:"expires_in"`
+}
+
+func handleCreateShare(c *gin.Context) {
+	var req shareReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	path := outputPath(req.URL)
+	if req.URL == "" || outputURL(path) != req.URL || !fileExists(path) {
+		fail(c, http.StatusBadRequest, "not a generated file: %s", req.URL)
+		return
+	}
+	mu.Lock()
+	owner := outputOwners[req.URL]
+	mu.Unlock()
+	if !canAccess(c, owner) {
+		fail(c, http.StatusBadRequest, "not a generated file: %s", req.URL)
+		return
+	}
+	if req.MaxDownloads < 0 {
+		fail(c, http.StatusBadRequest, "max_downloads must not be negative")
+		return
+	}
+	now := time.Now()
+	s := &Share{ID: randID(8), URL: req.URL, Owner: ownerOf(c), MaxDownloads: req.MaxDownloads, Created: now.Format(time.RFC3339)}
+	if req.ExpiresIn != "" {
+		d, err := parseRetention(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			fail(c, http.StatusBadRequest, "bad expires_in: %s", req.ExpiresIn)
+			return
+		}
+		s.Expires = now.Add(d).Format(time.RFC3339)
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		s.PasswordHash, s.Protected = string(hash), true
+	}
+	tok := randID(16)
+	s.TokenHash = hashToken(tok)
+	sharesMu.Lock()
+	shares[s.ID] = s
+	sharesMu.Unlock()
+	putShare(s)
+	c.JSON(http.StatusOK, gin.H{"share": s.public(), "token": tok, "share_url": publicURL + "/s/" + tok})
+}
+
+func handleListShares(c *gin.Context) {
+	sharesMu.Lock()
+	out := make([]Share, 0, len(shares))
+	for _, s := range shares {
+		if canAccess(c, s.Owner) {
+			out = append(out, s.public())
+		}
+	}
+	sharesMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Created > out[j].Created })
+	c.JSON(http.StatusOK, gin.H{"shares": out})
+}
+
+func handleDeleteShare(c *gin.Context) {
+	id := c.Param("id")
+	sharesMu.Lock()
+	s := shares[id]
+	if s == nil || !canAccess(c, s.Owner) {
+		sharesMu.Unlock()
+		fail(c, http.StatusNotFound, "unknown share: %s", id)
+		return
+	}
+	delete(shares, id)
+	sharesMu.Unlock()
+	storeDelete(bucketShares, id)
+	c.Status(http.StatusNoContent)
+}
+
+// handleShareDownload serves a share to anyone holding its token. Password
+// protected shares take the password from the X-Share-Password header or,
+// from the browser, the form handleShareDownload shows on GET.
+func handleShareDownload(c *gin.Context) {
+	hash := hashToken(c.Param("token"))
+	now := time.Now()
+	sharesMu.Lock()
+	var s *Share
+	for _, v := range shares {
+		if v.TokenHash == hash {
+			s = v
+			break
+		}
+	}
+	if s == nil {
+		sharesMu.Unlock()
+		fail(c, http.StatusNotFound, "404 page not found")
+		return
+	}
+	if why := s.usable(now); why != "" {
+		sharesMu.Unlock()
+		fail(c, http.StatusGone, "%s", why)
+		return
+	}
+	if s.PasswordHash != "" {
+		pw := c.GetHeader("X-Share-Password")
+		if c.Request.Method == http.MethodPost {
+			pw = c.PostForm("password")
+		}
+		if pw == "" && c.Request.Method == http.MethodGet && !strings.Contains(c.GetHeader("Accept"), "application/json") {
+			sharesMu.Unlock()
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			c.Status(http.StatusUnauthorized)
+			_ = sharePasswordTmpl.Execute(c.Writer, gin.H{"Name": filepath.Base(s.URL)})
+			return
+		}
+		// bcrypt is slow on purpose: compare outside the lock, then look
+		// the share up again, as it may have been used up or revoked since
+		id, pwHash := s.ID, s.PasswordHash
+		sharesMu.Unlock()
+		if bcrypt.CompareHashAndPassword([]byte(pwHash), []byte(pw)) != nil {
+			fail(c, http.StatusUnauthorized, "wrong password")
+			return
+		}
+		sharesMu.Lock()
+		if s = shares[id]; s == nil {
+			sharesMu.Unlock()
+			fail(c, http.StatusNotFound, "404 page not found")
+			return
+		}
+		if why := s.usable(time.Now()); why != "" {
+			sharesMu.Unlock()
+			fail(c, http.StatusGone, "%s", why)
+			return
+		}
+	}
+	path := outputPath(s.URL)
+	if !fileExists(path) {
+		sharesMu.Unlock()
+		fail(c, http.StatusGone, "file no longer available")
+		return
+	}
+	s.Downloads++
+	snap := *s
+	sharesMu.Unlock()
+	putShare(&snap)
+	c.FileAttachment(path, filepath.Base(path))
+}
+
+// pruneShares drops shares that are used up, expired or whose file is
+// gone.
+func pruneShares(now time.Time) {
+	var ids []string
+	sharesMu.Lock()
+	for id, s := range shares {
+		if s.usable(now) != "" || !fileExists(outputPath(s.URL)) {
+			delete(shares, id)
+			ids = append(ids, id)
+		}
+	}
+	sharesMu.Unlock()
+	for _, id := range ids {
+		storeDelete(bucketShares, id)
+	}
+}
+
+var sharePasswordTmpl = template.Must(template.New("share").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>framespdf — {{.Name}}</title>
+<style>body{font-family:system-ui,sans-serif;display:flex;justify-content:center;margin-top:15vh}
+form{display:flex;flex-direction:column;gap:8px;width:260px}</style></head>
+<body><form method="post">
+<h2>{{.Name}}</h2>
+<input name="password" type="password" placeholder="Password" autofocus required>
+<button type="submit">Download</button>
+</form></body></html>`))
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long a SIGINT/SIGTERM waits for in-flight requests
+// and jobs before their external processes are cancelled.
+var shutdownTimeout = 60 * time.Second
+
+var (
+	// workCtx is cancelled when the shutdown grace period runs out; every
+	// external tool is started under it.
+	workCtx, cancelWork = context.WithCancel(context.Background())
+	// stopIntake is cancelled as soon as shutdown starts; workers then stop
+	// taking tasks.
+	stopIntake, cancelIntake = context.WithCancel(context.Background())
+	// activeJobs counts jobs between start and finish; jobs join it
+	// through beginWork.
+	activeJobs sync.WaitGroup
+	// intakeMu orders beginWork against cancelIntake, so no job is added
+	// to activeJobs once shutdown waits on it.
+	intakeMu sync.Mutex
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// beginWork adds a job to activeJobs, unless shutdown has started; the
+// caller calls activeJobs.Done when the job is over.
+func beginWork() bool {
+	intakeMu.Lock()
+	defer intakeMu.Unlock()
+	if stopIntake.Err() != nil {
+		return false
+	}
+	activeJobs.Add(1)
+	return true
+}
+
+// toolCmd is exec.Command bound to workCtx and to the tool's concurrency
+// limit. On cancellation the tool gets an interrupt first (ffmpeg then
+// finalizes what it has) and is killed if it hasn't exited a few seconds
+// later. Long paths among args are adapted for Windows (see platformArgs).
+func toolCmd(name string, args ...string) *toolProc {
+	cmd := exec.CommandContext(workCtx, name, platformArgs(args)...)
+	cmd.Cancel = func() error {
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return &toolProc{Cmd: cmd, slots: slotsFor(name)}
+}
+
+// serveUntilSignal runs srvs until SIGINT/SIGTERM, then stops accepting
+// requests, waits up to shutdownTimeout for running requests and async jobs,
+// cancels whatever is still running, removes its scratch space and flushes
+// the store.
+func serveUntilSignal(srvs ...*http.Server) {
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, len(srvs))
+	for _, srv := range srvs {
+		go func() {
+			if srv.TLSConfig != nil {
+				errc <- srv.ListenAndServeTLS("", "")
+			} else {
+				errc <- srv.ListenAndServe()
+			}
+		}()
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+		return
+	case <-sigCtx.Done():
+	}
+	stop() // a second signal kills the process the usual way
+	intakeMu.Lock()
+	cancelIntake()
+	intakeMu.Unlock()
+	slog.Info("shutting down, waiting for running work", "timeout", shutdownTimeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	jobsDone := make(chan struct{})
+	go func() {
+		activeJobs.Wait()
+		close(jobsDone)
+	}()
+	for _, srv := range srvs {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("shutdown", "addr", srv.Addr, "error", err.Error())
+		}
+	}
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		slog.Warn("shutdown grace period over, cancelling running tools")
+		cancelWork()
+		select {
+		case <-jobsDone:
+		case <-time.After(10 * time.Second):
+			slog.Warn("shutdown: some jobs did not stop")
+		}
+	}
+	cancelWork()
+	removeLocalScratch()
+	flushTraces()
+	if db != nil {
+		if err := db.Close(); err != nil {
+			slog.Error("store close", "error", err.Error())
+		}
+	}
+	slog.Info("bye")
+}
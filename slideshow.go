@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"video-to-pdf/audioconv"
+)
+
+// Slideshows are the reverse of /process: POST /slideshow renders ordered
+// image uploads into an H.264 MP4, each image held for its duration, with
+// an optional transition between images and an optional soundtrack from
+// an audio upload. Images are fitted into the frame with black bars
+// (fit "contain") or scaled and cropped to fill it ("cover"). The
+// soundtrack is cut to the video's length and faded out at the end; a
+// shorter one is followed by silence.
+
+// slideshowTransitions are the xfade transitions accepted from clients.
+var slideshowTransitions = map[string]bool{
+	"fade": true, "fadeblack": true, "fadewhite": true, "fadegrays": true, "dissolve": true, "pixelize": true,
+	"wipeleft": true, "wiperight": true, "wipeup": true, "wipedown": true,
+	"slideleft": true, "slideright": true, "slideup": true, "slidedown": true,
+	"smoothleft": true, "smoothright": true, "smoothup": true, "smoothdown": true,
+	"circleopen": true, "circleclose": true, "circlecrop": true, "rectcrop": true, "radial": true,
+	"horzopen": true, "horzclose": true, "vertopen": true, "vertclose": true, "zoomin": true,
+}
+
+// maxSlideshowImages caps the images of one slideshow; each is an ffmpeg
+// input.
+const maxSlideshowImages = 300
+
+type slideshowReq struct {
+	Items []struct {
+		ID    string `json:"id"`
+		Order int    `json:"order"`
+		// DurationS overrides the slideshow's image duration for this image.
+		DurationS float64 `json:"duration_seconds"`
+	} `json:"items"`
+	// ImageS is how long each image shows (default 3 seconds).
+	ImageS float64 `json:"image_seconds"`
+	// Transition is none (default) or an xfade transition ("fade",
+	// "slideleft", ...) lasting TransitionS (default 1 second).
+	Transition  string  `json:"transition"`
+	TransitionS float64 `json:"transition_seconds"`
+	// Fit is contain (default) or cover.
+	Fit    string `json:"fit"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	FPS    int    `json:"fps"`
+	// AudioID is an audio upload used as the soundtrack.
+	AudioID   string `json:"audio_id"`
+	OutName   string `json:"out_name"`
+	ProjectID string `json:"project_id"`
+	Async     bool   `json:"async"`
+	Priority  string `json:"priority"`
+}
+
+// slideshowOpts is a validated slideshow render.
+type slideshowOpts struct {
+	Images     []string
+	DurationsS []float64
+	Transition string
+	TransS     float64
+	Cover      bool
+	W, H, FPS  int
+	AudioPath  string
+}
+
+// length is the slideshow's running time: the images' durations less the
+// overlap of the transitions.
+func (o slideshowOpts) length() float64 {
+	total := 0.0
+	for _, d := range o.DurationsS {
+		total += d
+	}
+	if o.Transition != "" {
+		total -= float64(len(o.DurationsS)-1) * o.TransS
+	}
+	return total
+}
+
+func handleSlideshow(c *gin.Context) {
+	var req slideshowReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if len(req.Items) == 0 {
+		fail(c, http.StatusBadRequest, "no items provided")
+		return
+	}
+	if len(req.Items) > maxSlideshowImages {
+		fail(c, http.StatusBadRequest, "a slideshow takes at most %d images", maxSlideshowImages)
+		return
+	}
+	proj := lookupProject(c, req.ProjectID)
+	if req.ProjectID != "" && proj == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown project id: %s", req.ProjectID)
+		return
+	}
+	o := slideshowOpts{W: req.Width, H: req.Height, FPS: cmp.Or(req.FPS, 25)}
+	if o.W == 0 && o.H == 0 {
+		o.W, o.H = 1280, 720
+	}
+	if o.W < 160 || o.H < 120 || o.W > 3840 || o.H > 2160 || o.W%2 != 0 || o.H%2 != 0 {
+		fail(c, http.StatusBadRequest, "width/height must be even and between 160x120 and 3840x2160")
+		return
+	}
+	if o.FPS < 1 || o.FPS > 60 {
+		fail(c, http.StatusBadRequest, "fps must be between 1 and 60")
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(req.Fit)) {
+	case "", "contain":
+	case "cover":
+		o.Cover = true
+	default:
+		fail(c, http.StatusBadRequest, "fit must be contain or cover")
+		return
+	}
+	imageS := cmp.Or(req.ImageS, 3)
+	if imageS < 0.5 || imageS > 600 {
+		fail(c, http.StatusBadRequest, "image_seconds must be between 0.5 and 600")
+		return
+	}
+	if t := strings.ToLower(strings.TrimSpace(req.Transition)); t != "" && t != "none" {
+		if !slideshowTransitions[t] {
+			fail(c, http.StatusBadRequest, "unknown transition: %s", req.Transition)
+			return
+		}
+		o.Transition, o.TransS = t, cmp.Or(req.TransitionS, 1)
+		if o.TransS < 0.1 || o.TransS > 5 {
+			fail(c, http.StatusBadRequest, "transition_seconds must be between 0.1 and 5")
+			return
+		}
+	}
+	var bad itemErrors
+	for i, it := range req.Items {
+		d := cmp.Or(it.DurationS, imageS)
+		switch {
+		case getImage(c, it.ID) == nil:
+			bad.add(i, it.ID, errUnknownID, "unknown image id: %s", it.ID)
+		case d < 0.5 || d > 600:
+			bad.add(i, it.ID, "", "duration_seconds must be between 0.5 and 600")
+		case o.Transition != "" && d < 2*o.TransS:
+			// an image is shown through a transition at each end
+			bad.add(i, it.ID, "", "duration_seconds must be at least twice transition_seconds")
+		}
+	}
+	if bad.fail(c) {
+		return
+	}
+	var soundtrack *AudioMeta
+	if req.AudioID != "" {
+		if soundtrack = getAudio(c, req.AudioID); soundtrack == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", req.AudioID)
+			return
+		}
+		o.AudioPath = soundtrack.AbsPath
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	sort.SliceStable(req.Items, func(i, j int) bool { return req.Items[i].Order < req.Items[j].Order })
+	imageIDs := make([]string, 0, len(req.Items))
+	for _, it := range req.Items {
+		im := getImage(c, it.ID)
+		if im == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown image id: %s", it.ID)
+			return
+		}
+		o.Images = append(o.Images, im.AbsPath)
+		o.DurationsS = append(o.DurationsS, cmp.Or(it.DurationS, imageS))
+		imageIDs = append(imageIDs, im.ID)
+	}
+	name := "slideshow_" + time.Now().Format("20060102_150405") + "_" + randID(4) + ".mp4"
+	if strings.TrimSpace(req.OutName) != "" {
+		name = sanitizeName(req.OutName)
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".mp4") {
+		name += ".mp4"
+	}
+	owner := ownerOf(c)
+	out := claimOutput(owner, filepath.Join(rendersDir, name))
+	job := newJob(owner, requestID(c), "slideshow", prio, []string{""}, []string{filepath.Base(out)})
+	job.Params = req
+	job.addSources(imageIDs...)
+	if soundtrack != nil {
+		job.addSources(soundtrack.ID)
+	}
+	if req.Async {
+		go runSlideshow(job, proj, out, o)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runSlideshow(job, proj, out, o)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func runSlideshow(job *Job, proj *Project, out string, o slideshowOpts) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		job.setItem(0, jobRunning, 0)
+		if err := renderSlideshow(out, o, job.progressFunc(0)); err != nil {
+			return nil, fmt.Errorf("slideshow render failed: %w", err)
+		}
+		job.setItem(0, jobDone, 100)
+		url := "/renders/" + filepath.Base(out)
+		recordProjectOutputs(proj, url)
+		recordOutputs(job.Owner, url)
+		return gin.H{"job_id": job.ID, "video_url": url, "count": len(o.Images), "duration_seconds": o.length()}, nil
+	})
+}
+
+// renderSlideshow encodes o's images, each looped for its duration and
+// fitted into the frame, into out, chained with xfade when there is a
+// transition and concatenated otherwise.
+func renderSlideshow(out string, o slideshowOpts, onProgress func(float64)) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	fit := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=black", o.W, o.H, o.W, o.H)
+	if o.Cover {
+		fit = fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d", o.W, o.H, o.W, o.H)
+	}
+	var graph []string
+	for i, img := range o.Images {
+		args = append(args, "-loop", "1", "-framerate", fmt.Sprint(o.FPS), "-t", fmt.Sprintf("%.3f", o.DurationsS[i]), "-i", img)
+		graph = append(graph, fmt.Sprintf("[%d:v]%s,setsar=1,format=yuv420p,fps=%d[s%d]", i, fit, o.FPS, i))
+	}
+	switch {
+	case len(o.Images) == 1:
+		graph = append(graph, "[s0]null[v]")
+	case o.Transition == "":
+		var labels strings.Builder
+		for i := range o.Images {
+			fmt.Fprintf(&labels, "[s%d]", i)
+		}
+		graph = append(graph, fmt.Sprintf("%sconcat=n=%d:v=1:a=0[v]", labels.String(), len(o.Images)))
+	default:
+		// each transition starts where the chain so far, shortened by the
+		// earlier overlaps, has TransS left to run
+		prev, offset := "s0", 0.0
+		for i := 1; i < len(o.Images); i++ {
+			offset += o.DurationsS[i-1] - o.TransS
+			next := fmt.Sprintf("x%d", i)
+			if i == len(o.Images)-1 {
+				next = "v"
+			}
+			graph = append(graph, fmt.Sprintf("[%s][s%d]xfade=transition=%s:duration=%.3f:offset=%.3f[%s]", prev, i, o.Transition, o.TransS, offset, next))
+			prev = next
+		}
+	}
+	length := o.length()
+	maps := []string{"-map", "[v]"}
+	if o.AudioPath != "" {
+		// the soundtrack is the input after the images
+		args = append(args, "-i", o.AudioPath)
+		fade := audioconv.FadeFilters(0, math.Min(1, length/4), length)
+		graph = append(graph, fmt.Sprintf("[%d:a]apad,atrim=0:%.3f,%s[a]", len(o.Images), length, strings.Join(fade, ",")))
+		maps = append(maps, "-map", "[a]", "-c:a", "aac", "-b:a", "192k")
+	}
+	args = append(args, "-filter_complex", strings.Join(graph, ";"))
+	args = append(args, maps...)
+	args = append(args,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p",
+		"-t", fmt.Sprintf("%.3f", length), "-movflags", "+faststart", out)
+	return runFFmpeg(args, length, onProgress, nil)
+}
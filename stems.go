@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// demucsBin is the external stem separator. It is optional: /separate_audio
+// answers 501 when it isn't installed.
+var demucsBin = "demucs"
+
+// demucsModels are the pretrained models accepted from clients.
+var demucsModels = map[string]bool{"htdemucs": true, "htdemucs_ft": true, "htdemucs_6s": true, "hdemucs_mmi": true, "mdx": true, "mdx_extra": true, "mdx_q": true, "mdx_extra_q": true}
+
+type separateAudioReq struct {
+	ID    string `json:"id"`
+	Model string `json:"model"`
+	// TwoStems splits into just <stem> and no_<stem> (e.g. "vocals").
+	TwoStems string `json:"two_stems"`
+	Async    bool   `json:"async"`
+	Priority string `json:"priority"`
+}
+
+func handleSeparateAudio(c *gin.Context) {
+	var req separateAudioReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if _, err := exec.LookPath(demucsBin); err != nil {
+		fail(c, http.StatusNotImplemented, "stem separation needs %s in PATH", demucsBin)
+		return
+	}
+	am := getAudio(c, req.ID)
+	if am == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", req.ID)
+		return
+	}
+	if req.Model == "" {
+		req.Model = "htdemucs"
+	}
+	if !demucsModels[req.Model] {
+		fail(c, http.StatusBadRequest, "unknown model: %s", req.Model)
+		return
+	}
+	switch req.TwoStems {
+	case "", "vocals", "drums", "bass", "other", "guitar", "piano":
+	default:
+		fail(c, http.StatusBadRequest, "unknown stem: %s", req.TwoStems)
+		return
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	job := newJob(ownerOf(c), requestID(c), "separate_audio", prio, []string{am.ID}, []string{am.Name})
+	job.Params = req
+	if req.Async {
+		go runSeparateAudio(job, am, req.Model, req.TwoStems)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runSeparateAudio(job, am, req.Model, req.TwoStems)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// runSeparateAudio runs demucs over am and registers every stem it produced
+// as a new AudioMeta.
+func runSeparateAudio(job *Job, am *AudioMeta, model, twoStems string) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		job.setItem(0, jobRunning, 0)
+		tmp, err := job.scratch("stems")
+		if err != nil {
+			return nil, err
+		}
+
+		args := []string{"-n", model, "-o", tmp}
+		if twoStems != "" {
+			args = append(args, "--two-stems", twoStems)
+		}
+		args = append(args, am.AbsPath)
+		if err := runDemucs(args, job.progressFunc(0)); err != nil {
+			return nil, fmt.Errorf("separation failed for %s: %w", am.Name, err)
+		}
+		stems, _ := filepath.Glob(filepath.Join(tmp, model, "*", "*.wav"))
+		if len(stems) == 0 {
+			return nil, fmt.Errorf("separation produced no stems for %s", am.Name)
+		}
+		out := make([]*AudioMeta, 0, len(stems))
+		for _, p := range stems {
+			id := randID(8)
+			name := stripExt(am.Name) + "_" + filepath.Base(p)
+			rel := filepath.Join(id, storedName(name))
+			if err := os.MkdirAll(filepath.Join(uploadDir, id), 0o755); err != nil {
+				return nil, err
+			}
+			if err := moveFile(p, filepath.Join(uploadDir, rel)); err != nil {
+				return nil, err
+			}
+			out = append(out, registerDerivedAudio(job.Owner, id, name, rel))
+		}
+		job.setItem(0, jobDone, 100)
+		resp := gin.H{"job_id": job.ID, "audios": out}
+		return resp, nil
+	})
+}
+
+// demucsPctRe matches the tqdm progress bar demucs prints to stderr.
+var demucsPctRe = regexp.MustCompile(`(\d+)%\|`)
+
+func runDemucs(args []string, onProgress func(float64)) error {
+	cmd := toolCmd(demucsBin, args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var tail bytes.Buffer
+	sc := bufio.NewScanner(stderr)
+	// tqdm redraws with \r, so split on both line endings
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for sc.Scan() {
+		line := sc.Text()
+		if m := demucsPctRe.FindStringSubmatch(line); m != nil {
+			pct, _ := strconv.Atoi(m[1])
+			onProgress(float64(pct))
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			tail.WriteString(line + "\n")
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(tail.String())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return nil
+}
+
+// moveFile renames src to dst, copying when they are on different devices.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := ioCopyClose(out, in); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Object storage for outputs. Generated files are always written to the
+// work directory and served from there; with a backend configured they are
+// also uploaded to a bucket, and responses gain an "objects" map from each
+// local URL to its object URL. Set with the config file's storage section,
+// FRAMESPDF_STORAGE* or -storage.
+var storageConfig storageSettings
+
+type storageSettings struct {
+	// Backend is "local" (no uploads), "s3" (AWS and S3-compatible
+	// services), "gcs" (Google Cloud Storage through its S3-compatible API,
+	// with HMAC keys) or "azure".
+	Backend string `yaml:"backend"`
+	// Bucket is the bucket, or the container for azure.
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to every object key, e.g. "framespdf/".
+	Prefix   string `yaml:"prefix"`
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"`
+	// AccessKey and SecretKey are the S3/GCS HMAC credentials; for azure
+	// they are the account name and base64 account key.
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// PublicURL replaces the backend's own URL in returned object URLs,
+	// e.g. a CDN in front of the bucket.
+	PublicURL string `yaml:"public_url"`
+	// Frames also uploads the frames extracted by /process.
+	Frames bool `yaml:"frames"`
+	// IngestBuckets are the buckets /ingest_s3 may read sources from; "*"
+	// allows any the credentials can read. Empty disables ingest.
+	IngestBuckets []string `yaml:"ingest_buckets"`
+}
+
+// objectStore is an upload target for generated files.
+type objectStore interface {
+	// put uploads the file at path as key.
+	put(ctx context.Context, key, path string) error
+	// url is the backend's URL of key.
+	url(key string) string
+}
+
+// objects is the configured backend, nil for local storage.
+var objects objectStore
+
+const objectUploadTimeout = 30 * time.Minute
+
+// openObjectStore resolves storageConfig into objects.
+func openObjectStore() error {
+	sc := &storageConfig
+	sc.Backend = strings.ToLower(sc.Backend)
+	switch sc.Backend {
+	case "", "local":
+		return nil
+	case "s3", "gcs":
+		if sc.Endpoint == "" && sc.Backend == "gcs" {
+			sc.Endpoint = "https://storage.googleapis.com"
+		}
+		if sc.Region == "" {
+			sc.Region = "us-east-1"
+			if sc.Backend == "gcs" {
+				sc.Region = "auto"
+			}
+		}
+		if sc.Endpoint == "" {
+			sc.Endpoint = "https://s3." + sc.Region + ".amazonaws.com"
+		}
+		c, err := newS3Client(sc.Endpoint, sc.Region, sc.AccessKey, sc.SecretKey)
+		if err != nil {
+			return err
+		}
+		objects = &s3Store{client: c, bucket: sc.Bucket}
+	case "azure":
+		s, err := newAzureStore(sc.AccessKey, sc.SecretKey, sc.Bucket, sc.Endpoint)
+		if err != nil {
+			return err
+		}
+		objects = s
+	default:
+		return fmt.Errorf("unknown storage backend %q (local, s3, gcs or azure)", sc.Backend)
+	}
+	if sc.Bucket == "" {
+		return fmt.Errorf("storage backend %s needs a bucket", sc.Backend)
+	}
+	if sc.AccessKey == "" || sc.SecretKey == "" {
+		return fmt.Errorf("storage backend %s needs credentials", sc.Backend)
+	}
+	slog.Info("storing outputs in object storage", "backend", sc.Backend, "bucket", sc.Bucket)
+	return nil
+}
+
+// objectKey is the key of the work-directory file at path.
+func objectKey(path string) string {
+	rel, err := filepath.Rel(workRoot, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return storageConfig.Prefix + filepath.ToSlash(rel)
+}
+
+// putObject uploads the file at path, returning its object URL.
+func putObject(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(workCtx, objectUploadTimeout)
+	defer cancel()
+	key := objectKey(path)
+	if err := objects.put(ctx, key, path); err != nil {
+		return "", fmt.Errorf("upload %s: %w", key, err)
+	}
+	return objectURL(key), nil
+}
+
+// objectURL is the URL returned for key.
+func objectURL(key string) string {
+	if storageConfig.PublicURL != "" {
+		return strings.TrimSuffix(storageConfig.PublicURL, "/") + "/" + key
+	}
+	return objects.url(key)
+}
+
+// publishOutputs uploads every generated file linked from resp and records
+// the object URLs under resp["objects"]. A no-op without a backend.
+func publishOutputs(resp gin.H) error {
+	if objects == nil {
+		return nil
+	}
+	urls := map[string]string{}
+	for _, u := range resultURLs(resp) {
+		path := outputPath(u)
+		if path == "" {
+			continue
+		}
+		obj, err := putObject(path)
+		if err != nil {
+			return err
+		}
+		urls[u] = obj
+	}
+	if len(urls) > 0 {
+		resp["objects"] = urls
+	}
+	return nil
+}
+
+// publishFrames uploads the frame images when storage.frames is set and
+// returns the URL prefix they are under.
+func publishFrames(dir string, imgs []string) (string, error) {
+	if objects == nil || !storageConfig.Frames {
+		return "", nil
+	}
+	for _, p := range imgs {
+		if _, err := putObject(p); err != nil {
+			return "", err
+		}
+	}
+	return objectURL(objectKey(dir)) + "/", nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The metadata store is a Bolt file next to the work dirs. Every record is
+// the JSON form of its struct keyed by id; absolute paths are not stored but
+// rebuilt from RelPath on load.
+var (
+	storePath = filepath.Join(workRoot, "framespdf.db")
+	db        *bolt.DB
+)
+
+const (
+	bucketVideos = "videos"
+	bucketImages = "images"
+	bucketAudios = "audios"
+	bucketJobs   = "jobs"
+	// bucketProjects holds Project records.
+	bucketProjects = "projects"
+	// Accounts: users by id, sessions by token hash, and the owner of each
+	// generated file by URL.
+	bucketUsers    = "users"
+	bucketSessions = "sessions"
+	bucketOutputs  = "outputs"
+	// bucketMeta holds server-wide values such as the session secret.
+	bucketMeta = "meta"
+	// bucketShares holds share links by id.
+	bucketShares = "shares"
+	// bucketPins holds retention pins by output URL or upload ID.
+	bucketPins = "pins"
+	// bucketAudit holds the job history by finish time; see audit.go.
+	bucketAudit = "audit"
+	// bucketResults is the result cache; see cache.go.
+	bucketResults = "results"
+	// bucketProbes caches ffprobe output; see probes.go.
+	bucketProbes = "probes"
+	// bucketPresets holds Preset records by presetKey.
+	bucketPresets = "presets"
+	// bucketSchedules holds Schedule records; see schedules.go.
+	bucketSchedules = "schedules"
+)
+
+// openStore opens (creating if needed) the metadata store and loads every
+// record into the in-memory maps.
+func openStore() error {
+	var err error
+	db, err = bolt.Open(storePath, 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{bucketVideos, bucketImages, bucketAudios, bucketJobs, bucketProjects, bucketUsers, bucketSessions, bucketOutputs, bucketMeta, bucketShares, bucketPins, bucketAudit, bucketResults, bucketProbes, bucketPresets, bucketSchedules} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return loadStore()
+}
+
+// loadStore rehydrates uploads, projects, accounts and jobs. Uploads whose file is gone
+// are dropped; jobs that were still running when the server stopped are
+// marked failed.
+func loadStore() error {
+	var interrupted []*Job
+	var goneUploads [][2]string
+	err := db.View(func(tx *bolt.Tx) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := tx.Bucket([]byte(bucketVideos)).ForEach(func(k, v []byte) error {
+			var vm VideoMeta
+			if json.Unmarshal(v, &vm) != nil {
+				return nil
+			}
+			vm.AbsPath = filepath.Join(uploadDir, vm.RelPath)
+			if !fileExists(vm.AbsPath) {
+				goneUploads = append(goneUploads, [2]string{bucketVideos, vm.ID})
+				return nil
+			}
+			videos[vm.ID] = &vm
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketImages)).ForEach(func(k, v []byte) error {
+			var im ImgMeta
+			if json.Unmarshal(v, &im) != nil {
+				return nil
+			}
+			im.AbsPath = filepath.Join(uploadDir, im.RelPath)
+			if !fileExists(im.AbsPath) {
+				goneUploads = append(goneUploads, [2]string{bucketImages, im.ID})
+				return nil
+			}
+			images[im.ID] = &im
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketAudios)).ForEach(func(k, v []byte) error {
+			var am AudioMeta
+			if json.Unmarshal(v, &am) != nil {
+				return nil
+			}
+			am.AbsPath = filepath.Join(uploadDir, am.RelPath)
+			if !fileExists(am.AbsPath) {
+				goneUploads = append(goneUploads, [2]string{bucketAudios, am.ID})
+				return nil
+			}
+			audios[am.ID] = &am
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketProjects)).ForEach(func(k, v []byte) error {
+			p := &Project{}
+			if json.Unmarshal(v, p) == nil {
+				projects[p.ID] = p
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketPresets)).ForEach(func(k, v []byte) error {
+			p := &Preset{}
+			if json.Unmarshal(v, p) == nil {
+				presets[string(k)] = p
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketSchedules)).ForEach(func(k, v []byte) error {
+			s := &Schedule{}
+			if json.Unmarshal(v, s) == nil {
+				schedules[s.ID] = s
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketOutputs)).ForEach(func(k, v []byte) error {
+			var owner string
+			if json.Unmarshal(v, &owner) == nil {
+				outputOwners[string(k)] = owner
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketShares)).ForEach(func(k, v []byte) error {
+			s := &Share{}
+			if json.Unmarshal(v, s) == nil {
+				sharesMu.Lock()
+				shares[s.ID] = s
+				sharesMu.Unlock()
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketPins)).ForEach(func(k, v []byte) error {
+			p := &Pin{}
+			if json.Unmarshal(v, p) == nil {
+				pinsMu.Lock()
+				pins[p.Key] = p
+				pinsMu.Unlock()
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		usersMu.Lock()
+		defer usersMu.Unlock()
+		if err := tx.Bucket([]byte(bucketUsers)).ForEach(func(k, v []byte) error {
+			u := &User{}
+			if json.Unmarshal(v, u) == nil {
+				users[u.ID] = u
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketSessions)).ForEach(func(k, v []byte) error {
+			s := &session{}
+			if json.Unmarshal(v, s) == nil {
+				sessions[string(k)] = s
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(bucketJobs)).ForEach(func(k, v []byte) error {
+			j := &Job{}
+			if json.Unmarshal(v, j) != nil {
+				return nil
+			}
+			if j.Status == jobQueued || j.Status == jobRunning {
+				interrupted = append(interrupted, j)
+			}
+			jobsMu.Lock()
+			jobs[j.ID] = j
+			jobsMu.Unlock()
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, u := range goneUploads {
+		storeDelete(u[0], u[1])
+	}
+	for _, j := range interrupted {
+		j.finish(nil, errInterrupted)
+	}
+	slog.Info("store loaded", "videos", len(videos), "images", len(images), "audios", len(audios), "projects", len(projects), "jobs", len(jobs), "users", len(users))
+	return nil
+}
+
+// storePut writes v as JSON under bucket/id. Failures are logged; the
+// in-memory state stays authoritative for the running process.
+func storePut(bucket, id string, v any) {
+	if db == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("store write failed", "bucket", bucket, "id", id, "error", err.Error())
+		return
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(id), b)
+	}); err != nil {
+		slog.Error("store write failed", "bucket", bucket, "id", id, "error", err.Error())
+	}
+}
+
+// storeGet reads bucket/id into v and reports whether it was found.
+func storeGet(bucket, id string, v any) bool {
+	if db == nil {
+		return false
+	}
+	var raw []byte
+	_ = db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)).Get([]byte(id)); b != nil {
+			raw = append([]byte{}, b...)
+		}
+		return nil
+	})
+	return raw != nil && json.Unmarshal(raw, v) == nil
+}
+
+func storeDelete(bucket, id string) {
+	if db == nil {
+		return
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(id))
+	}); err != nil {
+		slog.Error("store write failed", "bucket", bucket, "id", id, "error", err.Error())
+	}
+}
+
+func putVideo(vm *VideoMeta) { storePut(bucketVideos, vm.ID, vm) }
+func putImage(im *ImgMeta)   { storePut(bucketImages, im.ID, im) }
+func putAudio(am *AudioMeta) { storePut(bucketAudios, am.ID, am) }
+
+func putJob(j *Job) {
+	snap := j.snapshot()
+	storePut(bucketJobs, snap.ID, snap)
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits for the free-form tags on uploads.
+const (
+	maxItemTags = 32
+	maxTagLen   = 64
+)
+
+// normalizeTags trims, drops empties and case-insensitive duplicates, and
+// enforces the tag limits. Commas split values so "a, b" is two tags.
+func normalizeTags(in []string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, raw := range in {
+		for _, t := range strings.Split(raw, ",") {
+			t = strings.TrimSpace(t)
+			if t == "" || seen[strings.ToLower(t)] {
+				continue
+			}
+			if len(t) > maxTagLen {
+				return nil, fmt.Errorf("tag too long (max %d chars): %s", maxTagLen, t)
+			}
+			seen[strings.ToLower(t)] = true
+			out = append(out, t)
+		}
+	}
+	if len(out) > maxItemTags {
+		return nil, fmt.Errorf("too many tags (max %d)", maxItemTags)
+	}
+	return out, nil
+}
+
+// hasAllTags reports whether have contains every tag in want (case-insensitive).
+func hasAllTags(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if strings.EqualFold(h, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// editTags applies a PATCH (add/remove) to cur.
+func editTags(cur, add, remove []string) ([]string, error) {
+	var keep []string
+	for _, t := range cur {
+		if !hasAllTags(remove, []string{t}) {
+			keep = append(keep, t)
+		}
+	}
+	return normalizeTags(append(keep, add...))
+}
+
+type tagsReq struct {
+	// Tags replaces the item's tags (PUT).
+	Tags []string `json:"tags"`
+	// Add and Remove edit them in place (PATCH).
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// handleTags serves PUT/PATCH /{videos,images,audios}/:id/tags; kind is the
+// collection name.
+func handleTags(kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req tagsReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+			return
+		}
+		id := c.Param("id")
+		// the record is replaced by an edited copy, never changed in place,
+		// so listings and the store can read the old one without the lock
+		mu.Lock()
+		var cur []string
+		var swap func(tags []string) (persist func())
+		switch kind {
+		case "videos":
+			if vm := videos[id]; vm != nil && canAccess(c, vm.Owner) {
+				cur, swap = vm.Tags, func(tags []string) func() {
+					cp := *vm
+					cp.Tags = tags
+					videos[id] = &cp
+					return func() { putVideo(&cp) }
+				}
+			}
+		case "images":
+			if im := images[id]; im != nil && canAccess(c, im.Owner) {
+				cur, swap = im.Tags, func(tags []string) func() {
+					cp := *im
+					cp.Tags = tags
+					images[id] = &cp
+					return func() { putImage(&cp) }
+				}
+			}
+		case "audios":
+			if am := audios[id]; am != nil && canAccess(c, am.Owner) {
+				cur, swap = am.Tags, func(tags []string) func() {
+					cp := *am
+					cp.Tags = tags
+					audios[id] = &cp
+					return func() { putAudio(&cp) }
+				}
+			}
+		}
+		if swap == nil {
+			mu.Unlock()
+			failCode(c, http.StatusNotFound, errUnknownID, "unknown id: %s", id)
+			return
+		}
+		var tags []string
+		var err error
+		if c.Request.Method == http.MethodPut {
+			tags, err = normalizeTags(req.Tags)
+		} else {
+			tags, err = editTags(cur, req.Add, req.Remove)
+		}
+		if err != nil {
+			mu.Unlock()
+			fail(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		persist := swap(tags)
+		mu.Unlock()
+		persist()
+		c.JSON(http.StatusOK, gin.H{"id": id, "tags": tags})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Job timeouts: a job may run for at most the timeout of its type (or the
+// default), counted from when it gets its slot and across retries. When
+// that runs out the tools it is running are killed, no new ones start, and
+// the job fails with a timeout error that isn't retried; its scratch space
+// goes as after any failed run. Workers apply the same limits to the tasks
+// they run. No limit is set by default.
+//
+// -job-timeout and FRAMESPDF_JOB_TIMEOUT take comma-separated values, a
+// duration for the default and type=duration for one job type; in the
+// config file they are the timeouts section, keyed by "default" and type.
+
+// jobTimeouts maps job types, and "default", to their limit; 0 is none.
+var jobTimeouts = map[string]time.Duration{}
+
+// jobTypes are the job types a timeout can be set for.
+var jobTypes = []string{"process", "frames_pdf", "images_pdf", "convert_audio", "analyze_music", "separate_audio", "waveform_video", "slideshow", "transcribe", "pipeline", "watch", "ingest_s3", "ingest_url", "ingest_ytdlp"}
+
+// setJobTimeouts applies a -job-timeout value.
+func setJobTimeouts(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		typ, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			typ, val = "default", typ
+		}
+		if err := setJobTimeout(typ, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setJobTimeout sets the timeout of job type typ ("default" for all
+// others) to val, a Go duration, or "0"/"off" for none.
+func setJobTimeout(typ, val string) error {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if typ != "default" && !slices.Contains(jobTypes, typ) {
+		return fmt.Errorf("unknown job type %q; one of default, %s", typ, strings.Join(jobTypes, ", "))
+	}
+	val = strings.ToLower(strings.TrimSpace(val))
+	if val == "off" {
+		val = "0"
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return fmt.Errorf("bad timeout for %s: %q", typ, val)
+	}
+	jobTimeouts[typ] = d
+	return nil
+}
+
+// jobTimeout is the limit for jobs of type typ; 0 when there is none.
+func jobTimeout(typ string) time.Duration {
+	if d, ok := jobTimeouts[typ]; ok {
+		return d
+	}
+	return jobTimeouts["default"]
+}
+
+// timeoutError fails a job that ran out of time.
+type timeoutError struct {
+	Type  string
+	Limit time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out: %s jobs may run for %s", e.Type, e.Limit)
+}
+
+// watch arms j's timeout; the returned func disarms it.
+func (j *Job) watch() (stop func()) {
+	d := jobTimeout(j.Type)
+	if d <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(d, func() { j.expire(d) })
+	return func() { t.Stop() }
+}
+
+// expire marks j as out of time and kills the tools it is running.
+func (j *Job) expire(d time.Duration) {
+	jobsMu.Lock()
+	j.timedOut = &timeoutError{Type: j.Type, Limit: d}
+	procs := make([]*toolProc, 0, len(j.procs))
+	for p := range j.procs {
+		procs = append(procs, p)
+	}
+	jobsMu.Unlock()
+	j.logger().Warn("job timed out, killing its tools", "timeout", d.String(), "tools", len(procs))
+	for _, p := range procs {
+		if p.Process != nil {
+			_ = p.Process.Kill()
+		}
+	}
+}
+
+// timeout returns j's timeoutError once it has run out of time, else nil.
+func (j *Job) timeout() error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if j.timedOut == nil {
+		return nil
+	}
+	return j.timedOut
+}
+
+// trackTool registers p as running for its jobs, so that their timeouts
+// can kill it; it fails if one of them is already out of time.
+func trackTool(p *toolProc) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range p.jobs {
+		if j.timedOut != nil {
+			return j.timedOut
+		}
+	}
+	for _, j := range p.jobs {
+		if j.procs == nil {
+			j.procs = map[*toolProc]bool{}
+		}
+		j.procs[p] = true
+	}
+	return nil
+}
+
+// untrackTool forgets p once it has finished.
+func untrackTool(p *toolProc) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range p.jobs {
+		delete(j.procs, p)
+	}
+}
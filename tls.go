@@ -0,0 +1,96 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HTTPS: with -tls-cert/-tls-key the server listens with that certificate,
+// with -acme-domains it gets and renews certificates from Let's Encrypt
+// (or another ACME CA) itself. ACME answers TLS-ALPN challenges on the
+// HTTPS listener, which the CA reaches on port 443; -http-addr adds a plain
+// HTTP listener that answers HTTP challenges and redirects everything else
+// to HTTPS.
+var (
+	tlsCert, tlsKey string
+	acmeDomains     []string
+	acmeEmail       string
+	// acmeCache holds the account key and certificates; <workdir>/acme
+	// when empty.
+	acmeCache string
+	// acmeDirectory is the CA's directory URL; Let's Encrypt when empty.
+	acmeDirectory string
+	httpAddr      string
+)
+
+// tlsEnabled reports whether the server listens with HTTPS.
+func tlsEnabled() bool { return tlsCert != "" || len(acmeDomains) > 0 }
+
+// checkTLSConfig validates the TLS settings once they are all read.
+func checkTLSConfig() error {
+	if (tlsCert == "") != (tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key go together")
+	}
+	if tlsCert != "" && len(acmeDomains) > 0 {
+		return fmt.Errorf("-tls-cert and -acme-domains exclude each other")
+	}
+	if httpAddr != "" && !tlsEnabled() {
+		return fmt.Errorf("-http-addr needs -tls-cert or -acme-domains")
+	}
+	return nil
+}
+
+// setupTLS gives srv its TLS configuration and returns the plain-HTTP
+// listener of -http-addr, or nil.
+func setupTLS(srv *http.Server) (*http.Server, error) {
+	redirect := http.HandlerFunc(redirectToHTTPS)
+	var plain http.Handler = redirect
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		slog.Info("https enabled", "cert", tlsCert)
+	} else {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomains...),
+			Cache:      autocert.DirCache(cmp.Or(acmeCache, filepath.Join(workRoot, "acme"))),
+			Email:      acmeEmail,
+		}
+		if acmeDirectory != "" {
+			m.Client = &acme.Client{DirectoryURL: acmeDirectory}
+		}
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		plain = m.HTTPHandler(redirect)
+		slog.Info("https enabled via acme", "domains", strings.Join(acmeDomains, ","))
+	}
+	if httpAddr == "" {
+		return nil, nil
+	}
+	return &http.Server{Addr: httpAddr, Handler: plain}, nil
+}
+
+// redirectToHTTPS sends plain-HTTP requests to the same URL over HTTPS, on
+// the HTTPS listener's port.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil && port != "443" && port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
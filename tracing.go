@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tracing exports OpenTelemetry spans over OTLP/HTTP (JSON encoding) to
+// otlpEndpoint, e.g. a collector on :4318; it is off while that is empty.
+// Requests get a server span (continuing an incoming W3C traceparent), jobs
+// a span under the request that queued them, and pipeline stages (probe,
+// extract, pdf, ...) and every tool run a span under those.
+//
+// Tool invocations don't carry a context, so spans are bound to the upload
+// IDs they work on and a tool run or stage nests under the innermost live
+// span bound to one of its sources, the same way tool runs are attributed
+// to jobs in the logs.
+var (
+	otlpEndpoint    string
+	otlpHeaders     = map[string]string{}
+	otlpServiceName = "framespdf"
+)
+
+// Span kinds and status codes of the OTLP data model.
+const (
+	spanInternal = 1
+	spanServer   = 2
+
+	statusOK    = 1
+	statusError = 2
+)
+
+// tracing reports whether spans are recorded at all.
+func tracing() bool { return otlpEndpoint != "" }
+
+// spanContext identifies a span across goroutines and jobs.
+type spanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+type span struct {
+	spanContext
+	parent string
+	name   string
+	kind   int
+	start  time.Time
+
+	mu      sync.Mutex
+	attrs   map[string]any
+	sources []string
+}
+
+var (
+	liveMu    sync.Mutex
+	liveSpans []*span
+)
+
+func newTraceID() string { return randHex(16) }
+func newSpanID() string  { return randHex(8) }
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a span under parent (a new trace when parent is zero)
+// bound to the upload IDs sources. It returns nil with tracing off; every
+// span method accepts nil.
+func startSpan(parent spanContext, name string, kind int, sources ...string) *span {
+	if !tracing() {
+		return nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]any{}, sources: sources}
+	s.TraceID, s.parent = parent.TraceID, parent.SpanID
+	if s.TraceID == "" {
+		s.TraceID = newTraceID()
+	}
+	s.SpanID = newSpanID()
+	liveMu.Lock()
+	liveSpans = append(liveSpans, s)
+	liveMu.Unlock()
+	return s
+}
+
+// startStage starts a pipeline stage span under the innermost span working
+// on the sources.
+func startStage(name string, sources ...string) *span {
+	if !tracing() {
+		return nil
+	}
+	return startSpan(spanFor(sources), name, spanInternal, sources...)
+}
+
+// spanFor returns the innermost live span bound to any of ids.
+func spanFor(ids []string) spanContext {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	for i := len(liveSpans) - 1; i >= 0; i-- {
+		s := liveSpans[i]
+		s.mu.Lock()
+		hit := slices.ContainsFunc(ids, func(id string) bool { return slices.Contains(s.sources, id) })
+		s.mu.Unlock()
+		if hit {
+			return s.spanContext
+		}
+	}
+	return spanContext{}
+}
+
+// spanByRequest returns the live server span of the request with the
+// given X-Request-ID.
+func spanByRequest(id string) spanContext {
+	if id == "" {
+		return spanContext{}
+	}
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	for _, s := range liveSpans {
+		s.mu.Lock()
+		hit := s.kind == spanServer && s.attrs["framespdf.request_id"] == id
+		s.mu.Unlock()
+		if hit {
+			return s.spanContext
+		}
+	}
+	return spanContext{}
+}
+
+// bind adds upload IDs the span works on.
+func (s *span) bind(ids ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.sources = append(s.sources, ids...)
+	s.mu.Unlock()
+}
+
+func (s *span) set(key string, v any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = v
+	s.mu.Unlock()
+}
+
+// end finishes the span, with an error status if err is set, and queues it
+// for export.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	liveMu.Lock()
+	if i := slices.Index(liveSpans, s); i >= 0 {
+		liveSpans = slices.Delete(liveSpans, i, i+1)
+	}
+	liveMu.Unlock()
+	s.mu.Lock()
+	if len(s.sources) > 0 {
+		s.attrs["framespdf.source_ids"] = strings.Join(s.sources, ",")
+	}
+	attrs := s.attrs
+	s.mu.Unlock()
+	exportSpan(s.spanContext, s.parent, s.name, s.kind, s.start, time.Now(), attrs, err)
+}
+
+// traceRequest starts the server span of a request, continuing the
+// caller's trace if it sent a traceparent header. Handlers that create
+// uploads bind them with traceSources so their probes nest under it.
+func traceRequest(c *gin.Context) {
+	if !tracing() {
+		c.Next()
+		return
+	}
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	s := startSpan(parseTraceparent(c.GetHeader("traceparent")), c.Request.Method+" "+route, spanServer)
+	s.set("http.request.method", c.Request.Method)
+	s.set("http.route", route)
+	s.set("url.path", c.Request.URL.Path)
+	s.set("client.address", c.ClientIP())
+	if id := requestID(c); id != "" {
+		s.set("framespdf.request_id", id)
+	}
+	c.Set("span", s)
+	c.Next()
+	status := c.Writer.Status()
+	s.set("http.response.status_code", status)
+	if owner := ownerOf(c); owner != "" {
+		s.set("enduser.id", owner)
+	}
+	var err error
+	if status >= 500 {
+		err = fmt.Errorf("status %d", status)
+	}
+	s.end(err)
+}
+
+// requestSpan returns the request's server span, nil with tracing off.
+func requestSpan(c *gin.Context) *span {
+	v, _ := c.Get("span")
+	s, _ := v.(*span)
+	return s
+}
+
+// traceSources binds new upload IDs to the request's span.
+func traceSources(c *gin.Context, ids ...string) { requestSpan(c).bind(ids...) }
+
+// parseTraceparent reads a W3C traceparent header; zero if absent or bad.
+func parseTraceparent(h string) spanContext {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return spanContext{}
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return spanContext{}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return spanContext{}
+	}
+	return spanContext{TraceID: strings.ToLower(parts[1]), SpanID: strings.ToLower(parts[2])}
+}
+
+// traceToolRun records a finished tool run under the innermost span working
+// on its sources.
+func traceToolRun(run ToolRun, ids []string, started time.Time, args []string) {
+	if !tracing() {
+		return
+	}
+	cmdline := strings.Join(args, " ")
+	if len(cmdline) > 1024 {
+		cmdline = strings.ToValidUTF8(cmdline[:1024], "") + "..."
+	}
+	attrs := map[string]any{
+		"process.executable.name": run.Tool,
+		"process.command_line":    cmdline,
+	}
+	if len(ids) > 0 {
+		attrs["framespdf.source_ids"] = strings.Join(ids, ",")
+	}
+	var err error
+	if run.Error != "" {
+		err = fmt.Errorf("%s", run.Error)
+		attrs["framespdf.stderr"] = run.Stderr
+	}
+	sc := spanFor(ids)
+	self := spanContext{TraceID: sc.TraceID, SpanID: newSpanID()}
+	if self.TraceID == "" {
+		self.TraceID = newTraceID()
+	}
+	exportSpan(self, sc.SpanID, run.Tool, spanInternal, started, started.Add(time.Duration(run.DurationMS)*time.Millisecond), attrs, err)
+}
+
+// ===== OTLP export =====
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpAttrs(m map[string]any) []otlpKeyValue {
+	out := make([]otlpKeyValue, 0, len(m))
+	for k, v := range m {
+		var val map[string]any
+		switch v := v.(type) {
+		case int:
+			val = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			val = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			val = map[string]any{"doubleValue": v}
+		case bool:
+			val = map[string]any{"boolValue": v}
+		default:
+			val = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpKeyValue{Key: k, Value: val})
+	}
+	slices.SortFunc(out, func(a, b otlpKeyValue) int { return strings.Compare(a.Key, b.Key) })
+	return out
+}
+
+// Export batching: spans are sent every traceFlushInterval or once
+// traceBatchSize are queued; at most maxQueuedSpans wait, later ones are
+// dropped while the collector is unreachable.
+const (
+	traceFlushInterval = 5 * time.Second
+	traceBatchSize     = 256
+	maxQueuedSpans     = 8192
+)
+
+var (
+	traceMu      sync.Mutex
+	traceQueue   []otlpSpan
+	traceDropped int
+	traceKick    = make(chan struct{}, 1)
+	traceClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+func exportSpan(sc spanContext, parent, name string, kind int, start, end time.Time, attrs map[string]any, err error) {
+	st := otlpStatus{Code: statusOK}
+	if err != nil {
+		st = otlpStatus{Code: statusError, Message: err.Error()}
+	}
+	sp := otlpSpan{
+		TraceID:           sc.TraceID,
+		SpanID:            sc.SpanID,
+		ParentSpanID:      parent,
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        otlpAttrs(attrs),
+		Status:            st,
+	}
+	traceMu.Lock()
+	if len(traceQueue) >= maxQueuedSpans {
+		traceDropped++
+	} else {
+		traceQueue = append(traceQueue, sp)
+	}
+	full := len(traceQueue) >= traceBatchSize
+	traceMu.Unlock()
+	if full {
+		select {
+		case traceKick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startTraceExporter sends queued spans in the background until shutdown,
+// when flushTraces sends the rest.
+func startTraceExporter() {
+	if !tracing() {
+		return
+	}
+	slog.Info("exporting traces", "endpoint", otlpEndpoint, "service", otlpServiceName)
+	go func() {
+		t := time.NewTicker(traceFlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-workCtx.Done():
+				return
+			case <-t.C:
+			case <-traceKick:
+			}
+			flushTraces()
+		}
+	}()
+}
+
+var flushMu sync.Mutex
+
+// flushTraces sends every queued span.
+func flushTraces() {
+	if !tracing() {
+		return
+	}
+	flushMu.Lock()
+	defer flushMu.Unlock()
+	for {
+		traceMu.Lock()
+		batch := traceQueue[:min(len(traceQueue), traceBatchSize)]
+		traceQueue = traceQueue[len(batch):]
+		dropped := traceDropped
+		traceDropped = 0
+		traceMu.Unlock()
+		if dropped > 0 {
+			slog.Warn("trace export queue full, spans dropped", "spans", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := postSpans(batch); err != nil {
+			slog.Warn("trace export failed", "endpoint", otlpEndpoint, "spans", len(batch), "error", err.Error())
+			return
+		}
+	}
+}
+
+func postSpans(spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttrs(map[string]any{"service.name": otlpServiceName})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "framespdf"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, otlpTracesURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range otlpHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := traceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpTracesURL appends the OTLP traces path unless the endpoint already
+// names one.
+func otlpTracesURL() string {
+	if strings.HasSuffix(otlpEndpoint, "/v1/traces") {
+		return otlpEndpoint
+	}
+	return strings.TrimSuffix(otlpEndpoint, "/") + "/v1/traces"
+}
+
+// parseOTLPHeaders reads OTEL_EXPORTER_OTLP_HEADERS ("k1=v1,k2=v2").
+func parseOTLPHeaders(v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, kv := range strings.Split(v, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(kv, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("bad OTLP header %q", kv)
+		}
+		// values are percent-encoded, as in the OTel spec
+		if u, err := url.QueryUnescape(strings.TrimSpace(val)); err == nil {
+			val = u
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(val)
+	}
+	return out, nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// transcriptSegment is one timed piece of recognized speech.
+type transcriptSegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// transcriber is a speech-to-text backend. Input is always a 16 kHz mono
+// file prepared by extractSpeechAudio.
+type transcriber interface {
+	Name() string
+	// Available reports whether the backend is configured on this host.
+	Available() bool
+	// InputFormat is the audio container the backend wants ("wav" or "mp3").
+	InputFormat() string
+	Transcribe(path, language string) ([]transcriptSegment, error)
+}
+
+// transcribers in order of preference when the request doesn't pick one.
+var transcribers = []transcriber{whisperCPP{}, openAITranscriber{}}
+
+func lookupTranscriber(name string) (transcriber, error) {
+	for _, t := range transcribers {
+		if name == "" && t.Available() {
+			return t, nil
+		}
+		if name == t.Name() {
+			if !t.Available() {
+				return nil, fmt.Errorf("transcription backend %s is not configured", name)
+			}
+			return t, nil
+		}
+	}
+	if name == "" {
+		return nil, errors.New("no transcription backend configured (install whisper.cpp and set WHISPER_MODEL, or set OPENAI_API_KEY)")
+	}
+	return nil, fmt.Errorf("unknown transcription backend: %s", name)
+}
+
+// ----- whisper.cpp -----
+
+// whisperCPP runs the whisper.cpp CLI (whisper-cli, or the older main
+// binary via WHISPER_CPP_BIN) with the ggml model at WHISPER_MODEL.
+type whisperCPP struct{}
+
+func (whisperCPP) Name() string        { return "whisper_cpp" }
+func (whisperCPP) InputFormat() string { return "wav" }
+
+func (whisperCPP) bin() string {
+	if b := os.Getenv("WHISPER_CPP_BIN"); b != "" {
+		return b
+	}
+	return "whisper-cli"
+}
+
+func (w whisperCPP) Available() bool {
+	if os.Getenv("WHISPER_MODEL") == "" {
+		return false
+	}
+	_, err := exec.LookPath(w.bin())
+	return err == nil
+}
+
+func (w whisperCPP) Transcribe(path, language string) ([]transcriptSegment, error) {
+	if language == "" {
+		language = "auto"
+	}
+	base := stripExt(path)
+	cmd := toolCmd(w.bin(), "-m", os.Getenv("WHISPER_MODEL"), "-f", path, "-l", language, "-oj", "-of", base, "-np")
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("whisper.cpp: %w", err)
+	}
+	raw, err := os.ReadFile(base + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("whisper.cpp: %w", err)
+	}
+	var out struct {
+		Transcription []struct {
+			Offsets struct {
+				From int64 `json:"from"`
+				To   int64 `json:"to"`
+			} `json:"offsets"`
+			Text string `json:"text"`
+		} `json:"transcription"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("whisper.cpp: %w", err)
+	}
+	segs := make([]transcriptSegment, 0, len(out.Transcription))
+	for _, t := range out.Transcription {
+		segs = append(segs, transcriptSegment{Start: float64(t.Offsets.From) / 1000, End: float64(t.Offsets.To) / 1000, Text: strings.TrimSpace(t.Text)})
+	}
+	return segs, nil
+}
+
+// ----- OpenAI-compatible API -----
+
+// openAITranscriber posts to an OpenAI-compatible /audio/transcriptions
+// endpoint (OPENAI_BASE_URL, default api.openai.com) with OPENAI_API_KEY.
+type openAITranscriber struct{}
+
+func (openAITranscriber) Name() string        { return "openai" }
+func (openAITranscriber) InputFormat() string { return "mp3" }
+func (openAITranscriber) Available() bool     { return os.Getenv("OPENAI_API_KEY") != "" }
+
+func (openAITranscriber) Transcribe(path, language string) ([]transcriptSegment, error) {
+	baseURL := strings.TrimSuffix(os.Getenv("OPENAI_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	model := os.Getenv("OPENAI_TRANSCRIBE_MODEL")
+	if model == "" {
+		model = "whisper-1"
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("model", model)
+	_ = mw.WriteField("response_format", "verbose_json")
+	if language != "" && language != "auto" {
+		_ = mw.WriteField("language", language)
+	}
+	fw, err := mw.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(fw, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENAI_API_KEY"))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := (&http.Client{Timeout: 30 * time.Minute}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("openai: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openai: %s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	var out struct {
+		Text     string              `json:"text"`
+		Duration float64             `json:"duration"`
+		Segments []transcriptSegment `json:"segments"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("openai: %w", err)
+	}
+	if len(out.Segments) == 0 && out.Text != "" {
+		out.Segments = []transcriptSegment{{Start: 0, End: out.Duration, Text: out.Text}}
+	}
+	for i := range out.Segments {
+		out.Segments[i].Text = strings.TrimSpace(out.Segments[i].Text)
+	}
+	return out.Segments, nil
+}
+
+// ----- handler -----
+
+type transcribeReq struct {
+	// Kind is "audio" (default) or "video".
+	Kind     string `json:"kind"`
+	ID       string `json:"id"`
+	Language string `json:"language"`
+	// AudioTrack chooses a video's audio track by index or language.
+	AudioTrack string `json:"audio_track"`
+	Backend    string `json:"backend"`
+	Async      bool   `json:"async"`
+	Priority   string `json:"priority"`
+}
+
+func handleTranscribe(c *gin.Context) {
+	var req transcribeReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	var src, name string
+	var dur float64
+	audioMap := "0:a:0"
+	switch req.Kind {
+	case "", "audio":
+		if am := getAudio(c, req.ID); am != nil {
+			src, name, dur = am.AbsPath, am.Name, am.DurationS
+		}
+	case "video":
+		if vm := getVideo(c, req.ID); vm != nil {
+			m, err := audioTrackMap(vm, req.AudioTrack)
+			if err != nil {
+				fail(c, http.StatusBadRequest, "%v", err)
+				return
+			}
+			src, name, dur, audioMap = vm.AbsPath, vm.Name, vm.DurationS, m
+		}
+	default:
+		fail(c, http.StatusBadRequest, "kind must be audio or video")
+		return
+	}
+	if src == "" {
+		fail(c, http.StatusBadRequest, "unknown %s id: %s", req.Kind, req.ID)
+		return
+	}
+	tr, err := lookupTranscriber(req.Backend)
+	if err != nil {
+		fail(c, http.StatusNotImplemented, "%v", err)
+		return
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	job := newJob(ownerOf(c), requestID(c), "transcribe", prio, []string{req.ID}, []string{name})
+	job.Params = req
+	if req.Async {
+		go runTranscribe(job, tr, req.ID, src, audioMap, name, dur, req.Language)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runTranscribe(job, tr, req.ID, src, audioMap, name, dur, req.Language)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func runTranscribe(job *Job, tr transcriber, id, src, audioMap, name string, dur float64, language string) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		fail := func(err error) (gin.H, error) {
+			return nil, fmt.Errorf("transcription failed for %s: %w", name, err)
+		}
+		tmp, err := job.scratch("transcribe")
+		if err != nil {
+			return fail(err)
+		}
+
+		speech := filepath.Join(tmp, "speech."+tr.InputFormat())
+		progress := job.progressFunc(0)
+		if err := extractSpeechAudio(src, audioMap, speech, dur, func(p float64) { progress(p * 0.1) }); err != nil {
+			return fail(err)
+		}
+		segs, err := tr.Transcribe(speech, language)
+		if err != nil {
+			return fail(err)
+		}
+		progress(90)
+
+		if err := os.MkdirAll(transcriptsDir, 0o755); err != nil {
+			return fail(err)
+		}
+		// the four files share the version the PDF gets
+		base := stripExt(claimOutput(job.Owner, filepath.Join(transcriptsDir, id+"_"+stripExt(sanitizeName(name))+".pdf")))
+		files := map[string]string{
+			".srt": formatSRT(segs),
+			".vtt": formatVTT(segs),
+			".txt": formatTranscriptText(name, segs),
+		}
+		for ext, body := range files {
+			if err := os.WriteFile(base+ext, []byte(body), 0o644); err != nil {
+				return fail(err)
+			}
+		}
+		pages, err := renderTextPages(base+".txt", tmp)
+		if err != nil {
+			return fail(err)
+		}
+		if err := imagesToPDF(pages, base+".pdf", 150, 92); err != nil {
+			return fail(err)
+		}
+		job.setItem(0, jobDone, 100)
+		url := "/transcripts/" + filepath.Base(base)
+		recordOutputs(job.Owner, url+".srt", url+".vtt", url+".txt", url+".pdf")
+		resp := gin.H{
+			"job_id":   job.ID,
+			"id":       id,
+			"name":     name,
+			"backend":  tr.Name(),
+			"segments": len(segs),
+			"srt_url":  url + ".srt",
+			"vtt_url":  url + ".vtt",
+			"txt_url":  url + ".txt",
+			"pdf_url":  url + ".pdf",
+		}
+		return resp, nil
+	})
+}
+
+// extractSpeechAudio downmixes the audio stream of src that audioMap maps to
+// 16 kHz mono, the input speech models expect.
+func extractSpeechAudio(src, audioMap, out string, dur float64, onProgress func(float64)) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-map", audioMap, "-vn", "-ac", "1", "-ar", "16000"}
+	if strings.HasSuffix(out, ".mp3") {
+		args = append(args, "-c:a", "libmp3lame", "-b:a", "32k")
+	} else {
+		args = append(args, "-c:a", "pcm_s16le")
+	}
+	return runFFmpeg(append(args, out), dur, onProgress, nil)
+}
+
+// ----- formatting -----
+
+func formatSRT(segs []transcriptSegment) string {
+	var b strings.Builder
+	for i, s := range segs {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, subTimestamp(s.Start, ","), subTimestamp(s.End, ","), s.Text)
+	}
+	return b.String()
+}
+
+func formatVTT(segs []transcriptSegment) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, s := range segs {
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n", subTimestamp(s.Start, "."), subTimestamp(s.End, "."), s.Text)
+	}
+	return b.String()
+}
+
+// subTimestamp renders seconds as HH:MM:SS<sep>mmm.
+func subTimestamp(sec float64, sep string) string {
+	ms := int64(sec*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// transcriptWidth is the wrap column of the text/PDF transcript.
+const transcriptWidth = 88
+
+// formatTranscriptText lays out a readable transcript: a title, then one
+// timestamped paragraph per segment, wrapped with a hanging indent.
+func formatTranscriptText(title string, segs []transcriptSegment) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Transcript: %s\n%s\n\n", title, strings.Repeat("=", min(transcriptWidth, utf8.RuneCountInString(title)+12)))
+	for _, s := range segs {
+		stamp := "[" + subTimestamp(s.Start, ".")[:8] + "] "
+		indent := strings.Repeat(" ", len(stamp))
+		for i, line := range wrapWords(s.Text, transcriptWidth-len(stamp)) {
+			if i == 0 {
+				b.WriteString(stamp)
+			} else {
+				b.WriteString(indent)
+			}
+			b.WriteString(line + "\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// wrapWords greedily wraps text to lines of at most width runes.
+func wrapWords(text string, width int) []string {
+	var lines []string
+	cur := ""
+	for _, w := range strings.Fields(text) {
+		switch {
+		case cur == "":
+			cur = w
+		case utf8.RuneCountInString(cur)+1+utf8.RuneCountInString(w) <= width:
+			cur += " " + w
+		default:
+			lines = append(lines, cur)
+			cur = w
+		}
+	}
+	if cur != "" || len(lines) == 0 {
+		lines = append(lines, cur)
+	}
+	return lines
+}
+
+// renderTextPages typesets a plain-text file onto A4 page images with
+// ImageMagick's text: coder (which paginates on its own) so the transcript
+// can go through imagesToPDF like every other PDF.
+func renderTextPages(txtPath, dir string) ([]string, error) {
+	pattern := filepath.Join(dir, "page_%03d.png")
+	cmd := toolCmd(magickBin, "-density", "150", "-page", "A4", "-pointsize", "10", "text:"+txtPath, pattern)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("render transcript: %w", err)
+	}
+	pages, _ := filepath.Glob(filepath.Join(dir, "page_*.png"))
+	if len(pages) == 0 {
+		return nil, errors.New("render transcript: no pages")
+	}
+	return pages, nil
+}
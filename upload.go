@@ -0,0 +1,354 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Uploads are read part by part off the request body: each file goes
+// straight to its place under uploadDir through a fixed-size buffer, so
+// neither memory nor the temp directory grows with the size or number of
+// files being uploaded at once.
+
+const (
+	// maxFormValueBytes bounds one text field of an upload form, and
+	// maxFormValuesBytes all of them together.
+	maxFormValueBytes  = 64 << 10
+	maxFormValuesBytes = 1 << 20
+	uploadBufferBytes  = 256 << 10
+)
+
+var uploadBuffers = sync.Pool{New: func() any { return make([]byte, uploadBufferBytes) }}
+
+// receivedFile is an uploaded file called Name, written to uploadDir/Rel.
+type receivedFile struct {
+	ID     string
+	Name   string
+	Rel    string
+	Abs    string
+	Size   int64
+	SHA256 string
+}
+
+// uploadLimits are the size limits of kind (video, image or audio): of
+// the request body, and of each file, which is the request limit unless a
+// lower file limit is set. Both are 0 if kind is unknown.
+func uploadLimits(kind string) (request, file int64) {
+	switch kind {
+	case "video":
+		request, file = maxVideoUploadBytes, maxVideoFileBytes
+	case "image":
+		request, file = maxImageUploadBytes, maxImageFileBytes
+	case "audio":
+		request, file = maxAudioUploadBytes, maxAudioFileBytes
+	}
+	if file <= 0 || file > request {
+		file = request
+	}
+	return request, file
+}
+
+// uploadLimit is the answer of GET /upload_limits for one kind.
+type uploadLimit struct {
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	MaxFileBytes    int64 `json:"max_file_bytes"`
+}
+
+// currentUploadLimits is the size limits of every kind.
+func currentUploadLimits() map[string]uploadLimit {
+	out := map[string]uploadLimit{}
+	for _, kind := range []string{"video", "image", "audio"} {
+		request, file := uploadLimits(kind)
+		out[kind] = uploadLimit{request, file}
+	}
+	return out
+}
+
+// handleUploadLimits lets clients check files against the size limits
+// before sending them.
+func handleUploadLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, currentUploadLimits())
+}
+
+// receiveUpload reads a multipart upload of kind within its size limits,
+// writing the files of field to new upload directories and collecting the
+// other fields. The form fields may come before or after the files. On
+// failure it answers the request, removes what it wrote and returns ok
+// false.
+func receiveUpload(c *gin.Context, kind, field string) (files []receivedFile, values url.Values, ok bool) {
+	limit, fileLimit := uploadLimits(kind)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		fail(c, http.StatusBadRequest, "failed to parse form: %v", err)
+		return nil, nil, false
+	}
+	values = url.Values{}
+	valueBytes := 0
+	buf := uploadBuffers.Get().([]byte)
+	defer uploadBuffers.Put(buf)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			discardUploads(files)
+			failUploadRead(c, err)
+			return nil, nil, false
+		}
+		switch {
+		case part.FormName() == field:
+			f, err := receiveFile(part, buf, fileLimit)
+			if err != nil {
+				discardUploads(files)
+				failUploadRead(c, err)
+				return nil, nil, false
+			}
+			files = append(files, f)
+		case part.FileName() == "":
+			b, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes+1))
+			if err == nil && (len(b) > maxFormValueBytes || valueBytes+len(b) > maxFormValuesBytes) {
+				err = fmt.Errorf("form field %q is too large", part.FormName())
+			}
+			if err != nil {
+				discardUploads(files)
+				failUploadRead(c, err)
+				return nil, nil, false
+			}
+			valueBytes += len(b)
+			values.Add(part.FormName(), string(b))
+		}
+		// files under other field names are skipped; NextPart discards the
+		// rest of the part
+		part.Close()
+	}
+	uploadReceived(c)
+	return files, values, true
+}
+
+// receiveFile writes one file part of at most limit bytes to a new upload
+// directory, hashing it on the way.
+func receiveFile(part *multipart.Part, buf []byte, limit int64) (receivedFile, error) {
+	f := receivedFile{ID: randID(8), Name: displayName(part.FileName())}
+	f.Rel = filepath.Join(f.ID, storedName(f.Name))
+	f.Abs = filepath.Join(uploadDir, f.Rel)
+	if err := os.MkdirAll(filepath.Dir(f.Abs), 0o755); err != nil {
+		return f, fmt.Errorf("mkdir: %w", err)
+	}
+	fw, err := os.Create(f.Abs)
+	if err != nil {
+		os.RemoveAll(filepath.Dir(f.Abs))
+		return f, fmt.Errorf("create: %w", err)
+	}
+	h := sha256.New()
+	// MultiWriter keeps io.CopyBuffer on buf instead of *os.File's ReadFrom
+	f.Size, err = io.CopyBuffer(io.MultiWriter(fw, h), io.LimitReader(part, limit+1), buf)
+	if closeErr := fw.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && f.Size > limit {
+		os.RemoveAll(filepath.Dir(f.Abs))
+		return f, &sizeLimit{Scope: "file", Bytes: limit, File: f.Name}
+	}
+	if err != nil {
+		os.RemoveAll(filepath.Dir(f.Abs))
+		return f, fmt.Errorf("write: %w", err)
+	}
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, nil
+}
+
+// failUploadRead answers an upload that couldn't be read: 413 past a size
+// limit, 500 for a local write error, else 400.
+func failUploadRead(c *gin.Context, err error) {
+	var tooBig *http.MaxBytesError
+	var overFile *sizeLimit
+	var pathErr *os.PathError
+	switch {
+	case errors.As(err, &tooBig):
+		failTooLarge(c, &sizeLimit{Scope: "request", Bytes: tooBig.Limit})
+	case errors.As(err, &overFile):
+		failTooLarge(c, overFile)
+	case errors.As(err, &pathErr):
+		fail(c, http.StatusInternalServerError, "%v", err)
+	default:
+		fail(c, http.StatusBadRequest, "failed to parse form: %v", err)
+	}
+}
+
+// discardUploads removes received files that won't be registered.
+func discardUploads(files []receivedFile) {
+	for _, f := range files {
+		os.RemoveAll(filepath.Dir(f.Abs))
+	}
+}
+
+// Upload progress: a client that names its upload with an X-Upload-ID
+// header (or upload_id query parameter) can follow it at GET
+// /uploads/:id/progress, first the bytes received and then the checks and
+// probing of the files, until it is done or failed. Finished uploads stay
+// visible for uploadProgressTTL.
+
+const (
+	uploadReceiving  = "receiving"
+	uploadProcessing = "processing"
+	uploadDone       = "done"
+	uploadFailed     = "failed"
+
+	uploadProgressTTL = 10 * time.Minute
+)
+
+// uploadProgress is the answer of GET /uploads/:id/progress.
+type uploadProgress struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	ReceivedBytes int64  `json:"received_bytes"`
+	// TotalBytes is the request's Content-Length, when it sent one; it
+	// includes the multipart framing, so ReceivedBytes ends up equal to it.
+	TotalBytes int64   `json:"total_bytes,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	Started    string  `json:"started_at"`
+	Finished   string  `json:"finished_at,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// uploadTracker follows one upload; received is counted off the request
+// body, the rest is guarded by uploadsMu.
+type uploadTracker struct {
+	p        uploadProgress
+	received atomic.Int64
+	finished time.Time
+}
+
+// uploadTrackers is keyed by uploadKey: upload IDs are the client's and
+// only need to be unique per owner.
+var (
+	uploadsMu      sync.Mutex
+	uploadTrackers = map[string]*uploadTracker{}
+)
+
+func uploadKey(owner, id string) string { return owner + "\x00" + id }
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// trackUpload registers an upload that carries an upload ID for progress
+// reports and records its outcome.
+func trackUpload(c *gin.Context) {
+	id := cmp.Or(c.GetHeader("X-Upload-ID"), c.Query("upload_id"))
+	if id == "" {
+		c.Next()
+		return
+	}
+	if !uploadIDPattern.MatchString(id) {
+		fail(c, http.StatusBadRequest, "bad upload id %q: want 1-64 letters, digits, '-' or '_'", id)
+		return
+	}
+	key := uploadKey(ownerOf(c), id)
+	t := &uploadTracker{p: uploadProgress{ID: id, Status: uploadReceiving, TotalBytes: max(c.Request.ContentLength, 0), Started: time.Now().Format(time.RFC3339)}}
+	uploadsMu.Lock()
+	for k, old := range uploadTrackers {
+		if !old.finished.IsZero() && time.Since(old.finished) > uploadProgressTTL {
+			delete(uploadTrackers, k)
+		}
+	}
+	if old := uploadTrackers[key]; old != nil && old.finished.IsZero() {
+		uploadsMu.Unlock()
+		fail(c, http.StatusConflict, "upload id %s is in use by an upload in progress", id)
+		return
+	}
+	uploadTrackers[key] = t
+	uploadsMu.Unlock()
+	c.Request.Body = countingBody{ReadCloser: c.Request.Body, n: &t.received}
+	c.Set("upload", t)
+	c.Next()
+
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	t.finished = time.Now()
+	t.p.Finished = t.finished.Format(time.RFC3339)
+	t.p.Status = uploadDone
+	if c.Writer.Status() >= 400 {
+		t.p.Status = uploadFailed
+		if e := c.Errors.Last(); e != nil {
+			t.p.Error = e.Error()
+		}
+	}
+}
+
+// uploadReceived marks the request's upload, if tracked, as read and now
+// being processed.
+func uploadReceived(c *gin.Context) {
+	if t, ok := c.Get("upload"); ok {
+		uploadsMu.Lock()
+		t.(*uploadTracker).p.Status = uploadProcessing
+		uploadsMu.Unlock()
+	}
+}
+
+func handleUploadProgress(c *gin.Context) {
+	uploadsMu.Lock()
+	t := uploadTrackers[uploadKey(ownerOf(c), c.Param("id"))]
+	var p uploadProgress
+	if t != nil {
+		p = t.p
+	}
+	uploadsMu.Unlock()
+	if t == nil {
+		failCode(c, http.StatusNotFound, errUnknownID, "unknown upload id: %s", c.Param("id"))
+		return
+	}
+	p.ReceivedBytes = t.received.Load()
+	if p.TotalBytes > 0 {
+		p.Percent = math.Round(float64(p.ReceivedBytes)/float64(p.TotalBytes)*1000) / 10
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// serveUploadProgress answers GET /uploads/:id/progress ahead of the static
+// files under /uploads, which gin can't route next to it; an uploaded file
+// actually named "progress" still wins.
+func serveUploadProgress(c *gin.Context) {
+	rest, _ := strings.CutPrefix(c.Request.URL.Path, "/uploads/")
+	id, tail, _ := strings.Cut(rest, "/")
+	if tail != "progress" || c.Request.Method != http.MethodGet {
+		c.Next()
+		return
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, id, tail)); err == nil {
+		c.Next()
+		return
+	}
+	c.Params = append(c.Params, gin.Param{Key: "id", Value: id})
+	handleUploadProgress(c)
+	c.Abort()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// mediaValidation is the integrity report attached to video/audio uploads.
+type mediaValidation struct {
+	OK bool `json:"ok"`
+	// Errors are the distinct decoder errors, capped at maxValidationErrors.
+	Errors   []string `json:"errors,omitempty"`
+	DecodedS float64  `json:"decoded_seconds"`
+	// Truncated is set when decoding stopped well before the duration the
+	// container claims, the usual sign of an interrupted transfer.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+const maxValidationErrors = 20
+
+// validateMedia decodes every stream of abs to the null muxer and collects
+// decoder errors. Video is decoded keyframes-only to keep uploads fast, which
+// still catches broken containers and missing tails; durationS is the probed
+// container duration (0 if unknown).
+func validateMedia(abs string, durationS float64, video bool) *mediaValidation {
+	args := []string{"-hide_banner", "-nostdin", "-nostats", "-v", "error", "-progress", "pipe:1"}
+	if video {
+		args = append(args, "-skip_frame", "nokey")
+	}
+	args = append(args, "-i", abs, "-map", "0:v?", "-map", "0:a?", "-f", "null", "-")
+	cmd := toolCmd(ffmpegBin, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	v := &mediaValidation{}
+	sc := bufio.NewScanner(&stdout)
+	for sc.Scan() {
+		if k, val, ok := strings.Cut(sc.Text(), "="); ok && (k == "out_time_us" || k == "out_time_ms") {
+			if us, err := strconv.ParseInt(val, 10, 64); err == nil && us > 0 {
+				v.DecodedS = math.Round(float64(us)/1e4) / 100
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || seen[line] {
+			continue
+		}
+		seen[line] = true
+		if len(v.Errors) < maxValidationErrors {
+			v.Errors = append(v.Errors, line)
+		}
+	}
+	if runErr != nil && len(v.Errors) == 0 {
+		v.Errors = append(v.Errors, runErr.Error())
+	}
+	// keyframe-only decoding can stop up to a GOP short of the end
+	tolerance := math.Max(1, durationS*0.02)
+	if video {
+		tolerance = math.Max(10, durationS*0.02)
+	}
+	v.Truncated = durationS > 0 && v.DecodedS+tolerance < durationS
+	v.OK = runErr == nil && len(v.Errors) == 0 && !v.Truncated
+	return v
+}
+
+// typeCheck is what happens to uploads whose content, sniffed from its
+// leading bytes, isn't what the endpoint takes (uploads.type_check,
+// FRAMESPDF_TYPE_CHECK, -type-check): "reject" refuses them, "warn" keeps
+// them with a type_warning, "off" skips the check.
+var typeCheck = "reject"
+
+// typeFits reports whether a file of type mt may be uploaded as kind.
+// Audio is accepted in video containers (webm, mp4) and vice versa for
+// audio-only, since the sniffer can't tell what streams they carry.
+func typeFits(kind, mt string) bool {
+	switch kind {
+	case "image":
+		return strings.HasPrefix(mt, "image/")
+	case "video":
+		// animated GIF and APNG count as videos
+		return strings.HasPrefix(mt, "video/") || mt == "audio/mp4" || mt == "application/ogg" || mt == "image/gif" || mt == "image/png" || mt == "image/vnd.mozilla.apng"
+	}
+	return strings.HasPrefix(mt, "audio/") || strings.HasPrefix(mt, "video/") || mt == "application/ogg"
+}
+
+// checkUploadType sniffs the file at abs, uploaded as kind, and returns its
+// MIME type. A type that doesn't fit kind is an error under
+// typeCheck=reject and a warning otherwise; content the sniffer doesn't
+// recognise only gets a warning, as ffmpeg reads formats it doesn't know.
+func checkUploadType(kind, name, abs string) (mt, warning string, err error) {
+	if typeCheck == "off" {
+		return "", "", nil
+	}
+	m, err := mimetype.DetectFile(abs)
+	if err != nil {
+		return "", "", err
+	}
+	mt, _, _ = strings.Cut(m.String(), ";")
+	switch {
+	case typeFits(kind, mt):
+		return mt, "", nil
+	case mt == "application/octet-stream":
+		return mt, "content type not recognised", nil
+	}
+	msg := fmt.Sprintf("%s is %s, not %s", name, mt, kind)
+	if typeCheck == "reject" {
+		return mt, "", errors.New(msg)
+	}
+	return mt, msg, nil
+}
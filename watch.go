@@ -0,0 +1,368 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"video-to-pdf/audioconv"
+)
+
+// Watch-folder presets.
+const (
+	// presetVideoPDF turns every video into a PDF of its frames.
+	presetVideoPDF = "video_pdf"
+	// presetAudioConvert converts every audio file to the folder's format.
+	presetAudioConvert = "audio_convert"
+	// presetImport only registers files, like an upload.
+	presetImport = "import"
+)
+
+// watchFolder is one directory the server watches (watch.folders in the
+// config file). Files dropped there are moved into the uploads, processed
+// with Preset as a bulk job and the results copied to Output.
+type watchFolder struct {
+	Dir    string `yaml:"dir"`
+	Preset string `yaml:"preset"`
+	// Output defaults to <dir>/out.
+	Output string `yaml:"output"`
+	// FPS, Format and BitrateKbps override the server defaults.
+	FPS         float64 `yaml:"fps"`
+	Format      string  `yaml:"format"`
+	BitrateKbps int     `yaml:"bitrate_kbps"`
+	// Owner is the account files are registered to when auth is enabled.
+	Owner string `yaml:"owner"`
+	// Manual folders aren't polled; only scheduled scans (see
+	// schedules.go) pick their files up.
+	Manual bool `yaml:"manual"`
+
+	owner string
+	// busy holds the files being processed, so that a poll and a scheduled
+	// scan don't both take one.
+	busyMu sync.Mutex
+	busy   map[string]bool
+}
+
+var (
+	watchFolders  []watchFolder
+	watchInterval = 10 * time.Second
+)
+
+var (
+	videoExts = extSet(".mp4", ".mov", ".mkv", ".webm", ".avi", ".m4v", ".mpg", ".mpeg", ".wmv", ".flv", ".ts", ".3gp")
+	imageExts = extSet(".jpg", ".jpeg", ".png", ".webp", ".gif", ".bmp", ".tif", ".tiff", ".heic")
+	// animationExts are the image formats that can hold an animation;
+	// uploaded as videos, they are processed frame by frame.
+	animationExts = extSet(".gif", ".apng", ".png")
+	audioExts     = extSet(".mp3", ".wav", ".flac", ".m4a", ".aac", ".ogg", ".oga", ".opus", ".wma", ".aif", ".aiff")
+)
+
+func extSet(exts ...string) map[string]bool {
+	m := make(map[string]bool, len(exts))
+	for _, e := range exts {
+		m[e] = true
+	}
+	return m
+}
+
+// mediaKind guesses a file's kind from its extension; "" if unknown.
+func mediaKind(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case videoExts[ext]:
+		return "video"
+	case imageExts[ext]:
+		return "image"
+	case audioExts[ext]:
+		return "audio"
+	}
+	return ""
+}
+
+// accepts reports whether the folder's preset handles files of kind.
+func (w *watchFolder) accepts(kind string) bool {
+	switch w.Preset {
+	case presetVideoPDF:
+		return kind == "video"
+	case presetAudioConvert:
+		return kind == "audio"
+	}
+	return kind != ""
+}
+
+// checkWatchFolders validates the configured folders, fills in their
+// defaults and creates the output directories.
+func checkWatchFolders() error {
+	for i := range watchFolders {
+		w := &watchFolders[i]
+		if w.Dir == "" {
+			return fmt.Errorf("watch folder %d: dir is required", i+1)
+		}
+		if st, err := os.Stat(w.Dir); err != nil || !st.IsDir() {
+			return fmt.Errorf("watch folder %s: not a directory", w.Dir)
+		}
+		switch w.Preset {
+		case presetImport:
+		case presetVideoPDF:
+			if !moduleOn("video") {
+				return fmt.Errorf("watch folder %s: the video module is disabled", w.Dir)
+			}
+		case presetAudioConvert:
+			if !moduleOn("audio") {
+				return fmt.Errorf("watch folder %s: the audio module is disabled", w.Dir)
+			}
+			w.Format = strings.ToLower(w.Format)
+			if w.Format != "" {
+				if _, err := audioconv.Lookup(w.Format); err != nil {
+					return fmt.Errorf("watch folder %s: %w", w.Dir, err)
+				}
+			}
+		default:
+			return fmt.Errorf("watch folder %s: preset must be video_pdf, audio_convert or import", w.Dir)
+		}
+		if w.FPS < 0 || w.BitrateKbps < 0 {
+			return fmt.Errorf("watch folder %s: fps and bitrate_kbps must not be negative", w.Dir)
+		}
+		w.Output = cmp.Or(w.Output, filepath.Join(w.Dir, "out"))
+		if err := os.MkdirAll(w.Output, 0o755); err != nil {
+			return err
+		}
+		if authEnabled {
+			if w.Owner == "" {
+				return fmt.Errorf("watch folder %s: owner is required with auth enabled", w.Dir)
+			}
+			usersMu.Lock()
+			u := findUser(w.Owner)
+			usersMu.Unlock()
+			if u == nil {
+				return fmt.Errorf("watch folder %s: unknown owner %s", w.Dir, w.Owner)
+			}
+			w.owner = u.ID
+		}
+	}
+	return nil
+}
+
+// startWatchers polls every watch folder but the manual ones each
+// watchInterval.
+func startWatchers() {
+	for i := range watchFolders {
+		w := &watchFolders[i]
+		if w.Manual {
+			slog.Info("watch folder left to schedules", "dir", w.Dir, "preset", w.Preset, "output", w.Output)
+			continue
+		}
+		slog.Info("watching folder", "dir", w.Dir, "preset", w.Preset, "output", w.Output)
+		go w.watch()
+	}
+}
+
+// findWatchFolder returns the configured folder dir, or nil.
+func findWatchFolder(dir string) *watchFolder {
+	for i := range watchFolders {
+		if filepath.Clean(watchFolders[i].Dir) == filepath.Clean(dir) {
+			return &watchFolders[i]
+		}
+	}
+	return nil
+}
+
+type fileState struct {
+	size  int64
+	mtime time.Time
+}
+
+func (w *watchFolder) watch() {
+	seen := map[string]fileState{}
+	for {
+		select {
+		case <-workCtx.Done():
+			return
+		case <-time.After(watchInterval):
+		}
+		seen = w.scan(seen, nil)
+	}
+}
+
+// scan lists the folder once and starts processing each file that has
+// stopped changing: one the same as in seen, the states of the previous
+// scan, or with seen nil one left untouched for watchInterval. It returns
+// the states for the next scan. wg, if set, counts the files started.
+func (w *watchFolder) scan(seen map[string]fileState, wg *sync.WaitGroup) map[string]fileState {
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		slog.Warn("watch", "dir", w.Dir, "error", err.Error())
+		return seen
+	}
+	next := map[string]fileState{}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") || isPartialName(name) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		st := fileState{info.Size(), info.ModTime()}
+		next[name] = st
+		if seen == nil {
+			if time.Since(st.mtime) < watchInterval {
+				continue
+			}
+		} else if prev, ok := seen[name]; !ok || prev != st {
+			// a file is picked up once it has stopped changing for a poll
+			continue
+		}
+		kind := mediaKind(name)
+		if !w.accepts(kind) {
+			continue
+		}
+		w.busyMu.Lock()
+		if w.busy[name] {
+			w.busyMu.Unlock()
+			continue
+		}
+		if w.busy == nil {
+			w.busy = map[string]bool{}
+		}
+		w.busy[name] = true
+		w.busyMu.Unlock()
+		if wg != nil {
+			wg.Add(1)
+		}
+		go func() {
+			w.process(name, kind, st.size)
+			w.busyMu.Lock()
+			delete(w.busy, name)
+			w.busyMu.Unlock()
+			if wg != nil {
+				wg.Done()
+			}
+		}()
+	}
+	return next
+}
+
+// isPartialName matches the temporary names browsers and copy tools use
+// while a file is still being written.
+func isPartialName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".part", ".partial", ".tmp", ".crdownload", ".download":
+		return true
+	}
+	return false
+}
+
+// process moves name out of the folder into the uploads, registers it and
+// runs the preset. Results are copied to the output folder; a failure
+// leaves <name>.error.txt there instead.
+func (w *watchFolder) process(name, kind string, size int64) {
+	id := randID(8)
+	dir := filepath.Join(uploadDir, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Warn("watch", "dir", w.Dir, "error", err.Error())
+		return
+	}
+	clean := sanitizeName(name)
+	if err := moveFile(filepath.Join(w.Dir, name), filepath.Join(dir, clean)); err != nil {
+		slog.Warn("watch", "dir", w.Dir, "file", name, "error", err.Error())
+		os.RemoveAll(dir)
+		return
+	}
+	job := newJob(w.owner, "", "watch", prioBulk, []string{id}, []string{clean})
+	job.Params = gin.H{"dir": w.Dir, "preset": w.Preset, "fps": w.FPS, "format": w.Format, "bitrate_kbps": w.BitrateKbps}
+	var meta any
+	_, err := runJob(job, func() (gin.H, error) {
+		job.setItem(0, jobRunning, 0)
+		if meta == nil {
+			var err error
+			if meta, err = registerSource(kind, w.owner, id, clean, size, nil, nil); err != nil {
+				return nil, err
+			}
+		}
+		outs, resp, err := w.run(job, meta)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range outs {
+			if err := copyFile(p, filepath.Join(w.Output, filepath.Base(p))); err != nil {
+				return nil, err
+			}
+		}
+		job.setItem(0, jobDone, 100)
+		return resp, nil
+	})
+	if err != nil {
+		msg := fmt.Sprintf("%s: %v\njob: %s\n", name, err, job.ID)
+		if werr := os.WriteFile(filepath.Join(w.Output, clean+".error.txt"), []byte(msg), 0o644); werr != nil {
+			slog.Warn("watch", "dir", w.Dir, "error", werr.Error())
+		}
+		slog.Warn("watch file failed", "dir", w.Dir, "file", name, "job_id", job.ID, "source_id", id, "error", err.Error())
+		return
+	}
+	slog.Info("watch file done", "dir", w.Dir, "file", name, "job_id", job.ID, "source_id", id)
+}
+
+// run applies the preset to the registered file and returns the output
+// paths to copy and the job result.
+func (w *watchFolder) run(job *Job, meta any) ([]string, gin.H, error) {
+	switch w.Preset {
+	case presetVideoPDF:
+		vm := meta.(*VideoMeta)
+		fps := cmp.Or(w.FPS, processDefaults.FPS)
+		pdfPath, _, st, err := videoToPDF(vm, job.ID, fps, framePrepFor(vm, fps), "", processDefaults.JPEGQuality, processDefaults.Density, processDefaults.Quality, job.progressFunc(0))
+		if err != nil {
+			return nil, nil, err
+		}
+		pruneFrameRuns(vm.ID, job.ID)
+		pdfURL := outputURL(pdfPath)
+		recordOutputs(job.Owner, pdfURL)
+		return []string{pdfPath}, gin.H{"job_id": job.ID, "id": vm.ID, "frames": st.Frames, "frames_dropped": st.Dropped, "frames_duplicated": st.Duplicated, "pdf_url": pdfURL}, nil
+	case presetAudioConvert:
+		am := meta.(*AudioMeta)
+		format := cmp.Or(w.Format, processDefaults.AudioFormat)
+		outs, err := convertAudio(am.AbsPath, am.Name, audioConvertOpts{
+			Format:      format,
+			Formats:     []string{format},
+			BitrateKbps: cmp.Or(w.BitrateKbps, processDefaults.AudioBitrateKbps),
+			DurationS:   am.DurationS,
+			SourceRate:  am.SampleRate,
+			TagSource:   tagSource(am.ProbeJSON),
+			Owner:       job.Owner,
+			Progress:    job.progressFunc(0),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("convert failed for %s: %w", am.Name, err)
+		}
+		urls := make([]string, len(outs))
+		for i, p := range outs {
+			urls[i] = outputURL(p)
+		}
+		recordOutputs(job.Owner, urls...)
+		return outs, gin.H{"job_id": job.ID, "id": am.ID, "out_urls": urls}, nil
+	}
+	return nil, gin.H{"job_id": job.ID, "source": meta}, nil
+}
+
+// copyFile copies src to dst, replacing it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = ioCopyClose(out, in)
+	return err
+}
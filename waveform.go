@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// waveformStyles maps the accepted `style` values to the ffmpeg visualizer.
+var waveformStyles = map[string]bool{"waveform": true, "spectrum": true, "cqt": true}
+
+var hexColorRe = regexp.MustCompile(`^(#|0x)?[0-9a-fA-F]{6}$`)
+
+type waveformVideoReq struct {
+	ID string `json:"id"`
+	// Style is waveform (default), spectrum or cqt (musical spectrum bars).
+	Style string `json:"style"`
+	// BackgroundImageID is an uploaded image scaled/cropped to fill the frame.
+	BackgroundImageID string `json:"background_image_id"`
+	Title             string `json:"title"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	FPS               int    `json:"fps"`
+	// Color is the waveform colour as hex RGB (waveform style only).
+	Color    string `json:"color"`
+	Async    bool   `json:"async"`
+	Priority string `json:"priority"`
+}
+
+// waveformOpts is a validated waveform video render.
+type waveformOpts struct {
+	Style     string
+	BgPath    string
+	Title     string
+	W, H, FPS int
+	Color     string
+}
+
+func handleWaveformVideo(c *gin.Context) {
+	var req waveformVideoReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	am := getAudio(c, req.ID)
+	if am == nil {
+		failCode(c, http.StatusBadRequest, errUnknownID, "unknown audio id: %s", req.ID)
+		return
+	}
+	o := waveformOpts{Style: strings.ToLower(strings.TrimSpace(req.Style)), Title: strings.TrimSpace(req.Title), W: req.Width, H: req.Height, FPS: req.FPS, Color: "ffffff"}
+	if o.Style == "" {
+		o.Style = "waveform"
+	}
+	if !waveformStyles[o.Style] {
+		fail(c, http.StatusBadRequest, "unknown style: %s", req.Style)
+		return
+	}
+	if o.W == 0 && o.H == 0 {
+		o.W, o.H = 1280, 720
+	}
+	if o.W < 160 || o.H < 120 || o.W > 3840 || o.H > 2160 || o.W%2 != 0 || o.H%2 != 0 {
+		fail(c, http.StatusBadRequest, "width/height must be even and between 160x120 and 3840x2160")
+		return
+	}
+	if o.FPS == 0 {
+		o.FPS = 25
+	}
+	if o.FPS < 1 || o.FPS > 60 {
+		fail(c, http.StatusBadRequest, "fps must be between 1 and 60")
+		return
+	}
+	if req.Color != "" {
+		if !hexColorRe.MatchString(req.Color) {
+			fail(c, http.StatusBadRequest, "color must be hex RGB, e.g. #33ccff")
+			return
+		}
+		o.Color = req.Color[len(req.Color)-6:]
+	}
+	if req.BackgroundImageID != "" {
+		im := getImage(c, req.BackgroundImageID)
+		if im == nil {
+			failCode(c, http.StatusBadRequest, errUnknownID, "unknown image id: %s", req.BackgroundImageID)
+			return
+		}
+		o.BgPath = im.AbsPath
+	}
+	prio, err := parsePriority(req.Priority)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	job := newJob(ownerOf(c), requestID(c), "waveform_video", prio, []string{am.ID}, []string{am.Name})
+	job.Params = req
+	if req.Async {
+		go runWaveformVideo(job, am, o)
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status_url": "/jobs/" + job.ID})
+		return
+	}
+	resp, err := runWaveformVideo(job, am, o)
+	if err != nil {
+		fail(c, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func runWaveformVideo(job *Job, am *AudioMeta, o waveformOpts) (gin.H, error) {
+	return runJob(job, func() (gin.H, error) {
+		job.setItem(0, jobRunning, 0)
+		out := claimOutput(job.Owner, filepath.Join(rendersDir, stripExt(sanitizeName(am.Name))+"_"+o.Style+".mp4"))
+		if err := renderWaveformVideo(am.AbsPath, out, job.ID, am.DurationS, o, job.progressFunc(0)); err != nil {
+			return nil, fmt.Errorf("render failed for %s: %w", am.Name, err)
+		}
+		job.setItem(0, jobDone, 100)
+		recordOutputs(job.Owner, "/renders/"+filepath.Base(out))
+		resp := gin.H{"job_id": job.ID, "id": am.ID, "name": am.Name, "video_url": "/renders/" + filepath.Base(out)}
+		return resp, nil
+	})
+}
+
+// renderWaveformVideo encodes inAbs into an H.264/AAC MP4 whose picture is the
+// chosen visualizer over a background image (or black), with optional title
+// text near the top, written to the scratch space of the job run.
+func renderWaveformVideo(inAbs, out, run string, totalS float64, o waveformOpts, onProgress func(float64)) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", inAbs}
+	var graph []string
+	if o.BgPath != "" {
+		args = append(args, "-loop", "1", "-framerate", fmt.Sprint(o.FPS), "-i", o.BgPath)
+		graph = append(graph, fmt.Sprintf("[1:v]scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,setsar=1[bg]", o.W, o.H, o.W, o.H))
+	} else {
+		graph = append(graph, fmt.Sprintf("color=c=black:s=%dx%d:r=%d[bg]", o.W, o.H, o.FPS))
+	}
+
+	// the waveform sits in the lower third; spectra fill most of the frame
+	visH := o.H / 3
+	if o.Style != "waveform" {
+		visH = o.H * 2 / 3
+	}
+	visH -= visH % 2
+	switch o.Style {
+	case "waveform":
+		graph = append(graph, fmt.Sprintf("[0:a]showwaves=s=%dx%d:mode=cline:rate=%d:colors=0x%s,format=rgba[vis]", o.W, visH, o.FPS, o.Color))
+	case "spectrum":
+		graph = append(graph, fmt.Sprintf("[0:a]showspectrum=s=%dx%d:mode=combined:slide=scroll:color=intensity:scale=log,fps=%d,format=rgba,colorchannelmixer=aa=0.85[vis]", o.W, visH, o.FPS))
+	case "cqt":
+		graph = append(graph, fmt.Sprintf("[0:a]showcqt=s=%dx%d:r=%d:axis=0,format=rgba,colorkey=black:0.01:0[vis]", o.W, visH, o.FPS))
+	}
+	graph = append(graph, fmt.Sprintf("[bg][vis]overlay=(W-w)/2:H-h-%d:shortest=1,format=yuv420p[v0]", o.H/20))
+
+	last := "[v0]"
+	if o.Title != "" {
+		// a text file under a fixed name sidesteps drawtext's quoting rules
+		// for arbitrary titles, and expansion=none keeps a % in one as is
+		dir, err := jobScratch(run, "waveform-title")
+		if err != nil {
+			return err
+		}
+		titlePath := filepath.Join(dir, "title.txt")
+		if err := os.WriteFile(titlePath, []byte(o.Title), 0o644); err != nil {
+			return err
+		}
+		graph = append(graph, fmt.Sprintf("[v0]drawtext=textfile='%s':expansion=none:fontcolor=white:fontsize=%d:borderw=2:bordercolor=black@0.6:x=(w-text_w)/2:y=h/10[v]", titlePath, o.H/14))
+		last = "[v]"
+	}
+
+	args = append(args,
+		"-filter_complex", strings.Join(graph, ";"),
+		"-map", last, "-map", "0:a:0",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "192k",
+		"-shortest", "-movflags", "+faststart", out)
+	return runFFmpeg(args, totalS, onProgress, nil)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The web UI is embedded in the binary: web/*.html are html/template pages
+// rendered per request, web/static is served as is at /static. The index
+// page carries the caller's uploads and the processing defaults, so it
+// shows them without fetching the listings first, and only has sections
+// for the enabled modules.
+//
+//go:embed web
+var webFiles embed.FS
+
+var pageTemplates = template.Must(template.ParseFS(webFiles, "web/*.html"))
+
+// staticFiles is web/static, served at /static.
+func staticFiles() http.FileSystem {
+	sub, err := fs.Sub(webFiles, "web/static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
+
+// indexState is the initial state of the UI script: the first page of each
+// listing, as GET /videos, /images and /audios return it, the processing
+// defaults and the upload size limits.
+type indexState struct {
+	Videos       []*VideoMeta           `json:"videos"`
+	Images       []*ImgMeta             `json:"images"`
+	Audios       []*AudioMeta           `json:"audios"`
+	Defaults     projectDefaults        `json:"defaults"`
+	UploadLimits map[string]uploadLimit `json:"upload_limits"`
+}
+
+// handleIndex renders the UI.
+func handleIndex(c *gin.Context) {
+	q := defaultListQuery()
+	st := indexState{Defaults: processDefaults, UploadLimits: currentUploadLimits()}
+	st.Videos, _ = listVideos(c, q)
+	st.Images, _ = listImages(c, q)
+	st.Audios, _ = listAudios(c, q)
+	c.HTML(http.StatusOK, "index.html", gin.H{"Defaults": processDefaults, "State": st, "Modules": enabledModules()})
+}
@@ -0,0 +1,336 @@
+// initialState is rendered into the page by the server: the caller's
+// uploads (newest first) and the processing defaults.
+const defaults = initialState.defaults;
+
+// ----- Videos -----
+const rowsDiv = document.getElementById('rows');
+const listDiv = document.getElementById('list');
+const resultsDiv = document.getElementById('results');
+const upForm = document.getElementById('upForm');
+const goBtn = document.getElementById('goBtn');
+let uploads = initialState.videos;
+
+upForm?.addEventListener('submit', async function(e) {
+  e.preventDefault();
+  const files = document.getElementById('videos').files;
+  if (!files || files.length === 0) { alert('Pick at least one video'); return; }
+  const tooBig = sizeError(files, 'video');
+  if (tooBig) { alert(tooBig); return; }
+  const fd = new FormData();
+  for (const f of files) fd.append('videos', f, f.name);
+  const res = await uploadForm('/upload', fd, upForm);
+  if (!res.ok) { alert('Upload failed: ' + await errorText(res)); return; }
+  const data = await res.json();
+  uploads = data.videos || [];
+  renderList();
+});
+
+function renderList() {
+  rowsDiv.innerHTML = '';
+  if (uploads.length === 0) { listDiv.style.display='none'; return; }
+  listDiv.style.display = 'block';
+  for (const v of uploads) {
+    const row = document.createElement('div'); 
+    row.className = 'grid grid-cols-5 gap-4 items-center py-3 border-b border-gray-100 last:border-b-0';
+    const dur = v.duration_seconds || 0; const hms = toHMS(dur);
+    const fpsInput = document.createElement('input'); 
+    fpsInput.type = 'number'; fpsInput.min = '0.1'; fpsInput.step = '0.1'; fpsInput.value = String(defaults.fps);
+    fpsInput.className = 'w-20 px-3 py-1.5 border border-gray-300 rounded-lg text-sm focus:ring-2 focus:ring-blue-500 focus:border-blue-500';
+    const estSpan = document.createElement('div'); 
+    estSpan.className = 'font-mono text-sm text-gray-600'; 
+    estSpan.textContent = Math.ceil(defaults.fps * dur);
+    fpsInput.oninput = function(){ estSpan.textContent = Math.ceil((Number(fpsInput.value)||0) * dur); };
+    
+    const fileDiv = document.createElement('div');
+    fileDiv.innerHTML = '<span class="font-mono text-sm text-gray-900">'+escapeHTML(v.name)+'</span>'+validationBadge(v.validation);
+    
+    const durDiv = document.createElement('div');
+    durDiv.innerHTML = '<span class="font-mono text-sm text-gray-600">'+hms+'</span>';
+    
+    const info = document.createElement('div'); 
+    info.className = 'text-xs text-gray-500'; 
+    info.textContent = 'id=' + v.id;
+    
+    row.appendChild(fileDiv);
+    row.appendChild(durDiv);
+    row.appendChild(fpsInput); 
+    row.appendChild(estSpan);
+    row.appendChild(info);
+    row.dataset.id = v.id; row.dataset.duration = dur; rowsDiv.appendChild(row);
+  }
+}
+
+goBtn?.addEventListener('click', async function(){
+  const items = []; const jpegq = Number(document.getElementById('jpegq').value || defaults.jpeg_quality); const density = Number(document.getElementById('density').value || defaults.pdf_density); const pdfq = Number(document.getElementById('pdfq').value || defaults.pdf_quality);
+  for (const row of rowsDiv.children) { const id = row.dataset.id; const fps = Number(row.querySelector('input[type=number]').value || defaults.fps); items.push({ id: id, fps: fps }); }
+  const payload = { items: items, jpeg_quality: jpegq, pdf_density: density, pdf_quality: pdfq };
+  resultsDiv.style.display = 'block'; resultsDiv.innerHTML = '<div class="text-gray-500 text-center py-4">Processing…</div>';
+  const res = await fetch('/process', { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify(payload) });
+  if (!res.ok) { resultsDiv.innerHTML = '<div class="text-red-600 p-4 bg-red-50 border border-red-200 rounded-lg whitespace-pre-wrap">'+escapeHTML(await errorText(res))+'</div>'; return; }
+  const data = await res.json();
+  const headerRow = '<div class="grid grid-cols-5 gap-4 items-center pb-3 border-b border-gray-200 mb-4 font-semibold text-gray-700"><div>File</div><div>Duration</div><div>FPS</div><div>Frames</div><div>PDF</div></div>';
+  const rows = (data.results||[]).map(function(r){ 
+    return '<div class="grid grid-cols-5 gap-4 items-center py-3 border-b border-gray-100 last:border-b-0">' + 
+           '<div><span class="font-mono text-sm text-gray-900">'+escapeHTML(r.name)+'</span></div>' + 
+           '<div><span class="font-mono text-sm text-gray-600">'+toHMS(r.duration_seconds)+'</span></div>' + 
+           '<div><span class="font-mono text-sm text-gray-600">'+r.fps+'</span></div>' + 
+           '<div><span class="font-mono text-sm text-gray-600">'+r.frames_wrote+' (est '+r.estimated_frames+')'+(r.frames_dropped || r.frames_duplicated ? ' <span title="dropped / duplicated source frames">−'+r.frames_dropped+' +'+r.frames_duplicated+'</span>' : '')+'</span></div>' + 
+           '<div><a href="'+r.pdf_url+'" download class="inline-flex items-center px-3 py-1.5 bg-blue-600 text-white text-sm rounded-lg hover:bg-blue-700 transition-colors">Download PDF</a></div>' + 
+           '</div>'; 
+  }).join('');
+  const bundle = data.bundle_url ? '<div class="pt-4"><a href="'+data.bundle_url+'" download class="inline-flex items-center px-3 py-1.5 bg-blue-700 text-white text-sm rounded-lg hover:bg-blue-800 transition-colors">Download all (ZIP)</a></div>' : '';
+  resultsDiv.innerHTML = headerRow + rows + bundle;
+});
+
+// ----- Images -----
+const imgForm = document.getElementById('imgForm');
+const thumbsDiv = document.getElementById('thumbs');
+const imgList = document.getElementById('imgList');
+const imgResult = document.getElementById('imgResult');
+let imgUploads = initialState.images;
+
+imgForm?.addEventListener('submit', async function(e){
+  e.preventDefault();
+  const files = document.getElementById('imgs').files;
+  if (!files || files.length === 0) { alert('Pick at least one image'); return; }
+  const tooBig = sizeError(files, 'image');
+  if (tooBig) { alert(tooBig); return; }
+  const fd = new FormData(); for (const f of files) fd.append('images', f, f.name);
+  const res = await uploadForm('/upload_images', fd, imgForm);
+  if (!res.ok) { alert('Upload failed: ' + await errorText(res)); return; }
+  const data = await res.json(); imgUploads = data.images || []; renderThumbs();
+});
+
+function renderThumbs(){
+  thumbsDiv.innerHTML = ''; if (imgUploads.length === 0) { imgList.style.display = 'none'; return; } imgList.style.display = 'block';
+  for (let i=0;i<imgUploads.length;i++){
+    const it = imgUploads[i];
+    const wrap = document.createElement('div'); 
+    wrap.className = 'bg-white border border-gray-200 rounded-lg p-4 text-center hover:shadow-md transition-shadow';
+    const im = document.createElement('img'); 
+    im.src = it.url; 
+    im.className = 'w-full h-32 object-contain mx-auto mb-3 rounded';
+    wrap.appendChild(im);
+    const caption = document.createElement('div'); 
+    caption.className = 'text-xs font-mono text-gray-600 mb-2 truncate'; 
+    caption.textContent = it.name; 
+    wrap.appendChild(caption);
+    const lab = document.createElement('label'); 
+    lab.className='text-xs font-medium text-gray-700 block mb-1'; 
+    lab.textContent = 'Order:'; 
+    wrap.appendChild(lab);
+    const order = document.createElement('input'); 
+    order.type='number'; order.step='1'; order.min='1'; order.value = String(i+1); 
+    order.className='orderInput w-full px-2 py-1 border border-gray-300 rounded text-sm focus:ring-2 focus:ring-purple-500 focus:border-purple-500'; 
+    wrap.appendChild(order);
+    wrap.dataset.id = it.id; thumbsDiv.appendChild(wrap);
+  }
+}
+
+document.getElementById('imgGo')?.addEventListener('click', async function(){
+  const density = Number(document.getElementById('idensity').value || defaults.pdf_density); const quality = Number(document.getElementById('iquality').value || defaults.pdf_quality); const outName = document.getElementById('iname').value || '';
+  const items = []; const cards = thumbsDiv.children; for (let i=0;i<cards.length;i++){ const id = cards[i].dataset.id; const ord = Number(cards[i].querySelector('input.orderInput').value || (i+1)); items.push({ id: id, order: ord }); }
+  imgResult.style.display='block'; imgResult.innerHTML = '<div class="text-gray-500 text-center py-4">Building PDF…</div>';
+  const payload = { items: items, pdf_density: density, pdf_quality: quality, out_name: outName };
+  const res = await fetch('/images_pdf', { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify(payload) });
+  if (!res.ok) { imgResult.innerHTML = '<div class="text-red-600 p-4 bg-red-50 border border-red-200 rounded-lg whitespace-pre-wrap">'+escapeHTML(await errorText(res))+'</div>'; return; }
+  const dat = await res.json(); 
+  imgResult.innerHTML = '<div class="p-4 bg-green-50 border border-green-200 rounded-lg"><a href="'+dat.pdf_url+'" download class="inline-flex items-center px-4 py-2 bg-green-600 text-white rounded-lg hover:bg-green-700 transition-colors font-medium">Download Images PDF</a> <span class="ml-3 text-green-700">('+dat.count+' pages)</span></div>';
+});
+
+// ----- Audio -----
+const audForm = document.getElementById('audForm');
+const audList = document.getElementById('audList');
+const audRows = document.getElementById('audRows');
+const audGo = document.getElementById('audGo');
+const audResults = document.getElementById('audResults');
+let audUploads = initialState.audios;
+
+audForm?.addEventListener('submit', async function(e){
+  e.preventDefault();
+  const files = document.getElementById('audios').files;
+  if (!files || files.length === 0) { alert('Pick at least one audio'); return; }
+  const tooBig = sizeError(files, 'audio');
+  if (tooBig) { alert(tooBig); return; }
+  const fd = new FormData(); for (const f of files) fd.append('audios', f, f.name);
+  const res = await uploadForm('/upload_audio', fd, audForm);
+  if (!res.ok) { alert('Upload failed: ' + await errorText(res)); return; }
+  const data = await res.json(); audUploads = data.audios || []; renderAud();
+});
+
+function renderAud(){
+  audRows.innerHTML=''; if (audUploads.length===0){audList.style.display='none'; return;} audList.style.display='block';
+  for (let i=0;i<audUploads.length;i++){
+    const a = audUploads[i];
+    const row = document.createElement('div'); 
+    row.className='grid grid-cols-12 gap-2 items-center py-3 border-b border-gray-100 last:border-b-0 text-sm';
+    const dur = toHMS(a.duration_seconds||0);
+    const br = (a.bitrate_kbps||0) ? (a.bitrate_kbps+' kbps') : '-';
+    
+    const fileDiv = document.createElement('div');
+    fileDiv.innerHTML = (a.cover_url ? '<img src="'+escapeHTML(a.cover_url)+'" class="w-10 h-10 object-cover rounded mb-1" />' : '')+'<span class="font-mono text-gray-900 text-xs truncate block">'+escapeHTML(a.name)+'</span>'+validationBadge(a.validation);
+    
+    row.appendChild(fileDiv);
+    row.innerHTML += '<div class="font-mono text-gray-600">'+dur+'</div>'+
+      '<div class="font-mono text-gray-600">'+(a.codec||'-')+'</div>'+
+      '<div class="font-mono text-gray-600">'+(a.channels||'-')+'</div>'+
+      '<div class="font-mono text-gray-600">'+(a.sample_rate||'-')+'</div>'+
+      '<div class="font-mono text-gray-600">'+br+'</div>';
+    
+    const fmt = document.createElement('select');
+    fmt.className = 'px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
+    ;['mp3','wav','flac','aac','ogg','opus','m4a','alac','aiff','wma','amr'].forEach(function(opt){ const o=document.createElement('option'); o.value=opt; o.textContent=opt; if(opt===defaults.audio_format) o.selected=true; fmt.appendChild(o); });
+    
+    const brI = document.createElement('input'); 
+    brI.type='number'; brI.min='32'; brI.max='512'; brI.step='16'; brI.value= String(a.bitrate_kbps||192);
+    brI.className = 'w-16 px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
+    
+    const srI = document.createElement('input'); 
+    srI.type='number'; srI.min='8000'; srI.max='192000'; srI.step='1000'; srI.value= String(a.sample_rate||44100);
+    srI.className = 'w-16 px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
+    
+    const chI = document.createElement('input'); 
+    chI.type='number'; chI.min='1'; chI.max='8'; chI.step='1'; chI.value= String(a.channels||2);
+    chI.className = 'w-12 px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
+    
+    const norm = document.createElement('select');
+    norm.className = 'px-2 py-1 border border-gray-300 rounded text-xs focus:ring-2 focus:ring-emerald-500 focus:border-emerald-500';
+    ;[['','off'],['podcast','podcast -16'],['broadcast','broadcast -23']].forEach(function(opt){ const o=document.createElement('option'); o.value=opt[0]; o.textContent=opt[1]; norm.appendChild(o); });
+    
+    const det = document.createElement('button'); 
+    det.type='button'; det.textContent='Details';
+    det.className = 'px-2 py-1 bg-gray-100 text-gray-700 rounded text-xs hover:bg-gray-200 transition-colors';
+    
+    const pre = document.createElement('pre'); 
+    pre.className='bg-gray-50 p-3 rounded-lg text-xs overflow-auto max-h-64 mt-2 border border-gray-200 col-span-12'; 
+    pre.style.display='none'; 
+    pre.textContent = a.probe_json||'';
+    det.onclick = function(){ pre.style.display = (pre.style.display==='none'?'block':'none'); };
+
+    const actions = document.createElement('div');
+    actions.className = 'flex flex-col gap-1';
+    const play = document.createElement('button');
+    play.type='button'; play.textContent='Preview';
+    play.className = 'px-2 py-1 bg-emerald-50 text-emerald-700 rounded text-xs hover:bg-emerald-100 transition-colors';
+    play.onclick = async function(){
+      play.disabled = true; play.textContent = '…';
+      const res = await fetch('/preview_audio', { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify({ id: a.id }) });
+      play.disabled = false; play.textContent = 'Preview';
+      if (!res.ok) { alert('Preview failed: ' + await errorText(res)); return; }
+      const p = await res.json();
+      let player = actions.querySelector('audio');
+      if (!player) { player = document.createElement('audio'); player.controls = true; player.className = 'w-40 h-8'; actions.appendChild(player); }
+      player.src = p.preview_url; player.play();
+    };
+    actions.appendChild(det); actions.appendChild(play);
+
+    row.appendChild(fmt); row.appendChild(brI); row.appendChild(srI); row.appendChild(chI); row.appendChild(norm); row.appendChild(actions);
+    audRows.appendChild(row); audRows.appendChild(pre);
+
+    row.dataset.id = a.id;
+  }
+}
+
+audGo?.addEventListener('click', async function(){
+  const items = []; const children = audRows.children;
+  for (let i=0;i<children.length;i+=2){
+    const row = children[i]; if (!row || !row.classList.contains('grid')) continue;
+    const id = row.dataset.id; const selects = row.getElementsByTagName('select'); const inputs = row.getElementsByTagName('input');
+    const fmt = selects[0].value; const br = Number(inputs[0].value||'192'); const sr = Number(inputs[1].value||'44100'); const ch = Number(inputs[2].value||'2'); const norm = selects[1].value;
+    items.push({ id: id, format: fmt, bitrate_kbps: br, sample_rate: sr, channels: ch, normalize: norm });
+  }
+  audResults.style.display='block'; audResults.innerHTML='<div class="text-gray-500 text-center py-4">Converting…</div>';
+  const res = await fetch('/convert_audio', { method: 'POST', headers: {'Content-Type':'application/json'}, body: JSON.stringify({ items: items, async: true }) });
+  if (!res.ok) { audResults.innerHTML = '<div class="text-red-600 p-4 bg-red-50 border border-red-200 rounded-lg whitespace-pre-wrap">'+escapeHTML(await errorText(res))+'</div>'; return; }
+  const started = await res.json();
+  const job = await pollJob(started.job_id, function(j){
+    audResults.innerHTML = (j.items||[]).map(function(it){
+      const pct = Math.round(it.progress||0);
+      return '<div class="mb-2"><div class="flex justify-between text-xs text-gray-600 mb-1"><span class="font-mono">'+escapeHTML(it.name)+'</span><span>'+escapeHTML(it.status)+' '+pct+'%</span></div>'+
+             '<div class="w-full bg-gray-200 rounded h-2"><div class="bg-emerald-600 h-2 rounded" style="width:'+pct+'%"></div></div></div>';
+    }).join('');
+  });
+  if (job.status !== 'done') { audResults.innerHTML = '<div class="text-red-600 p-4 bg-red-50 border border-red-200 rounded-lg">'+escapeHTML(job.error||'conversion failed')+'</div>'; return; }
+  const data = job.result || {};
+  const rows = (data.results||[]).map(function(r){ 
+    return '<div class="p-3 bg-gray-50 border border-gray-200 rounded-lg mb-2"><a href="'+r.out_url+'" download class="inline-flex items-center px-3 py-1.5 bg-emerald-600 text-white text-sm rounded-lg hover:bg-emerald-700 transition-colors">'+escapeHTML(r.name)+' → '+escapeHTML(r.format)+'</a></div>'; 
+  }).join('');
+  const zip = data.zip_url ? '<div class="p-3 bg-emerald-50 border border-emerald-200 rounded-lg mb-2"><a href="'+data.zip_url+'" download class="inline-flex items-center px-3 py-1.5 bg-emerald-700 text-white text-sm rounded-lg hover:bg-emerald-800 transition-colors">Download all (ZIP)</a></div>' : '';
+  audResults.innerHTML = (zip + rows) || '<div class="text-gray-500 text-center py-4">No results</div>';
+});
+
+// uploadForm posts fd to url under a fresh upload ID, showing the
+// server's progress for it on the form's submit button meanwhile.
+async function uploadForm(url, fd, form) {
+  const id = Date.now().toString(36) + Math.random().toString(36).slice(2, 10);
+  const btn = form.querySelector('button[type=submit]');
+  const label = btn.textContent;
+  btn.disabled = true;
+  const timer = setInterval(async function(){
+    try {
+      const r = await fetch('/uploads/' + id + '/progress');
+      if (!r.ok) return;
+      const p = await r.json();
+      if (p.status === 'receiving' && p.total_bytes) btn.textContent = 'Uploading ' + Math.floor(p.percent || 0) + '%';
+      else if (p.status === 'processing') btn.textContent = 'Checking…';
+    } catch (_) {}
+  }, 500);
+  try {
+    return await fetch(url, { method: 'POST', headers: { 'X-Upload-ID': id }, body: fd });
+  } finally {
+    clearInterval(timer);
+    btn.textContent = label;
+    btn.disabled = false;
+  }
+}
+
+// sizeError checks files against the server's upload size limits for kind
+// and describes the first problem, or returns ''.
+function sizeError(files, kind) {
+  const l = initialState.upload_limits[kind];
+  let total = 0;
+  for (const f of files) {
+    if (f.size > l.max_file_bytes) return f.name + ' is over the ' + (l.max_file_bytes / 1048576).toFixed(1) + ' MB file size limit';
+    total += f.size;
+  }
+  if (total > l.max_request_bytes) return 'These files are over the ' + (l.max_request_bytes / 1048576).toFixed(1) + ' MB upload limit; send fewer at a time';
+  return '';
+}
+
+// pollJob polls /jobs/:id until the job finishes, calling onUpdate with each snapshot.
+async function pollJob(id, onUpdate) {
+  for (;;) {
+    const res = await fetch('/jobs/' + encodeURIComponent(id));
+    if (!res.ok) return { status: 'failed', error: await errorText(res) };
+    const j = await res.json();
+    onUpdate(j);
+    if (j.status === 'done' || j.status === 'failed') return j;
+    await new Promise(function(r){ setTimeout(r, 700); });
+  }
+}
+
+function toHMS(sec) { sec = Number(sec||0); const h = Math.floor(sec/3600); const m = Math.floor((sec%3600)/60); const s = (sec - h*3600 - m*60).toFixed(3); return pad(h)+":"+pad(m)+":"+s.padStart(6,'0'); }
+function pad(n){ return String(n).padStart(2,'0'); }
+function validationBadge(v){
+  if (!v || v.ok) return '';
+  const msg = v.truncated ? 'truncated ('+toHMS(v.decoded_seconds)+' decodable)' : 'decode errors';
+  return '<span class="block text-xs text-red-600" title="'+escapeHTML((v.errors||[]).join('\n'))+'">⚠ '+escapeHTML(msg)+'</span>';
+}
+// errorText renders an API error body: its message, each bad item and the
+// failing tool's output.
+async function errorText(res){
+  const body = await res.text();
+  try {
+    const e = JSON.parse(body);
+    let msg = e.message || body;
+    (e.items || []).forEach(function(it){ msg += '\n#' + (it.index + 1) + ': ' + it.message; });
+    if (e.stderr) msg += '\n\n' + e.stderr;
+    return msg;
+  } catch (_) { return body; }
+}
+function escapeHTML(s){ return (s||'').replace(/[&<>"']/g, function(c){ return {"&":"&amp;","<":"&lt;",">":"&gt;","\"":"&quot;","'":"&#39;"}[c]; }); }
+
+// sections of disabled modules aren't on the page
+if (upForm) renderList();
+if (imgForm) renderThumbs();
+if (audForm) renderAud();
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Distributed workers. With a queue configured (-queue redis://...), the
+// web node doesn't run /process and /images_pdf jobs itself: it pushes them
+// onto Redis lists and waits, and processes started with -worker pop them,
+// do the work and report progress and the outcome back. Every node must
+// see the same work directory (NFS, EFS, a shared volume...): workers read
+// the uploads from it and write the outputs to it. Only the web node opens
+// the store; workers keep no state of their own.
+//
+// Keys: framespdf:tasks:<priority> are the task lists, popped interactive
+// first, then normal, then bulk; framespdf:events:<task> carries a task's
+// reports (see taskEvent) back to the node that queued it.
+var (
+	queueURL   = ""
+	workerMode = false
+)
+
+const (
+	queueKeyPrefix = "framespdf:"
+	// queuePoll is how long a blocking pop waits before looking around.
+	queuePoll = 5 * time.Second
+	// workerTimeout is how long a worker may go without a report before
+	// its task counts as lost; workers report at least every
+	// workerHeartbeat.
+	workerTimeout   = time.Minute
+	workerHeartbeat = 15 * time.Second
+	taskEventTTL    = time.Hour
+)
+
+// remoteTasks are the job types workers run, each decoding its task and
+// doing the work.
+var remoteTasks = map[string]func(*Job, json.RawMessage) (any, error){
+	"process":    runRemote[processTask, []processItem],
+	"images_pdf": runRemote[imagesPDFTask, struct{}],
+}
+
+// jobTask is the self-contained work of a job, which can be sent to a
+// worker.
+type jobTask[R any] interface {
+	run(job *Job) (R, error)
+}
+
+func runRemote[T jobTask[R], R any](job *Job, raw json.RawMessage) (any, error) {
+	var t T
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, fmt.Errorf("bad task: %w", err)
+	}
+	return t.run(job)
+}
+
+// remote reports whether the job runs on a worker.
+func (j *Job) remote() bool {
+	return queueURL != "" && !workerMode && remoteTasks[j.Type] != nil
+}
+
+// runWork runs t for job, on a worker if the job is remote.
+func runWork[R any](job *Job, t jobTask[R]) (R, error) {
+	var out R
+	if !job.remote() {
+		return t.run(job)
+	}
+	raw, err := dispatchTask(job, t)
+	if err != nil {
+		return out, err
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return out, fmt.Errorf("bad result from worker: %w", err)
+	}
+	return out, nil
+}
+
+// queuedTask is a job's work as queued for a worker.
+type queuedTask struct {
+	// ID names the task's events list; a retried job is queued anew.
+	ID        string          `json:"id"`
+	JobID     string          `json:"job_id"`
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id,omitempty"`
+	Items     []JobItem       `json:"items"`
+	Sources   []string        `json:"sources,omitempty"`
+	Task      json.RawMessage `json:"task"`
+}
+
+// taskEvent is a worker's report on a task: the items' progress and the
+// tool runs so far, and once Done the result or error.
+type taskEvent struct {
+	Worker string          `json:"worker"`
+	Items  []JobItem       `json:"items,omitempty"`
+	Tools  []ToolRun       `json:"tools,omitempty"`
+	Done   bool            `json:"done,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	// Tool and Stderr describe a failed tool run (see toolError).
+	Tool   string `json:"tool,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+func taskListKey(prio string) string { return queueKeyPrefix + "tasks:" + prio }
+func taskEventsKey(id string) string { return queueKeyPrefix + "events:" + id }
+
+// dispatchTask queues t for a worker and follows its reports until it is
+// done, mirroring progress onto job.
+func dispatchTask(job *Job, t any) (json.RawMessage, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	qt := queuedTask{ID: randID(8), JobID: job.ID, Type: job.Type, RequestID: job.RequestID, Task: payload}
+	jobsMu.Lock()
+	for _, it := range job.Items {
+		qt.Items = append(qt.Items, *it)
+	}
+	qt.Sources = append(qt.Sources, job.sources...)
+	jobsMu.Unlock()
+	raw, err := json.Marshal(qt)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := dialRedis(queueURL)
+	if err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	defer rc.Close()
+	list := taskListKey(job.Priority)
+	if _, err := rc.do("LPUSH", list, string(raw)); err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	var worker string
+	// taken is when the task was seen gone from the list with no report
+	// yet: a worker that dies between the pop and its first report leaves
+	// no other trace, so that report is due within workerTimeout too
+	var lastReport, taken time.Time
+	for {
+		if err := workCtx.Err(); err != nil {
+			if worker == "" {
+				_, _ = rc.do("LREM", list, "1", string(raw))
+			}
+			return nil, fmt.Errorf("waiting for a worker: %w", err)
+		}
+		if err := job.timeout(); err != nil {
+			// the worker kills its tools on its own timeout
+			if worker == "" {
+				_, _ = rc.do("LREM", list, "1", string(raw))
+			}
+			return nil, err
+		}
+		_, val, err := rc.pop("BLPOP", queuePoll, taskEventsKey(qt.ID))
+		if err != nil {
+			return nil, fmt.Errorf("queue: %w", err)
+		}
+		if val == "" {
+			switch {
+			case worker != "":
+				if time.Since(lastReport) > workerTimeout {
+					return nil, fmt.Errorf("worker %s stopped responding", worker)
+				}
+			case taken.IsZero():
+				if pos, err := rc.do("LPOS", list, string(raw)); err == nil && pos == nil {
+					taken = time.Now()
+				}
+			case time.Since(taken) > workerTimeout:
+				return nil, errors.New("the worker that took the task stopped responding before its first report")
+			}
+			continue
+		}
+		var ev taskEvent
+		if err := json.Unmarshal([]byte(val), &ev); err != nil {
+			return nil, fmt.Errorf("bad report from worker: %w", err)
+		}
+		if worker == "" {
+			job.logger().Info("job taken by worker", "worker", ev.Worker)
+		}
+		worker, lastReport = ev.Worker, time.Now()
+		job.mirror(ev)
+		if !ev.Done {
+			continue
+		}
+		if ev.Error != "" {
+			err := errors.New(ev.Error)
+			if ev.Tool != "" {
+				err = &toolError{Tool: ev.Tool, Stderr: ev.Stderr, err: err}
+			}
+			return nil, err
+		}
+		return ev.Result, nil
+	}
+}
+
+// mirror applies a worker's report to the job.
+func (j *Job) mirror(ev taskEvent) {
+	for i, it := range ev.Items {
+		j.setItem(i, it.Status, it.Progress)
+	}
+	if ev.Tools != nil {
+		jobsMu.Lock()
+		j.Tools = ev.Tools
+		jobsMu.Unlock()
+	}
+}
+
+// workerName identifies this process in reports and logs.
+var workerName = func() string {
+	host, _ := os.Hostname()
+	return host + ":" + strconv.Itoa(os.Getpid())
+}()
+
+// runWorker takes tasks off the queue, maxJobs at a time, until shutdown.
+func runWorker() {
+	slog.Info("worker started", "queue", redactURL(queueURL), "workdir", workRoot, "concurrency", maxJobs, "worker", workerName)
+	for range maxJobs {
+		go workerLoop()
+	}
+	serveUntilSignal()
+}
+
+func workerLoop() {
+	keys := []string{taskListKey(prioInteractive), taskListKey(prioNormal), taskListKey(prioBulk)}
+	var rc *redisConn
+	defer func() {
+		if rc != nil {
+			rc.Close()
+		}
+	}()
+	for stopIntake.Err() == nil {
+		if rc == nil {
+			var err error
+			if rc, err = dialRedis(queueURL); err != nil {
+				slog.Warn("queue unreachable", "error", err.Error())
+				rc = nil
+				time.Sleep(queuePoll)
+				continue
+			}
+		}
+		if len(overloaded()) > 0 {
+			// leave the tasks to other workers until this box recovers
+			time.Sleep(admissionPoll)
+			continue
+		}
+		key, val, err := rc.pop("BRPOP", queuePoll, keys...)
+		if err != nil {
+			slog.Warn("queue", "error", err.Error())
+			rc.Close()
+			rc = nil
+			time.Sleep(time.Second)
+			continue
+		}
+		if val == "" {
+			continue
+		}
+		if !beginWork() {
+			// shutting down: hand the task back for another worker
+			if _, err := rc.do("RPUSH", key, val); err != nil {
+				slog.Error("could not requeue task", "error", err.Error())
+			}
+			return
+		}
+		runQueuedTask(rc, val)
+		activeJobs.Done()
+	}
+}
+
+// runQueuedTask runs one task under a local copy of its job, which collects
+// progress and tool runs the way a job on the web node does, and reports
+// back on rc.
+func runQueuedTask(rc *redisConn, raw string) {
+	var qt queuedTask
+	if err := json.Unmarshal([]byte(raw), &qt); err != nil {
+		slog.Error("bad task on queue", "error", err.Error())
+		return
+	}
+	job := &Job{ID: qt.JobID, Type: qt.Type, Status: jobRunning, RequestID: qt.RequestID, sources: qt.Sources}
+	for _, it := range qt.Items {
+		job.Items = append(job.Items, &JobItem{ID: it.ID, Name: it.Name, Status: jobQueued})
+	}
+	jobsMu.Lock()
+	jobs[job.ID] = job
+	jobsMu.Unlock()
+	defer func() {
+		job.removeScratch()
+		jobsMu.Lock()
+		delete(jobs, job.ID)
+		jobsMu.Unlock()
+	}()
+	events := taskEventsKey(qt.ID)
+	report := func(ev taskEvent) {
+		ev.Worker = workerName
+		b, _ := json.Marshal(ev)
+		if _, err := rc.do("RPUSH", events, string(b)); err != nil {
+			job.logger().Warn("report failed", "error", err.Error())
+			return
+		}
+		_, _ = rc.do("EXPIRE", events, strconv.Itoa(int(taskEventTTL.Seconds())))
+	}
+	progress := func() taskEvent {
+		snap := job.snapshot()
+		ev := taskEvent{Tools: snap.Tools}
+		for _, it := range snap.Items {
+			ev.Items = append(ev.Items, *it)
+		}
+		return ev
+	}
+	job.logger().Info("task started", "worker", workerName)
+	report(progress())
+
+	// reports go out while the task runs, on this goroutine's connection
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		var last []byte
+		lastSent := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+			ev := progress()
+			b, _ := json.Marshal(ev)
+			if string(b) != string(last) || time.Since(lastSent) > workerHeartbeat {
+				report(ev)
+				last, lastSent = b, time.Now()
+			}
+		}
+	}()
+	var result any
+	run := remoteTasks[qt.Type]
+	err := fmt.Errorf("this worker can't run %s jobs", qt.Type)
+	if run != nil {
+		stopTimer := job.watch()
+		result, err = run(job, qt.Task)
+		stopTimer()
+		if terr := job.timeout(); terr != nil {
+			result, err = nil, terr
+		}
+	}
+	close(stop)
+	<-stopped
+
+	ev := progress()
+	ev.Done = true
+	if err == nil {
+		ev.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		ev.Error = err.Error()
+		var te *toolError
+		if errors.As(err, &te) {
+			ev.Tool, ev.Stderr = te.Tool, te.Stderr
+		}
+		job.logger().Error("task failed", "error", err.Error())
+	} else {
+		job.logger().Info("task done")
+	}
+	report(ev)
+}
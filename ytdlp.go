@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ytdlpBin fetches videos from YouTube, Vimeo and the other sites yt-dlp
+// supports. It is optional: /ingest_ytdlp answers 501 when it isn't
+// installed.
+var ytdlpBin = "yt-dlp"
+
+type ytdlpReq struct {
+	Items []struct {
+		URL string `json:"url"`
+	} `json:"items"`
+	// MaxHeight caps the video resolution, e.g. 720; 0 takes the best.
+	MaxHeight int      `json:"max_height"`
+	Tags      []string `json:"tags"`
+	ProjectID string   `json:"project_id"`
+	Async     bool     `json:"async"`
+	Priority  string   `json:"priority"`
+}
+
+func handleIngestYtdlp(c *gin.Context) {
+	var req ytdlpReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		failCode(c, http.StatusBadRequest, errInvalidJSON, "bad json: %v", err)
+		return
+	}
+	if _, err := exec.LookPath(ytdlpBin); err != nil {
+		fail(c, http.StatusNotImplemented, "video site downloads need %s in PATH", ytdlpBin)
+		return
+	}
+	if len(req.Items) == 0 {
+		fail(c, http.StatusBadRequest, "no items provided")
+		return
+	}
+	if req.MaxHeight < 0 {
+		fail(c, http.StatusBadRequest, "max_height must not be negative")
+		return
+	}
+	common := ingestCommon{Kind: "video", Tags: req.Tags, ProjectID: req.ProjectID, Async: req.Async, Priority: req.Priority}
+	tags, proj, prio, ok := parseIngest(c, common)
+	if !ok {
+		return
+	}
+	var left atomic.Int64
+	left.Store(-1)
+	if quota, used := ownerQuota(c); quota > 0 {
+		left.Store(max(quota-used, 0))
+	}
+	srcs := make([]ingestSource, 0, len(req.Items))
+	for _, it := range req.Items {
+		u, err := url.Parse(it.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail(c, http.StatusBadRequest, "not an http(s) URL: %s", it.URL)
+			return
+		}
+		src := u.String()
+		srcs = append(srcs, ingestSource{
+			name:  src,
+			label: src,
+			fetch: func(_ context.Context, dir string, progress func(float64)) (string, int64, error) {
+				return runYtdlp(src, dir, req.MaxHeight, &left, progress)
+			},
+		})
+	}
+	runIngest(c, "ingest_ytdlp", common, prio, srcs, tags, proj)
+}
+
+// ytdlpPctRe matches yt-dlp's "[download]  42.1% of ..." progress lines.
+var ytdlpPctRe = regexp.MustCompile(`^\[download\]\s+([\d.]+)%`)
+
+// runYtdlp downloads the video at src into dir, merging the best streams
+// into one file, and returns its name and size. Like the other tools it is
+// bound to workCtx. Sizes count against the video file size limit and the
+// remaining quota (left, -1 for none).
+func runYtdlp(src, dir string, maxHeight int, left *atomic.Int64, progress func(float64)) (string, int64, error) {
+	limit := maxIngestBytes("video")
+	if l := left.Load(); l >= 0 {
+		limit = min(limit, l)
+	}
+	format := "bv*+ba/b"
+	if maxHeight > 0 {
+		format = fmt.Sprintf("bv*[height<=%d]+ba/b[height<=%d]", maxHeight, maxHeight)
+	}
+	pathFile := filepath.Join(dir, ".ytdlp-path")
+	defer os.Remove(pathFile)
+	args := []string{
+		"--no-playlist", "--no-mtime", "--newline", "--no-colors",
+		"--format", format,
+		"--merge-output-format", "mp4/mkv",
+		"--max-filesize", strconv.FormatInt(limit, 10),
+		"--ffmpeg-location", ffmpegBin,
+		"--paths", dir,
+		"--output", "%(title).120B [%(id)s].%(ext)s",
+		"--print-to-file", "after_move:filepath", pathFile,
+	}
+	if !ingestPrivate {
+		// the generic extractor downloads any URL; keep to real video sites
+		args = append(args, "--use-extractors", "default,-generic")
+	}
+	args = append(args, "--", src)
+	cmd := toolCmd(ytdlpBin, args...)
+	// progress and messages may go to either stream
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+	cmd.Stdout, cmd.Stderr = w, w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	var tail bytes.Buffer
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if m := ytdlpPctRe.FindStringSubmatch(line); m != nil {
+			pct, _ := strconv.ParseFloat(m[1], 64)
+			progress(pct)
+			continue
+		}
+		if line != "" {
+			tail.WriteString(line + "\n")
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(tail.String())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		return "", 0, fmt.Errorf("%w: %s", err, msg)
+	}
+	printed, _ := os.ReadFile(pathFile)
+	lines := strings.Split(strings.TrimSpace(string(printed)), "\n")
+	path := strings.TrimSpace(lines[len(lines)-1])
+	if path == "" {
+		// --max-filesize skips the download rather than failing
+		return "", 0, fmt.Errorf("nothing downloaded (over the %.1f MB limit?)", float64(limit)/(1<<20))
+	}
+	name := sanitizeName(filepath.Base(path))
+	if dst := filepath.Join(dir, name); dst != path {
+		if err := os.Rename(path, dst); err != nil {
+			return "", 0, err
+		}
+		path = dst
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	if st.Size() > limit {
+		return "", 0, fmt.Errorf("%.1f MB is over the %.1f MB limit", float64(st.Size())/(1<<20), float64(limit)/(1<<20))
+	}
+	if left.Load() >= 0 {
+		left.Add(-st.Size())
+	}
+	return name, st.Size(), nil
+}